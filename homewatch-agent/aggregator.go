@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Aggregator: Counts datapoints by source in windows which end each time it's
+flushed. Add and Flush can be called from any goroutine; a datapoint is counted
+in exactly one window, the one open when it was added.
+*/
+type Aggregator struct {
+	lock        sync.Mutex
+	windowStart time.Time
+	// metrics: Every source seen, so sources without datapoints are published with a zero count
+	metrics map[string]*DatapointMetric
+}
+
+// AggregateWindow: The datapoints counted between Start and End
+type AggregateWindow struct {
+	Start time.Time
+	End   time.Time
+	// Metrics: A metric per source ever seen, sorted by source
+	Metrics []DatapointMetric
+}
+
+func NewAggregator() *Aggregator {
+	return &Aggregator{
+		windowStart: time.Now(),
+		metrics:     map[string]*DatapointMetric{},
+	}
+}
+
+// Add: Count datapoints in the open window
+func (a *Aggregator) Add(datapoints ...Datapoint) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, datapoint := range datapoints {
+		metric, exists := a.metrics[datapoint.Source]
+		if !exists {
+			// The first datapoint of a source describes it
+			metric = &DatapointMetric{Datapoint: datapoint, Detections: []RuleDetection{}}
+			metric.Count = 0
+			a.metrics[datapoint.Source] = metric
+		}
+		metric.Count += datapoint.Count
+		if datapoint.Detection != nil {
+			metric.Detections = append(metric.Detections, *datapoint.Detection)
+		}
+	}
+}
+
+// Flush: Close the open window at end, returning what was counted in it, and open the next
+func (a *Aggregator) Flush(end time.Time) AggregateWindow {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	window := AggregateWindow{
+		Start:   a.windowStart,
+		End:     end,
+		Metrics: make([]DatapointMetric, 0, len(a.metrics)),
+	}
+	for _, metric := range a.metrics {
+		window.Metrics = append(window.Metrics, *metric)
+		metric.Count = 0
+		metric.Detections = []RuleDetection{}
+	}
+	sort.Slice(window.Metrics, func(i, j int) bool { return window.Metrics[i].Source < window.Metrics[j].Source })
+	a.windowStart = end
+	return window
+}
+
+// Pending: The datapoint count of the open window
+func (a *Aggregator) Pending() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	pending := 0
+	for _, metric := range a.metrics {
+		pending += metric.Count
+	}
+	return pending
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAggregatorCountsBySource(t *testing.T) {
+	aggregator := NewAggregator()
+	detection := &RuleDetection{}
+	aggregator.Add(
+		Datapoint{Source: "Camera1:Start:CrossLineDetection", Count: 1, Detection: detection},
+		Datapoint{Source: "Camera1:Start:CrossLineDetection", Count: 1},
+		Datapoint{Source: "Camera2:Start:MotionDetection", Count: 1},
+	)
+	window := aggregator.Flush(time.Now())
+	if len(window.Metrics) != 2 {
+		t.Fatalf("Expected 2 sources, got %d", len(window.Metrics))
+	}
+	camera1 := window.Metrics[0]
+	if camera1.Source != "Camera1:Start:CrossLineDetection" || camera1.Count != 2 || len(camera1.Detections) != 1 {
+		t.Fatalf("Expected 2 Camera1 datapoints with 1 detection, got %+v", camera1)
+	}
+
+	aggregator.Add(Datapoint{Source: "Camera2:Start:MotionDetection", Count: 1})
+	next := aggregator.Flush(time.Now())
+	if !next.Start.Equal(window.End) {
+		t.Fatalf("Expected the next window to start at %s, got %s", window.End, next.Start)
+	}
+	if next.Metrics[0].Count != 0 || len(next.Metrics[0].Detections) != 0 || next.Metrics[1].Count != 1 {
+		t.Fatalf("Expected only the new Camera2 datapoint, got %+v", next.Metrics)
+	}
+	if len(camera1.Detections) != 1 {
+		t.Fatalf("Expected a flushed window to be unchanged by the next, got %+v", camera1)
+	}
+}
+
+// Run with -race to check Add and Flush are safe together
+func TestAggregatorConcurrentProducers(t *testing.T) {
+	aggregator := NewAggregator()
+	producers, datapoints := 8, 1000
+	sources := []string{"Camera1:Start:CrossLineDetection", "Camera2:Start:MotionDetection"}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < producers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < datapoints; j++ {
+				aggregator.Add(Datapoint{Source: sources[(i+j)%len(sources)], Count: 1})
+			}
+		}(i)
+	}
+
+	counted := 0
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for flushing := true; flushing; {
+		select {
+		case <-done:
+			flushing = false
+		default:
+		}
+		for _, metric := range aggregator.Flush(time.Now()).Metrics {
+			counted += metric.Count
+		}
+	}
+	if counted != producers*datapoints {
+		t.Fatalf("Expected %d datapoints counted once each, got %d", producers*datapoints, counted)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Alert sink types
+const (
+	WebhookAlertSink = "webhook"
+	SMTPAlertSink    = "smtp"
+	CommandAlertSink = "command"
+)
+
+// DefaultAlertTimeout: How long sending an alert may take when its sink doesn't say
+const DefaultAlertTimeout = 30 * time.Second
+
+// AlertSink: Where alerts are sent
+type AlertSink interface {
+	Send(ctx context.Context, alert Alert) error
+}
+
+// NewAlertSink: The sink config declares
+func NewAlertSink(config AlertSinkConfig) (AlertSink, error) {
+	timeout := time.Duration(config.Timeout)
+	if timeout == 0 {
+		timeout = DefaultAlertTimeout
+	}
+	switch config.Type {
+	case WebhookAlertSink:
+		return &WebhookSink{
+			Url:           config.Url,
+			Authorization: config.Authorization,
+			Client:        &http.Client{Timeout: timeout},
+		}, nil
+	case SMTPAlertSink:
+		return &SMTPSink{Address: config.Address, From: config.From, To: config.To, Timeout: timeout}, nil
+	case CommandAlertSink:
+		return &CommandSink{Command: config.Command, Timeout: timeout}, nil
+	}
+	return nil, fmt.Errorf("alert sink %s has an unknown type %q", config.Name, config.Type)
+}
+
+// WebhookSink: Posts each alert as JSON to Url
+type WebhookSink struct {
+	Url           string
+	Authorization string
+	Client        *http.Client
+}
+
+func (s *WebhookSink) Send(ctx context.Context, alert Alert) error {
+	b, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(s.Authorization) > 0 {
+		req.Header.Set("Authorization", s.Authorization)
+	}
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s responded %s", s.Url, res.Status)
+	}
+	return nil
+}
+
+// SMTPSink: Mails each alert through a relay, like a local postfix, which doesn't need authentication
+type SMTPSink struct {
+	Address string
+	From    string
+	To      []string
+	Timeout time.Duration
+}
+
+func (s *SMTPSink) Send(ctx context.Context, alert Alert) error {
+	dialer := net.Dialer{Timeout: s.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.Address)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(s.Timeout))
+	host, _, _ := net.SplitHostPort(s.Address)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if err := client.Mail(s.From); err != nil {
+		return err
+	}
+	for _, to := range s.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(alertMessage(s.From, s.To, alert)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// alertMessage: A plain text mail of alert
+func alertMessage(from string, to []string, alert Alert) []byte {
+	message := &bytes.Buffer{}
+	fmt.Fprintf(message, "From: %s\r\n", from)
+	fmt.Fprintf(message, "To: %s\r\n", strings.Join(to, ", "))
+	if len(alert.Status) > 0 {
+		fmt.Fprintf(message, "Subject: Homewatch: %s is %s\r\n", alert.Camera, alert.Status)
+		fmt.Fprintf(message, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+		fmt.Fprintf(message, "%s is %s, its last video was at %s and one is expected every %s\r\n",
+			alert.Camera, alert.Status, alert.LastVideo.Local().Format(time.RFC3339), alert.Cadence)
+		return message.Bytes()
+	}
+	fmt.Fprintf(message, "Subject: Homewatch: %s on %s\r\n", alert.Rule, alert.Camera)
+	fmt.Fprintf(message, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(message, "%s matched %d detections on %s\r\n\r\n", alert.Rule, len(alert.Detections), alert.Camera)
+	for _, detection := range alert.Detections {
+		fmt.Fprintf(message, "%s %s %s %d by %s with confidence %g at %v\r\n",
+			detection.Time.Local().Format(time.RFC3339), detection.Kind, detection.ObjectType,
+			detection.ObjectID, detection.Rule, detection.Confidence, detection.BoundingBox)
+	}
+	return message.Bytes()
+}
+
+/*
+CommandSink: Runs Command with each alert as JSON on stdin, and its rule,
+camera and liveness status in HOMEWATCH_ALERT_RULE, HOMEWATCH_ALERT_CAMERA and
+HOMEWATCH_ALERT_STATUS
+*/
+type CommandSink struct {
+	Command []string
+	Timeout time.Duration
+}
+
+func (s *CommandSink) Send(ctx context.Context, alert Alert) error {
+	b, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.Command[0], s.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Env = append(os.Environ(), "HOMEWATCH_ALERT_RULE="+alert.Rule, "HOMEWATCH_ALERT_CAMERA="+alert.Camera, "HOMEWATCH_ALERT_STATUS="+alert.Status)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %s", s.Command[0], err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alert: The detections which matched a rule on a camera, or a change in a camera's liveness
+type Alert struct {
+	Rule       string            `json:"rule"`
+	Camera     string            `json:"camera"`
+	Detections []DetectionRecord `json:"detections"`
+	// Status, LastVideo, Cadence: Only set by liveness alerts, whose status is silent or recovered
+	Status    string     `json:"status,omitempty"`
+	LastVideo *time.Time `json:"lastVideo,omitempty"`
+	Cadence   Duration   `json:"cadence,omitempty"`
+}
+
+// alertRule: An AlertRuleConfig ready to match
+type alertRule struct {
+	AlertRuleConfig
+	// from, until: Minutes after midnight, equal when the rule matches all day
+	from, until int
+}
+
+// alertState: A rule's pending alert and cooldown on one camera
+type alertState struct {
+	rule    alertRule
+	pending *Alert
+	// debounce: Sends pending when it fires
+	debounce      *time.Timer
+	cooldownUntil time.Time
+}
+
+/*
+Alerter: Matches the objects detected in index files against rules. The first
+match of a rule on a camera is held for the rule's Debounce, collecting later
+matches, and then sent once to each of its sinks. Matches on that camera are
+then ignored for the rule's Cooldown.
+*/
+type Alerter struct {
+	lock  sync.Mutex
+	rules []alertRule
+	sinks map[string]AlertSink
+	// state: By rule name and camera
+	state   map[string]*alertState
+	sending sync.WaitGroup
+	now     func() time.Time
+}
+
+// NewAlerter: An Alerter of config's rules, whose sinks must exist
+func NewAlerter(config AlertsConfig) (*Alerter, error) {
+	a := &Alerter{
+		sinks: map[string]AlertSink{},
+		state: map[string]*alertState{},
+		now:   time.Now,
+	}
+	for _, sinkConfig := range config.Sinks {
+		sink, err := NewAlertSink(sinkConfig)
+		if err != nil {
+			return nil, err
+		}
+		a.sinks[sinkConfig.Name] = sink
+	}
+	for _, ruleConfig := range config.Rules {
+		rule := alertRule{AlertRuleConfig: ruleConfig}
+		if len(ruleConfig.Between) > 0 {
+			from, until, err := parseBetween(ruleConfig.Between)
+			if err != nil {
+				return nil, fmt.Errorf("alert rule %s: %w", ruleConfig.Name, err)
+			}
+			rule.from, rule.until = from, until
+		}
+		for _, sink := range ruleConfig.Sinks {
+			if _, exists := a.sinks[sink]; !exists {
+				return nil, fmt.Errorf("alert rule %s: no sink named %s", ruleConfig.Name, sink)
+			}
+		}
+		a.rules = append(a.rules, rule)
+	}
+	return a, nil
+}
+
+// Evaluate: Match the rule detections of event against every rule
+func (a *Alerter) Evaluate(event *IndexedEvent) {
+	for _, e := range event.Events {
+		detection := e.RuleDetection()
+		if detection == nil {
+			continue
+		}
+		record := NewDetectionRecord(e.Action, detection)
+		for _, rule := range a.rules {
+			if rule.matches(event.Source, record, a.detectedAt(record)) {
+				a.match(rule, event.Source, record)
+			}
+		}
+	}
+}
+
+// detectedAt: When the camera says the object was detected, or now when it doesn't say
+func (a *Alerter) detectedAt(record DetectionRecord) time.Time {
+	if record.Time.Unix() <= 0 {
+		return a.now()
+	}
+	return record.Time.In(time.Local)
+}
+
+func (r alertRule) matches(camera string, record DetectionRecord, at time.Time) bool {
+	if !matchesAny(r.Cameras, camera) || !matchesAny(r.ObjectTypes, record.ObjectType) || !matchesAny(r.Kinds, record.Kind) {
+		return false
+	}
+	if record.Confidence < r.MinConfidence {
+		return false
+	}
+	if r.from == r.until {
+		return true
+	}
+	minute := at.Hour()*60 + at.Minute()
+	// A window like 22:00-06:00 wraps around midnight
+	if r.from > r.until {
+		return minute >= r.from || minute < r.until
+	}
+	return minute >= r.from && minute < r.until
+}
+
+// matchesAny: True when values is empty or has value, ignoring case
+func matchesAny(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return len(values) == 0
+}
+
+func (a *Alerter) match(rule alertRule, camera string, record DetectionRecord) {
+	key := rule.Name + "/" + camera
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	state, exists := a.state[key]
+	if !exists {
+		state = &alertState{rule: rule}
+		a.state[key] = state
+	}
+	if a.now().Before(state.cooldownUntil) {
+		if flagDebug {
+			log.Printf("DEBUG: Ignoring %s on %s until %s", rule.Name, camera, state.cooldownUntil)
+		}
+		return
+	}
+	if state.pending != nil {
+		state.pending.Detections = append(state.pending.Detections, record)
+		return
+	}
+	state.pending = &Alert{Rule: rule.Name, Camera: camera, Detections: []DetectionRecord{record}}
+	a.sending.Add(1)
+	if rule.Debounce <= 0 {
+		go a.send(state)
+		return
+	}
+	state.debounce = time.AfterFunc(time.Duration(rule.Debounce), func() { a.send(state) })
+}
+
+// send: Send the pending alert of state and start its cooldown
+func (a *Alerter) send(state *alertState) {
+	defer a.sending.Done()
+	rule := state.rule
+	a.lock.Lock()
+	alert := state.pending
+	state.pending = nil
+	state.debounce = nil
+	state.cooldownUntil = a.now().Add(time.Duration(rule.Cooldown))
+	sinks := []AlertSink{}
+	for _, name := range rule.Sinks {
+		sinks = append(sinks, a.sinks[name])
+	}
+	a.lock.Unlock()
+
+	log.Printf("INFO: Alerting %s on %s, %d detections", alert.Rule, alert.Camera, len(alert.Detections))
+	for i, sink := range sinks {
+		if err := sink.Send(context.Background(), *alert); err != nil {
+			log.Printf("ERROR: Unable to send the %s alert to %s: %s", alert.Rule, rule.Sinks[i], err)
+		}
+	}
+}
+
+/*
+Close: Send the alerts still being debounced, then wait for alerts being sent
+until ctx is done
+*/
+func (a *Alerter) Close(ctx context.Context) {
+	a.lock.Lock()
+	for _, state := range a.state {
+		if state.debounce != nil && state.debounce.Stop() {
+			go a.send(state)
+		}
+	}
+	a.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		a.sending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("WARN: Stopped waiting for alerts to be sent: %s", ctx.Err())
+	}
+}
+
+// parseBetween: The minutes after midnight of a time window like 22:00-06:00
+func parseBetween(between string) (int, int, error) {
+	times := strings.Split(between, "-")
+	if len(times) != 2 {
+		return 0, 0, fmt.Errorf("%q isn't like 22:00-06:00", between)
+	}
+	minutes := make([]int, 2)
+	for i, s := range times {
+		t, err := time.Parse("15:04", strings.TrimSpace(s))
+		if err != nil {
+			return 0, 0, fmt.Errorf("%q isn't like 22:00-06:00: %w", between, err)
+		}
+		minutes[i] = t.Hour()*60 + t.Minute()
+	}
+	return minutes[0], minutes[1], nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink: An AlertSink keeping what it's sent
+type recordingSink struct {
+	lock   sync.Mutex
+	alerts []Alert
+}
+
+func (s *recordingSink) Send(ctx context.Context, alert Alert) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.alerts = append(s.alerts, alert)
+	return nil
+}
+
+func (s *recordingSink) Alerts() []Alert {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Alert{}, s.alerts...)
+}
+
+func newTestAlerter(t *testing.T, rule AlertRuleConfig) (*Alerter, *recordingSink) {
+	rule.Sinks = []string{"recorder"}
+	alerter, err := NewAlerter(AlertsConfig{
+		Rules: []AlertRuleConfig{rule},
+		Sinks: []AlertSinkConfig{{Name: "recorder", Type: CommandAlertSink, Command: []string{"true"}}},
+	})
+	if err != nil {
+		t.Fatalf("Expected an alerter, got %s", err)
+	}
+	sink := &recordingSink{}
+	alerter.sinks["recorder"] = sink
+	return alerter, sink
+}
+
+func newTestDetectionEvent(t *testing.T, camera string) *IndexedEvent {
+	var event Event
+	b, _ := os.ReadFile(eventWithDetection)
+	if err := json.Unmarshal(b, &event); err != nil {
+		t.Fatalf("Expected to unmarshal event, got %s", err)
+	}
+	return &IndexedEvent{Source: camera, Events: []Event{event}}
+}
+
+func TestAlertRuleMatches(t *testing.T) {
+	from, until, _ := parseBetween("22:00-06:00")
+	rule := alertRule{
+		AlertRuleConfig: AlertRuleConfig{Cameras: []string{"Camera1"}, ObjectTypes: []string{"human"}, MinConfidence: 0.8},
+		from:            from,
+		until:           until,
+	}
+	human := DetectionRecord{ObjectType: "Human", Confidence: 0.9}
+	night := time.Date(2022, 3, 6, 23, 30, 0, 0, time.Local)
+	expectations := []struct {
+		Camera    string
+		Detection DetectionRecord
+		At        time.Time
+		Matches   bool
+	}{
+		{"Camera1", human, night, true},
+		{"Camera1", human, night.Add(6 * time.Hour), true},
+		{"Camera1", human, night.Add(7 * time.Hour), false},
+		{"Camera2", human, night, false},
+		{"Camera1", DetectionRecord{ObjectType: "Vehicle", Confidence: 0.9}, night, false},
+		{"Camera1", DetectionRecord{ObjectType: "Human", Confidence: 0.5}, night, false},
+	}
+	for _, expectation := range expectations {
+		if matches := rule.matches(expectation.Camera, expectation.Detection, expectation.At); matches != expectation.Matches {
+			t.Fatalf("Expected %s %+v at %s to match %t", expectation.Camera, expectation.Detection, expectation.At, expectation.Matches)
+		}
+	}
+}
+
+func TestAlerterDebouncesAndCoolsDown(t *testing.T) {
+	alerter, sink := newTestAlerter(t, AlertRuleConfig{
+		Name:        "vehicles",
+		ObjectTypes: []string{"Vehicle"},
+		Debounce:    Duration(20 * time.Millisecond),
+		Cooldown:    Duration(time.Hour),
+	})
+	alerter.Evaluate(newTestDetectionEvent(t, "Camera1"))
+	alerter.Evaluate(newTestDetectionEvent(t, "Camera1"))
+	alerter.Evaluate(newTestDetectionEvent(t, "Camera2"))
+	if alerts := sink.Alerts(); len(alerts) != 0 {
+		t.Fatalf("Expected alerts to wait for the debounce, got %v", alerts)
+	}
+	alerts := sink.Alerts()
+	for deadline := time.Now().Add(time.Second); len(alerts) < 2 && time.Now().Before(deadline); alerts = sink.Alerts() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(alerts) != 2 {
+		t.Fatalf("Expected an alert per camera, got %d", len(alerts))
+	}
+	for _, alert := range alerts {
+		detections := map[string]int{"Camera1": 2, "Camera2": 1}[alert.Camera]
+		if alert.Rule != "vehicles" || len(alert.Detections) != detections {
+			t.Fatalf("Expected %d detections on %s, got %+v", detections, alert.Camera, alert)
+		}
+	}
+
+	alerter.Evaluate(newTestDetectionEvent(t, "Camera1"))
+	alerter.Close(context.Background())
+	if alerts := sink.Alerts(); len(alerts) != 2 {
+		t.Fatalf("Expected the cooldown to ignore Camera1, got %d alerts", len(alerts))
+	}
+}
+
+func TestAlerterCloseSendsPendingAlerts(t *testing.T) {
+	alerter, sink := newTestAlerter(t, AlertRuleConfig{Name: "everything", Debounce: Duration(time.Hour)})
+	alerter.Evaluate(newTestDetectionEvent(t, "Camera1"))
+	alerter.Close(context.Background())
+	if alerts := sink.Alerts(); len(alerts) != 1 {
+		t.Fatalf("Expected the debounced alert to be sent on close, got %d", len(alerts))
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	received := make(chan Alert, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alert := Alert{}
+		if r.Header.Get("Authorization") != "Bearer secret" || json.NewDecoder(r.Body).Decode(&alert) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- alert
+	}))
+	defer server.Close()
+
+	sink, _ := NewAlertSink(AlertSinkConfig{Type: WebhookAlertSink, Url: server.URL, Authorization: "Bearer secret"})
+	if err := sink.Send(context.Background(), Alert{Rule: "night", Camera: "Camera1"}); err != nil {
+		t.Fatalf("Expected the webhook to accept the alert, got %s", err)
+	}
+	if alert := <-received; alert.Rule != "night" {
+		t.Fatalf("Expected the night alert, got %+v", alert)
+	}
+}
+
+func TestCommandSink(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "alert")
+	sink, _ := NewAlertSink(AlertSinkConfig{
+		Type:    CommandAlertSink,
+		Command: []string{"sh", "-c", "echo $HOMEWATCH_ALERT_CAMERA > " + output + " && cat >> " + output},
+	})
+	if err := sink.Send(context.Background(), Alert{Rule: "night", Camera: "Camera1"}); err != nil {
+		t.Fatalf("Expected the command to run, got %s", err)
+	}
+	b, _ := os.ReadFile(output)
+	if !strings.HasPrefix(string(b), "Camera1\n{\"rule\":\"night\"") {
+		t.Fatalf("Expected the camera and alert, got %q", b)
+	}
+
+	sink, _ = NewAlertSink(AlertSinkConfig{Type: CommandAlertSink, Command: []string{"sh", "-c", "echo broken >&2; exit 1"}})
+	if err := sink.Send(context.Background(), Alert{}); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Fatalf("Expected the command's output in the error, got %v", err)
+	}
+}
+
+// serveSMTP: Accept one mail on listener, sending its data to mail
+func serveSMTP(listener net.Listener, mail chan<- string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	io.WriteString(conn, "220 relay\r\n")
+	data := &strings.Builder{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch command := strings.ToUpper(strings.TrimSpace(line)); {
+		case strings.HasPrefix(command, "DATA"):
+			io.WriteString(conn, "354 go ahead\r\n")
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil || line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			mail <- data.String()
+			io.WriteString(conn, "250 queued\r\n")
+		case strings.HasPrefix(command, "QUIT"):
+			io.WriteString(conn, "221 bye\r\n")
+			return
+		default:
+			io.WriteString(conn, "250 ok\r\n")
+		}
+	}
+}
+
+func TestSMTPSink(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer listener.Close()
+	mail := make(chan string, 1)
+	go serveSMTP(listener, mail)
+
+	sink, _ := NewAlertSink(AlertSinkConfig{
+		Type:    SMTPAlertSink,
+		Address: listener.Addr().String(),
+		From:    "homewatch@localhost",
+		To:      []string{"me@localhost"},
+	})
+	alert := Alert{Rule: "night", Camera: "Camera1", Detections: []DetectionRecord{{ObjectType: "Human", Kind: TripwireEventKind}}}
+	if err := sink.Send(context.Background(), alert); err != nil {
+		t.Fatalf("Expected the relay to accept the alert, got %s", err)
+	}
+	if message := <-mail; !strings.Contains(message, "Subject: Homewatch: night on Camera1") || !strings.Contains(message, "tripwire Human") {
+		t.Fatalf("Expected the alert in the mail, got %q", message)
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultApiFilesLimit: How many files /files lists unless ?limit= is given
+const DefaultApiFilesLimit = 100
+
+// ApiStatus: Whether uploads are paused and how many files each pipeline hasn't handled yet
+type ApiStatus struct {
+	Version       string              `json:"version"`
+	UploadsPaused bool                `json:"uploadsPaused"`
+	Pipelines     []ApiPipelineStatus `json:"pipelines"`
+}
+
+type ApiPipelineStatus struct {
+	Name       string `json:"name"`
+	IndexQueue int    `json:"indexQueue"`
+	VideoQueue int    `json:"videoQueue"`
+	Publisher  bool   `json:"publisher"`
+}
+
+// ApiCamera: How many of a camera's files are in each state, and its liveness when it's followed
+type ApiCamera struct {
+	Camera   string          `json:"camera"`
+	Files    map[string]int  `json:"files"`
+	LastFile *time.Time      `json:"lastFile,omitempty"`
+	Liveness *CameraLiveness `json:"liveness,omitempty"`
+}
+
+// ApiQueueItem: An index or video file a pipeline's queue hasn't had acknowledged
+type ApiQueueItem struct {
+	Pipeline   string    `json:"pipeline"`
+	Type       string    `json:"type"`
+	Sequence   uint64    `json:"sequence"`
+	Path       string    `json:"path"`
+	EnqueuedAt time.Time `json:"enqueuedAt"`
+	Delivered  bool      `json:"delivered"`
+}
+
+// ApiDeadLetter: An index or video file a pipeline gave up uploading
+type ApiDeadLetter struct {
+	Pipeline string    `json:"pipeline"`
+	Type     string    `json:"type"`
+	Path     string    `json:"path"`
+	Bytes    int64     `json:"bytes"`
+	ModTime  time.Time `json:"modTime"`
+}
+
+// ApiReupload: A file being uploaded again
+type ApiReupload struct {
+	Path       string `json:"path"`
+	Pipeline   string `json:"pipeline"`
+	DeadLetter bool   `json:"deadLetter"`
+}
+
+type ApiPublishResult struct {
+	Pipeline string `json:"pipeline"`
+	Error    string `json:"error,omitempty"`
+}
+
+/*
+Api: The local status and control API. Lists the cameras, recent files and
+their upload state, queued files and dead letters, and re-uploads files,
+pauses and resumes uploads and publishes the datapoints collected so far.
+Every request must be authorized with the bearer token.
+*/
+type Api struct {
+	token     string
+	pipelines []*Pipeline
+	gate      *UploadGate
+	state     *StateStore
+	liveness  *LivenessTracker
+	mux       *http.ServeMux
+	server    *http.Server
+	// reuploads: The uploads started by /reupload which haven't finished
+	reuploads sync.WaitGroup
+}
+
+// NewApi: An API on config's address controlling pipelines, whose uploaders are held back by gate
+func NewApi(config ApiConfig, pipelines []*Pipeline, gate *UploadGate) *Api {
+	a := &Api{
+		token:     config.Token,
+		pipelines: pipelines,
+		gate:      gate,
+		mux:       http.NewServeMux(),
+	}
+	a.server = &http.Server{Addr: config.Address, Handler: a}
+	a.handle("/status", http.MethodGet, a.status)
+	a.handle("/cameras", http.MethodGet, a.cameras)
+	a.handle("/files", http.MethodGet, a.files)
+	a.handle("/queue", http.MethodGet, a.queue)
+	a.handle("/dead-letters", http.MethodGet, a.deadLetters)
+	a.handle("/reupload", http.MethodPost, a.reupload)
+	a.handle("/uploads/pause", http.MethodPost, a.pauseUploads)
+	a.handle("/uploads/resume", http.MethodPost, a.resumeUploads)
+	a.handle("/publish", http.MethodPost, a.publish)
+	return a
+}
+
+// AddStateStore: List files and cameras from state
+func (a *Api) AddStateStore(state *StateStore) {
+	a.state = state
+}
+
+// AddLiveness: Include each camera's liveness
+func (a *Api) AddLiveness(liveness *LivenessTracker) {
+	a.liveness = liveness
+}
+
+// handle: Serve path with handler, refusing every other method
+func (a *Api) handle(path, method string, handler http.HandlerFunc) {
+	a.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, fmt.Sprintf("%s only accepts %s", path, method), http.StatusMethodNotAllowed)
+			return
+		}
+		handler(w, r)
+	})
+}
+
+func (a *Api) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	authorization := []byte(r.Header.Get("Authorization"))
+	if subtle.ConstantTimeCompare(authorization, []byte("Bearer "+a.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="homewatch-agent"`)
+		http.Error(w, "a valid bearer token is required", http.StatusUnauthorized)
+		return
+	}
+	if flagDebug {
+		log.Printf("DEBUG: API %s %s", r.Method, r.URL)
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+// Serve: Serve the API until Close
+func (a *Api) Serve() {
+	log.Printf("INFO: Serving the API on %s", a.server.Addr)
+	if err := a.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("ERROR: Unable to serve the API on %s: %s", a.server.Addr, err)
+	}
+}
+
+// Close: Stop serving, then wait for re-uploads until ctx is done
+func (a *Api) Close(ctx context.Context) {
+	if err := a.server.Shutdown(ctx); err != nil {
+		log.Printf("WARN: Stopped waiting for API requests: %s", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		a.reuploads.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("WARN: Stopped waiting for re-uploads: %s", ctx.Err())
+	}
+}
+
+func writeApiJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (a *Api) status(w http.ResponseWriter, r *http.Request) {
+	status := ApiStatus{Version: softwareVersion, UploadsPaused: a.gate.Paused(), Pipelines: []ApiPipelineStatus{}}
+	for _, pipeline := range a.pipelines {
+		index, video := pipeline.QueueDepths()
+		status.Pipelines = append(status.Pipelines, ApiPipelineStatus{
+			Name:       pipeline.Config.Name,
+			IndexQueue: index,
+			VideoQueue: video,
+			Publisher:  pipeline.eventHandler != nil,
+		})
+	}
+	writeApiJSON(w, http.StatusOK, status)
+}
+
+// lastChanged: When record last entered a state
+func lastChanged(record FileRecord) time.Time {
+	last := time.Time{}
+	for _, at := range record.Times {
+		if at.After(last) {
+			last = at
+		}
+	}
+	return last
+}
+
+// cameras: Every camera with a recorded file or followed liveness, by name
+func (a *Api) cameras(w http.ResponseWriter, r *http.Request) {
+	records, err := a.state.Files(nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cameras := map[string]*ApiCamera{}
+	camera := func(name string) *ApiCamera {
+		if _, exists := cameras[name]; !exists {
+			cameras[name] = &ApiCamera{Camera: name, Files: map[string]int{}}
+		}
+		return cameras[name]
+	}
+	for _, record := range records {
+		c := camera(record.Camera)
+		c.Files[record.State]++
+		if last := lastChanged(record); c.LastFile == nil || last.After(*c.LastFile) {
+			c.LastFile = &last
+		}
+	}
+	if a.liveness != nil {
+		for _, liveness := range a.liveness.Cameras() {
+			liveness := liveness
+			camera(liveness.Camera).Liveness = &liveness
+		}
+	}
+
+	list := []ApiCamera{}
+	for _, c := range cameras {
+		list = append(list, *c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Camera < list[j].Camera })
+	writeApiJSON(w, http.StatusOK, list)
+}
+
+// files: The most recently changed files, filtered by the state and camera query parameters, newest first
+func (a *Api) files(w http.ResponseWriter, r *http.Request) {
+	if a.state == nil {
+		http.Error(w, "files are only recorded with statePath", http.StatusNotFound)
+		return
+	}
+	limit := DefaultApiFilesLimit
+	if value := r.URL.Query().Get("limit"); len(value) > 0 {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			http.Error(w, fmt.Sprintf("limit must be a positive number, got %q", value), http.StatusBadRequest)
+			return
+		}
+	}
+	state := r.URL.Query().Get("state")
+	camera := r.URL.Query().Get("camera")
+	records, err := a.state.Files(func(record FileRecord) bool {
+		return (len(state) == 0 || record.State == state) && (len(camera) == 0 || record.Camera == camera)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(records, func(i, j int) bool { return lastChanged(records[i]).After(lastChanged(records[j])) })
+	if len(records) > limit {
+		records = records[:limit]
+	}
+	writeApiJSON(w, http.StatusOK, records)
+}
+
+// queue: The files each pipeline's queues haven't had acknowledged, oldest first. Only queuePath's queues are listed.
+func (a *Api) queue(w http.ResponseWriter, r *http.Request) {
+	items := []ApiQueueItem{}
+	for _, pipeline := range a.pipelines {
+		queues := map[string]*DiskQueue{IndexFileType: pipeline.indexQueue, VideoFileType: pipeline.videoQueue}
+		for fileType, queue := range queues {
+			if queue == nil {
+				continue
+			}
+			for _, item := range queue.Pending() {
+				items = append(items, ApiQueueItem{
+					Pipeline:   pipeline.Config.Name,
+					Type:       fileType,
+					Sequence:   item.Sequence,
+					Path:       item.Path,
+					EnqueuedAt: item.EnqueuedAt,
+					Delivered:  item.Delivered,
+				})
+			}
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].EnqueuedAt.Before(items[j].EnqueuedAt) })
+	writeApiJSON(w, http.StatusOK, items)
+}
+
+// deadLetters: The files under each pipeline's dead letter paths
+func (a *Api) deadLetters(w http.ResponseWriter, r *http.Request) {
+	deadLetters := []ApiDeadLetter{}
+	for _, pipeline := range a.pipelines {
+		for _, fileType := range []string{IndexFileType, VideoFileType} {
+			uploader := pipeline.uploader(fileType)
+			if uploader == nil || len(uploader.DeadLetterPath) == 0 {
+				continue
+			}
+			filepath.WalkDir(uploader.DeadLetterPath, func(path string, d fs.DirEntry, err error) error {
+				if err != nil || d.IsDir() {
+					return nil
+				}
+				info, err := d.Info()
+				if err != nil {
+					return nil
+				}
+				deadLetters = append(deadLetters, ApiDeadLetter{
+					Pipeline: pipeline.Config.Name,
+					Type:     fileType,
+					Path:     path,
+					Bytes:    info.Size(),
+					ModTime:  info.ModTime(),
+				})
+				return nil
+			})
+		}
+	}
+	writeApiJSON(w, http.StatusOK, deadLetters)
+}
+
+/*
+reuploader: The pipeline and uploader of path's file type which uploads it,
+preferring the pipeline it's a dead letter of, then the one whose trim prefix
+holds the most of it. Files outside every dead letter path and non-empty trim
+prefix aren't uploaded by any pipeline, so the API can't upload just any file.
+*/
+func (a *Api) reuploader(path, fileType string) (*Pipeline, *Uploader, bool) {
+	var matched *Pipeline
+	var matchedUploader *Uploader
+	for _, pipeline := range a.pipelines {
+		uploader := pipeline.uploader(fileType)
+		if uploader == nil {
+			continue
+		}
+		if uploader.isDeadLetter(path) {
+			return pipeline, uploader, true
+		}
+		if len(uploader.localTrimPrefix) == 0 || !withinDirectory(uploader.localTrimPrefix, path) {
+			continue
+		}
+		if matchedUploader == nil || len(uploader.localTrimPrefix) > len(matchedUploader.localTrimPrefix) {
+			matched, matchedUploader = pipeline, uploader
+		}
+	}
+	return matched, matchedUploader, false
+}
+
+/*
+reupload: Upload the file at the path given as {"path": ...} again, in the
+background. Dead letters are uploaded to the key they would have had and
+removed once they're uploaded.
+*/
+func (a *Api) reupload(w http.ResponseWriter, r *http.Request) {
+	request := struct {
+		Path string `json:"path"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, fmt.Sprintf(`the body must be like {"path": "/absolute/path"}: %s`, err), http.StatusBadRequest)
+		return
+	}
+	path := request.Path
+	if !filepath.IsAbs(path) || filepath.Clean(path) != path {
+		http.Error(w, fmt.Sprintf("path must be absolute and clean, got %q", path), http.StatusBadRequest)
+		return
+	}
+	fileType := fileTypeOf(path)
+	if len(fileType) == 0 {
+		http.Error(w, fmt.Sprintf("only .dav, .idx and %s files are uploaded, got %s", transcodedVideoExtension, path), http.StatusBadRequest)
+		return
+	}
+	pipeline, uploader, deadLetter := a.reuploader(path, fileType)
+	if uploader == nil {
+		http.Error(w, fmt.Sprintf("no pipeline uploads %s", path), http.StatusBadRequest)
+		return
+	}
+	if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+		http.Error(w, fmt.Sprintf("%s isn't a file", path), http.StatusNotFound)
+		return
+	}
+
+	log.Printf("INFO: Uploading %s again with the %s pipeline", path, pipeline.Config.Name)
+	a.reuploads.Add(1)
+	go func() {
+		defer a.reuploads.Done()
+		status := 0
+		if deadLetter {
+			status = redriveDeadLetter(path, uploader.redriver())
+		} else {
+			status = uploadFile(path, uploader)
+		}
+		if status != DoneUploadVideoFile {
+			log.Printf("ERROR: Unable to upload %s again", path)
+		}
+	}()
+	writeApiJSON(w, http.StatusAccepted, ApiReupload{Path: path, Pipeline: pipeline.Config.Name, DeadLetter: deadLetter})
+}
+
+// withinDirectory: Whether path is under dir, rather than merely sharing its prefix like /srv/cam and /srv/cameras
+func withinDirectory(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
+
+func (a *Api) pauseUploads(w http.ResponseWriter, r *http.Request) {
+	a.gate.Pause()
+	log.Printf("INFO: Uploads paused from the API")
+	a.status(w, r)
+}
+
+func (a *Api) resumeUploads(w http.ResponseWriter, r *http.Request) {
+	a.gate.Resume()
+	log.Printf("INFO: Uploads resumed from the API")
+	a.status(w, r)
+}
+
+// publish: Publish the datapoints each pipeline with a publisher has collected so far
+func (a *Api) publish(w http.ResponseWriter, r *http.Request) {
+	results := []ApiPublishResult{}
+	status := http.StatusOK
+	for _, pipeline := range a.pipelines {
+		err := pipeline.Publish()
+		if errors.Is(err, ErrNoPublisher) {
+			continue
+		}
+		result := ApiPublishResult{Pipeline: pipeline.Config.Name}
+		if err != nil {
+			log.Printf("ERROR: Unable to publish the %s pipeline's datapoints from the API: %s", pipeline.Config.Name, err)
+			result.Error = err.Error()
+			status = http.StatusBadGateway
+		}
+		results = append(results, result)
+	}
+	if len(results) == 0 {
+		http.Error(w, "no pipeline has a publisher", http.StatusNotFound)
+		return
+	}
+	log.Printf("INFO: Published %d pipelines' datapoints from the API", len(results))
+	writeApiJSON(w, status, results)
+}
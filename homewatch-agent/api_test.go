@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testApiToken = "secret"
+
+// testApi: An API controlling one pipeline uploading to a file:// bucket, and the bucket's root
+type testApi struct {
+	*Api
+	pipeline   *Pipeline
+	root       string
+	bucket     string
+	deadLetter string
+}
+
+func newTestApi(t *testing.T) testApi {
+	root := t.TempDir()
+	bucket := t.TempDir()
+	config := DefaultConfig()
+	config.QueuePath = t.TempDir()
+	config.DeadLetterPath = t.TempDir()
+	pipeline := &config.Pipelines[0]
+	pipeline.Index.Upload = true
+	pipeline.Index.StorageUrl = "file://" + bucket
+	pipeline.Index.TrimPrefix = root + "/"
+	pipeline.Video.Upload = true
+	pipeline.Video.StorageUrl = "file://" + bucket
+	pipeline.Video.TrimPrefix = root + "/"
+	pipeline.Publisher.NDJSON.Path = filepath.Join(t.TempDir(), "datapoints.ndjson")
+
+	p := NewPipeline(config, *pipeline, nil)
+	t.Cleanup(func() {
+		p.indexQueue.Close()
+		p.videoQueue.Close()
+	})
+	gate := NewUploadGate()
+	p.AddUploadGate(gate)
+	api := NewApi(ApiConfig{Address: "127.0.0.1:0", Token: testApiToken}, []*Pipeline{p}, gate)
+	return testApi{Api: api, pipeline: p, root: root, bucket: bucket, deadLetter: p.uploader(VideoFileType).DeadLetterPath}
+}
+
+// request: Serve method path with body, authorized with the test token
+func (a testApi) request(method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+testApiToken)
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+	return w
+}
+
+func decodeApiResponse(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("Expected JSON, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestApiRequiresTheToken(t *testing.T) {
+	api := newTestApi(t)
+	for _, authorization := range []string{"", "Bearer wrong", testApiToken} {
+		r := httptest.NewRequest("GET", "/status", nil)
+		r.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected %q to be unauthorized, got %d", authorization, w.Code)
+		}
+	}
+
+	w := api.request("GET", "/status", "")
+	status := ApiStatus{}
+	decodeApiResponse(t, w, &status)
+	if w.Code != http.StatusOK || len(status.Pipelines) != 1 || !status.Pipelines[0].Publisher {
+		t.Fatalf("Expected the status of a pipeline with a publisher, got %d %#v", w.Code, status)
+	}
+	if w := api.request("GET", "/publish", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected /publish to only accept POST, got %d", w.Code)
+	}
+}
+
+func TestApiPausesUploadsUntilResumed(t *testing.T) {
+	api := newTestApi(t)
+	video := filepath.Join(api.root, "Camera1", "a.dav")
+	writeTestFile(t, video, "video")
+	uploaded := filepath.Join(api.bucket, "Camera1", "a.dav")
+
+	status := ApiStatus{}
+	decodeApiResponse(t, api.request("POST", "/uploads/pause", ""), &status)
+	if !status.UploadsPaused {
+		t.Fatalf("Expected uploads to be paused, got %#v", status)
+	}
+	w := api.request("POST", "/reupload", `{"path": "`+video+`"}`)
+	reupload := ApiReupload{}
+	decodeApiResponse(t, w, &reupload)
+	if w.Code != http.StatusAccepted || reupload.DeadLetter {
+		t.Fatalf("Expected %s to be uploaded again, got %d %#v", video, w.Code, reupload)
+	}
+	if _, err := os.Stat(uploaded); !os.IsNotExist(err) {
+		t.Fatalf("Expected nothing to be uploaded while paused, got %v", err)
+	}
+
+	api.request("POST", "/uploads/resume", "")
+	api.reuploads.Wait()
+	if _, err := os.Stat(uploaded); err != nil {
+		t.Fatalf("Expected %s to be uploaded once resumed, got %s", uploaded, err)
+	}
+	if w := api.request("POST", "/reupload", `{"path": "relative/a.dav"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a relative path to be refused, got %d", w.Code)
+	}
+}
+
+func TestApiOnlyReuploadsCameraFilesUnderATrimPrefix(t *testing.T) {
+	api := newTestApi(t)
+	video := filepath.Join(api.root, "Camera1", "a.dav")
+	sibling := filepath.Join(api.root+"-other", "Camera1", "a.dav")
+	state := filepath.Join(api.root, "state.db")
+	for _, path := range []string{video, sibling, state} {
+		writeTestFile(t, path, "file")
+	}
+
+	for _, path := range []string{sibling, state} {
+		if w := api.request("POST", "/reupload", `{"path": "`+path+`"}`); w.Code != http.StatusBadRequest {
+			t.Fatalf("Expected %s to be refused, got %d %s", path, w.Code, w.Body.String())
+		}
+	}
+	for _, fileType := range []string{IndexFileType, VideoFileType} {
+		api.pipeline.uploader(fileType).TrimLocalPrefix("")
+	}
+	if w := api.request("POST", "/reupload", `{"path": "`+video+`"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected no pipeline without a trim prefix to upload %s, got %d", video, w.Code)
+	}
+	api.reuploads.Wait()
+	if entries, err := os.ReadDir(api.bucket); err != nil || len(entries) != 0 {
+		t.Fatalf("Expected nothing to be uploaded, got %v %v", entries, err)
+	}
+}
+
+func TestApiReuploadsDeadLetters(t *testing.T) {
+	api := newTestApi(t)
+	deadLetter := filepath.Join(api.deadLetter, "Camera1", "a.dav")
+	writeTestFile(t, deadLetter, "video")
+
+	deadLetters := []ApiDeadLetter{}
+	decodeApiResponse(t, api.request("GET", "/dead-letters", ""), &deadLetters)
+	if len(deadLetters) != 1 || deadLetters[0].Path != deadLetter || deadLetters[0].Type != VideoFileType {
+		t.Fatalf("Expected %s to be listed, got %#v", deadLetter, deadLetters)
+	}
+
+	reupload := ApiReupload{}
+	decodeApiResponse(t, api.request("POST", "/reupload", `{"path": "`+deadLetter+`"}`), &reupload)
+	if !reupload.DeadLetter {
+		t.Fatalf("Expected %s to be redriven, got %#v", deadLetter, reupload)
+	}
+	api.reuploads.Wait()
+	if _, err := os.Stat(filepath.Join(api.bucket, "Camera1", "a.dav")); err != nil {
+		t.Fatalf("Expected the dead letter to be uploaded to its key, got %s", err)
+	}
+	if _, err := os.Stat(deadLetter); !os.IsNotExist(err) {
+		t.Fatalf("Expected the redriven dead letter to be removed, got %v", err)
+	}
+}
+
+func TestApiListsFilesCamerasAndQueue(t *testing.T) {
+	api := newTestApi(t)
+	state := openTestStateStore(t, filepath.Join(t.TempDir(), "state.db"))
+	defer state.Close()
+	api.AddStateStore(state)
+	older, newer := cameraVideo("Camera1"), cameraVideo("Camera2")
+	now := time.Now()
+	state.now = func() time.Time { return now.Add(-time.Minute) }
+	state.Uploaded(older, "a")
+	state.now = func() time.Time { return now }
+	state.Discovered(newer)
+
+	files := []FileRecord{}
+	decodeApiResponse(t, api.request("GET", "/files?limit=1", ""), &files)
+	if len(files) != 1 || files[0].Path != newer {
+		t.Fatalf("Expected only the newest file, %s, got %#v", newer, files)
+	}
+	decodeApiResponse(t, api.request("GET", "/files?state=uploaded&camera=Camera1", ""), &files)
+	if len(files) != 1 || files[0].Path != older || files[0].ETag != "a" {
+		t.Fatalf("Expected only Camera1's uploaded video, got %#v", files)
+	}
+	decodeApiResponse(t, api.request("GET", "/files?state=uploaded&camera=Camera2", ""), &files)
+	if len(files) != 0 {
+		t.Fatalf("Expected Camera2 to have no uploaded videos, got %#v", files)
+	}
+	cameras := []ApiCamera{}
+	decodeApiResponse(t, api.request("GET", "/cameras", ""), &cameras)
+	if len(cameras) != 2 || cameras[0].Camera != "Camera1" || cameras[0].Files[UploadedFile] != 1 || cameras[1].Files[DiscoveredFile] != 1 {
+		t.Fatalf("Expected the files of Camera1 and Camera2 by state, got %#v", cameras)
+	}
+
+	if err := api.pipeline.indexQueue.Enqueue("/data/a.idx"); err != nil {
+		t.Fatalf("Expected /data/a.idx to be queued, got %s", err)
+	}
+	items := []ApiQueueItem{}
+	decodeApiResponse(t, api.request("GET", "/queue", ""), &items)
+	if len(items) != 1 || items[0].Path != "/data/a.idx" || items[0].Type != IndexFileType {
+		t.Fatalf("Expected /data/a.idx to be queued, got %#v", items)
+	}
+
+	results := []ApiPublishResult{}
+	w := api.request("POST", "/publish", "")
+	decodeApiResponse(t, w, &results)
+	if w.Code != http.StatusOK || len(results) != 1 || len(results[0].Error) > 0 {
+		t.Fatalf("Expected the pipeline to publish, got %d %#v", w.Code, results)
+	}
+}
+
+// Run with -race to check /publish is safe while the pipeline's Publisher runs and is reconfigured
+func TestApiPublishesWhileThePublisherRuns(t *testing.T) {
+	api := newTestApi(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go api.pipeline.eventHandler.Publisher(ctx)
+
+	published := make(chan int)
+	go func() {
+		defer close(published)
+		for i := 0; i < 100; i++ {
+			if w := api.request("POST", "/publish", ""); w.Code != http.StatusOK {
+				published <- w.Code
+				return
+			}
+		}
+	}()
+	publisher := api.pipeline.Config.Publisher
+	for i := 0; i < 100; i++ {
+		publisher.ConsolidationInterval = Duration(time.Duration(i%5+1) * time.Millisecond)
+		api.pipeline.Reconfigure(publisher)
+	}
+	for code := range published {
+		t.Fatalf("Expected to publish, got %d", code)
+	}
+}
@@ -0,0 +1,811 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	v2 "github.com/mrmod/homewatch/v2"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultPipelineName = "default"
+
+/*
+Config: Everything the agent runs, loaded from a YAML or JSON file given with
+--config or built from flags. Settings shared by every pipeline are at the top
+level and each pipeline has its own syslog listeners, handlers and publisher.
+*/
+type Config struct {
+	Debug   bool `json:"debug" yaml:"debug"`
+	Verbose bool `json:"verbose" yaml:"verbose"`
+	// QueuePath, DeadLetterPath, UploadStatePath, PublishBufferPath: Directories
+	// with a subdirectory per pipeline when there's more than one pipeline
+	QueuePath         string `json:"queuePath" yaml:"queuePath"`
+	DeadLetterPath    string `json:"deadLetterPath" yaml:"deadLetterPath"`
+	UploadStatePath   string `json:"uploadStatePath" yaml:"uploadStatePath"`
+	PublishBufferPath string `json:"publishBufferPath" yaml:"publishBufferPath"`
+	// StatePath: The database recording each file's lifecycle and the watched directories, shared by every pipeline
+	StatePath string `json:"statePath" yaml:"statePath"`
+	// ShutdownTimeout: How long shutdown waits for files being handled before cancelling them
+	ShutdownTimeout Duration         `json:"shutdownTimeout" yaml:"shutdownTimeout"`
+	Storage         StorageConfig    `json:"storage" yaml:"storage"`
+	Pipelines       []PipelineConfig `json:"pipelines" yaml:"pipelines"`
+	V2              V2Config         `json:"v2" yaml:"v2"`
+	Alerts          AlertsConfig     `json:"alerts" yaml:"alerts"`
+	Retention       RetentionConfig  `json:"retention" yaml:"retention"`
+	Api             ApiConfig        `json:"api" yaml:"api"`
+}
+
+// StorageConfig: How uploaders reach and write to their storage URLs
+type StorageConfig struct {
+	S3Endpoint  string          `json:"s3Endpoint" yaml:"s3Endpoint"`
+	S3Region    string          `json:"s3Region" yaml:"s3Region"`
+	S3PathStyle bool            `json:"s3PathStyle" yaml:"s3PathStyle"`
+	Retry       RetryConfig     `json:"retry" yaml:"retry"`
+	Multipart   MultipartConfig `json:"multipart" yaml:"multipart"`
+}
+
+type RetryConfig struct {
+	MaxAttempts int      `json:"maxAttempts" yaml:"maxAttempts"`
+	BaseDelay   Duration `json:"baseDelay" yaml:"baseDelay"`
+	MaxDelay    Duration `json:"maxDelay" yaml:"maxDelay"`
+}
+
+func (r RetryConfig) Backoff() Backoff {
+	return Backoff{
+		MaxAttempts: r.MaxAttempts,
+		BaseDelay:   time.Duration(r.BaseDelay),
+		MaxDelay:    time.Duration(r.MaxDelay),
+	}
+}
+
+type MultipartConfig struct {
+	PartSize    int64 `json:"partSize" yaml:"partSize"`
+	Concurrency int   `json:"concurrency" yaml:"concurrency"`
+}
+
+// PipelineConfig: One syslog source and the handlers for the files it reports
+type PipelineConfig struct {
+	Name      string          `json:"name" yaml:"name"`
+	Syslog    SyslogConfig    `json:"syslog" yaml:"syslog"`
+	Index     IndexConfig     `json:"index" yaml:"index"`
+	Video     VideoConfig     `json:"video" yaml:"video"`
+	Publisher PublisherConfig `json:"publisher" yaml:"publisher"`
+}
+
+type SyslogConfig struct {
+	// Address: UDP IP:Port
+	Address    string          `json:"address" yaml:"address"`
+	TcpAddress string          `json:"tcpAddress" yaml:"tcpAddress"`
+	Tls        SyslogTLSConfig `json:"tls" yaml:"tls"`
+}
+
+type SyslogTLSConfig struct {
+	Address      string `json:"address" yaml:"address"`
+	CertFile     string `json:"certFile" yaml:"certFile"`
+	KeyFile      string `json:"keyFile" yaml:"keyFile"`
+	ClientCAFile string `json:"clientCAFile" yaml:"clientCAFile"`
+}
+
+type IndexConfig struct {
+	Upload     bool   `json:"upload" yaml:"upload"`
+	StorageUrl string `json:"storageUrl" yaml:"storageUrl"`
+	TrimPrefix string `json:"trimPrefix" yaml:"trimPrefix"`
+	// Cleanup: Remove index files once they're uploaded
+	Cleanup bool `json:"cleanup" yaml:"cleanup"`
+	// InvalidLines: fail, stop or skip, what to do with invalid lines when reading index files
+	InvalidLines string `json:"invalidLines" yaml:"invalidLines"`
+}
+
+type VideoConfig struct {
+	Upload     bool   `json:"upload" yaml:"upload"`
+	StorageUrl string `json:"storageUrl" yaml:"storageUrl"`
+	TrimPrefix string `json:"trimPrefix" yaml:"trimPrefix"`
+	// Cleanup: Remove videos once they're uploaded
+	Cleanup   bool            `json:"cleanup" yaml:"cleanup"`
+	Transcode TranscodeConfig `json:"transcode" yaml:"transcode"`
+	// Sidecar: Upload a JSON summary of each video's index file next to it
+	Sidecar bool `json:"sidecar" yaml:"sidecar"`
+}
+
+type TranscodeConfig struct {
+	Enabled        bool   `json:"enabled" yaml:"enabled"`
+	FFmpegPath     string `json:"ffmpegPath" yaml:"ffmpegPath"`
+	Workers        int    `json:"workers" yaml:"workers"`
+	UploadOriginal bool   `json:"uploadOriginal" yaml:"uploadOriginal"`
+}
+
+/*
+PublisherConfig: Where datapoints consolidated from index files are published.
+Datapoints are published to each publisher with a Url or Path, and aren't
+published when none have one.
+*/
+type PublisherConfig struct {
+	// Url: The index event API, which is put each window's datapoints as JSON
+	Url                   string   `json:"url" yaml:"url"`
+	Authorization         string   `json:"authorization" yaml:"authorization"`
+	ConsolidationInterval Duration `json:"consolidationInterval" yaml:"consolidationInterval"`
+	// Timeout: How long each request to a publisher may take
+	Timeout Duration `json:"timeout" yaml:"timeout"`
+	// Retry: Attempts to put each window to Url
+	Retry RetryConfig `json:"retry" yaml:"retry"`
+	// Gzip: Compress the windows put to Url
+	Gzip bool `json:"gzip" yaml:"gzip"`
+	// BufferMaxBytes: The most the windows waiting in the agent's publishBufferPath may take up, 0 for no limit
+	BufferMaxBytes int64             `json:"bufferMaxBytes" yaml:"bufferMaxBytes"`
+	Influx         InfluxConfig      `json:"influx" yaml:"influx"`
+	Pushgateway    PushgatewayConfig `json:"pushgateway" yaml:"pushgateway"`
+	NDJSON         NDJSONConfig      `json:"ndjson" yaml:"ndjson"`
+}
+
+// Enabled: True when there's a publisher to publish to
+func (p PublisherConfig) Enabled() bool {
+	return len(p.Url) > 0 || len(p.Influx.Url) > 0 || len(p.Pushgateway.Url) > 0 || len(p.NDJSON.Path) > 0
+}
+
+type InfluxConfig struct {
+	// Url: A write endpoint like http://influx:8086/api/v2/write?org=home&bucket=homewatch or http://influx:8086/write?db=homewatch
+	Url         string `json:"url" yaml:"url"`
+	Token       string `json:"token" yaml:"token"`
+	Measurement string `json:"measurement" yaml:"measurement"`
+}
+
+type PushgatewayConfig struct {
+	// Url: The pushgateway, like http://pushgateway:9091
+	Url string `json:"url" yaml:"url"`
+	Job string `json:"job" yaml:"job"`
+}
+
+type NDJSONConfig struct {
+	Path string `json:"path" yaml:"path"`
+	// MaxBytes, MaxFiles: Rotate Path once it's larger than MaxBytes, keeping MaxFiles rotated files
+	MaxBytes int64 `json:"maxBytes" yaml:"maxBytes"`
+	MaxFiles int   `json:"maxFiles" yaml:"maxFiles"`
+}
+
+// AlertsConfig: Rules matched against the objects detected in every pipeline's index files, and where their alerts are sent
+type AlertsConfig struct {
+	Rules    []AlertRuleConfig `json:"rules" yaml:"rules"`
+	Sinks    []AlertSinkConfig `json:"sinks" yaml:"sinks"`
+	Liveness LivenessConfig    `json:"liveness" yaml:"liveness"`
+}
+
+// LivenessConfig: When a camera which stopped sending videos is silent, and which sinks are alerted
+type LivenessConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Cadence: How often every camera is expected to send a video, learned for each camera when zero
+	Cadence Duration `json:"cadence" yaml:"cadence"`
+	// Cameras: Cameras expected from the start, at their own cadences
+	Cameras []CameraCadenceConfig `json:"cameras" yaml:"cameras"`
+	// Tolerance: How many cadences a camera can go without a video before it's silent
+	Tolerance float64 `json:"tolerance" yaml:"tolerance"`
+	// Interval: How often cameras are checked
+	Interval Duration `json:"interval" yaml:"interval"`
+	Sinks    []string `json:"sinks" yaml:"sinks"`
+}
+
+type CameraCadenceConfig struct {
+	Camera  string   `json:"camera" yaml:"camera"`
+	Cadence Duration `json:"cadence" yaml:"cadence"`
+}
+
+type AlertRuleConfig struct {
+	Name string `json:"name" yaml:"name"`
+	// Cameras, ObjectTypes, Kinds: What the rule matches, like Camera1, Human and intrusion, anything when empty
+	Cameras     []string `json:"cameras" yaml:"cameras"`
+	ObjectTypes []string `json:"objectTypes" yaml:"objectTypes"`
+	Kinds       []string `json:"kinds" yaml:"kinds"`
+	// Between: The local times, like 22:00-06:00, the rule matches between, any time when empty
+	Between       string  `json:"between" yaml:"between"`
+	MinConfidence float64 `json:"minConfidence" yaml:"minConfidence"`
+	// Debounce: How long to collect matches on a camera before alerting once for all of them
+	Debounce Duration `json:"debounce" yaml:"debounce"`
+	// Cooldown: How long after alerting to ignore matches on the same camera
+	Cooldown Duration `json:"cooldown" yaml:"cooldown"`
+	// Sinks: The names of the sinks to alert
+	Sinks []string `json:"sinks" yaml:"sinks"`
+}
+
+// AlertSinkConfig: Where alerts are sent, with the settings of its type
+type AlertSinkConfig struct {
+	Name string `json:"name" yaml:"name"`
+	// Type: webhook, smtp or command
+	Type string `json:"type" yaml:"type"`
+	// Url, Authorization: Where the webhook posts alerts as JSON
+	Url           string `json:"url" yaml:"url"`
+	Authorization string `json:"authorization" yaml:"authorization"`
+	// Address, From, To: The SMTP relay, like localhost:25, and the envelope
+	Address string   `json:"address" yaml:"address"`
+	From    string   `json:"from" yaml:"from"`
+	To      []string `json:"to" yaml:"to"`
+	// Command: The program and arguments run with the alert as JSON on stdin
+	Command []string `json:"command" yaml:"command"`
+	// Timeout: How long sending an alert may take, DefaultAlertTimeout when it's zero
+	Timeout Duration `json:"timeout" yaml:"timeout"`
+}
+
+/*
+RetentionConfig: When uploaded files are removed so the recording directory
+doesn't fill up. Requires statePath, since only files it records as uploaded
+are removed.
+*/
+type RetentionConfig struct {
+	// Path: Where minFreePercent is measured, the first of v2.watchPaths when empty
+	Path     string   `json:"path" yaml:"path"`
+	Interval Duration `json:"interval" yaml:"interval"`
+	// DryRun: Log what would be removed without removing it
+	DryRun   bool                    `json:"dryRun" yaml:"dryRun"`
+	Policies []RetentionPolicyConfig `json:"policies" yaml:"policies"`
+}
+
+// RetentionPolicyConfig: How long the files it matches are kept. Limits which are zero don't apply.
+type RetentionPolicyConfig struct {
+	Name string `json:"name" yaml:"name"`
+	// Cameras, FileTypes: What the policy matches, like Camera1 and video, anything when empty
+	Cameras   []string `json:"cameras" yaml:"cameras"`
+	FileTypes []string `json:"fileTypes" yaml:"fileTypes"`
+	// MaxAge: How long after they're uploaded the policy's files are kept
+	MaxAge Duration `json:"maxAge" yaml:"maxAge"`
+	// MaxBytes: The most the files the policy matches can take up
+	MaxBytes int64 `json:"maxBytes" yaml:"maxBytes"`
+	// MinFreePercent: Remove the policy's oldest files while less of the file system holding retention.path is free
+	MinFreePercent float64 `json:"minFreePercent" yaml:"minFreePercent"`
+}
+
+// ApiConfig: Where the status and control API is served, not served when Address is empty
+type ApiConfig struct {
+	// Address: Like 127.0.0.1:2113, which keeps the API local
+	Address string `json:"address" yaml:"address"`
+	// Token: The bearer token every request must be authorized with
+	Token string `json:"token" yaml:"token"`
+}
+
+type V2Config struct {
+	Enabled    bool     `json:"enabled" yaml:"enabled"`
+	WatchPaths []string `json:"watchPaths" yaml:"watchPaths"`
+	// WatchMode: NotifyWatchMode, PollWatchMode or BothWatchMode
+	WatchMode    string   `json:"watchMode" yaml:"watchMode"`
+	ScanInterval Duration `json:"scanInterval" yaml:"scanInterval"`
+	// SeenFilesPath: A file recording what scanning has reported, so it isn't reported again after a restart
+	SeenFilesPath string `json:"seenFilesPath" yaml:"seenFilesPath"`
+	Metrics       bool   `json:"metrics" yaml:"metrics"`
+	// MetricsAddress: Where the metrics are served, like :2112 or 127.0.0.1:2112
+	MetricsAddress string `json:"metricsAddress" yaml:"metricsAddress"`
+	WatchReaper    bool   `json:"watchReaper" yaml:"watchReaper"`
+	// WatchMaxAge: How long the watch reaper keeps a directory's watch
+	WatchMaxAge Duration `json:"watchMaxAge" yaml:"watchMaxAge"`
+	// UploadReaper: Remove uploaded files after DefaultUploadReaperMaxAge when there are no retention policies
+	UploadReaper bool `json:"uploadReaper" yaml:"uploadReaper"`
+}
+
+// Duration: A time.Duration written like 5m or 1h30m in configuration files
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like 5m: %w", err)
+	}
+	return d.parse(s)
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	return d.parse(value.Value)
+}
+
+func (d *Duration) parse(s string) error {
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// DefaultConfig: The configuration of a single pipeline with every flag at its default
+func DefaultConfig() *Config {
+	return &Config{
+		ShutdownTimeout: Duration(DefaultShutdownTimeout),
+		Storage: StorageConfig{
+			Retry: RetryConfig{
+				MaxAttempts: DefaultBackoff.MaxAttempts,
+				BaseDelay:   Duration(DefaultBackoff.BaseDelay),
+				MaxDelay:    Duration(DefaultBackoff.MaxDelay),
+			},
+			Multipart: MultipartConfig{
+				PartSize:    DefaultMultipartPartSize,
+				Concurrency: 4,
+			},
+		},
+		Pipelines: []PipelineConfig{DefaultPipelineConfig(defaultPipelineName)},
+		V2: V2Config{
+			WatchMode:      NotifyWatchMode,
+			ScanInterval:   Duration(DefaultScanInterval),
+			WatchMaxAge:    Duration(24 * time.Hour),
+			MetricsAddress: v2.DefaultMetricsAddress,
+		},
+		Retention: RetentionConfig{
+			Interval: Duration(DefaultRetentionInterval),
+		},
+		Alerts: AlertsConfig{
+			Liveness: LivenessConfig{
+				Tolerance: DefaultLivenessTolerance,
+				Interval:  Duration(DefaultLivenessInterval),
+			},
+		},
+	}
+}
+
+// RetentionPolicies: The retention policies, or with v2.uploadReaper and none, one removing every uploaded file after DefaultUploadReaperMaxAge
+func (c *Config) RetentionPolicies() []RetentionPolicyConfig {
+	if len(c.Retention.Policies) == 0 && c.V2.UploadReaper {
+		return []RetentionPolicyConfig{{Name: "uploadReaper", MaxAge: Duration(DefaultUploadReaperMaxAge)}}
+	}
+	return c.Retention.Policies
+}
+
+// RetentionPath: Where retention measures free space
+func (c *Config) RetentionPath() string {
+	if len(c.Retention.Path) == 0 && len(c.V2.WatchPaths) > 0 {
+		return c.V2.WatchPaths[0]
+	}
+	return c.Retention.Path
+}
+
+func DefaultPipelineConfig(name string) PipelineConfig {
+	return PipelineConfig{
+		Name: name,
+		Index: IndexConfig{
+			InvalidLines: FailInvalidIndexLines,
+		},
+		Video: VideoConfig{
+			Transcode: TranscodeConfig{
+				FFmpegPath: "ffmpeg",
+				Workers:    1,
+			},
+		},
+		Publisher: PublisherConfig{
+			ConsolidationInterval: Duration(5 * time.Minute),
+			Timeout:               Duration(DefaultPublishTimeout),
+			Retry: RetryConfig{
+				MaxAttempts: 3,
+				BaseDelay:   Duration(time.Second),
+				MaxDelay:    Duration(30 * time.Second),
+			},
+			BufferMaxBytes: 10 * 1024 * 1024,
+			Influx:         InfluxConfig{Measurement: "homewatch_index_events"},
+			Pushgateway:    PushgatewayConfig{Job: "homewatch"},
+			NDJSON:         NDJSONConfig{MaxBytes: 100 * 1024 * 1024, MaxFiles: 5},
+		},
+	}
+}
+
+/*
+LoadConfig: Read a YAML, or JSON when the file ends in .json, configuration.
+Settings missing from the file keep their defaults and unknown settings are
+errors so typos aren't silently ignored. The result still needs validating.
+*/
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read configuration: %w", err)
+	}
+	config := DefaultConfig()
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(b))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(config)
+		if err == nil {
+			err = decodeJSONPipelines(b, config)
+		}
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(b))
+		decoder.KnownFields(true)
+		err = decoder.Decode(config)
+		if err == nil {
+			err = decodeYAMLPipelines(b, config)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse configuration %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// decodeJSONPipelines: Decode each pipeline again onto its defaults
+func decodeJSONPipelines(b []byte, config *Config) error {
+	file := struct {
+		Pipelines []json.RawMessage `json:"pipelines"`
+	}{}
+	if err := json.Unmarshal(b, &file); err != nil || file.Pipelines == nil {
+		return err
+	}
+	config.Pipelines = make([]PipelineConfig, len(file.Pipelines))
+	for i, raw := range file.Pipelines {
+		config.Pipelines[i] = DefaultPipelineConfig("")
+		if err := json.Unmarshal(raw, &config.Pipelines[i]); err != nil {
+			return fmt.Errorf("pipelines[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// decodeYAMLPipelines: Decode each pipeline again onto its defaults
+func decodeYAMLPipelines(b []byte, config *Config) error {
+	file := struct {
+		Pipelines []yaml.Node `yaml:"pipelines"`
+	}{}
+	if err := yaml.Unmarshal(b, &file); err != nil || file.Pipelines == nil {
+		return err
+	}
+	config.Pipelines = make([]PipelineConfig, len(file.Pipelines))
+	for i := range file.Pipelines {
+		config.Pipelines[i] = DefaultPipelineConfig("")
+		if err := file.Pipelines[i].Decode(&config.Pipelines[i]); err != nil {
+			return fmt.Errorf("pipelines[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// ConfigError: Every problem found validating a configuration
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid configuration:\n\t%s", strings.Join(e.Problems, "\n\t"))
+}
+
+func (e *ConfigError) add(field, format string, args ...interface{}) {
+	e.Problems = append(e.Problems, field+": "+fmt.Sprintf(format, args...))
+}
+
+// Validate: Return a *ConfigError listing every invalid setting, or nil
+func (c *Config) Validate() error {
+	problems := &ConfigError{}
+
+	if c.ShutdownTimeout <= 0 {
+		problems.add("shutdownTimeout", "must be positive, got %s", c.ShutdownTimeout)
+	}
+	if c.Storage.Retry.MaxAttempts < 1 {
+		problems.add("storage.retry.maxAttempts", "must be at least 1, got %d", c.Storage.Retry.MaxAttempts)
+	}
+	if c.Storage.Multipart.PartSize < MinMultipartPartSize {
+		problems.add("storage.multipart.partSize", "must be at least %d, got %d", MinMultipartPartSize, c.Storage.Multipart.PartSize)
+	}
+	if c.Storage.Multipart.Concurrency < 1 {
+		problems.add("storage.multipart.concurrency", "must be at least 1, got %d", c.Storage.Multipart.Concurrency)
+	}
+	if len(c.Storage.S3Endpoint) > 0 {
+		validateHttpUrl(problems, "storage.s3Endpoint", c.Storage.S3Endpoint)
+	}
+	if c.V2.Enabled && len(c.V2.WatchPaths) == 0 {
+		problems.add("v2.watchPaths", "at least one path is required when v2 is enabled")
+	}
+	switch c.V2.WatchMode {
+	case NotifyWatchMode, PollWatchMode, BothWatchMode:
+	default:
+		problems.add("v2.watchMode", "must be %s, %s or %s, got %q", NotifyWatchMode, PollWatchMode, BothWatchMode, c.V2.WatchMode)
+	}
+	if c.V2.ScanInterval <= 0 {
+		problems.add("v2.scanInterval", "must be positive, got %s", c.V2.ScanInterval)
+	}
+	if len(c.Pipelines) == 0 {
+		problems.add("pipelines", "at least one pipeline is required")
+	}
+	// The v2 watch paths feed a single pipeline, which is only unambiguous when there is one
+	if c.V2.Enabled && len(c.Pipelines) > 1 {
+		problems.add("pipelines", "only one pipeline is supported when v2 is enabled, got %d", len(c.Pipelines))
+	}
+	if c.V2.Metrics {
+		if _, _, err := net.SplitHostPort(c.V2.MetricsAddress); err != nil {
+			problems.add("v2.metricsAddress", "%s isn't an IP:Port: %s", c.V2.MetricsAddress, err)
+		}
+	}
+	if c.V2.WatchMaxAge <= 0 {
+		problems.add("v2.watchMaxAge", "must be positive, got %s", c.V2.WatchMaxAge)
+	}
+	if len(c.Api.Address) > 0 {
+		if _, _, err := net.SplitHostPort(c.Api.Address); err != nil {
+			problems.add("api.address", "%s isn't an IP:Port: %s", c.Api.Address, err)
+		}
+		if len(c.Api.Token) == 0 {
+			problems.add("api.token", "is required to serve the API")
+		}
+	}
+	c.Alerts.validate(problems)
+	c.validateRetention(problems)
+
+	names := map[string]bool{}
+	addresses := map[string]string{}
+	for i, pipeline := range c.Pipelines {
+		field := fmt.Sprintf("pipelines[%d]", i)
+		if len(pipeline.Name) == 0 {
+			problems.add(field+".name", "is required")
+		} else if names[pipeline.Name] {
+			problems.add(field+".name", "%s is used by another pipeline", pipeline.Name)
+		}
+		names[pipeline.Name] = true
+		// With v2 the pipeline watches v2.watchPaths instead of listening for syslog
+		pipeline.validate(problems, field, addresses, c.V2.Enabled)
+	}
+
+	if len(problems.Problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+func (p PipelineConfig) validate(problems *ConfigError, field string, addresses map[string]string, watching bool) {
+	listeners := map[string]string{
+		field + ".syslog.address":     p.Syslog.Address,
+		field + ".syslog.tcpAddress":  p.Syslog.TcpAddress,
+		field + ".syslog.tls.address": p.Syslog.Tls.Address,
+	}
+	listening := false
+	for listenerField, address := range listeners {
+		if len(address) == 0 {
+			continue
+		}
+		listening = true
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			problems.add(listenerField, "%s isn't an IP:Port: %s", address, err)
+		}
+		// UDP and TCP can share a port, so only compare addresses of the same protocol
+		protocol := "tcp"
+		if strings.HasSuffix(listenerField, ".syslog.address") {
+			protocol = "udp"
+		}
+		if other, ok := addresses[protocol+address]; ok {
+			problems.add(listenerField, "%s is also used by %s", address, other)
+		}
+		addresses[protocol+address] = listenerField
+	}
+	if !listening && !watching {
+		problems.add(field+".syslog", "an address, tcpAddress or tls.address is required")
+	}
+	if len(p.Syslog.Tls.Address) > 0 && (len(p.Syslog.Tls.CertFile) == 0 || len(p.Syslog.Tls.KeyFile) == 0) {
+		problems.add(field+".syslog.tls", "certFile and keyFile are required with an address")
+	}
+
+	if p.Index.Upload {
+		validateStorageUrl(problems, field+".index.storageUrl", p.Index.StorageUrl)
+	}
+	switch p.Index.InvalidLines {
+	case FailInvalidIndexLines, StopAtInvalidIndexLines, SkipInvalidIndexLines:
+	default:
+		problems.add(field+".index.invalidLines", "must be %s, %s or %s, got %q", FailInvalidIndexLines, StopAtInvalidIndexLines, SkipInvalidIndexLines, p.Index.InvalidLines)
+	}
+	if p.Video.Upload {
+		validateStorageUrl(problems, field+".video.storageUrl", p.Video.StorageUrl)
+	}
+	if p.Video.Sidecar && !p.Video.Upload {
+		problems.add(field+".video.sidecar", "requires video.upload")
+	}
+	if p.Video.Transcode.Enabled && p.Video.Transcode.Workers < 1 {
+		problems.add(field+".video.transcode.workers", "must be at least 1, got %d", p.Video.Transcode.Workers)
+	}
+	if len(p.Publisher.Url) > 0 {
+		validateHttpUrl(problems, field+".publisher.url", p.Publisher.Url)
+	}
+	if len(p.Publisher.Influx.Url) > 0 {
+		validateHttpUrl(problems, field+".publisher.influx.url", p.Publisher.Influx.Url)
+		if len(p.Publisher.Influx.Measurement) == 0 {
+			problems.add(field+".publisher.influx.measurement", "is required")
+		}
+	}
+	if len(p.Publisher.Pushgateway.Url) > 0 {
+		validateHttpUrl(problems, field+".publisher.pushgateway.url", p.Publisher.Pushgateway.Url)
+		if len(p.Publisher.Pushgateway.Job) == 0 {
+			problems.add(field+".publisher.pushgateway.job", "is required")
+		}
+	}
+	if len(p.Publisher.NDJSON.Path) > 0 && (p.Publisher.NDJSON.MaxBytes < 0 || p.Publisher.NDJSON.MaxFiles < 0) {
+		problems.add(field+".publisher.ndjson", "maxBytes and maxFiles can't be negative")
+	}
+	if p.Publisher.ConsolidationInterval <= 0 {
+		problems.add(field+".publisher.consolidationInterval", "must be positive, got %s", p.Publisher.ConsolidationInterval)
+	}
+	if p.Publisher.Timeout <= 0 {
+		problems.add(field+".publisher.timeout", "must be positive, got %s", p.Publisher.Timeout)
+	}
+	if p.Publisher.Retry.MaxAttempts < 1 {
+		problems.add(field+".publisher.retry.maxAttempts", "must be at least 1, got %d", p.Publisher.Retry.MaxAttempts)
+	}
+	if p.Publisher.BufferMaxBytes < 0 {
+		problems.add(field+".publisher.bufferMaxBytes", "can't be negative, got %d", p.Publisher.BufferMaxBytes)
+	}
+}
+
+func (c *Config) validateRetention(problems *ConfigError) {
+	policies := c.RetentionPolicies()
+	if len(policies) > 0 && len(c.StatePath) == 0 {
+		problems.add("retention", "statePath is required, only files it records as uploaded are removed")
+	}
+	if c.Retention.Interval <= 0 {
+		problems.add("retention.interval", "must be positive, got %s", c.Retention.Interval)
+	}
+	names := map[string]bool{}
+	for i, policy := range c.Retention.Policies {
+		field := fmt.Sprintf("retention.policies[%d]", i)
+		if len(policy.Name) == 0 {
+			problems.add(field+".name", "is required")
+		} else if names[policy.Name] {
+			problems.add(field+".name", "%s is used by another policy", policy.Name)
+		}
+		names[policy.Name] = true
+		for _, fileType := range policy.FileTypes {
+			if fileType != IndexFileType && fileType != VideoFileType {
+				problems.add(field+".fileTypes", "must be %s or %s, got %q", IndexFileType, VideoFileType, fileType)
+			}
+		}
+		if policy.MaxAge < 0 || policy.MaxBytes < 0 {
+			problems.add(field, "maxAge and maxBytes can't be negative")
+		}
+		if policy.MinFreePercent < 0 || policy.MinFreePercent >= 100 {
+			problems.add(field+".minFreePercent", "must be from 0 up to 100, got %g", policy.MinFreePercent)
+		}
+		if policy.MinFreePercent > 0 && len(c.RetentionPath()) == 0 {
+			problems.add("retention.path", "is required with %s.minFreePercent", field)
+		}
+		if policy.MaxAge == 0 && policy.MaxBytes == 0 && policy.MinFreePercent == 0 {
+			problems.add(field, "one of maxAge, maxBytes or minFreePercent is required")
+		}
+	}
+}
+
+func (a AlertsConfig) validate(problems *ConfigError) {
+	sinks := map[string]bool{}
+	for i, sink := range a.Sinks {
+		field := fmt.Sprintf("alerts.sinks[%d]", i)
+		if len(sink.Name) == 0 {
+			problems.add(field+".name", "is required")
+		} else if sinks[sink.Name] {
+			problems.add(field+".name", "%s is used by another sink", sink.Name)
+		}
+		sinks[sink.Name] = true
+		if sink.Timeout < 0 {
+			problems.add(field+".timeout", "can't be negative, got %s", sink.Timeout)
+		}
+		switch sink.Type {
+		case WebhookAlertSink:
+			validateHttpUrl(problems, field+".url", sink.Url)
+		case SMTPAlertSink:
+			if _, _, err := net.SplitHostPort(sink.Address); err != nil {
+				problems.add(field+".address", "%s isn't a host:port: %s", sink.Address, err)
+			}
+			if len(sink.From) == 0 || len(sink.To) == 0 {
+				problems.add(field, "from and to are required")
+			}
+		case CommandAlertSink:
+			if len(sink.Command) == 0 {
+				problems.add(field+".command", "is required")
+			}
+		default:
+			problems.add(field+".type", "must be %s, %s or %s, got %q", WebhookAlertSink, SMTPAlertSink, CommandAlertSink, sink.Type)
+		}
+	}
+
+	rules := map[string]bool{}
+	for i, rule := range a.Rules {
+		field := fmt.Sprintf("alerts.rules[%d]", i)
+		if len(rule.Name) == 0 {
+			problems.add(field+".name", "is required")
+		} else if rules[rule.Name] {
+			problems.add(field+".name", "%s is used by another rule", rule.Name)
+		}
+		rules[rule.Name] = true
+		if len(rule.Between) > 0 {
+			if _, _, err := parseBetween(rule.Between); err != nil {
+				problems.add(field+".between", "%s", err)
+			}
+		}
+		if rule.Debounce < 0 || rule.Cooldown < 0 {
+			problems.add(field, "debounce and cooldown can't be negative")
+		}
+		if len(rule.Sinks) == 0 {
+			problems.add(field+".sinks", "at least one sink is required")
+		}
+		for _, sink := range rule.Sinks {
+			if !sinks[sink] {
+				problems.add(field+".sinks", "%s isn't a sink", sink)
+			}
+		}
+	}
+
+	liveness := a.Liveness
+	if !liveness.Enabled {
+		return
+	}
+	if liveness.Cadence < 0 {
+		problems.add("alerts.liveness.cadence", "can't be negative, got %s", liveness.Cadence)
+	}
+	if liveness.Tolerance < 1 {
+		problems.add("alerts.liveness.tolerance", "must be at least 1, got %g", liveness.Tolerance)
+	}
+	if liveness.Interval <= 0 {
+		problems.add("alerts.liveness.interval", "must be positive, got %s", liveness.Interval)
+	}
+	for i, camera := range liveness.Cameras {
+		field := fmt.Sprintf("alerts.liveness.cameras[%d]", i)
+		if len(camera.Camera) == 0 {
+			problems.add(field+".camera", "is required")
+		}
+		if camera.Cadence <= 0 {
+			problems.add(field+".cadence", "must be positive, got %s", camera.Cadence)
+		}
+	}
+	for _, sink := range liveness.Sinks {
+		if !sinks[sink] {
+			problems.add("alerts.liveness.sinks", "%s isn't a sink", sink)
+		}
+	}
+}
+
+func validateStorageUrl(problems *ConfigError, field, storageUrl string) {
+	if len(storageUrl) == 0 {
+		problems.add(field, "is required to upload")
+		return
+	}
+	u, err := url.Parse(storageUrl)
+	if err != nil {
+		problems.add(field, "%s", err)
+		return
+	}
+	switch u.Scheme {
+	case "s3", "memory":
+		if len(u.Host) == 0 {
+			problems.add(field, "%s has no bucket", storageUrl)
+		}
+	case "file":
+		if len(u.Path) == 0 {
+			problems.add(field, "%s has no path", storageUrl)
+		}
+	default:
+		problems.add(field, "%s: %s", ErrUnsupportedStorageScheme, storageUrl)
+	}
+}
+
+func validateHttpUrl(problems *ConfigError, field, rawUrl string) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		problems.add(field, "%s", err)
+		return
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		problems.add(field, "%s isn't an http or https URL", rawUrl)
+	}
+}
+
+// pipelinePath: Where pipeline keeps its files under root, shared by a lone pipeline
+func (c *Config) pipelinePath(root string, pipeline PipelineConfig, name string) string {
+	if len(c.Pipelines) == 1 {
+		return filepath.Join(root, name)
+	}
+	return filepath.Join(root, pipeline.Name, name)
+}
+
+// Backoff: The upload retry settings
+func (c *Config) Backoff() Backoff {
+	return c.Storage.Retry.Backoff()
+}
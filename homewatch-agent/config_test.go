@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0640); err != nil {
+		t.Fatalf("Unable to write %s: %s", path, err)
+	}
+	return path
+}
+
+func TestLoadYAMLConfig(t *testing.T) {
+	path := writeTestConfig(t, "homewatch.yaml", `
+queuePath: /var/lib/homewatch/queue
+storage:
+  retry:
+    maxAttempts: 3
+pipelines:
+  - name: garage
+    syslog:
+      address: 0.0.0.0:5140
+    video:
+      upload: true
+      storageUrl: s3://bucket/garage
+      transcode:
+        enabled: true
+  - name: porch
+    syslog:
+      tcpAddress: 0.0.0.0:6514
+    publisher:
+      url: https://example.com/events
+      consolidationInterval: 1m
+`)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Expected the configuration to load, got %s", err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected a valid configuration, got %s", err)
+	}
+	if config.Storage.Retry.MaxAttempts != 3 || time.Duration(config.Storage.Retry.BaseDelay) != DefaultBackoff.BaseDelay {
+		t.Fatalf("Expected 3 attempts with the default delay, got %+v", config.Storage.Retry)
+	}
+	if len(config.Pipelines) != 2 {
+		t.Fatalf("Expected 2 pipelines, got %d", len(config.Pipelines))
+	}
+	garage, porch := config.Pipelines[0], config.Pipelines[1]
+	if garage.Video.Transcode.FFmpegPath != "ffmpeg" || garage.Video.Transcode.Workers != 1 {
+		t.Fatalf("Expected transcode defaults, got %+v", garage.Video.Transcode)
+	}
+	if time.Duration(garage.Publisher.ConsolidationInterval) != 5*time.Minute {
+		t.Fatalf("Expected the default interval, got %s", garage.Publisher.ConsolidationInterval)
+	}
+	if time.Duration(porch.Publisher.ConsolidationInterval) != time.Minute {
+		t.Fatalf("Expected 1m, got %s", porch.Publisher.ConsolidationInterval)
+	}
+	if queue := config.pipelinePath(config.QueuePath, porch, VideoFileType); queue != "/var/lib/homewatch/queue/porch/video" {
+		t.Fatalf("Expected a queue per pipeline, got %s", queue)
+	}
+}
+
+func TestLoadJSONConfig(t *testing.T) {
+	path := writeTestConfig(t, "homewatch.json", `{
+		"pipelines": [{"name": "garage", "syslog": {"address": "0.0.0.0:5140"}, "index": {"cleanup": true}}]
+	}`)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Expected the configuration to load, got %s", err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected a valid configuration, got %s", err)
+	}
+	if !config.Pipelines[0].Index.Cleanup || config.Pipelines[0].Video.Transcode.Workers != 1 {
+		t.Fatalf("Expected index cleanup with defaults, got %+v", config.Pipelines[0])
+	}
+	if queue := config.pipelinePath("/queue", config.Pipelines[0], IndexFileType); queue != "/queue/index" {
+		t.Fatalf("Expected a lone pipeline to keep the flat layout, got %s", queue)
+	}
+}
+
+func TestLoadConfigRejectsUnknownSettings(t *testing.T) {
+	for name, content := range map[string]string{
+		"homewatch.yaml": "pipelines:\n  - name: garage\n    syslog:\n      adress: 0.0.0.0:5140\n",
+		"homewatch.json": `{"debgu": true}`,
+	} {
+		if _, err := LoadConfig(writeTestConfig(t, name, content)); err == nil {
+			t.Fatalf("Expected an error for the unknown setting in %s", name)
+		}
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	config := DefaultConfig()
+	config.Storage.Multipart.PartSize = 1024
+	config.Pipelines[0].Syslog.Address = "0.0.0.0:5140"
+	config.Pipelines[0].Video.Upload = true
+	second := DefaultPipelineConfig(defaultPipelineName)
+	second.Syslog.Address = "0.0.0.0:5140"
+	second.Syslog.TcpAddress = "5140"
+	second.Index.Upload = true
+	second.Index.StorageUrl = "ftp://host/indexes"
+	second.Index.InvalidLines = "ignore"
+	second.Publisher.Retry.MaxAttempts = 0
+	config.Pipelines = append(config.Pipelines, second)
+	config.Alerts = AlertsConfig{
+		Rules: []AlertRuleConfig{{Name: "night", Between: "22:00", Sinks: []string{"phone"}}},
+		Sinks: []AlertSinkConfig{{Name: "phone", Type: "pager"}},
+	}
+
+	err := config.Validate()
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) {
+		t.Fatalf("Expected a ConfigError, got %v", err)
+	}
+	expectations := []string{
+		"storage.multipart.partSize",
+		"pipelines[0].video.storageUrl: is required to upload",
+		"pipelines[1].name: default is used by another pipeline",
+		"pipelines[1].syslog.address: 0.0.0.0:5140 is also used by pipelines[0].syslog.address",
+		"pipelines[1].syslog.tcpAddress",
+		"pipelines[1].index.storageUrl",
+		"pipelines[1].index.invalidLines: must be fail, stop or skip",
+		"pipelines[1].publisher.retry.maxAttempts: must be at least 1",
+		"alerts.sinks[0].type",
+		"alerts.rules[0].between",
+	}
+	for _, expectation := range expectations {
+		if !strings.Contains(err.Error(), expectation) {
+			t.Fatalf("Expected %q in %s", expectation, err)
+		}
+	}
+	if len(configErr.Problems) != len(expectations) {
+		t.Fatalf("Expected %d problems, got %d: %s", len(expectations), len(configErr.Problems), err)
+	}
+}
+
+func TestValidateRequiresAListener(t *testing.T) {
+	config := DefaultConfig()
+	if err := config.Validate(); err == nil {
+		t.Fatalf("Expected an error for a pipeline without a listener")
+	}
+	config.V2.Enabled = true
+	config.V2.WatchPaths = []string{"/mnt/cameras"}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected v2 to need no listener, got %s", err)
+	}
+	config.Pipelines = append(config.Pipelines, DefaultPipelineConfig("porch"))
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "only one pipeline is supported when v2 is enabled, got 2") {
+		t.Fatalf("Expected v2 to refuse a second pipeline, got %v", err)
+	}
+}
+
+func TestValidateRetention(t *testing.T) {
+	config := DefaultConfig()
+	config.Pipelines[0].Syslog.Address = "0.0.0.0:5140"
+	config.Retention.Policies = []RetentionPolicyConfig{
+		{Name: "space", FileTypes: []string{"dav"}, MinFreePercent: 10},
+		{Name: "space"},
+	}
+
+	err := config.Validate()
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) {
+		t.Fatalf("Expected a ConfigError, got %v", err)
+	}
+	expectations := []string{
+		"retention: statePath is required",
+		"retention.policies[0].fileTypes: must be index or video",
+		"retention.path: is required with retention.policies[0].minFreePercent",
+		"retention.policies[1].name: space is used by another policy",
+		"retention.policies[1]: one of maxAge, maxBytes or minFreePercent is required",
+	}
+	for _, expectation := range expectations {
+		if !strings.Contains(err.Error(), expectation) {
+			t.Fatalf("Expected %q in %s", expectation, err)
+		}
+	}
+	if len(configErr.Problems) != len(expectations) {
+		t.Fatalf("Expected %d problems, got %d: %s", len(expectations), len(configErr.Problems), err)
+	}
+
+	config = DefaultConfig()
+	config.Pipelines[0].Syslog.Address = "0.0.0.0:5140"
+	config.V2.UploadReaper = true
+	config.StatePath = "/var/lib/homewatch/state.db"
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected the upload reaper to be valid with a state path, got %s", err)
+	}
+	if policies := config.RetentionPolicies(); len(policies) != 1 || time.Duration(policies[0].MaxAge) != DefaultUploadReaperMaxAge {
+		t.Fatalf("Expected the upload reaper to keep uploaded files for a week, got %v", policies)
+	}
+}
+
+func TestValidateLiveness(t *testing.T) {
+	config := DefaultConfig()
+	config.Pipelines[0].Syslog.Address = "0.0.0.0:5140"
+	config.Alerts.Liveness = LivenessConfig{
+		Enabled:   true,
+		Tolerance: 0.5,
+		Interval:  Duration(time.Minute),
+		Cameras:   []CameraCadenceConfig{{Camera: "Porch"}},
+		Sinks:     []string{"phone"},
+	}
+
+	err := config.Validate()
+	expectations := []string{
+		"alerts.liveness.tolerance: must be at least 1",
+		"alerts.liveness.cameras[0].cadence: must be positive",
+		"alerts.liveness.sinks: phone isn't a sink",
+	}
+	for _, expectation := range expectations {
+		if err == nil || !strings.Contains(err.Error(), expectation) {
+			t.Fatalf("Expected %q in %v", expectation, err)
+		}
+	}
+}
+
+func TestValidateApi(t *testing.T) {
+	config := DefaultConfig()
+	config.Pipelines[0].Syslog.Address = "0.0.0.0:5140"
+	config.Api = ApiConfig{Address: "localhost"}
+
+	err := config.Validate()
+	expectations := []string{
+		"api.address: localhost isn't an IP:Port",
+		"api.token: is required",
+	}
+	for _, expectation := range expectations {
+		if err == nil || !strings.Contains(err.Error(), expectation) {
+			t.Fatalf("Expected %q in %v", expectation, err)
+		}
+	}
+
+	config.Api = ApiConfig{Address: "127.0.0.1:2113", Token: "secret"}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Expected a local API with a token to be valid, got %s", err)
+	}
+}
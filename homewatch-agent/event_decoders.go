@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+)
+
+// Kinds of event, the type of their datapoints
+const (
+	MotionEventKind    = "motion"
+	TripwireEventKind  = "tripwire"
+	IntrusionEventKind = "intrusion"
+	FaceEventKind      = "face"
+	AudioEventKind     = "audio"
+	HumanEventKind     = "human"
+	VehicleEventKind   = "vehicle"
+	UnknownEventKind   = "unknown"
+)
+
+// EventData: The decoded Data of an Event
+type EventData interface {
+	// Kind: What sort of event it is, like motion or tripwire
+	Kind() string
+	// Subject: What was detected, like Human or Vehicle, or empty when the event doesn't say
+	Subject() string
+}
+
+// EventDecoder: Decodes the Data of an Event
+type EventDecoder func(data json.RawMessage) (EventData, error)
+
+type eventDecoderKey struct {
+	name   string
+	action string
+}
+
+var (
+	eventDecodersLock sync.RWMutex
+	// eventDecoders: By Event.Name and Event.Action, where an empty action matches every action
+	eventDecoders = map[eventDecoderKey]EventDecoder{
+		{"VideoMotion", ""}:          decodeEventData(func() EventData { return &MotionDetection{} }),
+		{"CrossLineDetection", ""}:   decodeEventData(func() EventData { return &RuleDetection{kind: TripwireEventKind} }),
+		{"CrossRegionDetection", ""}: decodeEventData(func() EventData { return &RuleDetection{kind: IntrusionEventKind} }),
+		{"FaceDetection", ""}:        decodeEventData(func() EventData { return &FaceDetection{} }),
+		{"AudioMutation", ""}:        decodeEventData(func() EventData { return &AudioDetection{} }),
+		{"AudioAnomaly", ""}:         decodeEventData(func() EventData { return &AudioDetection{} }),
+		{"SmartMotionHuman", ""}:     decodeEventData(func() EventData { return &SmartMotionDetection{kind: HumanEventKind} }),
+		{"SmartMotionVehicle", ""}:   decodeEventData(func() EventData { return &SmartMotionDetection{kind: VehicleEventKind} }),
+	}
+)
+
+// RegisterEventDecoder: Decode the Data of events with name and action with decoder. An empty action matches every action.
+func RegisterEventDecoder(name, action string, decoder EventDecoder) {
+	eventDecodersLock.Lock()
+	defer eventDecodersLock.Unlock()
+	eventDecoders[eventDecoderKey{name, action}] = decoder
+}
+
+// decodeEventData: An EventDecoder unmarshaling data as JSON into what newData returns
+func decodeEventData(newData func() EventData) EventDecoder {
+	return func(data json.RawMessage) (EventData, error) {
+		v := newData()
+		if err := json.Unmarshal(data, v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+}
+
+/*
+Decode: The Data of the event decoded by the decoder registered for its Name
+and Action, or its Name alone. Events without a decoder, or which it can't
+decode, are decoded as GenericEventData.
+*/
+func (e Event) Decode() EventData {
+	eventDecodersLock.RLock()
+	decoder, exists := eventDecoders[eventDecoderKey{e.Name, e.Action}]
+	if !exists {
+		decoder, exists = eventDecoders[eventDecoderKey{e.Name, ""}]
+	}
+	eventDecodersLock.RUnlock()
+
+	if exists {
+		data, err := decoder(e.Data)
+		if err == nil {
+			return data
+		}
+		log.Printf("WARN: Unable to decode %s %s event: %s", e.Name, e.Action, err)
+	}
+	generic := GenericEventData{}
+	if err := json.Unmarshal(e.Data, &generic); err != nil && flagDebug {
+		log.Printf("Unable to decode %s %s event data: %s", e.Name, e.Action, err)
+	}
+	return generic
+}
+
+// GenericEventData: The Data of an event without a decoder
+type GenericEventData map[string]interface{}
+
+func (d GenericEventData) Kind() string    { return UnknownEventKind }
+func (d GenericEventData) Subject() string { return "" }
+
+// MotionDetection: Motion in the regions of a VideoMotion event
+type MotionDetection struct {
+	Id         []int
+	RegionName []string
+}
+
+func (d *MotionDetection) Kind() string    { return MotionEventKind }
+func (d *MotionDetection) Subject() string { return "" }
+
+func (d *RuleDetection) Kind() string {
+	if len(d.kind) == 0 {
+		return UnknownEventKind
+	}
+	return d.kind
+}
+func (d *RuleDetection) Subject() string { return d.Object.ObjectType }
+
+// FaceDetection: The faces of a FaceDetection event
+type FaceDetection struct {
+	BaseEventData
+	Faces      []ObjectDetection
+	Object     ObjectDetection
+	PTS        float64
+	UTC, UTCMS int64
+}
+
+func (d *FaceDetection) Kind() string    { return FaceEventKind }
+func (d *FaceDetection) Subject() string { return "" }
+
+// AudioDetection: A loud or abnormal sound from AudioMutation and AudioAnomaly events
+type AudioDetection struct {
+	BaseEventData
+	UTC, UTCMS int64
+}
+
+func (d *AudioDetection) Kind() string    { return AudioEventKind }
+func (d *AudioDetection) Subject() string { return "" }
+
+// SmartMotionDetection: Motion classified as a human or vehicle
+type SmartMotionDetection struct {
+	RegionName []string
+	Object     []ObjectDetection
+	kind       string
+}
+
+func (d *SmartMotionDetection) Kind() string    { return d.kind }
+func (d *SmartMotionDetection) Subject() string { return "" }
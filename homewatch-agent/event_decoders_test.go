@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestEventDecodeMotion(t *testing.T) {
+	event := Event{}
+	line := `{"Action":"Start","Data":{"Id":[1],"RegionName":["Street"]},"Index":1,"Name":"VideoMotion"}`
+	if err := json.Unmarshal([]byte(line), &event); err != nil {
+		t.Fatalf("Expected to unmarshal the event, got %s", err)
+	}
+	motion, ok := event.Decode().(*MotionDetection)
+	if !ok {
+		t.Fatalf("Expected a MotionDetection, got %#v", event.Decode())
+	}
+	if len(motion.RegionName) != 1 || motion.RegionName[0] != "Street" || motion.Kind() != MotionEventKind {
+		t.Fatalf("Expected motion in Street, got %+v", motion)
+	}
+	if event.RuleDetection() != nil {
+		t.Fatalf("Expected no rule detection for a VideoMotion event")
+	}
+}
+
+func TestEventDecodeRuleDetection(t *testing.T) {
+	var event Event
+	b, _ := os.ReadFile(eventWithDetection)
+	if err := json.Unmarshal(b, &event); err != nil {
+		t.Fatalf("Expected to unmarshal event, got %s", err)
+	}
+	data := event.Decode()
+	if data.Kind() != IntrusionEventKind || data.Subject() != "Vehicle" {
+		t.Fatalf("Expected an intrusion by a Vehicle, got %s by %s", data.Kind(), data.Subject())
+	}
+	if rd := event.RuleDetection(); rd == nil || rd.Object.ObjectID != 439 {
+		t.Fatalf("Expected the rule detection of object 439, got %+v", rd)
+	}
+}
+
+func TestEventDecodeRuleDetectionWithAnyTrack(t *testing.T) {
+	expectations := []struct {
+		track  string
+		points int
+		raw    bool
+	}{
+		{`[[1,2],[3,4]]`, 2, false},
+		{`[]`, 0, false},
+		{`{"Points":[[1,2]]}`, 0, true},
+		{`7`, 0, true},
+	}
+	for _, expectation := range expectations {
+		event := Event{Action: "Start", Name: "CrossLineDetection", Data: json.RawMessage(`{"Object":{"ObjectID":5},"Track":` + expectation.track + `}`)}
+		rd := event.RuleDetection()
+		if rd == nil || rd.Object.ObjectID != 5 {
+			t.Fatalf("Expected the rule detection of object 5 with Track %s, got %#v", expectation.track, event.Decode())
+		}
+		if len(rd.Track.Points) != expectation.points || (rd.Track.Raw != nil) != expectation.raw {
+			t.Fatalf("Expected %d points and raw %t for Track %s, got %#v", expectation.points, expectation.raw, expectation.track, rd.Track)
+		}
+		if b, err := json.Marshal(rd.Track); err != nil || string(b) != expectation.track {
+			t.Fatalf("Expected Track %s to be encoded as it was sent, got %s %v", expectation.track, b, err)
+		}
+	}
+}
+
+func TestEventDecodeFallsBackToGeneric(t *testing.T) {
+	event := Event{Action: "Pulse", Name: "NewCameraEvent", Data: json.RawMessage(`{"Level":3}`)}
+	generic, ok := event.Decode().(GenericEventData)
+	if !ok || generic["Level"] != float64(3) || generic.Kind() != UnknownEventKind {
+		t.Fatalf("Expected generic data with Level 3, got %#v", event.Decode())
+	}
+
+	// A registered decoder which can't decode the data falls back too
+	event = Event{Action: "Start", Name: "CrossLineDetection", Data: json.RawMessage(`{"Object":"Vehicle"}`)}
+	if _, ok := event.Decode().(GenericEventData); !ok {
+		t.Fatalf("Expected generic data, got %#v", event.Decode())
+	}
+}
+
+type doorbellPress struct {
+	Button int
+}
+
+func (d *doorbellPress) Kind() string    { return "doorbell" }
+func (d *doorbellPress) Subject() string { return "" }
+
+func TestRegisterEventDecoder(t *testing.T) {
+	RegisterEventDecoder("DoorbellPress", "Pulse", decodeEventData(func() EventData { return &doorbellPress{} }))
+	defer func() {
+		eventDecodersLock.Lock()
+		delete(eventDecoders, eventDecoderKey{"DoorbellPress", "Pulse"})
+		eventDecodersLock.Unlock()
+	}()
+
+	pressed := Event{Action: "Pulse", Name: "DoorbellPress", Data: json.RawMessage(`{"Button":2}`)}
+	if press, ok := pressed.Decode().(*doorbellPress); !ok || press.Button != 2 {
+		t.Fatalf("Expected button 2 to be pressed, got %#v", pressed.Decode())
+	}
+	released := Event{Action: "Stop", Name: "DoorbellPress", Data: json.RawMessage(`{"Button":2}`)}
+	if _, ok := released.Decode().(GenericEventData); !ok {
+		t.Fatalf("Expected a decoder registered for Pulse not to decode Stop, got %#v", released.Decode())
+	}
+}
+
+func TestCreateDatapointsByEventType(t *testing.T) {
+	indexed := &IndexedEvent{
+		Source: "Camera1",
+		Events: []Event{
+			{Action: "Start", Name: "VideoMotion", Data: json.RawMessage(`{"Id":[1],"RegionName":["Street"]}`)},
+			{Action: "Start", Name: "CrossLineDetection", Data: json.RawMessage(`{"Object":{"ObjectType":"Human"}}`)},
+			{Action: "Start", Name: "SmartMotionVehicle", Data: json.RawMessage(`{"RegionName":["Driveway"]}`)},
+		},
+	}
+	expectations := []Datapoint{
+		{Source: "Camera1:Start:VideoMotion", Type: MotionEventKind},
+		{Source: "Camera1:Start:CrossLineDetection:Human", Type: TripwireEventKind},
+		{Source: "Camera1:Start:SmartMotionVehicle", Type: VehicleEventKind},
+	}
+	datapoints := CreateDatapoints(indexed)
+	for i, expectation := range expectations {
+		if datapoints[i].Source != expectation.Source || datapoints[i].Type != expectation.Type {
+			t.Fatalf("Expected %s %s, got %s %s", expectation.Type, expectation.Source, datapoints[i].Type, datapoints[i].Source)
+		}
+	}
+	if datapoints[0].Detection != nil || datapoints[1].Detection == nil {
+		t.Fatalf("Expected only the tripwire datapoint to have a detection")
+	}
+}
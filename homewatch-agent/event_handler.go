@@ -1,21 +1,28 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 )
 
 type IndexEventHandler struct {
 	ConsolidationInterval time.Duration
-	Datapoints            []Datapoint
 	events                chan *IndexedEvent
 	publisher             Publisher
-	listenerControl       chan int
-	publisherControl      chan int
-	isLocked              bool
-	datapointMetrics      map[string]DatapointMetric
+	aggregator            *Aggregator
 	FileUploader          *S3FileUploader
+	reconfigure           chan publisherSettings
+	// publishLock: Serializes publishing and changing the publisher
+	publishLock sync.Mutex
+}
+
+// publisherSettings: What Reconfigure changes, applied between publishes
+type publisherSettings struct {
+	interval  time.Duration
+	publisher Publisher
 }
 
 func NewIndexEventHandler(interval string, events chan *IndexedEvent, publisher Publisher) *IndexEventHandler {
@@ -28,107 +35,139 @@ func NewIndexEventHandler(interval string, events chan *IndexedEvent, publisher
 		ConsolidationInterval: d,
 		publisher:             publisher,
 		events:                events,
-		listenerControl:       make(chan int, 1),
-		publisherControl:      make(chan int, 1),
-		datapointMetrics:      map[string]DatapointMetric{},
-	}
-}
-func (h *IndexEventHandler) Lock() {
-	h.isLocked = true
-	if flagVerbose {
-		log.Printf("Locked")
+		aggregator:            NewAggregator(),
+		reconfigure:           make(chan publisherSettings, 1),
 	}
 }
-func (h *IndexEventHandler) Unlock() {
-	h.isLocked = false
-	if flagVerbose {
-		log.Printf("Unlocked")
+
+/*
+Reconfigure: Publish to publisher every interval from now on. Datapoints
+collected since the last publish are kept and published to the new publisher.
+Settings which haven't been applied yet, like while a publish is being retried,
+are replaced so Reconfigure never waits.
+*/
+func (h *IndexEventHandler) Reconfigure(interval time.Duration, publisher Publisher) {
+	settings := publisherSettings{interval, publisher}
+	for {
+		select {
+		case h.reconfigure <- settings:
+			return
+		default:
+		}
+		select {
+		case <-h.reconfigure:
+		default:
+		}
 	}
 }
-func (h *IndexEventHandler) Stop() {
-	h.listenerControl <- 1
-	h.publisherControl <- 1
 
-}
-func (h *IndexEventHandler) Publisher() {
+// Publisher: Publish the datapoints consolidated each interval until ctx is done
+func (h *IndexEventHandler) Publisher(ctx context.Context) {
 	log.Printf("EventHandler Publisher started")
-	go func() {
-		for {
-			time.Sleep(h.ConsolidationInterval)
-			// Spin waiting on lock to release
-			for h.isLocked {
-				time.Sleep(time.Millisecond * 5)
-			}
-			h.Lock()
-			if flagDebug {
-				log.Printf("Consolidating %d datapoints", len(h.Datapoints))
-			}
-			for _, datapoint := range h.Datapoints {
-				dp, exists := h.datapointMetrics[datapoint.Source]
-				if exists {
-					dp.Count += datapoint.Count
-					if datapoint.Detection != nil {
-						dp.Detections = append(dp.Detections, *datapoint.Detection)
-					}
-					h.datapointMetrics[datapoint.Source] = dp
-				} else {
-					detections := []RuleDetection{}
-					if datapoint.Detection != nil {
-						detections = append(detections, *datapoint.Detection)
-					}
-					h.datapointMetrics[datapoint.Source] = DatapointMetric{datapoint, detections}
-				}
-			}
-			// Memory of datapoint presence
-			h.Datapoints = []Datapoint{}
-			if flagVerbose {
-				log.Printf("Cleared datapoints")
-			}
-			h.Unlock()
-			if err := h.publisher.Publish(flattenMetrics(h.datapointMetrics)); err != nil {
-				log.Printf("Error while publishing: %s", err)
-			}
-			for source, datapoint := range h.datapointMetrics {
-				datapoint.Count = 0
-				datapoint.Detections = []RuleDetection{}
-				h.datapointMetrics[source] = datapoint
+	interval := h.ConsolidationInterval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case settings := <-h.reconfigure:
+			h.applySettings(settings)
+			interval = settings.interval
+			if !timer.Stop() {
+				<-timer.C
 			}
+			timer.Reset(interval)
+			log.Printf("INFO: Publishing every %s", interval)
+			continue
+		case <-timer.C:
+		}
+		if err := h.publish(); err != nil {
+			log.Printf("Error while publishing: %s", err)
 		}
-	}()
-	<-h.publisherControl
+		timer.Reset(interval)
+	}
 }
 
-func flattenMetrics(metricMap map[string]DatapointMetric) []DatapointMetric {
-	var datapointMetrics []DatapointMetric
+/*
+Flush: Publish the datapoints collected since the last publish, with any
+settings from Reconfigure. Used at shutdown once Listen has returned.
+*/
+func (h *IndexEventHandler) Flush() error {
+	select {
+	case settings := <-h.reconfigure:
+		h.applySettings(settings)
+	default:
+	}
+	return h.publish()
+}
+
+/*
+PublishNow: Publish the datapoints collected since the last publish without
+waiting for the interval. Unlike Flush it leaves settings from Reconfigure to
+Publisher, so it's safe while Publisher runs.
+*/
+func (h *IndexEventHandler) PublishNow() error {
+	return h.publish()
+}
 
-	for _, datapointMetric := range metricMap {
-		datapointMetrics = append(datapointMetrics, datapointMetric)
+func (h *IndexEventHandler) applySettings(settings publisherSettings) {
+	h.publishLock.Lock()
+	defer h.publishLock.Unlock()
+	h.ConsolidationInterval = settings.interval
+	h.publisher = settings.publisher
+}
+
+// publish: Close the aggregator's window and publish what was counted in it
+func (h *IndexEventHandler) publish() error {
+	h.publishLock.Lock()
+	defer h.publishLock.Unlock()
+	window := h.aggregator.Flush(time.Now())
+	if flagDebug {
+		log.Printf("Consolidated %d sources from %s to %s", len(window.Metrics), window.Start.Format(time.RFC3339), window.End.Format(time.RFC3339))
 	}
-	return datapointMetrics
+	return h.publisher.Publish(window.Metrics)
 }
 
-func (h *IndexEventHandler) Listen() {
+// Listen: Collect the datapoints of each indexed event until ctx is done
+func (h *IndexEventHandler) Listen(ctx context.Context) {
 	log.Printf("EventHandler Listener started")
 
-	go func() {
-		for event := range h.events {
+	for {
+		var event *IndexedEvent
+		select {
+		case <-ctx.Done():
+			return
+		case indexedEvent, ok := <-h.events:
+			if !ok {
+				return
+			}
+			event = indexedEvent
+		}
 
-			newDatapoints := CreateDatapoints(event)
+		h.aggregator.Add(CreateDatapoints(event)...)
+	}
+}
 
-			for h.isLocked {
-				time.Sleep(time.Millisecond * 50)
+// Collect: Add the events already sent to the handler to its datapoints, like those left once Listen stops
+func (h *IndexEventHandler) Collect() {
+	for {
+		select {
+		case event, ok := <-h.events:
+			if !ok {
+				return
 			}
-
-			h.Lock()
-			h.Datapoints = append(h.Datapoints, newDatapoints...)
-			h.Unlock()
+			h.aggregator.Add(CreateDatapoints(event)...)
+		default:
+			return
 		}
-	}()
-	<-h.listenerControl
+	}
 }
 
 type Datapoint struct {
-	Source    string         `json:"source"`
+	Source string `json:"source"`
+	// Type: The kind of event counted, like motion or tripwire
+	Type      string         `json:"type"`
 	Count     int            `json:"count"`
 	Detection *RuleDetection `json:"detection"`
 }
@@ -137,28 +176,34 @@ type DatapointMetric struct {
 	Detections []RuleDetection `json:"detections"`
 }
 
+// CreateDatapoints: A datapoint per event, typed by the kind of event and with the rule detection of tripwire and intrusion events
 func CreateDatapoints(event *IndexedEvent) []Datapoint {
 	var datapoints []Datapoint
 
 	for _, e := range event.Events {
-		rd := e.RuleDetection()
-		datapoints = append(datapoints, Datapoint{
-			Source:    mkSource(event, e, rd),
-			Count:     1,
-			Detection: rd,
-		})
+		data := e.Decode()
+		datapoint := Datapoint{
+			Source: mkSource(event, e, data),
+			Type:   data.Kind(),
+			Count:  1,
+		}
+		if rd, ok := data.(*RuleDetection); ok {
+			datapoint.Detection = rd
+		}
+		datapoints = append(datapoints, datapoint)
 	}
 	return datapoints
 }
 
-func mkSource(ie *IndexedEvent, e Event, rd *RuleDetection) string {
+// mkSource: Camera:Action:Name, followed by :Subject when the event has one
+func mkSource(ie *IndexedEvent, e Event, data EventData) string {
 	if ie == nil {
 		return "EventMissing"
 	}
 	source := fmt.Sprintf("%s:%s:%s", ie.Source, e.Action, e.Name)
-	if rd == nil {
+	if data == nil || len(data.Subject()) == 0 {
 		return source
 	}
 
-	return fmt.Sprintf("%s:%s", source, rd.Object.ObjectType)
+	return fmt.Sprintf("%s:%s", source, data.Subject())
 }
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"os"
 	"regexp"
 	"testing"
+	"time"
 )
 
 var (
@@ -47,3 +49,96 @@ func TestDatapointSerialization(t *testing.T) {
 		t.Fatalf("Expected Detection to be nil, got %s", s)
 	}
 }
+
+// channelPublisher: Sends the sources of each publish to published
+type channelPublisher struct {
+	published chan []string
+}
+
+func (p channelPublisher) Publish(metrics []DatapointMetric) error {
+	sources := []string{}
+	for _, metric := range metrics {
+		if metric.Count > 0 {
+			sources = append(sources, metric.Source)
+		}
+	}
+	p.published <- sources
+	return nil
+}
+
+func TestIndexEventHandlerReconfigureKeepsDatapoints(t *testing.T) {
+	old := channelPublisher{make(chan []string, 1)}
+	handler := NewIndexEventHandler("1h", make(chan *IndexedEvent), old)
+	handler.aggregator.Add(Datapoint{Source: "Camera1:Start:CrossLineDetection", Count: 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go handler.Publisher(ctx)
+
+	reconfigured := channelPublisher{make(chan []string, 1)}
+	handler.Reconfigure(10*time.Millisecond, reconfigured)
+	select {
+	case sources := <-reconfigured.published:
+		if len(sources) != 1 || sources[0] != "Camera1:Start:CrossLineDetection" {
+			t.Fatalf("Expected the datapoint collected before reconfiguring, got %v", sources)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected to publish at the new interval")
+	}
+	if len(old.published) != 0 {
+		t.Fatalf("Expected nothing published to the old publisher")
+	}
+}
+
+func TestIndexEventHandlerFlush(t *testing.T) {
+	publisher := channelPublisher{make(chan []string, 1)}
+	handler := NewIndexEventHandler("1h", make(chan *IndexedEvent), publisher)
+	handler.aggregator.Add(Datapoint{Source: "Camera1:Start:CrossLineDetection", Count: 1})
+
+	if err := handler.Flush(); err != nil {
+		t.Fatalf("Expected to flush, got %s", err)
+	}
+	if sources := <-publisher.published; len(sources) != 1 {
+		t.Fatalf("Expected the buffered datapoint to be published, got %v", sources)
+	}
+	if pending := handler.aggregator.Pending(); pending != 0 {
+		t.Fatalf("Expected no datapoints after flushing, got %d", pending)
+	}
+}
+
+// blockingPublisher: Blocks each publish until release is closed
+type blockingPublisher struct {
+	publishing chan struct{}
+	release    chan struct{}
+}
+
+func (p blockingPublisher) Publish(metrics []DatapointMetric) error {
+	p.publishing <- struct{}{}
+	<-p.release
+	return nil
+}
+
+func TestIndexEventHandlerReconfigureDoesNotWaitForAPublish(t *testing.T) {
+	publisher := blockingPublisher{make(chan struct{}, 1), make(chan struct{})}
+	handler := NewIndexEventHandler("1ms", make(chan *IndexedEvent), publisher)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go handler.Publisher(ctx)
+	<-publisher.publishing
+
+	reconfigured := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			handler.Reconfigure(time.Duration(i+1)*time.Hour, publisher)
+		}
+		close(reconfigured)
+	}()
+	select {
+	case <-reconfigured:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected Reconfigure not to wait for the publish being retried")
+	}
+	if settings := <-handler.reconfigure; settings.interval != 3*time.Hour {
+		t.Fatalf("Expected the last settings to be kept, got %s", settings.interval)
+	}
+	close(publisher.release)
+}
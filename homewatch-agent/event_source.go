@@ -0,0 +1,172 @@
+package main
+
+import (
+	"log"
+
+	v2 "github.com/mrmod/homewatch/v2"
+)
+
+/*
+EventSource: Reports the index and video files cameras have finished writing,
+from an SFTP server's syslog or by watching the directories they're written to
+*/
+type EventSource interface {
+	// Start: Send the paths of finished index files to indexFiles and videos to videoFiles until Stop
+	Start(indexFiles, videoFiles chan string)
+	Stop()
+}
+
+// PathWatcher: An EventSource whose directories can change while it runs
+type PathWatcher interface {
+	Watch(root string) error
+	Unwatch(root string)
+}
+
+// SyslogEventSource: The files an SFTP server logs renaming into place
+type SyslogEventSource struct {
+	name    string
+	server  *SyslogServer
+	handler SyslogMessageHandler
+}
+
+// NewSyslogEventSource: Listen on each of config's addresses, exiting when its TLS certificates can't be loaded
+func NewSyslogEventSource(name string, config SyslogConfig) *SyslogEventSource {
+	s := &SyslogEventSource{
+		name:    name,
+		server:  NewSyslogServer(config.Address),
+		handler: NewSyslogMessageHandler(),
+	}
+	if len(config.TcpAddress) > 0 {
+		s.server.AddTcpListener(config.TcpAddress, nil)
+	}
+	if tls := config.Tls; len(tls.Address) > 0 {
+		tlsConfig, err := LoadSyslogTLSConfig(tls.CertFile, tls.KeyFile, tls.ClientCAFile)
+		if err != nil {
+			log.Fatalf("Unable to start the %s syslog TLS listener: %s", name, err)
+		}
+		s.server.AddTcpListener(tls.Address, tlsConfig)
+	}
+	return s
+}
+
+// CountParseErrors: Count the messages which can't be parsed in the syslog_parse_errors metric
+func (s *SyslogEventSource) CountParseErrors() {
+	s.server.ParseErrors = func() { v2.SyslogParseError(s.name) }
+}
+
+func (s *SyslogEventSource) Start(indexFiles, videoFiles chan string) {
+	s.handler.IndexEvents = indexFiles
+	s.handler.VideoEvents = videoFiles
+	go s.handler.Run()
+	go s.server.Serve(s.handler.Messages)
+}
+
+func (s *SyslogEventSource) Stop() {
+	s.server.Stop()
+}
+
+/*
+WatchEventSource: The files created in watched directories and the
+directories created under them. Cameras write to a name ending in _ and rename
+it once it's finished, so a file is reported when it's created by the rename.
+*/
+type WatchEventSource struct {
+	listener *v2.Listener
+	files    chan string
+	paths    []string
+	// Seen: Files already reported, by another source, which aren't reported again. Nil to report every file.
+	Seen *SeenFiles
+}
+
+func NewWatchEventSource(paths []string, seen *SeenFiles) (*WatchEventSource, error) {
+	files := make(chan string, 1)
+	listener, err := v2.NewListener(files)
+	if err != nil {
+		return nil, err
+	}
+	return &WatchEventSource{listener: listener, files: files, paths: paths, Seen: seen}, nil
+}
+
+func (s *WatchEventSource) Start(indexFiles, videoFiles chan string) {
+	for _, path := range s.paths {
+		if err := s.Watch(path); err != nil {
+			log.Printf("WARN: Error watching %s: %s", path, err)
+		}
+	}
+	go func() {
+		defer close(s.files)
+		s.listener.Run()
+	}()
+	go dispatchFiles(s.files, s.Seen, indexFiles, videoFiles)
+}
+
+func (s *WatchEventSource) Stop() {
+	s.listener.Close()
+}
+
+func (s *WatchEventSource) Watch(root string) error {
+	return s.listener.Watch(root)
+}
+
+func (s *WatchEventSource) Unwatch(root string) {
+	s.listener.Unwatch(root)
+}
+
+/*
+dispatchFiles: Send each of files to indexFiles or videoFiles by its extension
+until files is closed. Files in seen aren't sent again.
+*/
+func dispatchFiles(files <-chan string, seen *SeenFiles, indexFiles, videoFiles chan string) {
+	for file := range files {
+		if (isIndexFilePath(file) || isVideoFilePath(file)) && seen != nil && !seen.Add(file) {
+			if flagDebug {
+				log.Printf("DEBUG: Already reported %s", file)
+			}
+			continue
+		}
+		switch {
+		case isIndexFilePath(file):
+			indexFiles <- file
+		case isVideoFilePath(file):
+			videoFiles <- file
+		default:
+			if flagVerbose {
+				log.Printf("Ignoring %s", file)
+			}
+		}
+	}
+}
+
+// MultiEventSource: The files each of its sources report
+type MultiEventSource []EventSource
+
+func (s MultiEventSource) Start(indexFiles, videoFiles chan string) {
+	for _, source := range s {
+		source.Start(indexFiles, videoFiles)
+	}
+}
+
+func (s MultiEventSource) Stop() {
+	for _, source := range s {
+		source.Stop()
+	}
+}
+
+func (s MultiEventSource) Watch(root string) error {
+	for _, source := range s {
+		if watcher, ok := source.(PathWatcher); ok {
+			if err := watcher.Watch(root); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s MultiEventSource) Unwatch(root string) {
+	for _, source := range s {
+		if watcher, ok := source.(PathWatcher); ok {
+			watcher.Unwatch(root)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// receive: The next path sent to files, failing after a second
+func receive(t *testing.T, files chan string) string {
+	select {
+	case file := <-files:
+		return file
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a file")
+	}
+	return ""
+}
+
+// writeRenamed: Write path as a camera does, to a temporary name which is renamed once it's finished
+func writeRenamed(t *testing.T, path string) {
+	if err := os.WriteFile(path+"_", []byte("data"), 0640); err != nil {
+		t.Fatalf("Expected to write %s, got %s", path, err)
+	}
+	if err := os.Rename(path+"_", path); err != nil {
+		t.Fatalf("Expected to rename %s, got %s", path, err)
+	}
+}
+
+func TestWatchEventSource(t *testing.T) {
+	root := t.TempDir()
+	source, err := NewWatchEventSource([]string{root}, nil)
+	if err != nil {
+		t.Fatalf("Expected to watch, got %s", err)
+	}
+	indexFiles := make(chan string, 1)
+	videoFiles := make(chan string, 1)
+	source.Start(indexFiles, videoFiles)
+	defer source.Stop()
+
+	// Directories made for each hour are watched as they're created
+	dir := filepath.Join(root, "Camera1", "2022-03-06", "001", "dav", "04")
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		t.Fatalf("Expected %s, got %s", dir, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	video := filepath.Join(dir, "04.51.56-04.52.18[M][0@0][0].dav")
+	index := filepath.Join(dir, "04.51.56-04.52.18[M][0@0][0].idx")
+	writeRenamed(t, video)
+	if file := receive(t, videoFiles); file != video {
+		t.Fatalf("Expected %s, got %s", video, file)
+	}
+	writeRenamed(t, index)
+	if file := receive(t, indexFiles); file != index {
+		t.Fatalf("Expected %s, got %s", index, file)
+	}
+}
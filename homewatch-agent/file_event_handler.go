@@ -1,20 +1,27 @@
 package main
 
-import "log"
+import (
+	"context"
+	"log"
+)
 
 type FileEventHandler struct {
-	enableUpload bool
-	fileEvents   chan string
-	control      chan int
-	Uploader     S3FileUploader
+	config      IndexConfig
+	fileEvents  chan string
+	Uploader    S3FileUploader
+	queue       FileEventQueue
+	indexEvents chan<- *IndexedEvent
+	sidecars    *Sidecars
+	alerter     *Alerter
+	state       *StateStore
+	inFlight    *InFlight
 }
 
-func NewFileEventHandler(enableUpload bool, fileEvents chan string) *FileEventHandler {
+func NewFileEventHandler(config IndexConfig, fileEvents chan string) *FileEventHandler {
 	return &FileEventHandler{
-		enableUpload,
-		fileEvents,
-		make(chan int, 1),
-		nil,
+		config:     config,
+		fileEvents: fileEvents,
+		inFlight:   NewInFlight(),
 	}
 }
 
@@ -22,34 +29,91 @@ func (e *FileEventHandler) AddUploader(uploader S3FileUploader) {
 	e.Uploader = uploader
 }
 
-func (e *FileEventHandler) Listen() {
-	defer close(e.control)
-	go func() {
+// AddQueue: Acknowledge each file event on queue once it has been handled
+func (e *FileEventHandler) AddQueue(queue FileEventQueue) {
+	e.queue = queue
+}
+
+// AddIndexEvents: Read each index file and send its events to indexEvents
+func (e *FileEventHandler) AddIndexEvents(indexEvents chan<- *IndexedEvent) {
+	e.indexEvents = indexEvents
+}
+
+// AddSidecars: Read each index file for the sidecar of its video
+func (e *FileEventHandler) AddSidecars(sidecars *Sidecars) {
+	e.sidecars = sidecars
+}
+
+// AddAlerter: Match the detections in each index file against alerter's rules
+func (e *FileEventHandler) AddAlerter(alerter *Alerter) {
+	e.alerter = alerter
+}
+
+// AddStateStore: Record each index file's lifecycle in state
+func (e *FileEventHandler) AddStateStore(state *StateStore) {
+	e.state = state
+}
+
+// Listen: Handle each index file event, one at a time, until ctx is done
+func (e *FileEventHandler) Listen(ctx context.Context) {
+	if flagDebug {
+		log.Printf("Listening for idx files")
+	}
+	for {
+		var filepath string
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-e.fileEvents:
+			if !ok {
+				return
+			}
+			filepath = event
+		}
 		if flagDebug {
-			log.Printf("Listening for idx files")
+			log.Printf("File event %s", filepath)
 		}
-		for filepath := range e.fileEvents {
-			if flagDebug {
-				log.Printf("File event %s", filepath)
-			}
-
-			if e.enableUpload && e.Uploader != nil {
-				done := make(chan int, 1)
-				go e.Uploader.UploadFile(filepath, done)
-				<-done
-				if flagDebug {
-					log.Printf("Uploaded %s", filepath)
-				}
-				if flagCleanupAllFiles || flagCleanupIndexFiles {
-					tryRemove(filepath)
-				}
+		if !e.inFlight.Start(filepath) {
+			return
+		}
+		e.handle(filepath)
+		e.inFlight.Finish(filepath)
+	}
+}
 
+func (e *FileEventHandler) handle(filepath string) {
+	e.state.Discovered(filepath)
+	if e.indexEvents != nil || e.sidecars != nil || e.alerter != nil {
+		if event := NewIndexedEvent(filepath, false, e.config.InvalidLines); event != nil {
+			if e.alerter != nil {
+				e.alerter.Evaluate(event)
+			}
+			if e.sidecars != nil {
+				e.sidecars.AddIndex(filepath, event)
+			}
+			if e.indexEvents != nil {
+				e.indexEvents <- event
 			}
 		}
-	}()
-	<-e.control
+	}
+	if e.config.Upload && e.Uploader != nil {
+		uploadStatus := uploadFile(filepath, e.Uploader)
+		// Left unacknowledged so it's uploaded after a restart
+		if !uploadSettled(uploadStatus) {
+			return
+		}
+		if flagDebug {
+			log.Printf("Uploaded %s", filepath)
+		}
+		if uploadStatus == DoneUploadVideoFile && e.config.Cleanup {
+			cleanup(filepath, e.state)
+		}
+
+	}
+	ackFileEvent(e.queue, filepath)
 }
 
-func (e *FileEventHandler) Stop() {
-	e.control <- 1
+// Drain: Wait for the index file being handled until ctx is done, returning it if it didn't finish
+func (e *FileEventHandler) Drain(ctx context.Context) []string {
+	return e.inFlight.Wait(ctx)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"testing"
 )
 
@@ -24,11 +25,12 @@ func TestFileEventHandler(t *testing.T) {
 	}
 	defer close(fileEvents)
 	defer close(uploader.MockS3)
-	eventHandler := NewFileEventHandler(true, fileEvents)
-	defer eventHandler.Stop()
+	eventHandler := NewFileEventHandler(IndexConfig{Upload: true}, fileEvents)
 	eventHandler.AddUploader(uploader)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	go eventHandler.Listen()
+	go eventHandler.Listen(ctx)
 	fileEvents <- mockFilename
 	uploadedFilename := <-uploader.MockS3
 
@@ -1,10 +1,8 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"encoding/json"
-	"io"
+	"fmt"
 	"log"
 	"os"
 	"path"
@@ -26,6 +24,33 @@ type Event struct {
 // XYPoing: X,Y
 type XYPoint []int
 
+/*
+Track: Where an object has been. Cameras send the points it moved through,
+like DetectRegion, which are decoded into Points. Any other shape is kept as it
+was sent in Raw instead of failing the whole detection's decode.
+*/
+type Track struct {
+	Points []XYPoint
+	Raw    json.RawMessage
+}
+
+func (t *Track) UnmarshalJSON(b []byte) error {
+	t.Points, t.Raw = nil, nil
+	if err := json.Unmarshal(b, &t.Points); err != nil {
+		t.Points = nil
+		t.Raw = append(json.RawMessage{}, b...)
+	}
+	return nil
+}
+
+// MarshalJSON: The track as it was sent, so datapoints' detections keep the camera's shape
+func (t Track) MarshalJSON() ([]byte, error) {
+	if t.Raw != nil {
+		return t.Raw, nil
+	}
+	return json.Marshal(t.Points)
+}
+
 // BoundingBox: X,Y, W, H
 type BoundingBox []int
 
@@ -45,8 +70,10 @@ type RuleDetection struct {
 	Object       ObjectDetection
 	PTS          float64
 	RuleID       int
-	Track        interface{}
+	Track        Track
 	UTC, UTCMS   int64
+	// kind: Tripwire or intrusion, set by the event's decoder
+	kind string
 }
 type ObjectDetection struct {
 	Action       string
@@ -110,8 +137,10 @@ func tryRemove(filepath string) {
 		log.Printf("Removed %s", filepath)
 	}
 }
-func NewIndexedEvent(filepath string, cleanup bool) *IndexedEvent {
-	event, err := ReadIndex(filepath)
+
+// NewIndexedEvent: Read the index file at filepath, handling its invalid lines as invalidLines says
+func NewIndexedEvent(filepath string, cleanup bool, invalidLines string) *IndexedEvent {
+	event, err := ReadIndex(filepath, invalidLines)
 	event.Source = GetSourceFromPath(filepath)
 
 	defer func() {
@@ -127,7 +156,7 @@ func NewIndexedEvent(filepath string, cleanup bool) *IndexedEvent {
 
 	return &event
 }
-func ReadIndex(filepath string) (IndexedEvent, error) {
+func ReadIndex(filepath string, invalidLines string) (IndexedEvent, error) {
 	var event IndexedEvent
 	fp, err := os.Open(filepath)
 	_, filename := path.Split(filepath)
@@ -137,86 +166,92 @@ func ReadIndex(filepath string) (IndexedEvent, error) {
 	}
 	defer fp.Close()
 
-	reader := bufio.NewReader(fp)
-
-	return demuxIndex(reader)
+	parser := NewIndexParser(fp)
+	if len(invalidLines) > 0 {
+		parser.InvalidLines = invalidLines
+	}
+	return parser.Parse()
 }
 
-/* demuxIndex: Locate the Frames, Encodings, and Events in a .idx reader
- */
-func demuxIndex(reader *bufio.Reader) (IndexedEvent, error) {
-	event := IndexedEvent{}
-
-	data, err := reader.ReadBytes('\n')
-	for err != io.EOF {
-		line := bytes.SplitN(data, []byte("="), 2)
-		lineType := string(line[0])
-		lineData := line[1]
-		data, err = reader.ReadBytes('\n')
-
-		switch {
-		case lineType == "Frame":
-			frame := &Frame{}
+// FrameError: Why a Frame couldn't be decoded and the offset of the field it stopped at
+type FrameError struct {
+	Offset int
+	Err    error
+}
 
-			decodeError := frame.UnmarshalText(lineData)
-			if decodeError != nil {
-				return event, decodeError
-			}
-			event.Frames = append(event.Frames, *frame)
+func (e *FrameError) Error() string {
+	return e.Err.Error()
+}
 
-		case lineType == "Event":
-			v := &Event{}
-			decodeError := json.Unmarshal(lineData, v)
-			if decodeError != nil {
-				return event, decodeError
-			}
+func (e *FrameError) Unwrap() error {
+	return e.Err
+}
 
-			event.Events = append(event.Events, *v)
-		case lineType == "EncodeFormat":
-			v := &Encoding{}
-			decodeError := json.Unmarshal(lineData, v)
-			if decodeError != nil {
-				return event, decodeError
-			}
-			event.Encodings = append(event.Encodings, *v)
+// frameFields: Type, FrameNumber, StartOffsetMs, EndOffsetMs and IsFirstFrame
+const frameFields = 5
 
-			if len(event.Encodings) > 1 {
-				log.Printf("Warning: Found multiple encodings")
-			}
-		default:
-			log.Printf("Unknown line type: %s", lineType)
+/*
+UnmarshalText: Decode a quoted frame like "P,47281928210,0,5158,1", returning a
+*FrameError when a field is missing or isn't a number.
+*/
+func (frame *Frame) UnmarshalText(b []byte) error {
+	offset := 0
+	if len(b) >= 2 && b[0] == '"' && b[len(b)-1] == '"' {
+		b = b[1 : len(b)-1]
+		offset = 1
+	}
+	fields := strings.Split(string(b), ",")
+	// fieldOffset: Where field i starts
+	fieldOffset := func(i int) int {
+		start := offset
+		for _, field := range fields[:i] {
+			start += len(field) + 1
 		}
+		return start
 	}
-	return event, nil
-}
-
-func (frame *Frame) UnmarshalText(b []byte) error {
-	line := strings.ReplaceAll(string(b), "\"", "")
-	fields := strings.Split(line, ",")
-
-	frame.Type = fields[0]
-	if frameNumber, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
-		frame.FrameNumber = int64(frameNumber)
+	if len(fields) < frameFields {
+		return &FrameError{
+			Offset: offset + len(b),
+			Err:    fmt.Errorf("%w: %d fields, expected %d", ErrInvalidIndexFrame, len(fields), frameFields),
+		}
 	}
-	if startOffsetMs, err := strconv.ParseInt(fields[2], 10, 64); err == nil {
-		frame.StartOffsetMs = startOffsetMs
+	if len(fields[0]) == 0 {
+		return &FrameError{Offset: offset, Err: fmt.Errorf("%w: missing type", ErrInvalidIndexFrame)}
 	}
-	if endOffsetMs, err := strconv.ParseInt(fields[3], 10, 64); err == nil {
-		frame.EndOffsetMs = endOffsetMs
+
+	numbers := make([]int64, 3)
+	for i := range numbers {
+		number, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil {
+			return &FrameError{
+				Offset: fieldOffset(i + 1),
+				Err:    fmt.Errorf("%w: field %d %q isn't a number", ErrInvalidIndexFrame, i+2, fields[i+1]),
+			}
+		}
+		numbers[i] = number
 	}
-	if v, err := strconv.ParseBool(fields[len(fields)-1]); err == nil {
-		frame.IsFirstFrame = v
+	last := len(fields) - 1
+	isFirstFrame, err := strconv.ParseBool(fields[last])
+	if err != nil {
+		return &FrameError{
+			Offset: fieldOffset(last),
+			Err:    fmt.Errorf("%w: field %d %q isn't a boolean", ErrInvalidIndexFrame, last+1, fields[last]),
+		}
 	}
+
+	frame.Type = fields[0]
+	frame.FrameNumber = numbers[0]
+	frame.StartOffsetMs = numbers[1]
+	frame.EndOffsetMs = numbers[2]
+	frame.IsFirstFrame = isFirstFrame
 	return nil
 }
 
+// RuleDetection: The object detected by a tripwire or intrusion rule, or nil for other events
 func (e Event) RuleDetection() *RuleDetection {
-	var ruleDetection RuleDetection
-	err := json.Unmarshal([]byte(e.Data), &ruleDetection)
-	if err == nil {
-		return &ruleDetection
+	if ruleDetection, ok := e.Decode().(*RuleDetection); ok {
+		return ruleDetection
 	}
-	log.Printf("Unable to decode rule detection: %s", err)
 	return nil
 }
 
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+// What to do with an index file's invalid lines
+const (
+	// FailInvalidIndexLines: An invalid line fails the whole file
+	FailInvalidIndexLines = "fail"
+	// StopAtInvalidIndexLines: Keep the lines before the first invalid line, as from a partially written file
+	StopAtInvalidIndexLines = "stop"
+	// SkipInvalidIndexLines: Keep every valid line
+	SkipInvalidIndexLines = "skip"
+)
+
+// DefaultMaxIndexLineLength: The longest index line read, in bytes, so a corrupt file can't exhaust memory
+const DefaultMaxIndexLineLength = 16 * 1024 * 1024
+
+var (
+	ErrMissingIndexSeparator = errors.New("missing = after the line type")
+	ErrIndexLineTooLong      = errors.New("line too long")
+	ErrInvalidIndexFrame     = errors.New("invalid frame")
+)
+
+// IndexParseError: The line and byte column, both from 1, an index line couldn't be decoded at
+type IndexParseError struct {
+	Line   int
+	Column int
+	// Type: The line type, like Event or Frame, when it was read
+	Type string
+	Err  error
+}
+
+func (e *IndexParseError) Error() string {
+	if len(e.Type) > 0 {
+		return fmt.Sprintf("line %d, column %d: %s: %s", e.Line, e.Column, e.Type, e.Err)
+	}
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Err)
+}
+
+func (e *IndexParseError) Unwrap() error {
+	return e.Err
+}
+
+/*
+IndexParser: Reads the Frames, Encodings and Events of a .idx file a line at a
+time. Lines end in LF or CRLF, the last one may have no line ending, and
+trailing whitespace and blank lines are ignored.
+*/
+type IndexParser struct {
+	reader *bufio.Reader
+	line   int
+	// InvalidLines: What Parse does with invalid lines, FailInvalidIndexLines when empty
+	InvalidLines  string
+	MaxLineLength int
+}
+
+func NewIndexParser(r io.Reader) *IndexParser {
+	return &IndexParser{
+		reader:        bufio.NewReader(r),
+		InvalidLines:  FailInvalidIndexLines,
+		MaxLineLength: DefaultMaxIndexLineLength,
+	}
+}
+
+/*
+Parse: Read every line into an IndexedEvent. Invalid lines are handled by
+InvalidLines and read errors are always returned with what was read so far.
+*/
+func (p *IndexParser) Parse() (IndexedEvent, error) {
+	event := IndexedEvent{}
+	for {
+		err := p.Next(&event)
+		var parseError *IndexParseError
+		switch {
+		case err == nil:
+		case err == io.EOF:
+			return event, nil
+		case !errors.As(err, &parseError):
+			return event, err
+		case p.InvalidLines == SkipInvalidIndexLines:
+			log.Printf("WARN: Skipping invalid index line: %s", err)
+		case p.InvalidLines == StopAtInvalidIndexLines:
+			log.Printf("WARN: Stopping at invalid index line: %s", err)
+			return event, nil
+		default:
+			return event, err
+		}
+	}
+}
+
+/*
+Next: Decode the next line into event, returning io.EOF after the last line.
+An invalid line returns an *IndexParseError and leaves event unchanged, so the
+lines after it can still be read.
+*/
+func (p *IndexParser) Next(event *IndexedEvent) error {
+	for {
+		line, err := p.readLine()
+		if err != nil {
+			return err
+		}
+		line = bytes.TrimRight(line, " \t\r")
+		if len(line) > 0 {
+			return p.decode(line, event)
+		}
+	}
+}
+
+// readLine: The next line without its line ending
+func (p *IndexParser) readLine() ([]byte, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := p.reader.ReadSlice('\n')
+		if len(line)+len(bytes.TrimSuffix(chunk, []byte("\n"))) > p.MaxLineLength {
+			// Keep reading to the end of the line so the next line can be read
+			tooLong = true
+		} else {
+			line = append(line, chunk...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		// The last line may not have a line ending
+		if err == io.EOF && (len(line) > 0 || tooLong) {
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.line++
+		if tooLong {
+			return nil, &IndexParseError{Line: p.line, Column: p.MaxLineLength + 1, Err: ErrIndexLineTooLong}
+		}
+		return bytes.TrimSuffix(line, []byte("\n")), nil
+	}
+}
+
+func (p *IndexParser) decode(line []byte, event *IndexedEvent) error {
+	separator := bytes.IndexByte(line, '=')
+	if separator < 0 {
+		return &IndexParseError{Line: p.line, Column: len(line) + 1, Err: ErrMissingIndexSeparator}
+	}
+	lineType := string(line[:separator])
+	lineData := line[separator+1:]
+	// fail: Report err at offset into lineData
+	fail := func(offset int, err error) error {
+		return &IndexParseError{Line: p.line, Column: separator + 2 + offset, Type: lineType, Err: err}
+	}
+
+	switch lineType {
+	case "Frame":
+		frame := Frame{}
+		if err := frame.UnmarshalText(lineData); err != nil {
+			offset := 0
+			var frameError *FrameError
+			if errors.As(err, &frameError) {
+				offset = frameError.Offset
+			}
+			return fail(offset, err)
+		}
+		event.Frames = append(event.Frames, frame)
+	case "Event":
+		v := Event{}
+		if err := json.Unmarshal(lineData, &v); err != nil {
+			return fail(jsonErrorOffset(err), err)
+		}
+		event.Events = append(event.Events, v)
+	case "EncodeFormat":
+		v := Encoding{}
+		if err := json.Unmarshal(lineData, &v); err != nil {
+			return fail(jsonErrorOffset(err), err)
+		}
+		event.Encodings = append(event.Encodings, v)
+
+		if len(event.Encodings) > 1 {
+			log.Printf("Warning: Found multiple encodings")
+		}
+	default:
+		log.Printf("Unknown line type: %s on line %d", lineType, p.line)
+	}
+	return nil
+}
+
+// jsonErrorOffset: The offset into the JSON decoding failed at, or near for type errors
+func jsonErrorOffset(err error) int {
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxError) && syntaxError.Offset > 0:
+		// Offset counts the invalid byte
+		return int(syntaxError.Offset) - 1
+	case errors.As(err, &typeError):
+		return int(typeError.Offset)
+	}
+	return 0
+}
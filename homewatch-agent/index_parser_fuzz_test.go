@@ -0,0 +1,50 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"testing"
+)
+
+func FuzzIndexParser(f *testing.F) {
+	b, err := os.ReadFile(testIndexFile)
+	if err != nil {
+		f.Fatalf("Unable to read %s: %s", testIndexFile, err)
+	}
+	f.Add(b)
+	f.Add(bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n")))
+	f.Add([]byte("Frame=\"P,1,0,10,1\"\nEvent={\"Action\":\"St"))
+	f.Add([]byte("Frame\n=\n\"\"=\n"))
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	f.Fuzz(func(t *testing.T, index []byte) {
+		lines := bytes.Count(index, []byte("\n")) + 1
+		for _, invalidLines := range []string{FailInvalidIndexLines, StopAtInvalidIndexLines, SkipInvalidIndexLines} {
+			parser := NewIndexParser(bytes.NewReader(index))
+			parser.InvalidLines = invalidLines
+			parser.MaxLineLength = 512
+			event, err := parser.Parse()
+
+			var parseError *IndexParseError
+			switch {
+			case err == nil:
+			case invalidLines != FailInvalidIndexLines:
+				t.Fatalf("Expected %s not to return %s", invalidLines, err)
+			case !errors.As(err, &parseError):
+				t.Fatalf("Expected an IndexParseError, got %s", err)
+			case parseError.Line < 1 || parseError.Line > lines || parseError.Column < 1:
+				t.Fatalf("Expected a position within %d lines, got %s", lines, err)
+			}
+			if decoded := len(event.Events) + len(event.Encodings) + len(event.Frames); decoded > lines {
+				t.Fatalf("Expected at most %d lines decoded, got %d", lines, decoded)
+			}
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testIndexFile = "testdata/test.idx"
+
+func TestIndexParserReadsFixture(t *testing.T) {
+	b, err := os.ReadFile(testIndexFile)
+	if err != nil {
+		t.Fatalf("Unable to read %s: %s", testIndexFile, err)
+	}
+
+	// The fixture starts with the shell session it was copied from, which also wrapped its EncodeFormat
+	_, err = NewIndexParser(strings.NewReader(string(b))).Parse()
+	var parseError *IndexParseError
+	if !errors.As(err, &parseError) || parseError.Line != 1 || !errors.Is(err, ErrMissingIndexSeparator) {
+		t.Fatalf("Expected a missing separator on line 1, got %v", err)
+	}
+
+	parser := NewIndexParser(strings.NewReader(string(b)))
+	parser.InvalidLines = SkipInvalidIndexLines
+	event, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("Expected the invalid lines to be skipped, got %s", err)
+	}
+	if len(event.Events) != 1 || len(event.Encodings) != 0 || len(event.Frames) != 5 {
+		t.Fatalf("Expected 1 event, no encodings and 5 frames, got %d, %d and %d", len(event.Events), len(event.Encodings), len(event.Frames))
+	}
+	expectation := Frame{Type: "P", FrameNumber: 47281928510, StartOffsetMs: 57291, EndOffsetMs: 1229}
+	if event.Frames[4] != expectation {
+		t.Fatalf("Expected %+v, got %+v", expectation, event.Frames[4])
+	}
+	if !event.Frames[0].IsFirstFrame || event.Events[0].Name != "VideoMotion" {
+		t.Fatalf("Expected the first frame and a VideoMotion event, got %+v and %+v", event.Frames[0], event.Events[0])
+	}
+}
+
+func TestIndexParserLineEndings(t *testing.T) {
+	index := "Event={\"Action\":\"Start\",\"Index\":1,\"Name\":\"VideoMotion\"}\r\n\r\n  \nFrame=\"P,1,0,10,1\""
+	event, err := NewIndexParser(strings.NewReader(index)).Parse()
+	if err != nil {
+		t.Fatalf("Expected to parse CRLF lines, got %s", err)
+	}
+	if len(event.Events) != 1 || event.Events[0].Name != "VideoMotion" {
+		t.Fatalf("Expected a VideoMotion event, got %+v", event.Events)
+	}
+	if len(event.Frames) != 1 || event.Frames[0].EndOffsetMs != 10 {
+		t.Fatalf("Expected the last line without a newline to be read, got %+v", event.Frames)
+	}
+}
+
+func TestIndexParserLargeLines(t *testing.T) {
+	region := strings.Repeat("a", 256*1024)
+	index := "Event={\"Name\":\"VideoMotion\",\"Data\":{\"RegionName\":[\"" + region + "\"]}}\nFrame=\"P,1,0,10,1\"\n"
+	event, err := NewIndexParser(strings.NewReader(index)).Parse()
+	if err != nil || len(event.Events) != 1 || len(event.Events[0].Data) < len(region) {
+		t.Fatalf("Expected a %d byte event, got %v", len(region), err)
+	}
+
+	parser := NewIndexParser(strings.NewReader(index))
+	parser.MaxLineLength = 1024
+	parser.InvalidLines = SkipInvalidIndexLines
+	event, err = parser.Parse()
+	if err != nil || len(event.Events) != 0 || len(event.Frames) != 1 {
+		t.Fatalf("Expected only the frame after the long line, got %+v and %v", event, err)
+	}
+
+	parser = NewIndexParser(strings.NewReader(index))
+	parser.MaxLineLength = 1024
+	err = parser.Next(&event)
+	var parseError *IndexParseError
+	if !errors.As(err, &parseError) || !errors.Is(err, ErrIndexLineTooLong) || parseError.Column != 1025 {
+		t.Fatalf("Expected the line to be too long at column 1025, got %v", err)
+	}
+}
+
+func TestIndexParserErrorPositions(t *testing.T) {
+	expectations := []struct {
+		Index  string
+		Line   int
+		Column int
+		Err    error
+	}{
+		{"Event={}\nFrame\n", 2, 6, ErrMissingIndexSeparator},
+		{"Frame=\"P,1,2\"", 1, 13, ErrInvalidIndexFrame},
+		{"Frame=\"P,x,0,10,1\"", 1, 10, ErrInvalidIndexFrame},
+		{"Frame=\"P,1,0,10,yes\"", 1, 17, ErrInvalidIndexFrame},
+		{"\n\nEvent={\"Action\":x}", 3, 17, nil},
+		// A file cut off while it was written
+		{"Frame=\"P,1,0,10,1\"\nEvent={\"Action\":\"St", 2, 19, nil},
+	}
+	for _, expectation := range expectations {
+		_, err := NewIndexParser(strings.NewReader(expectation.Index)).Parse()
+		var parseError *IndexParseError
+		if !errors.As(err, &parseError) {
+			t.Fatalf("Expected an IndexParseError for %q, got %v", expectation.Index, err)
+		}
+		if parseError.Line != expectation.Line || parseError.Column != expectation.Column {
+			t.Fatalf("Expected line %d, column %d for %q, got %s", expectation.Line, expectation.Column, expectation.Index, err)
+		}
+		if expectation.Err != nil && !errors.Is(err, expectation.Err) {
+			t.Fatalf("Expected %s for %q, got %s", expectation.Err, expectation.Index, err)
+		}
+	}
+}
+
+func TestIndexParserInvalidLines(t *testing.T) {
+	index := "Frame=\"P,1,0,10,1\"\nFrame=\"P,2\"\nFrame=\"P,3,10,20,0\"\n"
+	expectations := map[string]int{
+		FailInvalidIndexLines:   0,
+		StopAtInvalidIndexLines: 1,
+		SkipInvalidIndexLines:   2,
+	}
+	for invalidLines, frames := range expectations {
+		parser := NewIndexParser(strings.NewReader(index))
+		parser.InvalidLines = invalidLines
+		event, err := parser.Parse()
+		if invalidLines == FailInvalidIndexLines {
+			if err == nil {
+				t.Fatalf("Expected %s to return the invalid line", invalidLines)
+			}
+			continue
+		}
+		if err != nil || len(event.Frames) != frames {
+			t.Fatalf("Expected %s to keep %d frames, got %d and %v", invalidLines, frames, len(event.Frames), err)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	v2 "github.com/mrmod/homewatch/v2"
+)
+
+// Liveness alert statuses
+const (
+	SilentCamera    = "silent"
+	RecoveredCamera = "recovered"
+)
+
+// livenessRule: The rule of liveness alerts
+const livenessRule = "liveness"
+
+const (
+	// DefaultLivenessTolerance: How many cadences a camera can go without a video before it's silent
+	DefaultLivenessTolerance = 3
+	// DefaultLivenessInterval: How often cameras are checked for silence
+	DefaultLivenessInterval = time.Minute
+	// minLearnedIntervals: Videos apart a camera is seen before its learned cadence is trusted
+	minLearnedIntervals = 5
+	// learningRate: The weight of each new interval in a learned cadence
+	learningRate = 0.2
+)
+
+// CameraLiveness: When a camera last sent a video and whether it's gone silent
+type CameraLiveness struct {
+	Camera    string    `json:"camera"`
+	LastVideo time.Time `json:"lastVideo"`
+	// Cadence: How often the camera is expected to send a video, zero until it's learned
+	Cadence Duration `json:"cadence"`
+	Learned bool     `json:"learned"`
+	Silent  bool     `json:"silent"`
+	// SilentSince: When the camera missed its window, while it's silent
+	SilentSince *time.Time `json:"silentSince,omitempty"`
+	// intervals: How many intervals the learned cadence is the average of
+	intervals int
+}
+
+/*
+LivenessTracker: Follows each camera's videos and alerts its sinks once a
+camera hasn't sent one for Tolerance times its cadence, then again once it
+recovers. A camera's cadence is configured, or learned as the moving average
+of the time between its videos.
+*/
+type LivenessTracker struct {
+	lock       sync.Mutex
+	config     LivenessConfig
+	configured map[string]time.Duration
+	cameras    map[string]*CameraLiveness
+	sinks      map[string]AlertSink
+	sending    sync.WaitGroup
+	now        func() time.Time
+	stop       chan struct{}
+	stopOnce   sync.Once
+}
+
+// NewLivenessTracker: Track config's cameras, alerting the sinks config names from sinks
+func NewLivenessTracker(config LivenessConfig, sinks []AlertSinkConfig) (*LivenessTracker, error) {
+	l := &LivenessTracker{
+		config:     config,
+		configured: map[string]time.Duration{},
+		cameras:    map[string]*CameraLiveness{},
+		sinks:      map[string]AlertSink{},
+		now:        time.Now,
+		stop:       make(chan struct{}),
+	}
+	for _, name := range config.Sinks {
+		for _, sinkConfig := range sinks {
+			if sinkConfig.Name != name {
+				continue
+			}
+			sink, err := NewAlertSink(sinkConfig)
+			if err != nil {
+				return nil, err
+			}
+			l.sinks[name] = sink
+		}
+		if _, exists := l.sinks[name]; !exists {
+			return nil, fmt.Errorf("liveness: no sink named %s", name)
+		}
+	}
+	// Configured cameras are expected to send a video from the start
+	started := l.now()
+	for _, camera := range config.Cameras {
+		l.configured[camera.Camera] = time.Duration(camera.Cadence)
+		l.cameras[camera.Camera] = &CameraLiveness{Camera: camera.Camera, LastVideo: started, Cadence: camera.Cadence}
+	}
+	return l, nil
+}
+
+// cadence: The cadence camera is expected to keep, zero when it isn't known yet
+func (l *LivenessTracker) cadence(camera *CameraLiveness) time.Duration {
+	if cadence, ok := l.configured[camera.Camera]; ok {
+		return cadence
+	}
+	if l.config.Cadence > 0 {
+		return time.Duration(l.config.Cadence)
+	}
+	if camera.Learned {
+		return time.Duration(camera.Cadence)
+	}
+	return 0
+}
+
+// Heartbeat: Record a video from the camera of path, alerting when the camera was silent. A nil tracker records nothing.
+func (l *LivenessTracker) Heartbeat(path string) {
+	if l == nil {
+		return
+	}
+	cameraName := GetSourceFromPath(path)
+	now := l.now()
+	l.lock.Lock()
+	camera, exists := l.cameras[cameraName]
+	if !exists {
+		camera = &CameraLiveness{Camera: cameraName, LastVideo: now}
+		l.cameras[cameraName] = camera
+		l.lock.Unlock()
+		return
+	}
+	// The gap while a camera was silent isn't its cadence
+	if interval := now.Sub(camera.LastVideo); interval > 0 && !camera.Silent {
+		if camera.intervals == 0 {
+			camera.Cadence = Duration(interval)
+		} else {
+			camera.Cadence = Duration(float64(camera.Cadence)*(1-learningRate) + float64(interval)*learningRate)
+		}
+		camera.intervals++
+		camera.Learned = camera.intervals >= minLearnedIntervals
+	}
+	camera.LastVideo = now
+	recovered := camera.Silent
+	camera.Silent = false
+	camera.SilentSince = nil
+	alert := l.alert(camera, RecoveredCamera)
+	l.lock.Unlock()
+
+	if recovered {
+		log.Printf("INFO: Camera %s recovered, it sent %s", cameraName, path)
+		l.send(alert)
+	}
+}
+
+// alert: A liveness alert of camera with status
+func (l *LivenessTracker) alert(camera *CameraLiveness, status string) Alert {
+	lastVideo := camera.LastVideo
+	return Alert{
+		Rule:      livenessRule,
+		Camera:    camera.Camera,
+		Status:    status,
+		LastVideo: &lastVideo,
+		Cadence:   Duration(l.cadence(camera)),
+	}
+}
+
+// Run: Check the cameras every interval until Close
+func (l *LivenessTracker) Run() {
+	ticker := time.NewTicker(time.Duration(l.config.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.Check()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// Check: Alert about each camera which has gone silent since the last check and update the liveness metrics
+func (l *LivenessTracker) Check() {
+	now := l.now()
+	alerts := []Alert{}
+	l.lock.Lock()
+	for _, camera := range l.cameras {
+		cadence := l.cadence(camera)
+		window := time.Duration(float64(cadence) * l.config.Tolerance)
+		if cadence > 0 && !camera.Silent && now.Sub(camera.LastVideo) > window {
+			camera.Silent = true
+			silentSince := camera.LastVideo.Add(window)
+			camera.SilentSince = &silentSince
+			log.Printf("WARN: Camera %s is silent, its last video was at %s and one was expected every %s", camera.Camera, camera.LastVideo.Format(time.RFC3339), cadence)
+			alerts = append(alerts, l.alert(camera, SilentCamera))
+		}
+		v2.SetCameraLiveness(camera.Camera, camera.Silent, cadence)
+	}
+	l.lock.Unlock()
+
+	for _, alert := range alerts {
+		l.send(alert)
+	}
+}
+
+// send: Send alert to every sink without waiting
+func (l *LivenessTracker) send(alert Alert) {
+	l.sending.Add(1)
+	go func() {
+		defer l.sending.Done()
+		for _, name := range l.config.Sinks {
+			if err := l.sinks[name].Send(context.Background(), alert); err != nil {
+				log.Printf("ERROR: Unable to send the %s %s alert to %s: %s", alert.Camera, alert.Status, name, err)
+			}
+		}
+	}()
+}
+
+// Cameras: The liveness of every camera, by name
+func (l *LivenessTracker) Cameras() []CameraLiveness {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	cameras := []CameraLiveness{}
+	for _, camera := range l.cameras {
+		liveness := *camera
+		liveness.Cadence = Duration(l.cadence(camera))
+		cameras = append(cameras, liveness)
+	}
+	sort.Slice(cameras, func(i, j int) bool { return cameras[i].Camera < cameras[j].Camera })
+	return cameras
+}
+
+// Close: Stop checking, then wait for alerts being sent until ctx is done
+func (l *LivenessTracker) Close(ctx context.Context) {
+	l.stopOnce.Do(func() { close(l.stop) })
+	done := make(chan struct{})
+	go func() {
+		l.sending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("WARN: Stopped waiting for liveness alerts to be sent: %s", ctx.Err())
+	}
+}
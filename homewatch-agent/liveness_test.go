@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func newTestLivenessTracker(t *testing.T, config LivenessConfig) (*LivenessTracker, *recordingSink, *time.Time) {
+	config.Sinks = []string{"recorder"}
+	if config.Tolerance == 0 {
+		config.Tolerance = DefaultLivenessTolerance
+	}
+	tracker, err := NewLivenessTracker(config, []AlertSinkConfig{{Name: "recorder", Type: CommandAlertSink, Command: []string{"true"}}})
+	if err != nil {
+		t.Fatalf("Expected a liveness tracker, got %s", err)
+	}
+	// Configured cameras were last seen when the tracker was created
+	now := time.Now()
+	tracker.now = func() time.Time { return now }
+	sink := &recordingSink{}
+	tracker.sinks["recorder"] = sink
+	return tracker, sink, &now
+}
+
+func cameraVideo(camera string) string {
+	return "/data/" + camera + "/2022-03-01/001/dav/04/04.51.56-04.52.18[M][0@0][0].dav"
+}
+
+// waitForAlerts: The alerts sink has been sent once tracker is done sending
+func waitForAlerts(tracker *LivenessTracker, sink *recordingSink) []Alert {
+	tracker.sending.Wait()
+	return sink.Alerts()
+}
+
+func TestLivenessLearnsCadenceAndAlertsOnSilence(t *testing.T) {
+	tracker, sink, now := newTestLivenessTracker(t, LivenessConfig{})
+	video := cameraVideo("Camera1")
+	for i := 0; i < minLearnedIntervals; i++ {
+		tracker.Heartbeat(video)
+		tracker.Check()
+		*now = now.Add(time.Minute)
+	}
+	if alerts := waitForAlerts(tracker, sink); len(alerts) != 0 {
+		t.Fatalf("Expected no alerts while the cadence is learned, got %v", alerts)
+	}
+	tracker.Heartbeat(video)
+	if cameras := tracker.Cameras(); len(cameras) != 1 || !cameras[0].Learned || time.Duration(cameras[0].Cadence) != time.Minute {
+		t.Fatalf("Expected a learned cadence of 1m, got %#v", cameras)
+	}
+
+	*now = now.Add(3*time.Minute + time.Second)
+	tracker.Check()
+	tracker.Check()
+	alerts := waitForAlerts(tracker, sink)
+	if len(alerts) != 1 || alerts[0].Status != SilentCamera || alerts[0].Camera != "Camera1" {
+		t.Fatalf("Expected one silent alert for Camera1, got %v", alerts)
+	}
+
+	*now = now.Add(time.Hour)
+	tracker.Heartbeat(video)
+	alerts = waitForAlerts(tracker, sink)
+	if len(alerts) != 2 || alerts[1].Status != RecoveredCamera {
+		t.Fatalf("Expected a recovered alert, got %v", alerts)
+	}
+	if cameras := tracker.Cameras(); cameras[0].Silent || time.Duration(cameras[0].Cadence) != time.Minute {
+		t.Fatalf("Expected Camera1 to recover without learning the silence as its cadence, got %#v", cameras[0])
+	}
+}
+
+func TestLivenessConfiguredCamerasAreExpectedFromTheStart(t *testing.T) {
+	tracker, sink, now := newTestLivenessTracker(t, LivenessConfig{
+		Cameras: []CameraCadenceConfig{{Camera: "Porch", Cadence: Duration(10 * time.Minute)}},
+	})
+	*now = now.Add(31 * time.Minute)
+	tracker.Check()
+	alerts := waitForAlerts(tracker, sink)
+	if len(alerts) != 1 || alerts[0].Camera != "Porch" || time.Duration(alerts[0].Cadence) != 10*time.Minute {
+		t.Fatalf("Expected Porch to be silent, got %v", alerts)
+	}
+
+	api := newTestApi(t)
+	api.AddLiveness(tracker)
+	cameras := []ApiCamera{}
+	decodeApiResponse(t, api.request("GET", "/cameras", ""), &cameras)
+	if len(cameras) != 1 || cameras[0].Liveness == nil || !cameras[0].Liveness.Silent || cameras[0].Liveness.SilentSince == nil {
+		t.Fatalf("Expected Porch to be served as silent, got %#v", cameras)
+	}
+	tracker.Close(context.Background())
+}
@@ -1,53 +1,117 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	v2 "github.com/mrmod/homewatch/v2"
 )
 
 var (
-	flagConsolidationInterval      = "5m"
+	flagConfigPath                 string
+	flagConsolidationInterval      = 5 * time.Minute
 	flagIndexEventApiUrl           string
 	flagS3VideoBucketUrl           string
 	flagS3IndexBucketUrl           string
+	flagS3Endpoint                 string
+	flagS3Region                   string
+	flagS3PathStyle                bool
 	flagSyslogServerAddress        = "0.0.0.0:5140"
+	flagSyslogTcpAddress           = ""
+	flagSyslogTlsAddress           = ""
+	flagSyslogTlsCertFile          string
+	flagSyslogTlsKeyFile           string
+	flagSyslogTlsClientCAFile      string
 	flagIndexEventApiAuthorization string
+	flagInfluxUrl                  string
+	flagInfluxToken                string
+	flagPushgatewayUrl             string
+	flagNDJSONPath                 string
+	flagPublishTimeout             = DefaultPublishTimeout
+	flagPublishMaxAttempts         = 3
+	flagPublishGzip                bool
+	flagPublishBufferPath          = ""
 	flagVideoTrimPrefix            = ""
 	flagIndexTrimPrefix            = ""
+	flagIndexInvalidLines          = FailInvalidIndexLines
+	flagQueuePath                  = ""
+	flagDeadLetterPath             = ""
+	flagUploadMaxAttempts          = DefaultBackoff.MaxAttempts
+	flagUploadRetryBaseDelay       = DefaultBackoff.BaseDelay
+	flagUploadRetryMaxDelay        = DefaultBackoff.MaxDelay
+	flagMultipartPartSize          = int64(DefaultMultipartPartSize)
+	flagMultipartConcurrency       = 4
+	flagUploadStatePath            = ""
+	flagStatePath                  = ""
+	flagShutdownTimeout            = DefaultShutdownTimeout
 
 	flagCleanupAllFiles   bool
 	flagCleanupIndexFiles bool
 	flagCleanupVideoFiles bool
-	flagDebug             bool
-	flagVerbose           bool
+	// flagDebug, flagVerbose: Logging levels, set from the configuration once it's loaded
+	flagDebug   bool
+	flagVerbose bool
 
 	flagDecodeVideo       bool
+	flagFFmpegPath        = "ffmpeg"
+	flagTranscodeWorkers  = 1
+	flagUploadOriginal    bool
+	flagVideoSidecar      bool
 	flagEnableEventUpload bool
 	flagEnableVideoUpload bool
 
 	flagEnableV2             bool
 	flagV2WatchPaths         string
+	flagV2WatchMode          = NotifyWatchMode
+	flagV2ScanInterval       = DefaultScanInterval
+	flagV2SeenFilesPath      string
 	flagV2EnableMetrics      bool
+	flagV2MetricsAddress     = v2.DefaultMetricsAddress
 	flagV2EnableWatchReaper  bool
+	flagV2WatchMaxAge        = 24 * time.Hour
 	flagV2EnableUploadReaper bool
 
+	flagRetentionDryRun bool
+
+	flagApiAddress string
+	flagApiToken   string
+
 	softwareVersion string
 )
 
 func parseFlags() {
+	flag.StringVar(&flagConfigPath, "config", "", "YAML, or JSON when it ends in .json, configuration file. Flags which are set override it")
 	flag.StringVar(&flagSyslogServerAddress, "syslog-server-address", flagSyslogServerAddress, "IP:Port the Syslog server should listen on")
-	flag.StringVar(&flagS3VideoBucketUrl, "s3-video-bucket-url", "", "Video Bucket URL like s3://bucket/some/prefix")
-	flag.StringVar(&flagS3IndexBucketUrl, "s3-index-bucket-url", "", "Index bucket URL like s3://bucket/some/prefix")
-	flag.StringVar(&flagConsolidationInterval, "consolidation-interval", flagConsolidationInterval, "Submits event datatpoints to indexEventApiUrl after each interval")
+	flag.StringVar(&flagSyslogTcpAddress, "syslog-tcp-address", "", "IP:Port the Syslog server should accept TCP streams on")
+	flag.StringVar(&flagSyslogTlsAddress, "syslog-tls-address", "", "IP:Port the Syslog server should accept TLS streams on")
+	flag.StringVar(&flagSyslogTlsCertFile, "syslog-tls-cert-file", "", "PEM certificate for the Syslog TLS listener")
+	flag.StringVar(&flagSyslogTlsKeyFile, "syslog-tls-key-file", "", "PEM private key for the Syslog TLS listener")
+	flag.StringVar(&flagSyslogTlsClientCAFile, "syslog-tls-client-ca-file", "", "When set, Syslog TLS clients must present a certificate signed by this PEM CA")
+	flag.StringVar(&flagS3VideoBucketUrl, "s3-video-bucket-url", "", "Video storage URL like s3://bucket/some/prefix or file:///mnt/nas/videos")
+	flag.StringVar(&flagS3IndexBucketUrl, "s3-index-bucket-url", "", "Index storage URL like s3://bucket/some/prefix or file:///mnt/nas/indexes")
+	flag.StringVar(&flagS3Endpoint, "s3-endpoint", "", "Base URL of an S3-compatible service, like http://minio:9000, to use instead of AWS")
+	flag.StringVar(&flagS3Region, "s3-region", "", "S3 region, defaults to the AWS configuration's region then us-west-2")
+	flag.BoolVar(&flagS3PathStyle, "s3-path-style", false, "Address S3 buckets by path instead of virtual host, as MinIO requires")
+	flag.DurationVar(&flagConsolidationInterval, "consolidation-interval", flagConsolidationInterval, "Submits event datatpoints to indexEventApiUrl after each interval")
 	flag.StringVar(&flagIndexEventApiUrl, "index-event-api-url", "", "URL to post indexed event metrics to")
 	flag.StringVar(&flagIndexEventApiAuthorization, "index-event-api-authorization", "", "Authorization header value to send when posting metrics")
+	flag.StringVar(&flagInfluxUrl, "influx-url", "", "InfluxDB write URL, like http://influx:8086/api/v2/write?org=home&bucket=homewatch, to write metrics to")
+	flag.StringVar(&flagInfluxToken, "influx-token", "", "InfluxDB API token")
+	flag.StringVar(&flagPushgatewayUrl, "pushgateway-url", "", "Prometheus pushgateway URL, like http://pushgateway:9091, to push metrics to")
+	flag.DurationVar(&flagPublishTimeout, "publish-timeout", flagPublishTimeout, "How long each request publishing metrics may take")
+	flag.IntVar(&flagPublishMaxAttempts, "publish-max-attempts", flagPublishMaxAttempts, "Attempts to make posting each window of metrics to indexEventApiUrl")
+	flag.BoolVar(&flagPublishGzip, "publish-gzip", false, "Gzip the metrics posted to indexEventApiUrl")
+	flag.StringVar(&flagPublishBufferPath, "publish-buffer-path", "", "Directory to keep metrics which couldn't be posted to indexEventApiUrl in until it can be reached")
+	flag.StringVar(&flagNDJSONPath, "ndjson-path", "", "File to append metrics to as JSON lines, rotated once it's larger than 100MiB")
 
 	flag.BoolVar(&flagCleanupIndexFiles, "cleanup-index-files", false, "Cleanup index files after reading or trying to read them")
 	flag.BoolVar(&flagCleanupVideoFiles, "cleanup-video-files", false, "Cleanup video files after uploading or trying to upload")
@@ -58,136 +122,444 @@ func parseFlags() {
 
 	flag.BoolVar(&flagEnableVideoUpload, "enable-video-upload", false, "When true, upload videos to the provided S3 Video Bucket")
 	flag.BoolVar(&flagDecodeVideo, "decode-video", false, "When true, decode videos from DAV to H264 before uploading")
+	flag.StringVar(&flagFFmpegPath, "ffmpeg-path", flagFFmpegPath, "ffmpeg executable used to decode videos")
+	flag.IntVar(&flagTranscodeWorkers, "transcode-workers", flagTranscodeWorkers, "Videos to decode at the same time")
+	flag.BoolVar(&flagUploadOriginal, "upload-original-video", false, "When decoding videos, upload the original DAV alongside the MP4 instead of only the MP4")
+	flag.BoolVar(&flagVideoSidecar, "video-sidecar", false, "Upload a JSON summary of each video's index file next to the video")
 	flag.BoolVar(&flagEnableEventUpload, "enable-event-upload", false, "When true upload events to the IndexEventApiUrl")
 	flag.StringVar(&flagVideoTrimPrefix, "video-trim-prefix", "", "Prefix to trim from uploaded videos")
 	flag.StringVar(&flagIndexTrimPrefix, "index-trim-prefix", "", "Prefix to trim from uploaded indexes")
+	flag.StringVar(&flagIndexInvalidLines, "index-invalid-lines", flagIndexInvalidLines, "When reading index files, fail the file, stop at or skip invalid lines")
+	flag.StringVar(&flagDeadLetterPath, "dead-letter-path", "", "Directory to move files to once their upload attempts are exhausted")
+	flag.IntVar(&flagUploadMaxAttempts, "upload-max-attempts", flagUploadMaxAttempts, "Attempts to make uploading each file")
+	flag.DurationVar(&flagUploadRetryBaseDelay, "upload-retry-base-delay", flagUploadRetryBaseDelay, "Wait before the first upload retry, doubling each retry")
+	flag.DurationVar(&flagUploadRetryMaxDelay, "upload-retry-max-delay", flagUploadRetryMaxDelay, "Longest wait between upload retries")
+	flag.Int64Var(&flagMultipartPartSize, "multipart-part-size", flagMultipartPartSize, "Files larger than this many bytes are uploaded in parts of this size, at least 5MiB")
+	flag.IntVar(&flagMultipartConcurrency, "multipart-concurrency", flagMultipartConcurrency, "Parts of each file to upload at the same time")
+	flag.StringVar(&flagUploadStatePath, "upload-state-path", "", "Directory to record completed parts in so interrupted multipart uploads resume")
+	flag.StringVar(&flagStatePath, "state-path", "", "File to record each index and video file's lifecycle in, which drives the v2 reapers")
+	flag.DurationVar(&flagShutdownTimeout, "shutdown-timeout", flagShutdownTimeout, "How long shutdown waits for uploads to finish before cancelling them")
+	flag.StringVar(&flagQueuePath, "queue-path", "", "Directory to durably queue index and video events in so they're replayed after a restart")
 
 	flag.BoolVar(&flagEnableV2, "v2", false, "Enable v2 API")
 	flag.StringVar(&flagV2WatchPaths, "v2-watch-paths", "", "Comma separated list of paths to watch for changes")
+	flag.StringVar(&flagV2WatchMode, "v2-watch-mode", flagV2WatchMode, "Be notified of files in the watch paths, poll them, or both, with poll for NFS and SMB")
+	flag.DurationVar(&flagV2ScanInterval, "v2-scan-interval", flagV2ScanInterval, "How often to poll the watch paths")
+	flag.StringVar(&flagV2SeenFilesPath, "v2-seen-files-path", "", "File to record polled files in so they're not reported again after a restart")
 	flag.BoolVar(&flagV2EnableMetrics, "v2-enable-metrics", false, "Enable prometheus metrics")
+	flag.StringVar(&flagV2MetricsAddress, "v2-metrics-address", flagV2MetricsAddress, "IP:Port to serve prometheus metrics on")
 	flag.BoolVar(&flagV2EnableWatchReaper, "v2-enable-watch-reaper", false, "Enable watch reaper")
-	flag.BoolVar(&flagV2EnableUploadReaper, "v2-enable-upload-reaper", false, "Enable upload reaper")
-	flag.Parse()
-	if len(strings.Split(flagSyslogServerAddress, ":")) != 2 {
-		panic(fmt.Sprintf("Invalid syslogserveraddress: %s", flagSyslogServerAddress))
+	flag.DurationVar(&flagV2WatchMaxAge, "v2-watch-max-age", flagV2WatchMaxAge, "How long the watch reaper keeps a directory's watch")
+	flag.BoolVar(&flagV2EnableUploadReaper, "v2-enable-upload-reaper", false, "Remove uploaded files after a week when there are no retention policies")
+	flag.BoolVar(&flagRetentionDryRun, "retention-dry-run", false, "Log the files retention would remove without removing them")
+	flag.StringVar(&flagApiAddress, "api-address", "", "IP:Port, like 127.0.0.1:2113, to serve the status and control API on")
+	flag.StringVar(&flagApiToken, "api-token", "", "Bearer token the status and control API requires")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [%s|%s]\n", os.Args[0], redriveDeadLettersCommand, enforceRetentionCommand)
+		flag.PrintDefaults()
 	}
+	flag.Parse()
+}
+
+// flagOverride: How the flag name changes the configuration
+type flagOverride struct {
+	name  string
+	apply func(*Config)
+}
 
-	if flagCleanupAllFiles {
-		flagCleanupIndexFiles = true
-		flagCleanupVideoFiles = true
+// eachPipeline: Apply a pipeline flag to every pipeline
+func eachPipeline(apply func(*PipelineConfig)) func(*Config) {
+	return func(c *Config) {
+		for i := range c.Pipelines {
+			apply(&c.Pipelines[i])
+		}
 	}
 }
 
-func debugFlags() {
-	log.Printf("SyslogServerAddress: %s", flagSyslogServerAddress)
-	log.Printf("S3VideoBucketUrl: %s", flagS3VideoBucketUrl)
-	log.Printf("S3IndexBucketUrl: %s", flagS3IndexBucketUrl)
-	log.Printf("IndexEventApiUrl: %s", flagIndexEventApiUrl)
-	log.Printf("CleanupIndexFiles: %v", flagCleanupIndexFiles)
-	log.Printf("CleanupVideoFiles: %v", flagCleanupVideoFiles)
-	log.Printf("CleanupAllFiles: %v", flagCleanupAllFiles)
-	log.Printf("DecodeVideo: %v", flagDecodeVideo)
-	log.Printf("EnableVideoUpload: %v", flagEnableVideoUpload)
-	log.Printf("EnableEventUpload: %v", flagEnableEventUpload)
-	log.Printf("VideoTrimPrefix: %s", flagVideoTrimPrefix)
-	log.Printf("DebugOutput: %v", flagDebug)
-	log.Printf("VerboseOutput: %v", flagVerbose)
+/*
+flagOverrides: What each flag configures. Without --config every flag
+configures the default pipeline, otherwise only flags which were set override
+the file, with pipeline flags applying to every pipeline.
+*/
+var flagOverrides = []flagOverride{
+	{"debug", func(c *Config) { c.Debug = flagDebug }},
+	{"vvv", func(c *Config) { c.Verbose = flagVerbose }},
+	{"verbose", func(c *Config) { c.Verbose = flagVerbose }},
+	{"queue-path", func(c *Config) { c.QueuePath = flagQueuePath }},
+	{"dead-letter-path", func(c *Config) { c.DeadLetterPath = flagDeadLetterPath }},
+	{"upload-state-path", func(c *Config) { c.UploadStatePath = flagUploadStatePath }},
+	{"publish-buffer-path", func(c *Config) { c.PublishBufferPath = flagPublishBufferPath }},
+	{"state-path", func(c *Config) { c.StatePath = flagStatePath }},
+	{"shutdown-timeout", func(c *Config) { c.ShutdownTimeout = Duration(flagShutdownTimeout) }},
+	{"s3-endpoint", func(c *Config) { c.Storage.S3Endpoint = flagS3Endpoint }},
+	{"s3-region", func(c *Config) { c.Storage.S3Region = flagS3Region }},
+	{"s3-path-style", func(c *Config) { c.Storage.S3PathStyle = flagS3PathStyle }},
+	{"upload-max-attempts", func(c *Config) { c.Storage.Retry.MaxAttempts = flagUploadMaxAttempts }},
+	{"upload-retry-base-delay", func(c *Config) { c.Storage.Retry.BaseDelay = Duration(flagUploadRetryBaseDelay) }},
+	{"upload-retry-max-delay", func(c *Config) { c.Storage.Retry.MaxDelay = Duration(flagUploadRetryMaxDelay) }},
+	{"multipart-part-size", func(c *Config) { c.Storage.Multipart.PartSize = flagMultipartPartSize }},
+	{"multipart-concurrency", func(c *Config) { c.Storage.Multipart.Concurrency = flagMultipartConcurrency }},
+
+	{"syslog-server-address", eachPipeline(func(p *PipelineConfig) { p.Syslog.Address = flagSyslogServerAddress })},
+	{"syslog-tcp-address", eachPipeline(func(p *PipelineConfig) { p.Syslog.TcpAddress = flagSyslogTcpAddress })},
+	{"syslog-tls-address", eachPipeline(func(p *PipelineConfig) { p.Syslog.Tls.Address = flagSyslogTlsAddress })},
+	{"syslog-tls-cert-file", eachPipeline(func(p *PipelineConfig) { p.Syslog.Tls.CertFile = flagSyslogTlsCertFile })},
+	{"syslog-tls-key-file", eachPipeline(func(p *PipelineConfig) { p.Syslog.Tls.KeyFile = flagSyslogTlsKeyFile })},
+	{"syslog-tls-client-ca-file", eachPipeline(func(p *PipelineConfig) { p.Syslog.Tls.ClientCAFile = flagSyslogTlsClientCAFile })},
+	{"enable-event-upload", eachPipeline(func(p *PipelineConfig) { p.Index.Upload = flagEnableEventUpload })},
+	{"s3-index-bucket-url", eachPipeline(func(p *PipelineConfig) { p.Index.StorageUrl = flagS3IndexBucketUrl })},
+	{"index-trim-prefix", eachPipeline(func(p *PipelineConfig) { p.Index.TrimPrefix = flagIndexTrimPrefix })},
+	{"index-invalid-lines", eachPipeline(func(p *PipelineConfig) { p.Index.InvalidLines = flagIndexInvalidLines })},
+	{"cleanup-index-files", eachPipeline(func(p *PipelineConfig) { p.Index.Cleanup = flagCleanupIndexFiles })},
+	{"enable-video-upload", eachPipeline(func(p *PipelineConfig) { p.Video.Upload = flagEnableVideoUpload })},
+	{"s3-video-bucket-url", eachPipeline(func(p *PipelineConfig) { p.Video.StorageUrl = flagS3VideoBucketUrl })},
+	{"video-trim-prefix", eachPipeline(func(p *PipelineConfig) { p.Video.TrimPrefix = flagVideoTrimPrefix })},
+	{"cleanup-video-files", eachPipeline(func(p *PipelineConfig) { p.Video.Cleanup = flagCleanupVideoFiles })},
+	{"cleanup-all-files", eachPipeline(func(p *PipelineConfig) {
+		if flagCleanupAllFiles {
+			p.Index.Cleanup = true
+			p.Video.Cleanup = true
+		}
+	})},
+	{"decode-video", eachPipeline(func(p *PipelineConfig) { p.Video.Transcode.Enabled = flagDecodeVideo })},
+	{"ffmpeg-path", eachPipeline(func(p *PipelineConfig) { p.Video.Transcode.FFmpegPath = flagFFmpegPath })},
+	{"transcode-workers", eachPipeline(func(p *PipelineConfig) { p.Video.Transcode.Workers = flagTranscodeWorkers })},
+	{"upload-original-video", eachPipeline(func(p *PipelineConfig) { p.Video.Transcode.UploadOriginal = flagUploadOriginal })},
+	{"video-sidecar", eachPipeline(func(p *PipelineConfig) { p.Video.Sidecar = flagVideoSidecar })},
+	{"index-event-api-url", eachPipeline(func(p *PipelineConfig) { p.Publisher.Url = flagIndexEventApiUrl })},
+	{"index-event-api-authorization", eachPipeline(func(p *PipelineConfig) { p.Publisher.Authorization = flagIndexEventApiAuthorization })},
+	{"influx-url", eachPipeline(func(p *PipelineConfig) { p.Publisher.Influx.Url = flagInfluxUrl })},
+	{"influx-token", eachPipeline(func(p *PipelineConfig) { p.Publisher.Influx.Token = flagInfluxToken })},
+	{"pushgateway-url", eachPipeline(func(p *PipelineConfig) { p.Publisher.Pushgateway.Url = flagPushgatewayUrl })},
+	{"publish-timeout", eachPipeline(func(p *PipelineConfig) { p.Publisher.Timeout = Duration(flagPublishTimeout) })},
+	{"publish-max-attempts", eachPipeline(func(p *PipelineConfig) { p.Publisher.Retry.MaxAttempts = flagPublishMaxAttempts })},
+	{"publish-gzip", eachPipeline(func(p *PipelineConfig) { p.Publisher.Gzip = flagPublishGzip })},
+	{"ndjson-path", eachPipeline(func(p *PipelineConfig) { p.Publisher.NDJSON.Path = flagNDJSONPath })},
+	{"consolidation-interval", eachPipeline(func(p *PipelineConfig) { p.Publisher.ConsolidationInterval = Duration(flagConsolidationInterval) })},
+
+	{"v2", func(c *Config) { c.V2.Enabled = flagEnableV2 }},
+	{"v2-watch-paths", func(c *Config) { c.V2.WatchPaths = splitList(flagV2WatchPaths) }},
+	{"v2-watch-mode", func(c *Config) { c.V2.WatchMode = flagV2WatchMode }},
+	{"v2-scan-interval", func(c *Config) { c.V2.ScanInterval = Duration(flagV2ScanInterval) }},
+	{"v2-seen-files-path", func(c *Config) { c.V2.SeenFilesPath = flagV2SeenFilesPath }},
+	{"v2-enable-metrics", func(c *Config) { c.V2.Metrics = flagV2EnableMetrics }},
+	{"v2-metrics-address", func(c *Config) { c.V2.MetricsAddress = flagV2MetricsAddress }},
+	{"v2-enable-watch-reaper", func(c *Config) { c.V2.WatchReaper = flagV2EnableWatchReaper }},
+	{"v2-watch-max-age", func(c *Config) { c.V2.WatchMaxAge = Duration(flagV2WatchMaxAge) }},
+	{"v2-enable-upload-reaper", func(c *Config) { c.V2.UploadReaper = flagV2EnableUploadReaper }},
+	{"retention-dry-run", func(c *Config) { c.Retention.DryRun = flagRetentionDryRun }},
+	{"api-address", func(c *Config) { c.Api.Address = flagApiAddress }},
+	{"api-token", func(c *Config) { c.Api.Token = flagApiToken }},
 }
-func tryCreateS3Uploader() *S3Uploader {
-	// Setup S3 uploader for video files
-	if flagEnableVideoUpload && strings.HasPrefix(flagS3VideoBucketUrl, "s3://") {
-		log.Printf("DEBUG: Creating S3 uploader for video files to %s", flagS3VideoBucketUrl)
-		uploader := NewS3Uploader(DefaultS3Client(), flagS3VideoBucketUrl)
-		uploader.TrimLocalPrefix(flagVideoTrimPrefix)
 
-		return uploader
+// splitList: The non-empty items of a comma separated list
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if len(item) > 0 {
+			items = append(items, item)
+		}
 	}
-	return nil
+	return items
 }
 
-func main() {
-	log.Printf("Starting Homewatch version %s", softwareVersion)
-	parseFlags()
-	if flagDebug {
-		debugFlags()
+// buildConfig: The validated configuration from --config and flags
+func buildConfig() (*Config, error) {
+	config := DefaultConfig()
+	if len(flagConfigPath) > 0 {
+		loaded, err := LoadConfig(flagConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		config = loaded
 	}
 
-	if flagEnableV2 {
-		var metrics *v2.CameraMetrics
-		log.Printf("Starting v2")
-		fileEvents := make(chan string, 1)
-		uploader := tryCreateS3Uploader()
-		if flagV2EnableMetrics {
-			// v2.MetricsPort = "2112"
-			metrics = v2.NewCameraMetrics(flagVideoTrimPrefix)
-			go metrics.Handle()
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for _, override := range flagOverrides {
+		if len(flagConfigPath) == 0 || set[override.name] {
+			override.apply(config)
 		}
-		if flagV2EnableWatchReaper {
-			go v2.WatchReaper()
+	}
+	return config, config.Validate()
+}
+
+// loadConfig: The configuration to start with, exiting when it's invalid
+func loadConfig() *Config {
+	config, err := buildConfig()
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	flagDebug = config.Debug
+	flagVerbose = config.Verbose
+	return config
+}
+
+// debugConfig: Log the configuration without publisher credentials or the API token
+func debugConfig(config *Config) {
+	redacted := *config
+	if len(redacted.Api.Token) > 0 {
+		redacted.Api.Token = "REDACTED"
+	}
+	redacted.Pipelines = make([]PipelineConfig, len(config.Pipelines))
+	for i, pipeline := range config.Pipelines {
+		if len(pipeline.Publisher.Authorization) > 0 {
+			pipeline.Publisher.Authorization = "REDACTED"
 		}
-		if flagV2EnableUploadReaper {
-			go v2.UploadReaper()
+		if len(pipeline.Publisher.Influx.Token) > 0 {
+			pipeline.Publisher.Influx.Token = "REDACTED"
 		}
+		redacted.Pipelines[i] = pipeline
+	}
+	b, _ := json.MarshalIndent(redacted, "", "  ")
+	log.Printf("Configuration: %s", b)
+}
 
-		go func() {
-			for fileEvent := range fileEvents {
-				log.Printf("DEBUG: File event: %s", fileEvent)
-				if flagV2EnableMetrics && metrics != nil {
-					log.Printf("DEBUG: Sending video event to metrics: %s", fileEvent)
-					metrics.VideoEvents <- fileEvent
-				}
+const redriveDeadLettersCommand = "redrive-dead-letters"
 
-				if uploader != nil {
-					go func(videoFilename string) {
-						done := make(chan int, 1)
-						log.Printf("DEBUG: Uploading file: %s", videoFilename)
-						go uploader.UploadFile(videoFilename, done)
-						<-done
-						log.Printf("DEBUG: Done uploading file: %s", videoFilename)
-						metrics.UploadEvents <- videoFilename
-					}(fileEvent)
-				}
+// redriveDeadLetters: Upload each pipeline's dead lettered index and video files to their storage URLs again
+func redriveDeadLetters(config *Config) {
+	if len(config.DeadLetterPath) == 0 {
+		log.Fatalf("--dead-letter-path is required to %s", redriveDeadLettersCommand)
+	}
+	failures := 0
+	for _, pipeline := range config.Pipelines {
+		buckets := []struct{ url, trimPrefix, fileType string }{
+			{pipeline.Index.StorageUrl, pipeline.Index.TrimPrefix, IndexFileType},
+			{pipeline.Video.StorageUrl, pipeline.Video.TrimPrefix, VideoFileType},
+		}
+		for _, bucket := range buckets {
+			if len(bucket.url) == 0 {
+				continue
 			}
-		}()
-		v2.Listen(fileEvents, strings.Split(flagV2WatchPaths, ",")...)
+			uploader := newUploader(config, pipeline, bucket.url, bucket.trimPrefix, bucket.fileType)
+			redriven, failed := uploader.RedriveDeadLetters()
+			log.Printf("INFO: Redrove %d %s %s dead letters to %s, %d still failing", redriven, pipeline.Name, bucket.fileType, bucket.url, failed)
+			failures += failed
+		}
+	}
+	if failures > 0 {
+		os.Exit(1)
+	}
+}
 
-		return
+const enforceRetentionCommand = "enforce-retention"
+
+// enforceRetention: Remove the uploaded files the retention policies don't keep once, or with --retention-dry-run list them
+func enforceRetention(config *Config) {
+	policies := config.RetentionPolicies()
+	if len(policies) == 0 {
+		log.Fatalf("retention.policies are required to %s", enforceRetentionCommand)
+	}
+	state, err := OpenStateStore(config.StatePath)
+	if err != nil {
+		log.Fatalf("Unable to read file state: %s", err)
+	}
+	defer state.Close()
+	retention := NewRetention(policies, config.RetentionPath(), state)
+	retention.DryRun = config.Retention.DryRun
+	removals, err := retention.Enforce()
+	bytes := int64(0)
+	for _, removal := range removals {
+		bytes += removal.Bytes
+	}
+	verb := "Removed"
+	if retention.DryRun {
+		verb = "Would remove"
 	}
-	log.Printf("Starting v1")
-	syslogServer := NewSyslogServer(flagSyslogServerAddress)
-	messageHandler := NewSyslogMessageHandler()
+	log.Printf("INFO: %s %d files, %d bytes", verb, len(removals), bytes)
+	if err != nil {
+		log.Fatalf("Unable to enforce retention: %s", err)
+	}
+}
+
+// metricsSampleInterval: How often the queue depth and free disk gauges are updated
+const metricsSampleInterval = 15 * time.Second
 
-	indexEventHandler := NewFileEventHandler(flagEnableEventUpload, messageHandler.IndexEvents)
-	videoEventHandler := NewVideoEventHandler(flagEnableVideoUpload, flagDecodeVideo, messageHandler.VideoEvents)
+// startMetrics: Count every pipeline's videos and uploads by camera and serve them on config's metrics address
+func startMetrics(config *Config, pipelines []*Pipeline) {
+	for _, pipeline := range pipelines {
+		metrics := v2.NewCameraMetrics(pipeline.Config.Video.TrimPrefix)
+		go metrics.Run()
+		pipeline.AddMetrics(metrics)
+	}
+	go sampleMetrics(metricsDiskPaths(config), pipelines)
 
-	// Setup S3 Uploader for index files
-	if flagEnableEventUpload && strings.HasPrefix(flagS3IndexBucketUrl, "s3://") {
-		uploader := NewS3Uploader(DefaultS3Client(), flagS3IndexBucketUrl)
-		uploader.TrimLocalPrefix(flagIndexTrimPrefix)
+	address := config.V2.MetricsAddress
+	go func() {
+		if err := v2.ServeMetrics(address, v2.NewMetricsServeMux()); err != nil {
+			log.Printf("ERROR: Unable to serve metrics on %s: %s", address, err)
+		}
+	}()
+}
 
-		indexEventHandler.AddUploader(uploader)
+// sampleMetrics: Update the queue depth of each pipeline and free space of each of paths, forever
+func sampleMetrics(paths []string, pipelines []*Pipeline) {
+	for {
+		for _, pipeline := range pipelines {
+			index, video := pipeline.QueueDepths()
+			v2.SetQueueDepth(pipeline.Config.Name, IndexFileType, index)
+			v2.SetQueueDepth(pipeline.Config.Name, VideoFileType, video)
+		}
+		for _, path := range paths {
+			free, total, err := diskUsage(path)
+			if err != nil {
+				if flagDebug {
+					log.Printf("DEBUG: Unable to measure free space on %s: %s", path, err)
+				}
+				continue
+			}
+			v2.SetDiskUsage(path, free, total)
+		}
+		time.Sleep(metricsSampleInterval)
 	}
+}
 
-	// Setup S3 uploader for video files
-	if flagEnableVideoUpload && strings.HasPrefix(flagS3VideoBucketUrl, "s3://") {
-		uploader := NewS3Uploader(DefaultS3Client(), flagS3VideoBucketUrl)
-		uploader.TrimLocalPrefix(flagVideoTrimPrefix)
+// metricsDiskPaths: The directories cameras record to, whose free space is measured
+func metricsDiskPaths(config *Config) []string {
+	paths := append([]string{config.Retention.Path}, config.V2.WatchPaths...)
+	for _, pipeline := range config.Pipelines {
+		paths = append(paths, pipeline.Index.TrimPrefix, pipeline.Video.TrimPrefix)
+	}
+	measured := []string{}
+	for _, path := range uniqueSorted(paths) {
+		if len(path) > 0 {
+			measured = append(measured, path)
+		}
+	}
+	return measured
+}
 
-		videoEventHandler.AddUploader(uploader)
+func main() {
+	log.Printf("Starting Homewatch version %s", softwareVersion)
+	parseFlags()
+	config := loadConfig()
+	if flagDebug {
+		debugConfig(config)
+	}
+	if flag.Arg(0) == redriveDeadLettersCommand {
+		redriveDeadLetters(config)
+		return
+	}
+	if flag.Arg(0) == enforceRetentionCommand {
+		enforceRetention(config)
+		return
+	}
 
+	var alerter *Alerter
+	if config.V2.Enabled {
+		log.Printf("Starting v2")
+	} else {
+		log.Printf("Starting v1")
+	}
+	if len(config.Alerts.Rules) > 0 {
+		var err error
+		if alerter, err = NewAlerter(config.Alerts); err != nil {
+			log.Fatalf("Unable to alert: %s", err)
+		}
+	}
+	var state *StateStore
+	if len(config.StatePath) > 0 {
+		var err error
+		if state, err = OpenStateStore(config.StatePath); err != nil {
+			log.Fatalf("Unable to record file state: %s", err)
+		}
+		defer state.Close()
+		v2.SetState(state)
+		go forgetReaped(state)
+	}
+	var liveness *LivenessTracker
+	if config.Alerts.Liveness.Enabled {
+		var err error
+		if liveness, err = NewLivenessTracker(config.Alerts.Liveness, config.Alerts.Sinks); err != nil {
+			log.Fatalf("Unable to follow camera liveness: %s", err)
+		}
+		go liveness.Run()
+	}
+	gate := NewUploadGate()
+	pipelines := []*Pipeline{}
+	for _, pipelineConfig := range config.Pipelines {
+		pipeline := NewPipeline(config, pipelineConfig, newEventSource(config, pipelineConfig))
+		pipeline.AddUploadGate(gate)
+		if alerter != nil {
+			pipeline.AddAlerter(alerter)
+		}
+		if state != nil {
+			pipeline.AddStateStore(state)
+		}
+		if liveness != nil {
+			pipeline.AddLiveness(liveness)
+		}
+		pipelines = append(pipelines, pipeline)
+	}
+	if config.V2.Metrics {
+		startMetrics(config, pipelines)
+	}
+	var api *Api
+	if len(config.Api.Address) > 0 {
+		api = NewApi(config.Api, pipelines, gate)
+		api.AddStateStore(state)
+		api.AddLiveness(liveness)
+		go api.Serve()
+	}
+	if config.V2.WatchReaper {
+		go v2.WatchReaper(time.Duration(config.V2.WatchMaxAge))
+	}
+	if policies := config.RetentionPolicies(); len(policies) > 0 {
+		retention := NewRetention(policies, config.RetentionPath(), state)
+		retention.DryRun = config.Retention.DryRun
+		go retention.Run(time.Duration(config.Retention.Interval))
+	}
+	for _, pipeline := range pipelines {
+		pipeline.Start()
 	}
-	go videoEventHandler.Listen()
-	go indexEventHandler.Listen()
-	go messageHandler.Run()
-	go syslogServer.Serve(messageHandler.Messages)
 
 	signals := make(chan os.Signal, 1)
-	go func() {
-		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
-	}()
-	defer close(signals)
-	<-signals
-	indexEventHandler.Stop()
-	syslogServer.Stop()
-	log.Printf("Shutdown server")
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		log.Printf("INFO: Reloading configuration")
+		config = reloadConfig(config, pipelines)
+	}
+	signal.Stop(signals)
+
+	log.Printf("INFO: Shutting down, waiting up to %s for files being handled", config.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.ShutdownTimeout))
+	defer cancel()
+	unfinished := []string{}
+	// Pipelines drain at the same time so they share the deadline
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	if api != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			api.Close(ctx)
+		}()
+	}
+	for _, pipeline := range pipelines {
+		wg.Add(1)
+		go func(pipeline *Pipeline) {
+			defer wg.Done()
+			files := pipeline.Shutdown(ctx)
+			lock.Lock()
+			unfinished = append(unfinished, files...)
+			lock.Unlock()
+		}(pipeline)
+	}
+	wg.Wait()
+	if alerter != nil {
+		alerter.Close(ctx)
+	}
+	if liveness != nil {
+		liveness.Close(ctx)
+	}
+	for _, filepath := range unfinished {
+		log.Printf("WARN: Not finished: %s", filepath)
+	}
+	log.Printf("Shutdown server, %d files not finished", len(unfinished))
 }
@@ -1,11 +1,9 @@
 package main
 
 import (
-	"fmt"
 	"log"
 	"regexp"
 	"strings"
-
 	"time"
 )
 
@@ -18,6 +16,15 @@ type SyslogMessage struct {
 	Action    string
 	Message   string
 	Command   string
+
+	Format   SyslogFormat
+	Priority int
+	Facility int
+	Severity int
+	// Version, MsgID, StructuredData: Only set by RFC 5424 messages
+	Version        int
+	MsgID          string
+	StructuredData map[string]map[string]string
 }
 type RenameMessage struct {
 	SyslogMessage
@@ -48,31 +55,12 @@ const (
 )
 
 var (
-	dateDecoderV1 = regexp.MustCompile(`^<(?P<code>\d+)>(?P<month>[A-Z][a-z]*)\ *(?P<dom>\d{1,2})\ (?P<hms>\d{1,2}:\d{1,2}:\d{1,2})\ *(?P<rest>.*$)`)
 	dataDecoderV2 = regexp.MustCompile(`^(?P<code>\d+) (?P<dateTime>\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2} [+-]\d{4} UTC)\ *(?P<rest>.*$)`)
-	bodyDecoderV1 = regexp.MustCompile(`(?P<logHost>\w+)\ *(?P<service>[\w-]*)\[(?P<pid>\d+)\]:\ *(?P<cmd>[\w-]*)\ *(?P<action>.*$)`)
 	bodyDecoderV2 = regexp.MustCompile(`^(?P<logHost>\w+)[\t\ ]*(?P<service>[\w-]*)[\t\ ]*(?P<pid>\d+)[\t\ ]*(?P<cmd>[\w-]*)\ *(?P<action>.*$)`)
-	dateDecoders  = []*regexp.Regexp{dateDecoderV1, dataDecoderV2}
-	bodyDecoders  = []*regexp.Regexp{bodyDecoderV1, bodyDecoderV2}
-	timeFormats   = []string{
-		// dateDecoderV1
-		"Jan 2, 2006 15:04:05 MST",
-		// dateDecoderV2
-		"2006-01-02 15:04:05 -0700 UTC",
-	}
-	timeStringers = []func() string{
-		// dataDecoderV1
-		func() string {
-			zone, _ := time.Now().Zone()
-			return fmt.Sprintf("$month $dom, %d $hms %s", time.Now().Local().Year(), zone)
-		},
-		// dateDecoderV2
-		func() string {
-			return "$dateTime"
-		},
-	}
 )
 
+const legacyTimeFormat = "2006-01-02 15:04:05 -0700 UTC"
+
 func NewSyslogMessage(b []byte) *SyslogMessage {
 	m := &SyslogMessage{}
 	if err := m.UnmarshalText(b); err != nil {
@@ -85,32 +73,6 @@ func NewSyslogMessage(b []byte) *SyslogMessage {
 	return m
 }
 
-func extractTime(logMessage string, matches [][]int) *time.Time {
-
-	output := []byte{}
-	var t time.Time
-	for i, decoder := range dateDecoders {
-		template := timeStringers[i]()
-		date := decoder.ExpandString(output, template, logMessage, matches[0])
-
-		_t, err := time.Parse(timeFormats[i], string(date))
-		if err != nil {
-			if flagDebug {
-				log.Printf("Failed to parse %s: %s", string(date), err)
-			}
-
-			continue
-		}
-		if flagVerbose {
-			log.Printf("[%s] Parsed log message time from %s", string(date), logMessage)
-		}
-		t = _t
-		break
-	}
-
-	return &t
-}
-
 func (m *SyslogMessage) RenameMessage() *RenameMessage {
 	if flagDebug {
 		log.Printf("Command: %s", m.Command)
@@ -124,6 +86,9 @@ func (m *SyslogMessage) RenameMessage() *RenameMessage {
 	if flagVerbose {
 		log.Printf("Parts: %#v", parts)
 	}
+	if len(parts) < 4 {
+		return nil
+	}
 	return &RenameMessage{
 		SyslogMessage: *m,
 		Src:           strings.Trim(parts[1], "\""),
@@ -136,6 +101,9 @@ func (m *SyslogMessage) PutMessage() *PutMessage {
 		return nil
 	}
 	parts := strings.Split(m.Action, " ")
+	if len(parts) < 3 {
+		return nil
+	}
 
 	return &PutMessage{
 		SyslogMessage: *m,
@@ -147,63 +115,9 @@ func (m *SyslogMessage) PutMessage() *PutMessage {
 }
 
 func (m *SyslogMessage) UnmarshalText(b []byte) error {
-	var (
-		dateDecoder *regexp.Regexp
-		matches     = [][]int{}
-	)
-
-	logMessage := string(b)
-
-	for i, decoder := range dateDecoders {
-
-		matches = decoder.FindAllStringSubmatchIndex(logMessage, -1)
-		if len(matches) != 1 {
-			if flagVerbose {
-				log.Printf("No matches for decoder %d with %s", i, logMessage)
-			}
-			continue
-		}
-		if flagVerbose {
-			log.Printf("Matched decoder %d", i)
-		}
-		dateDecoder = decoder
-		break
-	}
-	messageTime := extractTime(logMessage, matches)
-
-	m.Timestamp = *messageTime
-	m.Code = string(dateDecoder.ExpandString([]byte{}, "$code", logMessage, matches[0]))
-	m.Message = string(dateDecoder.ExpandString([]byte{}, "$rest", logMessage, matches[0]))
-
-	if flagVerbose {
-		log.Printf("Decoding: %s", m.Message)
-	}
-	var (
-		bodyDecoder *regexp.Regexp
-		bodyMatches []string
-	)
-	for i, decoder := range bodyDecoders {
-		bm := decoder.FindAllStringSubmatch(m.Message, -1)
-		if flagVerbose {
-			log.Printf("BM: %#v\n", bm)
-		}
-		if len(bm) != 1 {
-			if flagDebug {
-				log.Printf("invalid log message body for decoder %d", i)
-			}
-			continue
-		}
-
-		bodyDecoder = decoder
-		bodyMatches = bm[0]
-		break
+	if err := parseSyslogMessage(m, b); err != nil {
+		return err
 	}
-	m.Command = bodyMatches[bodyDecoder.SubexpIndex("cmd")]
-	m.LogHost = bodyMatches[bodyDecoder.SubexpIndex("logHost")]
-	m.Service = bodyMatches[bodyDecoder.SubexpIndex("service")]
-	m.PID = bodyMatches[bodyDecoder.SubexpIndex("pid")]
-	m.Action = bodyMatches[bodyDecoder.SubexpIndex("action")]
-
 	if flagVerbose {
 		log.Printf("Message: %#v", m)
 	}
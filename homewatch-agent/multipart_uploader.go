@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	// MinMultipartPartSize: S3 rejects parts, other than the last, smaller than 5MiB
+	MinMultipartPartSize     = 5 * 1024 * 1024
+	DefaultMultipartPartSize = 16 * 1024 * 1024
+	maxMultipartParts        = 10000
+	// multipartAbortTimeout: How long aborting an upload may take, even once the upload's context is done
+	multipartAbortTimeout = 30 * time.Second
+)
+
+// MultipartOptions: How S3Storage splits files larger than PartSize
+type MultipartOptions struct {
+	PartSize int64
+	// Concurrency: Parts of one file uploaded at the same time
+	Concurrency int
+	// StatePath: Directory completed parts are recorded in so an interrupted
+	// upload resumes after its last completed part
+	StatePath string
+}
+
+// multipartState: Progress of one multipart upload, persisted after every part
+type multipartState struct {
+	Bucket   string
+	Key      string
+	UploadID string
+	Size     int64
+	ModTime  time.Time
+	PartSize int64
+	// SHA256: Hex SHA-256 of the whole file
+	SHA256 string
+	Parts  map[int32]string
+	// Checksums: Base64 SHA-256 of each uploaded part
+	Checksums map[int32]string
+}
+
+func (o MultipartOptions) partSize(size int64) int64 {
+	partSize := o.PartSize
+	if partSize < MinMultipartPartSize {
+		partSize = MinMultipartPartSize
+	}
+	// Grow parts for files which would need more than S3's part limit
+	for size/partSize >= maxMultipartParts {
+		partSize *= 2
+	}
+	return partSize
+}
+
+func (o MultipartOptions) statePath(bucket, key string) string {
+	if len(o.StatePath) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(bucket + "/" + key))
+	return filepath.Join(o.StatePath, hex.EncodeToString(sum[:])+".json")
+}
+
+func loadMultipartState(path string) *multipartState {
+	if len(path) == 0 {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("WARN: Unable to read multipart upload state %s: %s", path, err)
+		}
+		return nil
+	}
+	state := &multipartState{}
+	if err := json.Unmarshal(b, state); err != nil {
+		log.Printf("WARN: Ignoring unreadable multipart upload state %s: %s", path, err)
+		return nil
+	}
+	return state
+}
+
+// save: Write state to path, replacing the previous state atomically
+func (state *multipartState) save(path string) error {
+	if len(path) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (state *multipartState) matches(bucket, key string, info os.FileInfo, partSize int64, sum string) bool {
+	return state.Bucket == bucket &&
+		state.Key == key &&
+		state.Size == info.Size() &&
+		state.ModTime.Equal(info.ModTime()) &&
+		state.PartSize == partSize &&
+		state.SHA256 == sum
+}
+
+func isNoSuchUpload(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchUpload"
+}
+
+/*
+putMultipart: Upload body in parts, resuming an earlier upload of the same
+unchanged file from its persisted state. State is kept when a part fails so the
+next attempt, or the next agent, picks up where this one stopped. Without a
+StatePath nothing can resume, so a failed upload is aborted rather than left
+holding the parts S3 bills for.
+*/
+func (s *S3Storage) putMultipart(ctx context.Context, body *os.File, info os.FileInfo, key string, sum []byte) (string, error) {
+	partSize := s.Multipart.partSize(info.Size())
+	statePath := s.Multipart.statePath(s.Bucket, key)
+	hexSum := hex.EncodeToString(sum)
+
+	state := loadMultipartState(statePath)
+	if state != nil && !state.matches(s.Bucket, key, info, partSize, hexSum) {
+		log.Printf("INFO: Restarting multipart upload of %s, the file changed since upload %s started", key, state.UploadID)
+		s.abortMultipart(state)
+		state = nil
+	}
+	if state == nil {
+		output, err := s.s3Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:       &s.Bucket,
+			Key:          &key,
+			StorageClass: types.StorageClassIntelligentTiering,
+			// Each part is verified against its own checksum
+			ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+			Metadata:          map[string]string{checksumMetadataKey: hexSum},
+		})
+		if err != nil {
+			return "", fmt.Errorf("unable to create multipart upload: %w", err)
+		}
+		state = &multipartState{
+			Bucket:    s.Bucket,
+			Key:       key,
+			UploadID:  *output.UploadId,
+			Size:      info.Size(),
+			ModTime:   info.ModTime(),
+			PartSize:  partSize,
+			SHA256:    hexSum,
+			Parts:     map[int32]string{},
+			Checksums: map[int32]string{},
+		}
+		if err := state.save(statePath); err != nil {
+			log.Printf("WARN: Unable to save multipart upload state %s, upload won't resume: %s", statePath, err)
+		}
+	} else {
+		log.Printf("INFO: Resuming multipart upload %s of %s with %d parts done", state.UploadID, key, len(state.Parts))
+	}
+
+	if err := s.uploadParts(ctx, body, state, statePath); err != nil {
+		if isNoSuchUpload(err) {
+			os.Remove(statePath)
+		} else if len(statePath) == 0 {
+			s.abortMultipart(state)
+		}
+		return "", err
+	}
+
+	completed := make([]types.CompletedPart, 0, len(state.Parts))
+	for partNumber, etag := range state.Parts {
+		completed = append(completed, types.CompletedPart{
+			ETag:           aws.String(etag),
+			PartNumber:     partNumber,
+			ChecksumSHA256: aws.String(state.Checksums[partNumber]),
+		})
+	}
+	sort.Slice(completed, func(i, j int) bool { return completed[i].PartNumber < completed[j].PartNumber })
+	output, err := s.s3Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &s.Bucket,
+		Key:             &key,
+		UploadId:        &state.UploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		if isNoSuchUpload(err) {
+			os.Remove(statePath)
+		} else if len(statePath) == 0 {
+			s.abortMultipart(state)
+		}
+		return "", fmt.Errorf("unable to complete multipart upload %s: %w", state.UploadID, err)
+	}
+	if len(statePath) > 0 {
+		os.Remove(statePath)
+	}
+	return aws.ToString(output.ETag), nil
+}
+
+// uploadParts: Upload the parts missing from state, Concurrency at a time
+func (s *S3Storage) uploadParts(ctx context.Context, body *os.File, state *multipartState, statePath string) error {
+	concurrency := s.Multipart.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var (
+		lock      sync.Mutex
+		wg        sync.WaitGroup
+		firstErr  error
+		semaphore = make(chan struct{}, concurrency)
+	)
+	partCount := int32((state.Size + state.PartSize - 1) / state.PartSize)
+	for partNumber := int32(1); partNumber <= partCount; partNumber++ {
+		lock.Lock()
+		_, done := state.Parts[partNumber]
+		failed := firstErr != nil
+		lock.Unlock()
+		if failed {
+			break
+		}
+		if done {
+			continue
+		}
+
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(partNumber int32) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			offset := int64(partNumber-1) * state.PartSize
+			length := state.PartSize
+			if offset+length > state.Size {
+				length = state.Size - offset
+			}
+			part := io.NewSectionReader(body, offset, length)
+			checksum, err := partSHA256(part)
+			var output *s3.UploadPartOutput
+			if err == nil {
+				output, err = s.s3Client.UploadPart(ctx, &s3.UploadPartInput{
+					Bucket:            &s.Bucket,
+					Key:               &state.Key,
+					UploadId:          &state.UploadID,
+					PartNumber:        partNumber,
+					ContentLength:     length,
+					Body:              part,
+					ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+					ChecksumSHA256:    aws.String(checksum),
+				})
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("unable to upload part %d of %d: %w", partNumber, partCount, err)
+				}
+				return
+			}
+			state.Parts[partNumber] = *output.ETag
+			state.Checksums[partNumber] = checksum
+			if err := state.save(statePath); err != nil {
+				log.Printf("WARN: Unable to save multipart upload state %s: %s", statePath, err)
+			}
+			if flagVerbose {
+				log.Printf("Uploaded part %d of %d of %s", partNumber, partCount, state.Key)
+			}
+		}(partNumber)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// partSHA256: The base64 SHA-256 of part, read before the part is uploaded since S3 takes it as a header, then rewound for uploading
+func partSHA256(part *io.SectionReader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, part); err != nil {
+		return "", err
+	}
+	if _, err := part.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+/*
+Abandon: Abort the multipart upload saved for key, and remove its state, once
+the Uploader has given up on the file so its parts aren't kept
+*/
+func (s *S3Storage) Abandon(key string) {
+	if s.Multipart == nil {
+		return
+	}
+	statePath := s.Multipart.statePath(s.Bucket, s.objectKey(key))
+	state := loadMultipartState(statePath)
+	if state == nil {
+		return
+	}
+	log.Printf("INFO: Aborting multipart upload %s of %s, the upload was given up on", state.UploadID, state.Key)
+	s.abortMultipart(state)
+	os.Remove(statePath)
+}
+
+// abortMultipart: Abort state's upload with a context of its own, so it's aborted even once the upload was cancelled
+func (s *S3Storage) abortMultipart(state *multipartState) {
+	ctx, cancel := context.WithTimeout(context.Background(), multipartAbortTimeout)
+	defer cancel()
+	_, err := s.s3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   &state.Bucket,
+		Key:      &state.Key,
+		UploadId: &state.UploadID,
+	})
+	if err != nil && !isNoSuchUpload(err) {
+		log.Printf("WARN: Unable to abort multipart upload %s of %s: %s", state.UploadID, state.Key, err)
+	}
+}
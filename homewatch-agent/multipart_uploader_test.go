@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMultipartUploadResumes(t *testing.T) {
+	client := &MockS3Client{FailPart: 3, Puts: map[string]string{}}
+	uploader, root := newTestUploader(t, client)
+	uploader.Retry = Backoff{MaxAttempts: 1}
+	uploader.DeadLetterPath = ""
+	uploader.Storage.(*S3Storage).Multipart = &MultipartOptions{
+		PartSize:    MinMultipartPartSize,
+		Concurrency: 1,
+		StatePath:   filepath.Join(root, "uploads"),
+	}
+	content := bytes.Repeat([]byte("0123456789abcdef"), (2*MinMultipartPartSize+1024)/16)
+	video := filepath.Join(root, "cameras", "Camera1", "a.dav")
+	writeTestFile(t, video, string(content))
+
+	// Like an agent stopped part way through, which keeps the upload to resume
+	body, err := os.Open(video)
+	if err != nil {
+		t.Fatalf("Unable to open %s: %s", video, err)
+	}
+	sum, _ := fileSHA256(body)
+	_, err = uploader.Storage.Put(uploader.Context, "Camera1/a.dav", body, sum)
+	body.Close()
+	if err == nil {
+		t.Fatalf("Expected the interrupted upload to fail")
+	}
+	states, _ := filepath.Glob(filepath.Join(root, "uploads", "*.json"))
+	if len(states) != 1 {
+		t.Fatalf("Expected the upload progress to be saved, got %v", states)
+	}
+
+	// A restarted agent has a new uploader but the same state path
+	restarted := *uploader
+	if status := uploadFile(video, &restarted); status != DoneUploadVideoFile {
+		t.Fatalf("Expected the resumed upload to finish, got %d", status)
+	}
+	if client.PartUploads != 4 {
+		t.Fatalf("Expected parts 1 and 2 once and part 3 twice, got %d part uploads", client.PartUploads)
+	}
+	if body := client.Puts["prefix/Camera1/a.dav"]; body != string(content) {
+		t.Fatalf("Expected the parts to reassemble the file, got %d bytes", len(body))
+	}
+	if states, _ := filepath.Glob(filepath.Join(root, "uploads", "*.json")); len(states) != 0 {
+		t.Fatalf("Expected the upload progress to be removed, got %v", states)
+	}
+}
+
+func TestMultipartUploadAbortsWithoutStatePath(t *testing.T) {
+	client := &MockS3Client{FailPart: 2, Puts: map[string]string{}}
+	uploader, root := newTestUploader(t, client)
+	uploader.Retry = Backoff{MaxAttempts: 2}
+	uploader.Storage.(*S3Storage).Multipart = &MultipartOptions{PartSize: MinMultipartPartSize, Concurrency: 1}
+	video := filepath.Join(root, "cameras", "Camera1", "a.dav")
+	writeTestFile(t, video, string(bytes.Repeat([]byte("a"), MinMultipartPartSize+1)))
+
+	if status := uploadFile(video, uploader); status != DoneUploadVideoFile {
+		t.Fatalf("Expected the retried upload to finish, got %d", status)
+	}
+	if len(client.Aborted) != 1 || client.Aborted[0] != "upload-1" {
+		t.Fatalf("Expected the failed attempt's upload to be aborted, got %v", client.Aborted)
+	}
+}
+
+func TestMultipartUploadAbortedWhenGivenUp(t *testing.T) {
+	client := &MockS3Client{FailPart: 2, Puts: map[string]string{}}
+	uploader, root := newTestUploader(t, client)
+	uploader.Retry = Backoff{MaxAttempts: 1}
+	uploader.Storage.(*S3Storage).Multipart = &MultipartOptions{
+		PartSize:    MinMultipartPartSize,
+		Concurrency: 1,
+		StatePath:   filepath.Join(root, "uploads"),
+	}
+	video := filepath.Join(root, "cameras", "Camera1", "a.dav")
+	writeTestFile(t, video, string(bytes.Repeat([]byte("a"), MinMultipartPartSize+1)))
+
+	if status := uploadFile(video, uploader); status != DeadLetterVideoFile {
+		t.Fatalf("Expected the upload to be given up on, got %d", status)
+	}
+	if len(client.Aborted) != 1 || client.Aborted[0] != "upload-1" {
+		t.Fatalf("Expected the given up upload to be aborted, got %v", client.Aborted)
+	}
+	if states, _ := filepath.Glob(filepath.Join(root, "uploads", "*.json")); len(states) != 0 {
+		t.Fatalf("Expected the given up upload's progress to be removed, got %v", states)
+	}
+}
+
+func TestMultipartUploadRestartsChangedFile(t *testing.T) {
+	client := &MockS3Client{FailPart: 2, Puts: map[string]string{}}
+	uploader, root := newTestUploader(t, client)
+	uploader.Retry = Backoff{MaxAttempts: 1}
+	uploader.DeadLetterPath = ""
+	uploader.Storage.(*S3Storage).Multipart = &MultipartOptions{
+		PartSize:    MinMultipartPartSize,
+		Concurrency: 2,
+		StatePath:   filepath.Join(root, "uploads"),
+	}
+	video := filepath.Join(root, "cameras", "Camera1", "a.dav")
+	writeTestFile(t, video, string(bytes.Repeat([]byte("a"), MinMultipartPartSize+1)))
+	uploadFile(video, uploader)
+
+	content := bytes.Repeat([]byte("b"), MinMultipartPartSize+2)
+	writeTestFile(t, video, string(content))
+	if status := uploadFile(video, uploader); status != DoneUploadVideoFile {
+		t.Fatalf("Expected the restarted upload to finish, got %d", status)
+	}
+	if body := client.Puts["prefix/Camera1/a.dav"]; body != string(content) {
+		t.Fatalf("Expected only the changed file's parts, got %d bytes", len(body))
+	}
+}
+
+func TestMultipartPartSize(t *testing.T) {
+	options := MultipartOptions{PartSize: 1}
+	if size := options.partSize(1024); size != MinMultipartPartSize {
+		t.Fatalf("Expected the minimum part size, got %d", size)
+	}
+	large := int64(MinMultipartPartSize) * maxMultipartParts * 3
+	if size := options.partSize(large); large/size >= maxMultipartParts {
+		t.Fatalf("Expected fewer than %d parts, got %d", maxMultipartParts, large/size)
+	}
+}
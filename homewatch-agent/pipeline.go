@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	v2 "github.com/mrmod/homewatch/v2"
+)
+
+// File types, which name each pipeline's queues, uploaders and their dead letters, and which retention policies match
+const (
+	IndexFileType = "index"
+	VideoFileType = "video"
+)
+
+// fileTypeOf: The file type of the index file, video or transcoded video at path, or "" for any other file
+func fileTypeOf(path string) string {
+	switch {
+	case isIndexFilePath(path):
+		return IndexFileType
+	case isVideoFilePath(path) || strings.EqualFold(filepath.Ext(path), transcodedVideoExtension):
+		return VideoFileType
+	}
+	return ""
+}
+
+var ErrNoPublisher = errors.New("the pipeline has no publisher")
+
+/*
+Pipeline: An EventSource and the handlers uploading and publishing the index
+and video files it reports, built from one PipelineConfig
+*/
+type Pipeline struct {
+	Config            PipelineConfig
+	source            EventSource
+	indexFiles        chan string
+	videoFiles        chan string
+	indexedEvents     chan *IndexedEvent
+	indexQueue        *DiskQueue
+	videoQueue        *DiskQueue
+	indexEventHandler *FileEventHandler
+	videoEventHandler *VideoEventHandler
+	eventHandler      *IndexEventHandler
+	transcoder        *TranscodePool
+	// publishBufferPath: Where windows wait when the index event API can't be reached
+	publishBufferPath string
+	// indexEvents, videoEvents: What the handlers read from
+	indexEvents chan string
+	videoEvents chan string
+	// uploads: Cancelled once shutdown stops waiting for uploads
+	uploads       context.Context
+	cancelUploads context.CancelFunc
+	// publishes: Cancelled once shutdown stops waiting for the last publish
+	publishes       context.Context
+	cancelPublishes context.CancelFunc
+	// stopListening, stopPublishing: Stop the handlers from starting new work
+	stopListening  context.CancelFunc
+	stopPublishing context.CancelFunc
+	// listened: Closed once the publishing handler stops listening for indexed events
+	listened chan struct{}
+}
+
+/*
+NewPipeline: Create everything config declares, exiting when any of it can't
+be created. Files are reported by source.
+*/
+func NewPipeline(agent *Config, config PipelineConfig, source EventSource) *Pipeline {
+	p := &Pipeline{
+		Config:        config,
+		source:        source,
+		indexFiles:    make(chan string, 1),
+		videoFiles:    make(chan string, 1),
+		indexedEvents: make(chan *IndexedEvent, 1),
+	}
+	p.uploads, p.cancelUploads = context.WithCancel(context.Background())
+	p.publishes, p.cancelPublishes = context.WithCancel(context.Background())
+
+	indexEvents := p.indexFiles
+	videoEvents := p.videoFiles
+	if len(agent.QueuePath) > 0 {
+		p.indexQueue = mustOpenDiskQueue(agent.pipelinePath(agent.QueuePath, config, IndexFileType))
+		p.videoQueue = mustOpenDiskQueue(agent.pipelinePath(agent.QueuePath, config, VideoFileType))
+		indexEvents = p.indexQueue.Events
+		videoEvents = p.videoQueue.Events
+	}
+	p.indexEvents = indexEvents
+	p.videoEvents = videoEvents
+
+	p.indexEventHandler = NewFileEventHandler(config.Index, indexEvents)
+	p.videoEventHandler = NewVideoEventHandler(config.Video, videoEvents)
+	p.videoEventHandler.Context = p.uploads
+	if p.indexQueue != nil && p.videoQueue != nil {
+		p.indexEventHandler.AddQueue(p.indexQueue)
+		p.videoEventHandler.AddQueue(p.videoQueue)
+	}
+
+	// Setup uploader for index files
+	if config.Index.Upload {
+		uploader := newUploader(agent, config, config.Index.StorageUrl, config.Index.TrimPrefix, IndexFileType)
+		uploader.Context = p.uploads
+
+		p.indexEventHandler.AddUploader(uploader)
+	}
+
+	// Setup uploader for video files
+	if config.Video.Upload {
+		uploader := newUploader(agent, config, config.Video.StorageUrl, config.Video.TrimPrefix, VideoFileType)
+		uploader.Context = p.uploads
+
+		p.videoEventHandler.AddUploader(uploader)
+		if transcode := config.Video.Transcode; transcode.Enabled {
+			if _, err := exec.LookPath(transcode.FFmpegPath); err != nil {
+				log.Fatalf("Unable to decode videos: %s", err)
+			}
+			p.transcoder = NewTranscodePool(NewFFmpegTranscoder(transcode.FFmpegPath), transcode.Workers)
+			p.videoEventHandler.AddTranscoder(p.transcoder)
+		}
+		if config.Video.Sidecar {
+			sidecars := NewSidecars(uploader)
+			p.videoEventHandler.AddSidecars(sidecars)
+			p.indexEventHandler.AddSidecars(sidecars)
+		}
+	}
+
+	// Setup publisher of datapoints read from index files
+	if len(agent.PublishBufferPath) > 0 {
+		p.publishBufferPath = agent.pipelinePath(agent.PublishBufferPath, config, "publisher")
+	}
+	if publisher := NewPublisher(p.publishes, config.Publisher, config.Name, p.publishBufferPath); publisher != nil {
+		p.eventHandler = NewIndexEventHandler(
+			config.Publisher.ConsolidationInterval.String(),
+			p.indexedEvents,
+			publisher,
+		)
+		p.indexEventHandler.AddIndexEvents(p.indexedEvents)
+	}
+	return p
+}
+
+// AddAlerter: Match the detections in the pipeline's index files against alerter's rules
+func (p *Pipeline) AddAlerter(alerter *Alerter) {
+	p.indexEventHandler.AddAlerter(alerter)
+}
+
+/*
+newEventSource: What reports the pipeline's files. With v2 the pipeline, which
+Config.Validate requires to be the only one, watches v2.watchPaths as
+v2.watchMode says, otherwise it listens for syslog messages.
+*/
+func newEventSource(agent *Config, config PipelineConfig) EventSource {
+	if !agent.V2.Enabled {
+		return NewSyslogEventSource(config.Name, config.Syslog)
+	}
+	log.Printf("INFO: Pipeline %s %s watches %v", config.Name, agent.V2.WatchMode, agent.V2.WatchPaths)
+	if agent.V2.WatchMode == NotifyWatchMode {
+		return mustWatch(agent.V2.WatchPaths, nil)
+	}
+	seen, err := NewSeenFiles(agent.V2.SeenFilesPath)
+	if err != nil {
+		log.Fatalf("Unable to scan for files: %s", err)
+	}
+	scanner := NewScanEventSource(agent.V2.WatchPaths, time.Duration(agent.V2.ScanInterval), seen)
+	if agent.V2.WatchMode == PollWatchMode {
+		return scanner
+	}
+	return MultiEventSource{mustWatch(agent.V2.WatchPaths, seen), scanner}
+}
+
+func mustWatch(paths []string, seen *SeenFiles) *WatchEventSource {
+	source, err := NewWatchEventSource(paths, seen)
+	if err != nil {
+		log.Fatalf("Unable to watch for files: %s", err)
+	}
+	return source
+}
+
+// AddLiveness: Follow the liveness of the pipeline's cameras in liveness
+func (p *Pipeline) AddLiveness(liveness *LivenessTracker) {
+	p.videoEventHandler.AddLiveness(liveness)
+}
+
+// AddStateStore: Record the lifecycle of the pipeline's files in state
+func (p *Pipeline) AddStateStore(state *StateStore) {
+	p.indexEventHandler.AddStateStore(state)
+	p.videoEventHandler.AddStateStore(state)
+	for _, uploader := range p.uploaders() {
+		uploader.State = state
+	}
+}
+
+// uploaders: The pipeline's index and video uploaders
+func (p *Pipeline) uploaders() []*Uploader {
+	uploaders := []*Uploader{}
+	for _, uploader := range []S3FileUploader{p.indexEventHandler.Uploader, p.videoEventHandler.Uploader} {
+		if uploader, ok := uploader.(*Uploader); ok {
+			uploaders = append(uploaders, uploader)
+		}
+	}
+	return uploaders
+}
+
+// AddUploadGate: Hold the pipeline's uploads back while gate is paused
+func (p *Pipeline) AddUploadGate(gate *UploadGate) {
+	for _, uploader := range p.uploaders() {
+		uploader.Gate = gate
+	}
+}
+
+// uploader: The pipeline's IndexFileType or VideoFileType uploader, nil when it doesn't upload those files
+func (p *Pipeline) uploader(fileType string) *Uploader {
+	handler := p.videoEventHandler.Uploader
+	if fileType == IndexFileType {
+		handler = p.indexEventHandler.Uploader
+	}
+	uploader, _ := handler.(*Uploader)
+	return uploader
+}
+
+// AddMetrics: Count the pipeline's videos, uploads and unparsable syslog messages in metrics
+func (p *Pipeline) AddMetrics(metrics *v2.CameraMetrics) {
+	p.videoEventHandler.AddMetrics(metrics)
+	for _, uploader := range p.uploaders() {
+		uploader.Metrics = metrics
+	}
+	if source, ok := p.source.(*SyslogEventSource); ok {
+		source.CountParseErrors()
+	}
+}
+
+// QueueDepths: How many index and video files are waiting to be handled
+func (p *Pipeline) QueueDepths() (index, video int) {
+	if p.indexQueue != nil && p.videoQueue != nil {
+		return len(p.indexQueue.Pending()), len(p.videoQueue.Pending())
+	}
+	return len(p.indexEvents), len(p.videoEvents)
+}
+
+// Start: Run the handlers, then start reporting files
+func (p *Pipeline) Start() {
+	listening, stopListening := context.WithCancel(context.Background())
+	publishing, stopPublishing := context.WithCancel(context.Background())
+	p.stopListening = stopListening
+	p.stopPublishing = stopPublishing
+	if p.indexQueue != nil && p.videoQueue != nil {
+		go p.indexQueue.Consume(p.indexFiles)
+		go p.videoQueue.Consume(p.videoFiles)
+	}
+	if p.eventHandler != nil {
+		p.listened = make(chan struct{})
+		go func() {
+			defer close(p.listened)
+			p.eventHandler.Listen(publishing)
+		}()
+		go p.eventHandler.Publisher(publishing)
+	}
+	go p.videoEventHandler.Listen(listening)
+	go p.indexEventHandler.Listen(listening)
+	p.source.Start(p.indexFiles, p.videoFiles)
+	log.Printf("Started pipeline %s", p.Config.Name)
+}
+
+/*
+Shutdown: Stop reporting files and wait for the files being handled
+until ctx is done, then cancel their uploads and publish the datapoints
+collected so far, stopping once ctx is done. Returns the files which weren't
+finished, which are replayed after a restart when there's a queue.
+*/
+func (p *Pipeline) Shutdown(ctx context.Context) []string {
+	p.source.Stop()
+	p.stopListening()
+	unfinished := p.indexEventHandler.Drain(ctx)
+	unfinished = append(unfinished, p.videoEventHandler.Drain(ctx)...)
+	p.cancelUploads()
+	if p.transcoder != nil {
+		p.transcoder.Close()
+	}
+
+	if p.eventHandler != nil {
+		p.stopPublishing()
+		// The index files handled already were acknowledged, so their events are published too
+		<-p.listened
+		p.eventHandler.Collect()
+		flushed := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				p.cancelPublishes()
+			case <-flushed:
+			}
+		}()
+		if err := p.eventHandler.Flush(); err != nil {
+			log.Printf("ERROR: Unable to publish the %s pipeline's last datapoints: %s", p.Config.Name, err)
+		}
+		close(flushed)
+	}
+	p.cancelPublishes()
+
+	unfinished = append(unfinished, drainEvents(p.indexEvents)...)
+	unfinished = append(unfinished, drainEvents(p.videoEvents)...)
+	if p.indexQueue != nil && p.videoQueue != nil {
+		for _, queue := range []*DiskQueue{p.indexQueue, p.videoQueue} {
+			queue.Close()
+			for _, item := range queue.Pending() {
+				unfinished = append(unfinished, item.Path)
+			}
+		}
+	}
+	return uniqueSorted(unfinished)
+}
+
+// Publish: Publish the datapoints collected so far now instead of at the end of the consolidation interval
+func (p *Pipeline) Publish() error {
+	if p.eventHandler == nil {
+		return ErrNoPublisher
+	}
+	return p.eventHandler.PublishNow()
+}
+
+// Reconfigure: Publish with publisher's settings, keeping the datapoints collected so far
+func (p *Pipeline) Reconfigure(publisher PublisherConfig) {
+	if p.eventHandler == nil {
+		return
+	}
+	p.eventHandler.Reconfigure(
+		time.Duration(publisher.ConsolidationInterval),
+		NewPublisher(p.publishes, publisher, p.Config.Name, p.publishBufferPath),
+	)
+	p.Config.Publisher = publisher
+}
+
+// newUploader: An uploader for storageUrl following the agent's storage, retry, dead letter and multipart settings
+func newUploader(agent *Config, pipeline PipelineConfig, storageUrl, trimPrefix, fileType string) *Uploader {
+	options := StorageOptions{
+		S3: S3ClientOptions{
+			Endpoint:     agent.Storage.S3Endpoint,
+			Region:       agent.Storage.S3Region,
+			UsePathStyle: agent.Storage.S3PathStyle,
+		},
+		Multipart: &MultipartOptions{
+			PartSize:    agent.Storage.Multipart.PartSize,
+			Concurrency: agent.Storage.Multipart.Concurrency,
+		},
+	}
+	if len(agent.UploadStatePath) > 0 {
+		options.Multipart.StatePath = agent.pipelinePath(agent.UploadStatePath, pipeline, fileType)
+	}
+	storage, err := NewStorage(storageUrl, options)
+	if err != nil {
+		log.Fatalf("Unable to create an uploader for %s: %s", storageUrl, err)
+	}
+
+	uploader := NewUploader(storage)
+	uploader.TrimLocalPrefix(trimPrefix)
+	uploader.Retry = agent.Backoff()
+	if len(agent.DeadLetterPath) > 0 {
+		uploader.DeadLetterPath = agent.pipelinePath(agent.DeadLetterPath, pipeline, fileType)
+	}
+	return uploader
+}
+
+func uniqueSorted(items []string) []string {
+	sort.Strings(items)
+	unique := []string{}
+	for i, item := range items {
+		if i == 0 || item != items[i-1] {
+			unique = append(unique, item)
+		}
+	}
+	return unique
+}
+
+func mustOpenDiskQueue(path string) *DiskQueue {
+	queue, err := NewDiskQueue(path)
+	if err != nil {
+		log.Fatalf("Unable to open event queue: %s", err)
+	}
+	return queue
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const publishBufferExtension = ".json"
+
+/*
+PublishBuffer: Request bodies which couldn't be published, a file each under
+Path so they're kept over a restart. Once they take up more than MaxBytes the
+oldest are dropped.
+*/
+type PublishBuffer struct {
+	lock     sync.Mutex
+	Path     string
+	MaxBytes int64
+	sequence uint64
+}
+
+func NewPublishBuffer(path string, maxBytes int64) *PublishBuffer {
+	return &PublishBuffer{Path: path, MaxBytes: maxBytes}
+}
+
+// Add: Keep body after the bodies already buffered
+func (b *PublishBuffer) Add(body []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err := os.MkdirAll(b.Path, 0750); err != nil {
+		return err
+	}
+	b.sequence++
+	name := filepath.Join(b.Path, fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), b.sequence%1000000, publishBufferExtension))
+	// A body is only buffered once it's completely written
+	if err := os.WriteFile(name+".tmp", body, 0640); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	return b.trim()
+}
+
+// trim: Drop the oldest bodies until the rest take up MaxBytes or less
+func (b *PublishBuffer) trim() error {
+	if b.MaxBytes <= 0 {
+		return nil
+	}
+	names, err := b.names()
+	if err != nil {
+		return err
+	}
+	sizes := make([]int64, len(names))
+	total := int64(0)
+	for i, name := range names {
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		sizes[i] = info.Size()
+		total += sizes[i]
+	}
+	for i := 0; i < len(names) && total > b.MaxBytes; i++ {
+		log.Printf("WARN: Dropping buffered window %s, the buffer is larger than %d bytes", names[i], b.MaxBytes)
+		if err := os.Remove(names[i]); err != nil {
+			return err
+		}
+		total -= sizes[i]
+	}
+	return nil
+}
+
+/*
+Replay: Send each buffered body, oldest first, removing those which are sent.
+Stops at the first which can't be sent, returning why.
+*/
+func (b *PublishBuffer) Replay(send func(body []byte) error) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	names, err := b.names()
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		log.Printf("INFO: Publishing %d buffered windows from %s", len(names), b.Path)
+	}
+	for _, name := range names {
+		body, err := os.ReadFile(name)
+		if err != nil {
+			log.Printf("ERROR: Dropping unreadable buffered window %s: %s", name, err)
+			tryRemove(name)
+			continue
+		}
+		if err := send(body); err != nil {
+			return err
+		}
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Len: How many bodies are buffered
+func (b *PublishBuffer) Len() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	names, _ := b.names()
+	return len(names)
+}
+
+// names: The buffered bodies, oldest first
+func (b *PublishBuffer) names() ([]string, error) {
+	entries, err := os.ReadDir(b.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to list publish buffer %s: %w", b.Path, err)
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), publishBufferExtension) {
+			names = append(names, filepath.Join(b.Path, entry.Name()))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
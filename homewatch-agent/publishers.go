@@ -2,17 +2,67 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
 )
 
 type DebugPublisher struct{}
+
+/*
+HttpPublisher: Puts each window's datapoints as JSON to Url. Requests which
+fail with a 5xx or 429 response, or don't get one, are retried with Retry,
+waiting as long as a Retry-After response header asks up to Retry.MaxDelay.
+Windows which still can't be published, or which Retry-After asks to wait
+longer for, wait in Buffer and are published, oldest first, before the next
+window.
+*/
 type HttpPublisher struct {
 	Url           string
 	Authorization string
+	Client        *http.Client
+	Retry         Backoff
+	// Gzip: Send request bodies with Content-Encoding: gzip
+	Gzip bool
+	// Buffer: Where windows which couldn't be published wait, or nil to drop them
+	Buffer *PublishBuffer
+	// Context: Cancels requests and waits between attempts once it's done
+	Context context.Context
+	// sleep: Waits between attempts instead of a timer, for tests
+	sleep func(time.Duration)
+}
+
+// PublishError: A response to a publish which isn't 2xx
+type PublishError struct {
+	Url        string
+	StatusCode int
+	Body       string
+	// RetryAfter: How long the response's Retry-After header asks to wait, or 0
+	RetryAfter time.Duration
+}
+
+func (e *PublishError) Error() string {
+	return fmt.Sprintf("failed to publish metrics to %s: [%d] %s", e.Url, e.StatusCode, e.Body)
+}
+
+// Temporary: True when publishing again may succeed
+func (e *PublishError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
 }
 
 type Publisher interface {
@@ -26,34 +76,452 @@ func (p DebugPublisher) Publish(metrics []DatapointMetric) error {
 	return nil
 }
 
-func (p HttpPublisher) Publish(metrics []DatapointMetric) error {
+func NewHttpPublisher(url, authorization string) *HttpPublisher {
+	return &HttpPublisher{
+		Url:           url,
+		Authorization: authorization,
+		Client:        &http.Client{Timeout: DefaultPublishTimeout},
+		Context:       context.Background(),
+	}
+}
+
+func (p *HttpPublisher) Publish(metrics []DatapointMetric) error {
 	log.Printf("HttpPublisher: Publishing to %s", p.Url)
 	if len(p.Url) == 0 {
 		return fmt.Errorf("invalid url: %s", p.Url)
 	}
 
-	body := &bytes.Buffer{}
-	json.NewEncoder(body).Encode(metrics)
-	log.Printf("HttpPublisher: Publishing %d bytes", body.Len())
-	request, err := http.NewRequest(http.MethodPut, p.Url, body)
-	request.Header.Add("Authorization", p.Authorization)
+	body, err := json.Marshal(metrics)
+	if err != nil {
+		return fmt.Errorf("unable to encode %d metrics: %w", len(metrics), err)
+	}
+	log.Printf("HttpPublisher: Publishing %d bytes", len(body))
+	if p.Buffer != nil {
+		// Windows which are still waiting are published first so they stay in order
+		if err := p.Buffer.Replay(p.replay); err != nil {
+			return p.buffer(body, err)
+		}
+	}
+	err = p.send(body)
+	if err == nil {
+		if flagDebug {
+			log.Printf("Published %d metrics to %s", len(metrics), p.Url)
+		}
+		return nil
+	}
+	if p.Buffer == nil || !unreachable(err) {
+		return err
+	}
+	return p.buffer(body, err)
+}
+
+// replay: Send a buffered body, dropping it when it's refused for good
+func (p *HttpPublisher) replay(body []byte) error {
+	err := p.send(body)
+	if err != nil && !unreachable(err) {
+		log.Printf("ERROR: Dropping a buffered window %s refused: %s", p.Url, err)
+		return nil
+	}
+	return err
+}
+
+// buffer: Keep body to publish later, returning why it wasn't published
+func (p *HttpPublisher) buffer(body []byte, err error) error {
+	if bufferErr := p.Buffer.Add(body); bufferErr != nil {
+		return fmt.Errorf("%w, and unable to buffer it: %s", err, bufferErr)
+	}
+	log.Printf("WARN: Buffered a window in %s until %s can be reached", p.Buffer.Path, p.Url)
+	return err
+}
+
+// unreachable: True when err is a failure to reach the publisher, or a response asking to try again later
+func unreachable(err error) bool {
+	var publishError *PublishError
+	if errors.As(err, &publishError) {
+		return publishError.Temporary()
+	}
+	return true
+}
+
+// send: Put body to Url, retrying temporary failures
+func (p *HttpPublisher) send(body []byte) error {
+	encoding := ""
+	if p.Gzip {
+		compressed := &bytes.Buffer{}
+		w := gzip.NewWriter(compressed)
+		if _, err := w.Write(body); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		body, encoding = compressed.Bytes(), "gzip"
+	}
+	for attempt := 1; ; attempt++ {
+		err := p.put(body, encoding)
+		if err == nil || !unreachable(err) || p.Retry.Exhausted(attempt) {
+			return err
+		}
+		delay := p.Retry.Delay(attempt)
+		var publishError *PublishError
+		if errors.As(err, &publishError) && publishError.RetryAfter > 0 {
+			if publishError.RetryAfter > p.maxRetryAfter() {
+				log.Printf("WARN: Not publishing to %s again, it asked to wait %s which is longer than %s", p.Url, publishError.RetryAfter, p.maxRetryAfter())
+				return err
+			}
+			delay = publishError.RetryAfter
+		}
+		log.Printf("WARN: Publishing to %s again in %s after attempt %d of %d: %s", p.Url, delay, attempt, p.Retry.MaxAttempts, err)
+		if waitErr := p.wait(delay); waitErr != nil {
+			return fmt.Errorf("%w, stopped retrying: %s", err, waitErr)
+		}
+	}
+}
 
+// maxRetryAfter: The longest a Retry-After header is waited for, Retry.MaxDelay or DefaultBackoff's when it isn't set
+func (p *HttpPublisher) maxRetryAfter() time.Duration {
+	if p.Retry.MaxDelay > 0 {
+		return p.Retry.MaxDelay
+	}
+	return DefaultBackoff.MaxDelay
+}
+
+// context: Context, or the background context when it isn't set
+func (p *HttpPublisher) context() context.Context {
+	if p.Context == nil {
+		return context.Background()
+	}
+	return p.Context
+}
+
+// wait: Wait for delay, or return the context's error once it's done
+func (p *HttpPublisher) wait(delay time.Duration) error {
+	ctx := p.context()
+	if p.sleep != nil {
+		p.sleep(delay)
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *HttpPublisher) put(body []byte, encoding string) error {
+	request, err := http.NewRequestWithContext(p.context(), http.MethodPut, p.Url, bytes.NewReader(body))
 	if err != nil {
 		log.Printf("Error building HttpPublisher request to %s: %s", p.Url, err)
 		return err
 	}
-	response, err := http.DefaultClient.Do(request)
+	request.Header.Set("Content-Type", "application/json")
+	if len(encoding) > 0 {
+		request.Header.Set("Content-Encoding", encoding)
+	}
+	if len(p.Authorization) > 0 {
+		request.Header.Set("Authorization", p.Authorization)
+	}
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
 	if err != nil {
 		log.Printf("Error publishing metrics to %s: %s", p.Url, err)
 		return err
 	}
-	if response.StatusCode != 200 {
-		defer response.Body.Close()
-		b, _ := ioutil.ReadAll(response.Body)
-		return fmt.Errorf("failed to publish metrics to %s: [%d] %s", p.Url, response.StatusCode, string(b))
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return &PublishError{
+			Url:        p.Url,
+			StatusCode: response.StatusCode,
+			Body:       string(b),
+			RetryAfter: retryAfter(response.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+	return nil
+}
+
+// retryAfter: How long a Retry-After header of seconds or an HTTP date asks to wait after now
+func retryAfter(header string, now time.Time) time.Duration {
+	if len(header) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+/*
+NewPublisher: The publishers config enables, sent to together when there's
+more than one, or nil when it enables none. pipeline names the pipeline
+publishing, to tell its datapoints from other pipelines'. Windows the index
+event API can't be sent wait in bufferPath, when it's set. Requests to the
+index event API and waits between them stop once ctx is done.
+*/
+func NewPublisher(ctx context.Context, config PublisherConfig, pipeline string, bufferPath string) Publisher {
+	timeout := time.Duration(config.Timeout)
+	if timeout <= 0 {
+		timeout = DefaultPublishTimeout
+	}
+	publishers := FanOutPublisher{}
+	if len(config.Url) > 0 {
+		publisher := NewHttpPublisher(config.Url, config.Authorization)
+		publisher.Client.Timeout = timeout
+		publisher.Retry = config.Retry.Backoff()
+		publisher.Gzip = config.Gzip
+		publisher.Context = ctx
+		if len(bufferPath) > 0 {
+			publisher.Buffer = NewPublishBuffer(bufferPath, config.BufferMaxBytes)
+		}
+		publishers = append(publishers, publisher)
+	}
+	if influx := config.Influx; len(influx.Url) > 0 {
+		publishers = append(publishers, &InfluxPublisher{
+			Url:         influx.Url,
+			Token:       influx.Token,
+			Measurement: influx.Measurement,
+			Tags:        map[string]string{"pipeline": pipeline},
+			Client:      &http.Client{Timeout: timeout},
+		})
+	}
+	if pushgateway := config.Pushgateway; len(pushgateway.Url) > 0 {
+		publishers = append(publishers, &PushgatewayPublisher{
+			Url:      pushgateway.Url,
+			Job:      pushgateway.Job,
+			Instance: pipeline,
+			Client:   &http.Client{Timeout: timeout},
+		})
+	}
+	if ndjson := config.NDJSON; len(ndjson.Path) > 0 {
+		publishers = append(publishers, NewNDJSONFilePublisher(ndjson.Path, ndjson.MaxBytes, ndjson.MaxFiles))
+	}
+	switch len(publishers) {
+	case 0:
+		return nil
+	case 1:
+		return publishers[0]
+	}
+	return publishers
+}
+
+// DefaultPublishTimeout: How long each request publishing a window may take
+const DefaultPublishTimeout = 30 * time.Second
+
+// FanOutPublisher: Publishes to each publisher, even when some fail
+type FanOutPublisher []Publisher
+
+func (p FanOutPublisher) Publish(metrics []DatapointMetric) error {
+	failures := []string{}
+	for _, publisher := range p {
+		if err := publisher.Publish(metrics); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d publishers failed: %s", len(failures), len(p), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// sourceCamera: The camera a datapoint's Camera:Action:Name source is from
+func sourceCamera(source string) string {
+	return strings.SplitN(source, ":", 2)[0]
+}
+
+/*
+InfluxPublisher: Writes each metric's count as InfluxDB line protocol to Url,
+a v2 /api/v2/write?org=...&bucket=... or v1 /write?db=... endpoint, tagged
+with its source, type, camera and Tags
+*/
+type InfluxPublisher struct {
+	Url         string
+	Token       string
+	Measurement string
+	Tags        map[string]string
+	Client      *http.Client
+	// now: When the metrics were counted
+	now func() time.Time
+}
+
+func (p *InfluxPublisher) Publish(metrics []DatapointMetric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	now := time.Now
+	if p.now != nil {
+		now = p.now
+	}
+	body := &bytes.Buffer{}
+	timestamp := now().UnixNano()
+	for _, metric := range metrics {
+		tags := map[string]string{
+			"source": metric.Source,
+			"type":   metric.Type,
+			"camera": sourceCamera(metric.Source),
+		}
+		for k, v := range p.Tags {
+			tags[k] = v
+		}
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			if len(tags[k]) > 0 {
+				keys = append(keys, k)
+			}
+		}
+		// Influx writes fastest with tags in key order
+		sort.Strings(keys)
+		body.WriteString(influxEscape(p.Measurement, ", "))
+		for _, k := range keys {
+			fmt.Fprintf(body, ",%s=%s", influxEscape(k, ", ="), influxEscape(tags[k], ", ="))
+		}
+		fmt.Fprintf(body, " count=%di,detections=%di %d\n", metric.Count, len(metric.Detections), timestamp)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, p.Url, body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if len(p.Token) > 0 {
+		request.Header.Set("Authorization", "Token "+p.Token)
+	}
+	response, err := p.Client.Do(request)
+	if err != nil {
+		return fmt.Errorf("unable to write to influx %s: %w", p.Url, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("failed to write to influx %s: [%d] %s", p.Url, response.StatusCode, string(b))
 	}
 	if flagDebug {
-		log.Printf("Published %d metrics to %s", len(metrics), p.Url)
+		log.Printf("Wrote %d metrics to influx %s", len(metrics), p.Url)
 	}
 	return nil
 }
+
+// influxEscape: s with the characters of special backslash escaped
+func influxEscape(s, special string) string {
+	escaped := strings.Builder{}
+	for _, r := range s {
+		if strings.ContainsRune(special, r) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
+
+/*
+PushgatewayPublisher: Replaces the job and instance's group on a Prometheus
+pushgateway with a homewatch_index_event_datapoints gauge of each metric's count
+*/
+type PushgatewayPublisher struct {
+	Url      string
+	Job      string
+	Instance string
+	Client   *http.Client
+}
+
+func (p *PushgatewayPublisher) Publish(metrics []DatapointMetric) error {
+	datapoints := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "homewatch_index_event_datapoints",
+		Help: "Datapoints counted from index file events in the last consolidation interval",
+	}, []string{"source", "type", "camera"})
+	for _, metric := range metrics {
+		datapoints.WithLabelValues(metric.Source, metric.Type, sourceCamera(metric.Source)).Set(float64(metric.Count))
+	}
+	err := push.New(p.Url, p.Job).
+		Grouping("instance", p.Instance).
+		Collector(datapoints).
+		Client(p.Client).
+		Push()
+	if err != nil {
+		return fmt.Errorf("unable to push to %s: %w", p.Url, err)
+	}
+	if flagDebug {
+		log.Printf("Pushed %d metrics to %s", len(metrics), p.Url)
+	}
+	return nil
+}
+
+// ndjsonRecord: A line of an NDJSONFilePublisher's file
+type ndjsonRecord struct {
+	Time time.Time `json:"time"`
+	DatapointMetric
+}
+
+/*
+NDJSONFilePublisher: Appends a JSON line per metric to Path. Once Path is
+larger than MaxBytes it's rotated to Path.1, Path.1 to Path.2 and so on,
+keeping MaxFiles rotated files.
+*/
+type NDJSONFilePublisher struct {
+	lock     sync.Mutex
+	Path     string
+	MaxBytes int64
+	MaxFiles int
+}
+
+func NewNDJSONFilePublisher(path string, maxBytes int64, maxFiles int) *NDJSONFilePublisher {
+	return &NDJSONFilePublisher{Path: path, MaxBytes: maxBytes, MaxFiles: maxFiles}
+}
+
+func (p *NDJSONFilePublisher) Publish(metrics []DatapointMetric) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	body := &bytes.Buffer{}
+	encoder := json.NewEncoder(body)
+	now := time.Now().UTC()
+	for _, metric := range metrics {
+		if err := encoder.Encode(ndjsonRecord{now, metric}); err != nil {
+			return err
+		}
+	}
+	if err := p.rotate(int64(body.Len())); err != nil {
+		return fmt.Errorf("unable to rotate %s: %w", p.Path, err)
+	}
+
+	fp, err := os.OpenFile(p.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(body.Bytes()); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+// rotate: Rotate Path when writing size more bytes would make it larger than MaxBytes
+func (p *NDJSONFilePublisher) rotate(size int64) error {
+	info, err := os.Stat(p.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if p.MaxBytes <= 0 || info.Size() == 0 || info.Size()+size <= p.MaxBytes {
+		return nil
+	}
+	if p.MaxFiles < 1 {
+		return os.Remove(p.Path)
+	}
+	for i := p.MaxFiles - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", p.Path, i), fmt.Sprintf("%s.%d", p.Path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(p.Path, p.Path+".1")
+}
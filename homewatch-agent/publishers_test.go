@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testMetrics = []DatapointMetric{
+	{Datapoint: Datapoint{Source: "Camera1:Start:VideoMotion", Type: MotionEventKind, Count: 3}},
+	{Datapoint: Datapoint{Source: "Front Door:Start:CrossLineDetection:Human", Type: TripwireEventKind, Count: 1}, Detections: []RuleDetection{{}}},
+}
+
+// recordingServer: Records the method, path, authorization and body of the last request
+func recordingServer(t *testing.T, status int) (*httptest.Server, chan *http.Request, chan string) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		requests <- r
+		bodies <- string(b)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests, bodies
+}
+
+func TestInfluxPublisher(t *testing.T) {
+	server, requests, bodies := recordingServer(t, http.StatusNoContent)
+	publisher := NewPublisher(context.Background(), PublisherConfig{
+		Influx: InfluxConfig{Url: server.URL + "/api/v2/write?org=home&bucket=homewatch", Token: "secret", Measurement: "homewatch_index_events"},
+	}, "porch", "").(*InfluxPublisher)
+	publisher.now = func() time.Time { return time.Unix(1, 0) }
+
+	if err := publisher.Publish(testMetrics); err != nil {
+		t.Fatalf("Expected to write to influx, got %s", err)
+	}
+	request := <-requests
+	if request.Header.Get("Authorization") != "Token secret" || request.URL.Query().Get("bucket") != "homewatch" {
+		t.Fatalf("Expected an authorized write to the homewatch bucket, got %s %s", request.Header.Get("Authorization"), request.URL)
+	}
+	expectation := "homewatch_index_events,camera=Camera1,pipeline=porch,source=Camera1:Start:VideoMotion,type=motion count=3i,detections=0i 1000000000\n" +
+		"homewatch_index_events,camera=Front\\ Door,pipeline=porch,source=Front\\ Door:Start:CrossLineDetection:Human,type=tripwire count=1i,detections=1i 1000000000\n"
+	if body := <-bodies; body != expectation {
+		t.Fatalf("Expected\n%s, got\n%s", expectation, body)
+	}
+}
+
+func TestPushgatewayPublisher(t *testing.T) {
+	server, requests, bodies := recordingServer(t, http.StatusOK)
+	publisher := NewPublisher(context.Background(), PublisherConfig{Pushgateway: PushgatewayConfig{Url: server.URL, Job: "homewatch"}}, "porch", "")
+
+	if err := publisher.Publish(testMetrics); err != nil {
+		t.Fatalf("Expected to push, got %s", err)
+	}
+	request := <-requests
+	if request.Method != http.MethodPut || request.URL.Path != "/metrics/job/homewatch/instance/porch" {
+		t.Fatalf("Expected to replace the porch instance's metrics, got %s %s", request.Method, request.URL.Path)
+	}
+	body := <-bodies
+	for _, expectation := range []string{"homewatch_index_event_datapoints", "Front Door:Start:CrossLineDetection:Human", "tripwire"} {
+		if !strings.Contains(body, expectation) {
+			t.Fatalf("Expected %s to be pushed, got %q", expectation, body)
+		}
+	}
+}
+
+func TestNDJSONFilePublisherRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.ndjson")
+	publisher := NewNDJSONFilePublisher(path, 200, 2)
+	for i := 0; i < 4; i++ {
+		if err := publisher.Publish(testMetrics); err != nil {
+			t.Fatalf("Expected to append metrics, got %s", err)
+		}
+	}
+
+	fp, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Expected %s, got %s", path, err)
+	}
+	defer fp.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(fp); scanner.Scan(); lines++ {
+		if !strings.HasPrefix(scanner.Text(), `{"time":`) {
+			t.Fatalf("Expected a JSON line, got %s", scanner.Text())
+		}
+	}
+	if lines != len(testMetrics) {
+		t.Fatalf("Expected the last window's %d lines, got %d", len(testMetrics), lines)
+	}
+	for _, rotated := range []string{".1", ".2"} {
+		if _, err := os.Stat(path + rotated); err != nil {
+			t.Fatalf("Expected %s to be kept, got %s", path+rotated, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("Expected only 2 rotated files, got %v", err)
+	}
+}
+
+// failingPublisher: Fails every publish with Err
+type failingPublisher struct {
+	Err error
+}
+
+func (p failingPublisher) Publish(metrics []DatapointMetric) error {
+	return p.Err
+}
+
+func TestFanOutPublisher(t *testing.T) {
+	published := channelPublisher{make(chan []string, 1)}
+	publisher := FanOutPublisher{failingPublisher{errors.New("unreachable")}, published}
+
+	err := publisher.Publish(testMetrics)
+	if err == nil || !strings.Contains(err.Error(), "1 of 2 publishers failed: unreachable") {
+		t.Fatalf("Expected the failure to be returned, got %v", err)
+	}
+	if sources := <-published.published; len(sources) != len(testMetrics) {
+		t.Fatalf("Expected the other publisher to publish, got %v", sources)
+	}
+
+	if NewPublisher(context.Background(), DefaultPipelineConfig("porch").Publisher, "porch", "") != nil {
+		t.Fatalf("Expected no publisher without a url or path")
+	}
+	config := PublisherConfig{Url: "http://api/events", NDJSON: NDJSONConfig{Path: "/tmp/metrics.ndjson"}}
+	if fanOut, ok := NewPublisher(context.Background(), config, "porch", "").(FanOutPublisher); !ok || len(fanOut) != 2 {
+		t.Fatalf("Expected to publish to both, got %#v", NewPublisher(context.Background(), config, "porch", ""))
+	}
+}
+
+func TestHttpPublisherRetries(t *testing.T) {
+	attempts := int32(0)
+	encodings := make(chan string, 2)
+	bodies := make(chan []DatapointMetric, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodings <- r.Header.Get("Content-Encoding")
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("Expected a gzipped body, got %s", err)
+			return
+		}
+		metrics := []DatapointMetric{}
+		json.NewDecoder(reader).Decode(&metrics)
+		bodies <- metrics
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	slept := []time.Duration{}
+	publisher := NewHttpPublisher(server.URL, "")
+	publisher.Retry = Backoff{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Second}
+	publisher.Gzip = true
+	publisher.sleep = func(d time.Duration) { slept = append(slept, d) }
+
+	if err := publisher.Publish(testMetrics); err != nil {
+		t.Fatalf("Expected to publish on the second attempt, got %s", err)
+	}
+	if len(slept) != 1 || slept[0] != 7*time.Second {
+		t.Fatalf("Expected to wait as long as Retry-After asked, got %v", slept)
+	}
+	for i := 0; i < 2; i++ {
+		if encoding, metrics := <-encodings, <-bodies; encoding != "gzip" || len(metrics) != len(testMetrics) {
+			t.Fatalf("Expected %d gzipped metrics, got %d with %q", len(testMetrics), len(metrics), encoding)
+		}
+	}
+}
+
+func TestHttpPublisherBuffersWhenRetryAfterIsTooLong(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "86400")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	publisher := NewHttpPublisher(server.URL, "")
+	publisher.Retry = Backoff{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Minute}
+	publisher.Buffer = NewPublishBuffer(t.TempDir(), 0)
+	publisher.sleep = func(d time.Duration) { t.Fatalf("Expected not to wait %s", d) }
+
+	if err := publisher.Publish(testMetrics); err == nil {
+		t.Fatalf("Expected the window not to be published")
+	}
+	if publisher.Buffer.Len() != 1 {
+		t.Fatalf("Expected the window to be buffered, got %d", publisher.Buffer.Len())
+	}
+}
+
+func TestHttpPublisherStopsWaitingOnceCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	publisher := NewHttpPublisher(server.URL, "")
+	publisher.Context = ctx
+	publisher.Retry = Backoff{MaxAttempts: 3, BaseDelay: time.Hour, MaxDelay: time.Hour}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	published := make(chan error, 1)
+	go func() { published <- publisher.Publish(testMetrics) }()
+	select {
+	case err := <-published:
+		if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+			t.Fatalf("Expected the publish to be cancelled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the wait between attempts to stop once cancelled")
+	}
+}
+
+func TestHttpPublisherBuffersUntilReachable(t *testing.T) {
+	status := int32(http.StatusBadGateway)
+	received := make(chan string, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		received <- string(b)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+	publisher := NewHttpPublisher(server.URL, "")
+	publisher.Retry = Backoff{MaxAttempts: 1}
+	publisher.Buffer = NewPublishBuffer(t.TempDir(), 0)
+
+	if err := publisher.Publish(testMetrics[:1]); err == nil {
+		t.Fatalf("Expected the window to fail")
+	}
+	<-received
+	if publisher.Buffer.Len() != 1 {
+		t.Fatalf("Expected the window to be buffered, got %d", publisher.Buffer.Len())
+	}
+
+	atomic.StoreInt32(&status, http.StatusOK)
+	if err := publisher.Publish(testMetrics[1:]); err != nil {
+		t.Fatalf("Expected to publish, got %s", err)
+	}
+	if buffered, next := <-received, <-received; !strings.Contains(buffered, "Camera1") || !strings.Contains(next, "Front Door") {
+		t.Fatalf("Expected the buffered window first, got %s then %s", buffered, next)
+	}
+	if publisher.Buffer.Len() != 0 {
+		t.Fatalf("Expected the buffer to be emptied, got %d", publisher.Buffer.Len())
+	}
+
+	atomic.StoreInt32(&status, http.StatusBadRequest)
+	if err := publisher.Publish(testMetrics); err == nil || publisher.Buffer.Len() != 0 {
+		t.Fatalf("Expected a refused window to fail without being buffered, got %v and %d", err, publisher.Buffer.Len())
+	}
+}
+
+func TestPublishBufferDropsOldest(t *testing.T) {
+	buffer := NewPublishBuffer(t.TempDir(), 10)
+	for _, body := range []string{"first", "second", "third"} {
+		if err := buffer.Add([]byte(body)); err != nil {
+			t.Fatalf("Expected to buffer %s, got %s", body, err)
+		}
+	}
+	replayed := []string{}
+	buffer.Replay(func(body []byte) error {
+		replayed = append(replayed, string(body))
+		return nil
+	})
+	if strings.Join(replayed, ",") != "third" {
+		t.Fatalf("Expected only the newest body under 10 bytes, got %v", replayed)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2022, 3, 6, 4, 51, 56, 0, time.UTC)
+	for header, expectation := range map[string]time.Duration{
+		"":                              0,
+		"120":                           2 * time.Minute,
+		"Sun, 06 Mar 2022 04:52:26 GMT": 30 * time.Second,
+		"Sun, 06 Mar 2022 04:50:00 GMT": 0,
+		"soon":                          0,
+	} {
+		if d := retryAfter(header, now); d != expectation {
+			t.Fatalf("Expected %q to wait %s, got %s", header, expectation, d)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	queueSegmentExtension  = ".log"
+	defaultMaxSegmentBytes = 1024 * 1024
+	queuePutOp             = "put"
+	queueAckOp             = "ack"
+)
+
+var ErrNotInFlight = errors.New("no delivered queue entry for path")
+
+// FileEventQueue: Acknowledges a file event was handled so it isn't replayed
+type FileEventQueue interface {
+	Ack(filepath string) error
+}
+
+/*
+DiskQueue: A crash-safe FIFO of file paths between the SyslogMessageHandler and
+the upload handlers. Every put and ack is appended and synced to a segment file
+under Path so paths which were never acknowledged are replayed on restart.
+*/
+type DiskQueue struct {
+	Path string
+	// Events: Paths to handle, in the order they were enqueued
+	Events chan string
+	// MaxSegmentBytes: Segments are rotated once they grow past this size
+	MaxSegmentBytes int64
+
+	lock           sync.Mutex
+	notify         chan struct{}
+	done           chan struct{}
+	closed         bool
+	segment        *os.File
+	segmentID      uint64
+	segmentBytes   int64
+	segments       []uint64
+	segmentPending map[uint64]int
+	sequence       uint64
+	pending        map[uint64]*QueueItem
+	backlog        []uint64
+	inFlight       map[string][]uint64
+}
+
+// QueueItem: A path which hasn't been acknowledged yet
+type QueueItem struct {
+	Sequence   uint64
+	Path       string
+	EnqueuedAt time.Time
+	Delivered  bool
+	segmentID  uint64
+}
+
+type queueRecord struct {
+	Op       string    `json:"op"`
+	Sequence uint64    `json:"seq"`
+	Path     string    `json:"path,omitempty"`
+	Time     time.Time `json:"time,omitempty"`
+}
+
+// NewDiskQueue: Open or create the queue in path and replay unacknowledged entries
+func NewDiskQueue(path string) (*DiskQueue, error) {
+	if err := os.MkdirAll(path, 0750); err != nil {
+		return nil, fmt.Errorf("unable to create queue %s: %w", path, err)
+	}
+	q := &DiskQueue{
+		Path:            path,
+		Events:          make(chan string, 1),
+		MaxSegmentBytes: defaultMaxSegmentBytes,
+		notify:          make(chan struct{}, 1),
+		done:            make(chan struct{}),
+		segmentPending:  map[uint64]int{},
+		pending:         map[uint64]*QueueItem{},
+		inFlight:        map[string][]uint64{},
+	}
+	if err := q.replay(); err != nil {
+		return nil, err
+	}
+	// Always append to a fresh segment so a torn write is never extended
+	nextSegment := uint64(1)
+	if len(q.segments) > 0 {
+		nextSegment = q.segments[len(q.segments)-1] + 1
+	}
+	if err := q.openSegment(nextSegment); err != nil {
+		return nil, err
+	}
+	q.compact()
+	if len(q.backlog) > 0 {
+		log.Printf("INFO: Replaying %d unacknowledged entries from %s", len(q.backlog), path)
+	}
+
+	go q.deliver()
+	return q, nil
+}
+
+func segmentName(id uint64) string {
+	return fmt.Sprintf("%020d%s", id, queueSegmentExtension)
+}
+
+func (q *DiskQueue) replay() error {
+	entries, err := os.ReadDir(q.Path)
+	if err != nil {
+		return fmt.Errorf("unable to list queue %s: %w", q.Path, err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, queueSegmentExtension) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, queueSegmentExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.segments = append(q.segments, id)
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+
+	for _, id := range q.segments {
+		if err := q.replaySegment(id); err != nil {
+			return err
+		}
+	}
+	for sequence := range q.pending {
+		q.backlog = append(q.backlog, sequence)
+	}
+	sort.Slice(q.backlog, func(i, j int) bool { return q.backlog[i] < q.backlog[j] })
+	return nil
+}
+
+func (q *DiskQueue) replaySegment(id uint64) error {
+	fp, err := os.Open(filepath.Join(q.Path, segmentName(id)))
+	if err != nil {
+		return fmt.Errorf("unable to replay queue segment %d: %w", id, err)
+	}
+	defer fp.Close()
+
+	q.segmentPending[id] = 0
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(make([]byte, 0, 4096), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		record := queueRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// Expected for the last record of a segment written during a crash
+			log.Printf("WARN: Skipping unreadable record %s:%d: %s", segmentName(id), line, err)
+			continue
+		}
+		if record.Sequence > q.sequence {
+			q.sequence = record.Sequence
+		}
+		switch record.Op {
+		case queuePutOp:
+			q.pending[record.Sequence] = &QueueItem{
+				Sequence:   record.Sequence,
+				Path:       record.Path,
+				EnqueuedAt: record.Time,
+				segmentID:  id,
+			}
+			q.segmentPending[id]++
+		case queueAckOp:
+			if item, ok := q.pending[record.Sequence]; ok {
+				q.segmentPending[item.segmentID]--
+				delete(q.pending, record.Sequence)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func (q *DiskQueue) openSegment(id uint64) error {
+	fp, err := os.OpenFile(filepath.Join(q.Path, segmentName(id)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("unable to open queue segment %d: %w", id, err)
+	}
+	if q.segment != nil {
+		q.segment.Close()
+	}
+	q.segment = fp
+	q.segmentID = id
+	q.segmentBytes = 0
+	q.segments = append(q.segments, id)
+	q.segmentPending[id] = 0
+	return nil
+}
+
+// append: Write and sync a record to the current segment, rotating when it's full
+func (q *DiskQueue) append(record queueRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	n, err := q.segment.Write(b)
+	q.segmentBytes += int64(n)
+	if err != nil {
+		return err
+	}
+	if err := q.segment.Sync(); err != nil {
+		return err
+	}
+	if q.segmentBytes >= q.MaxSegmentBytes {
+		if err := q.openSegment(q.segmentID + 1); err != nil {
+			log.Printf("WARN: Unable to rotate queue %s, continuing with %s: %s", q.Path, segmentName(q.segmentID), err)
+		}
+	}
+	return nil
+}
+
+// compact: Remove leading segments whose entries have all been acknowledged
+func (q *DiskQueue) compact() {
+	for len(q.segments) > 1 && q.segments[0] != q.segmentID && q.segmentPending[q.segments[0]] == 0 {
+		id := q.segments[0]
+		if err := os.Remove(filepath.Join(q.Path, segmentName(id))); err != nil && !os.IsNotExist(err) {
+			log.Printf("WARN: Unable to remove queue segment %s: %s", segmentName(id), err)
+			return
+		}
+		delete(q.segmentPending, id)
+		q.segments = q.segments[1:]
+	}
+}
+
+/*
+Enqueue: Durably record path then schedule it for delivery on Events. When the
+record can't be written the path is still delivered, it just won't survive a restart.
+*/
+func (q *DiskQueue) Enqueue(path string) error {
+	q.lock.Lock()
+	q.sequence++
+	item := &QueueItem{
+		Sequence:   q.sequence,
+		Path:       path,
+		EnqueuedAt: time.Now().UTC(),
+		segmentID:  q.segmentID,
+	}
+	err := q.append(queueRecord{queuePutOp, item.Sequence, item.Path, item.EnqueuedAt})
+	if err == nil {
+		q.segmentPending[item.segmentID]++
+	} else {
+		item.segmentID = 0
+		err = fmt.Errorf("unable to persist %s to queue %s: %w", path, q.Path, err)
+	}
+	q.pending[item.Sequence] = item
+	q.backlog = append(q.backlog, item.Sequence)
+	q.lock.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return err
+}
+
+// Consume: Enqueue each path received on events until events is closed
+func (q *DiskQueue) Consume(events <-chan string) {
+	for path := range events {
+		if err := q.Enqueue(path); err != nil {
+			log.Printf("ERROR: %s", err)
+		}
+	}
+}
+
+// Ack: Mark the oldest delivered entry for filepath as handled
+func (q *DiskQueue) Ack(filepath string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	sequences := q.inFlight[filepath]
+	if len(sequences) == 0 {
+		return fmt.Errorf("%w: %s", ErrNotInFlight, filepath)
+	}
+	sequence := sequences[0]
+	if len(sequences) == 1 {
+		delete(q.inFlight, filepath)
+	} else {
+		q.inFlight[filepath] = sequences[1:]
+	}
+
+	item := q.pending[sequence]
+	delete(q.pending, sequence)
+	if item.segmentID == 0 {
+		return nil
+	}
+	if err := q.append(queueRecord{Op: queueAckOp, Sequence: sequence}); err != nil {
+		return fmt.Errorf("unable to persist ack of %s to queue %s: %w", filepath, q.Path, err)
+	}
+	q.segmentPending[item.segmentID]--
+	q.compact()
+	return nil
+}
+
+/*
+uploadSettled: Whether an upload ended with the file uploaded or moved to the
+dead letters, so its queue entry can be acknowledged. Entries of uploads which
+failed or were cancelled are left pending to be replayed after a restart.
+*/
+func uploadSettled(uploadStatus int) bool {
+	return uploadStatus == DoneUploadVideoFile || uploadStatus == DeadLetterVideoFile
+}
+
+// ackFileEvent: Acknowledge filepath on queue when the handler has one
+func ackFileEvent(queue FileEventQueue, filepath string) {
+	if queue == nil {
+		return
+	}
+	if err := queue.Ack(filepath); err != nil {
+		log.Printf("WARN: Unable to acknowledge %s: %s", filepath, err)
+	}
+}
+
+// Pending: Entries which haven't been acknowledged, oldest first
+func (q *DiskQueue) Pending() []QueueItem {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	items := make([]QueueItem, 0, len(q.pending))
+	for _, item := range q.pending {
+		items = append(items, *item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Sequence < items[j].Sequence })
+	return items
+}
+
+func (q *DiskQueue) deliver() {
+	for {
+		q.lock.Lock()
+		if len(q.backlog) == 0 {
+			q.lock.Unlock()
+			select {
+			case <-q.notify:
+				continue
+			case <-q.done:
+				return
+			}
+		}
+		item := q.pending[q.backlog[0]]
+		q.backlog = q.backlog[1:]
+		item.Delivered = true
+		q.inFlight[item.Path] = append(q.inFlight[item.Path], item.Sequence)
+		q.lock.Unlock()
+
+		select {
+		case q.Events <- item.Path:
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// Close: Stop delivering events and close the current segment
+func (q *DiskQueue) Close() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	close(q.done)
+	return q.segment.Close()
+}
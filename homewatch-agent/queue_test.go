@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func receiveQueueEvent(t *testing.T, q *DiskQueue) string {
+	select {
+	case path := <-q.Events:
+		return path
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for a queue event")
+	}
+	return ""
+}
+
+func TestDiskQueueReplaysUnacknowledgedEvents(t *testing.T) {
+	dir := t.TempDir()
+	q, err := NewDiskQueue(dir)
+	if err != nil {
+		t.Fatalf("Expected to open the queue, got %s", err)
+	}
+	for _, path := range []string{"a.dav", "b.dav", "c.dav"} {
+		if err := q.Enqueue(path); err != nil {
+			t.Fatalf("Expected to enqueue %s, got %s", path, err)
+		}
+	}
+	for _, expectation := range []string{"a.dav", "b.dav", "c.dav"} {
+		if path := receiveQueueEvent(t, q); path != expectation {
+			t.Fatalf("Expected %s, got %s", expectation, path)
+		}
+	}
+	if err := q.Ack("b.dav"); err != nil {
+		t.Fatalf("Expected to ack b.dav, got %s", err)
+	}
+	q.Close()
+
+	q, err = NewDiskQueue(dir)
+	if err != nil {
+		t.Fatalf("Expected to reopen the queue, got %s", err)
+	}
+	defer q.Close()
+	for _, expectation := range []string{"a.dav", "c.dav"} {
+		if path := receiveQueueEvent(t, q); path != expectation {
+			t.Fatalf("Expected %s, got %s", expectation, path)
+		}
+	}
+	if pending := q.Pending(); len(pending) != 2 {
+		t.Fatalf("Expected 2 pending entries, got %#v", pending)
+	}
+	if err := q.Enqueue("d.dav"); err != nil {
+		t.Fatalf("Expected to enqueue d.dav, got %s", err)
+	}
+	if pending := q.Pending(); pending[2].Sequence <= pending[1].Sequence {
+		t.Fatalf("Expected sequences to keep increasing after replay, got %#v", pending)
+	}
+}
+
+func TestDiskQueueAckRequiresDelivery(t *testing.T) {
+	q, err := NewDiskQueue(t.TempDir())
+	if err != nil {
+		t.Fatalf("Expected to open the queue, got %s", err)
+	}
+	defer q.Close()
+
+	if err := q.Ack("never-enqueued.dav"); !errors.Is(err, ErrNotInFlight) {
+		t.Fatalf("Expected ErrNotInFlight, got %v", err)
+	}
+}
+
+func TestDiskQueueRemovesAcknowledgedSegments(t *testing.T) {
+	dir := t.TempDir()
+	q, err := NewDiskQueue(dir)
+	if err != nil {
+		t.Fatalf("Expected to open the queue, got %s", err)
+	}
+	defer q.Close()
+	q.MaxSegmentBytes = 1
+
+	paths := []string{"a.idx", "b.idx", "c.idx"}
+	for _, path := range paths {
+		q.Enqueue(path)
+	}
+	for range paths {
+		if err := q.Ack(receiveQueueEvent(t, q)); err != nil {
+			t.Fatalf("Expected to ack, got %s", err)
+		}
+	}
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+queueSegmentExtension))
+	if len(segments) != 1 {
+		t.Fatalf("Expected only the current segment to remain, got %v", segments)
+	}
+}
+
+func TestDiskQueueSkipsTornRecords(t *testing.T) {
+	dir := t.TempDir()
+	segment := "{\"op\":\"put\",\"seq\":1,\"path\":\"a.dav\"}\n{\"op\":\"put\",\"seq\":2,\"pa"
+	if err := os.WriteFile(filepath.Join(dir, segmentName(1)), []byte(segment), 0640); err != nil {
+		t.Fatalf("Unable to write segment: %s", err)
+	}
+
+	q, err := NewDiskQueue(dir)
+	if err != nil {
+		t.Fatalf("Expected to open the queue, got %s", err)
+	}
+	defer q.Close()
+	if path := receiveQueueEvent(t, q); path != "a.dav" {
+		t.Fatalf("Expected a.dav, got %s", path)
+	}
+	if pending := q.Pending(); len(pending) != 1 {
+		t.Fatalf("Expected 1 pending entry, got %#v", pending)
+	}
+}
+
+// failingStorage: Fails every Put, like a bucket which can't be reached, sending the key to failed
+type failingStorage struct {
+	*MemoryStorage
+	failed chan string
+}
+
+func (s failingStorage) Put(ctx context.Context, key string, body *os.File, sum []byte) (string, error) {
+	s.failed <- key
+	return "", errors.New("unreachable")
+}
+
+func TestFailedUploadsStayPendingWithoutADeadLetterPath(t *testing.T) {
+	root := t.TempDir()
+	storage := failingStorage{NewMemoryStorage("bucket"), make(chan string, 2)}
+	uploader := NewUploader(storage)
+	uploader.Retry = Backoff{MaxAttempts: 1}
+	uploader.TrimLocalPrefix(root + "/")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	videoQueue, err := NewDiskQueue(t.TempDir())
+	if err != nil {
+		t.Fatalf("Expected to open the queue, got %s", err)
+	}
+	defer videoQueue.Close()
+	videoHandler := NewVideoEventHandler(VideoConfig{Upload: true}, videoQueue.Events)
+	videoHandler.AddUploader(uploader)
+	videoHandler.AddQueue(videoQueue)
+	go videoHandler.Listen(ctx)
+
+	indexQueue, err := NewDiskQueue(t.TempDir())
+	if err != nil {
+		t.Fatalf("Expected to open the queue, got %s", err)
+	}
+	defer indexQueue.Close()
+	indexHandler := NewFileEventHandler(IndexConfig{Upload: true}, indexQueue.Events)
+	indexHandler.AddUploader(uploader)
+	indexHandler.AddQueue(indexQueue)
+	go indexHandler.Listen(ctx)
+
+	video := filepath.Join(root, "Camera1", "a.dav")
+	index := filepath.Join(root, "Camera1", "a.idx")
+	writeTestFile(t, video, "video")
+	writeTestFile(t, index, "")
+	for path, queue := range map[string]*DiskQueue{video: videoQueue, index: indexQueue} {
+		if err := queue.Enqueue(path); err != nil {
+			t.Fatalf("Expected to enqueue %s, got %s", path, err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-storage.failed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for the uploads to fail")
+		}
+	}
+	cancel()
+	videoHandler.Drain(context.Background())
+	indexHandler.Drain(context.Background())
+
+	for path, queue := range map[string]*DiskQueue{video: videoQueue, index: indexQueue} {
+		if pending := queue.Pending(); len(pending) != 1 || pending[0].Path != path {
+			t.Fatalf("Expected the failed upload of %s to stay pending, got %#v", path, pending)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+)
+
+/*
+ConfigChanges: How a reloaded configuration differs from the running one. Only
+v2 watch paths, the shutdown timeout and the settings of running publishers
+change without a restart, everything else which differs is listed in
+RestartRequired and left as it is.
+*/
+type ConfigChanges struct {
+	AddedWatchPaths   []string
+	RemovedWatchPaths []string
+	// Publishers: The new publisher settings by pipeline name
+	Publishers      map[string]PublisherConfig
+	RestartRequired []string
+}
+
+// DiffConfig: The changes to make to the running configuration to reach next
+func DiffConfig(running, next *Config) ConfigChanges {
+	changes := ConfigChanges{Publishers: map[string]PublisherConfig{}}
+	changes.AddedWatchPaths = missingFrom(running.V2.WatchPaths, next.V2.WatchPaths)
+	changes.RemovedWatchPaths = missingFrom(next.V2.WatchPaths, running.V2.WatchPaths)
+
+	// Compare everything else with the hot settings made equal
+	applied := *next
+	applied.V2.WatchPaths = running.V2.WatchPaths
+	applied.ShutdownTimeout = running.ShutdownTimeout
+	applied.Pipelines = nil
+	compared := *running
+	compared.Pipelines = nil
+	if !reflect.DeepEqual(applied, compared) {
+		changes.RestartRequired = append(changes.RestartRequired, "agent settings other than v2.watchPaths and shutdownTimeout")
+	}
+	if len(running.Pipelines) != len(next.Pipelines) {
+		changes.RestartRequired = append(changes.RestartRequired, "pipelines")
+		return changes
+	}
+	for i, pipeline := range next.Pipelines {
+		current := running.Pipelines[i]
+		field := fmt.Sprintf("pipelines[%d]", i)
+		if pipeline.Publisher != current.Publisher {
+			// A publisher can't be added or removed from a running pipeline
+			if pipeline.Publisher.Enabled() && current.Publisher.Enabled() {
+				changes.Publishers[pipeline.Name] = pipeline.Publisher
+			} else {
+				changes.RestartRequired = append(changes.RestartRequired, field+".publisher")
+			}
+		}
+		pipeline.Publisher = current.Publisher
+		if !reflect.DeepEqual(pipeline, current) {
+			changes.RestartRequired = append(changes.RestartRequired, field)
+		}
+	}
+	return changes
+}
+
+// missingFrom: The items of b which aren't in a
+func missingFrom(a, b []string) []string {
+	missing := []string{}
+	for _, item := range b {
+		found := false
+		for _, other := range a {
+			found = found || item == other
+		}
+		if !found {
+			missing = append(missing, item)
+		}
+	}
+	return missing
+}
+
+/*
+reloadConfig: Read the configuration again and apply what can change while
+running, returning the configuration now running. An invalid configuration
+is logged and leaves the agent as it is.
+*/
+func reloadConfig(running *Config, pipelines []*Pipeline) *Config {
+	next, err := buildConfig()
+	if err != nil {
+		log.Printf("ERROR: Not reloading: %s", err)
+		return running
+	}
+	changes := DiffConfig(running, next)
+	applied := *running
+	applied.V2.WatchPaths = next.V2.WatchPaths
+	applied.ShutdownTimeout = next.ShutdownTimeout
+	applied.Pipelines = append([]PipelineConfig{}, running.Pipelines...)
+
+	for _, pipeline := range pipelines {
+		watcher, ok := pipeline.source.(PathWatcher)
+		if !ok {
+			continue
+		}
+		for _, path := range changes.AddedWatchPaths {
+			if err := watcher.Watch(path); err != nil {
+				log.Printf("WARN: Error watching %s: %s", path, err)
+			}
+		}
+		for _, path := range changes.RemovedWatchPaths {
+			watcher.Unwatch(path)
+		}
+	}
+	for i, pipeline := range pipelines {
+		if publisher, ok := changes.Publishers[pipeline.Config.Name]; ok {
+			pipeline.Reconfigure(publisher)
+			applied.Pipelines[i].Publisher = publisher
+			log.Printf("INFO: Reconfigured the %s publisher", pipeline.Config.Name)
+		}
+	}
+	for _, field := range changes.RestartRequired {
+		log.Printf("WARN: Restart to apply the changes to %s", field)
+	}
+	log.Printf("INFO: Reloaded configuration")
+	return &applied
+}
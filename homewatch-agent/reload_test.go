@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func runningTestConfig() *Config {
+	config := DefaultConfig()
+	config.V2.WatchPaths = []string{"/mnt/garage", "/mnt/porch"}
+	config.Pipelines[0].Syslog.Address = "0.0.0.0:5140"
+	config.Pipelines[0].Publisher.Url = "https://example.com/events"
+	config.Pipelines[0].Publisher.Authorization = "Bearer old"
+	return config
+}
+
+func TestDiffConfigAppliesHotSettings(t *testing.T) {
+	running := runningTestConfig()
+	next := runningTestConfig()
+	next.V2.WatchPaths = []string{"/mnt/porch", "/mnt/driveway"}
+	next.Pipelines[0].Publisher.Authorization = "Bearer new"
+	next.Pipelines[0].Publisher.ConsolidationInterval = Duration(time.Minute)
+
+	changes := DiffConfig(running, next)
+	if len(changes.AddedWatchPaths) != 1 || changes.AddedWatchPaths[0] != "/mnt/driveway" {
+		t.Fatalf("Expected /mnt/driveway to be added, got %v", changes.AddedWatchPaths)
+	}
+	if len(changes.RemovedWatchPaths) != 1 || changes.RemovedWatchPaths[0] != "/mnt/garage" {
+		t.Fatalf("Expected /mnt/garage to be removed, got %v", changes.RemovedWatchPaths)
+	}
+	publisher, ok := changes.Publishers[defaultPipelineName]
+	if !ok || publisher.Authorization != "Bearer new" || time.Duration(publisher.ConsolidationInterval) != time.Minute {
+		t.Fatalf("Expected the new publisher settings, got %+v", changes.Publishers)
+	}
+	if len(changes.RestartRequired) != 0 {
+		t.Fatalf("Expected no restart, got %v", changes.RestartRequired)
+	}
+}
+
+func TestDiffConfigRequiresRestart(t *testing.T) {
+	running := runningTestConfig()
+	next := runningTestConfig()
+	next.QueuePath = "/var/lib/homewatch/queue"
+	next.Pipelines[0].Syslog.Address = "0.0.0.0:5141"
+	next.Pipelines[0].Publisher.Url = ""
+
+	changes := DiffConfig(running, next)
+	if len(changes.RestartRequired) != 3 {
+		t.Fatalf("Expected 3 changes requiring a restart, got %v", changes.RestartRequired)
+	}
+	if len(changes.Publishers) != 0 {
+		t.Fatalf("Expected the publisher to be left running, got %+v", changes.Publishers)
+	}
+
+	next = runningTestConfig()
+	next.Pipelines = append(next.Pipelines, DefaultPipelineConfig("porch"))
+	if changes := DiffConfig(running, next); len(changes.RestartRequired) != 1 {
+		t.Fatalf("Expected adding a pipeline to require a restart, got %v", changes.RestartRequired)
+	}
+}
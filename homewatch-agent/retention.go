@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// DefaultRetentionInterval: How often retention policies are enforced
+const DefaultRetentionInterval = time.Hour
+
+// DefaultUploadReaperMaxAge: How old uploaded files get with v2.uploadReaper and no retention policies
+const DefaultUploadReaperMaxAge = 7 * 24 * time.Hour
+
+// RetentionRemoval: A file retention removed, or would have in a dry run, and why
+type RetentionRemoval struct {
+	Path   string
+	Policy string
+	Reason string
+	Bytes  int64
+}
+
+// retainedFile: An uploaded file and the policy it's kept by
+type retainedFile struct {
+	path    string
+	policy  int
+	size    int64
+	modTime time.Time
+	// uploaded: When State recorded the file as uploaded, or its modTime when it has no upload time
+	uploaded time.Time
+}
+
+/*
+Retention: Removes uploaded files by the first of Policies matching each,
+oldest first, once they were uploaded longer than its maxAge ago, once its
+files take up more than its maxBytes, or while the file system holding Path has less than its
+minFreePercent free. Only files State records as uploaded are ever removed.
+*/
+type Retention struct {
+	Policies []RetentionPolicyConfig
+	// Path: Where free space is measured
+	Path   string
+	DryRun bool
+	State  *StateStore
+	now    func() time.Time
+	// diskUsage: The free and total bytes of the file system holding a path
+	diskUsage func(path string) (free, total uint64, err error)
+}
+
+func NewRetention(policies []RetentionPolicyConfig, path string, state *StateStore) *Retention {
+	return &Retention{
+		Policies:  policies,
+		Path:      path,
+		State:     state,
+		now:       time.Now,
+		diskUsage: diskUsage,
+	}
+}
+
+// Run: Enforce the policies every interval, forever
+func (r *Retention) Run(interval time.Duration) {
+	log.Printf("DEBUG: Enforcing %d retention policies every %s", len(r.Policies), interval)
+	for {
+		time.Sleep(interval)
+		if _, err := r.Enforce(); err != nil {
+			log.Printf("ERROR: Unable to enforce retention: %s", err)
+		}
+	}
+}
+
+/*
+Enforce: Remove the files the policies don't keep, or only report them in a
+dry run, returning what was removed
+*/
+func (r *Retention) Enforce() ([]RetentionRemoval, error) {
+	records, err := r.State.Files(func(record FileRecord) bool { return record.State == UploadedFile })
+	if err != nil {
+		return nil, fmt.Errorf("unable to list uploaded files: %w", err)
+	}
+	byPolicy := make([][]retainedFile, len(r.Policies))
+	for _, record := range records {
+		info, err := os.Stat(record.Path)
+		if os.IsNotExist(err) {
+			// Removed by something else, like cleanup
+			if !r.DryRun {
+				r.State.Reaped(record.Path)
+			}
+			continue
+		}
+		if err != nil {
+			log.Printf("WARN: Unable to check %s for retention: %s", record.Path, err)
+			continue
+		}
+		policy := r.match(record)
+		if policy < 0 {
+			continue
+		}
+		uploaded := record.Times[UploadedFile]
+		if uploaded.IsZero() {
+			uploaded = info.ModTime()
+		}
+		byPolicy[policy] = append(byPolicy[policy], retainedFile{record.Path, policy, info.Size(), info.ModTime(), uploaded})
+	}
+
+	removals := []RetentionRemoval{}
+	remove := func(file retainedFile, reason string) bool {
+		policy := r.Policies[file.policy].Name
+		if r.DryRun {
+			log.Printf("INFO: Would remove %s (%d bytes) by retention policy %s, %s", file.path, file.size, policy, reason)
+		} else {
+			log.Printf("INFO: Removing %s (%d bytes) by retention policy %s, %s", file.path, file.size, policy, reason)
+			if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+				log.Printf("WARN: Unable to remove %s: %s", file.path, err)
+				return false
+			}
+			r.State.Reaped(file.path)
+		}
+		removals = append(removals, RetentionRemoval{file.path, policy, reason, file.size})
+		return true
+	}
+
+	now := r.now()
+	for i, policy := range r.Policies {
+		files := byPolicy[i]
+		sort.Slice(files, func(a, b int) bool { return files[a].modTime.Before(files[b].modTime) })
+		kept := []retainedFile{}
+		total := int64(0)
+		for _, file := range files {
+			// Aged from the upload, so a file uploaded late, like from the dead letters, isn't removed right away
+			if policy.MaxAge > 0 && now.Sub(file.uploaded) > time.Duration(policy.MaxAge) {
+				if remove(file, fmt.Sprintf("uploaded more than %s ago", policy.MaxAge)) {
+					continue
+				}
+			}
+			kept = append(kept, file)
+			total += file.size
+		}
+		for len(kept) > 0 && policy.MaxBytes > 0 && total > policy.MaxBytes {
+			if remove(kept[0], fmt.Sprintf("its files take up more than %d bytes", policy.MaxBytes)) {
+				total -= kept[0].size
+			}
+			kept = kept[1:]
+		}
+		byPolicy[i] = kept
+	}
+
+	if err := r.freeSpace(byPolicy, removals, remove); err != nil {
+		return removals, err
+	}
+	return removals, nil
+}
+
+/*
+freeSpace: Remove the oldest files of each policy with a minFreePercent until
+that much of Path's file system is free. A dry run counts what it would already
+have removed as freed, so it reports the same files.
+*/
+func (r *Retention) freeSpace(byPolicy [][]retainedFile, removed []RetentionRemoval, remove func(retainedFile, string) bool) error {
+	needed := false
+	for _, policy := range r.Policies {
+		needed = needed || policy.MinFreePercent > 0
+	}
+	if !needed {
+		return nil
+	}
+	free, total, err := r.diskUsage(r.Path)
+	if err != nil {
+		return fmt.Errorf("unable to measure free space on %s: %w", r.Path, err)
+	}
+	if total == 0 {
+		return nil
+	}
+	for _, removal := range removed {
+		if r.DryRun {
+			free += uint64(removal.Bytes)
+		}
+	}
+	for i, policy := range r.Policies {
+		if policy.MinFreePercent <= 0 {
+			continue
+		}
+		reason := fmt.Sprintf("less than %g%% of %s is free", policy.MinFreePercent, r.Path)
+		files := byPolicy[i]
+		for len(files) > 0 && float64(free)*100/float64(total) < policy.MinFreePercent {
+			if remove(files[0], reason) {
+				free += uint64(files[0].size)
+			}
+			files = files[1:]
+		}
+		if percent := float64(free) * 100 / float64(total); percent < policy.MinFreePercent {
+			log.Printf("WARN: %.1f%% of %s is free, retention policy %s has no more uploaded files to remove", percent, r.Path, policy.Name)
+		}
+	}
+	return nil
+}
+
+// match: The index of the first policy matching record, or -1 when none do
+func (r *Retention) match(record FileRecord) int {
+	fileType := fileTypeOf(record.Path)
+	for i, policy := range r.Policies {
+		if matchesAny(policy.Cameras, record.Camera) && matchesAny(policy.FileTypes, fileType) {
+			return i
+		}
+	}
+	return -1
+}
+
+// diskUsage: The free and total bytes of the file system holding path
+func diskUsage(path string) (free, total uint64, err error) {
+	stat := syscall.Statfs_t{}
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), stat.Blocks * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// retentionTestFile: Write a file of size bytes under camera, last modified age before now
+func retentionTestFile(t *testing.T, root, camera, name string, size int, age time.Duration, now time.Time) string {
+	path := filepath.Join(root, camera, "2022-03-01", "001", "dav", "04", name)
+	writeTestFile(t, path, string(make([]byte, size)))
+	if err := os.Chtimes(path, now.Add(-age), now.Add(-age)); err != nil {
+		t.Fatalf("Expected to age %s, got %s", path, err)
+	}
+	return path
+}
+
+func newTestRetention(t *testing.T, policies ...RetentionPolicyConfig) (*Retention, time.Time) {
+	state := openTestStateStore(t, filepath.Join(t.TempDir(), "state.db"))
+	t.Cleanup(func() { state.Close() })
+	now := time.Date(2022, 3, 10, 0, 0, 0, 0, time.UTC)
+	retention := NewRetention(policies, t.TempDir(), state)
+	retention.now = func() time.Time { return now }
+	state.now = func() time.Time { return now }
+	return retention, now
+}
+
+// uploadedBefore: Record path as uploaded age before now
+func uploadedBefore(retention *Retention, path string, age time.Duration, now time.Time) {
+	retention.State.now = func() time.Time { return now.Add(-age) }
+	retention.State.Uploaded(path, "etag")
+	retention.State.now = func() time.Time { return now }
+}
+
+func removedPaths(removals []RetentionRemoval) map[string]bool {
+	paths := map[string]bool{}
+	for _, removal := range removals {
+		paths[removal.Path] = true
+	}
+	return paths
+}
+
+func TestRetentionOnlyRemovesUploadedFiles(t *testing.T) {
+	retention, now := newTestRetention(t, RetentionPolicyConfig{Name: "week", MaxAge: Duration(7 * 24 * time.Hour)})
+	root := t.TempDir()
+	uploaded := retentionTestFile(t, root, "Camera1", "a.dav", 10, 8*24*time.Hour, now)
+	pending := retentionTestFile(t, root, "Camera1", "b.dav", 10, 8*24*time.Hour, now)
+	recent := retentionTestFile(t, root, "Camera1", "c.dav", 10, time.Hour, now)
+	uploadedBefore(retention, uploaded, 8*24*time.Hour, now)
+	retention.State.Uploading(pending)
+	uploadedBefore(retention, recent, time.Hour, now)
+
+	removals, err := retention.Enforce()
+	if err != nil {
+		t.Fatalf("Expected retention to be enforced, got %s", err)
+	}
+	if removed := removedPaths(removals); len(removed) != 1 || !removed[uploaded] {
+		t.Fatalf("Expected only %s to be removed, got %v", uploaded, removals)
+	}
+	if _, err := os.Stat(uploaded); !os.IsNotExist(err) {
+		t.Fatalf("Expected %s to be removed, got %v", uploaded, err)
+	}
+	if _, err := os.Stat(pending); err != nil {
+		t.Fatalf("Expected the file not confirmed uploaded to be kept, got %s", err)
+	}
+	if record, _ := retention.State.File(uploaded); record.State != ReapedFile {
+		t.Fatalf("Expected %s to be recorded as reaped, got %s", uploaded, record.State)
+	}
+}
+
+func TestRetentionAgesFilesFromTheirUpload(t *testing.T) {
+	retention, now := newTestRetention(t, RetentionPolicyConfig{Name: "week", MaxAge: Duration(7 * 24 * time.Hour)})
+	root := t.TempDir()
+	late := retentionTestFile(t, root, "Camera1", "a.dav", 10, 8*24*time.Hour, now)
+	unrecorded := retentionTestFile(t, root, "Camera1", "b.dav", 10, 8*24*time.Hour, now)
+	// Like a dead letter redriven long after it was recorded
+	uploadedBefore(retention, late, time.Hour, now)
+	// Like a record from before upload times were kept
+	retention.State.record(unrecorded, UploadedFile, func(record *FileRecord) { delete(record.Times, UploadedFile) })
+
+	removals, err := retention.Enforce()
+	if err != nil {
+		t.Fatalf("Expected retention to be enforced, got %s", err)
+	}
+	if removed := removedPaths(removals); len(removed) != 1 || !removed[unrecorded] {
+		t.Fatalf("Expected only %s, aged by its modTime, to be removed, got %v", unrecorded, removals)
+	}
+}
+
+func TestRetentionDryRunRemovesNothing(t *testing.T) {
+	retention, now := newTestRetention(t, RetentionPolicyConfig{Name: "week", MaxAge: Duration(7 * 24 * time.Hour)})
+	retention.DryRun = true
+	old := retentionTestFile(t, t.TempDir(), "Camera1", "a.dav", 10, 8*24*time.Hour, now)
+	uploadedBefore(retention, old, 8*24*time.Hour, now)
+
+	removals, err := retention.Enforce()
+	if err != nil || len(removals) != 1 || removals[0].Path != old {
+		t.Fatalf("Expected %s to be reported, got %v %v", old, removals, err)
+	}
+	if _, err := os.Stat(old); err != nil {
+		t.Fatalf("Expected a dry run to keep %s, got %s", old, err)
+	}
+	if record, _ := retention.State.File(old); record.State != UploadedFile {
+		t.Fatalf("Expected a dry run to leave %s uploaded, got %s", old, record.State)
+	}
+}
+
+func TestRetentionMaxBytesByCameraAndFileType(t *testing.T) {
+	retention, now := newTestRetention(t,
+		RetentionPolicyConfig{Name: "camera1-video", Cameras: []string{"Camera1"}, FileTypes: []string{VideoFileType}, MaxBytes: 25},
+		RetentionPolicyConfig{Name: "rest", MaxAge: Duration(30 * 24 * time.Hour)},
+	)
+	root := t.TempDir()
+	oldest := retentionTestFile(t, root, "Camera1", "a.dav", 10, 3*time.Hour, now)
+	older := retentionTestFile(t, root, "Camera1", "b.dav", 10, 2*time.Hour, now)
+	newest := retentionTestFile(t, root, "Camera1", "c.dav", 10, time.Hour, now)
+	index := retentionTestFile(t, root, "Camera1", "a.idx", 100, 4*time.Hour, now)
+	other := retentionTestFile(t, root, "Camera2", "a.dav", 100, 4*time.Hour, now)
+	for _, path := range []string{oldest, older, newest, index, other} {
+		retention.State.Uploaded(path, "etag")
+	}
+
+	removals, err := retention.Enforce()
+	if err != nil {
+		t.Fatalf("Expected retention to be enforced, got %s", err)
+	}
+	if removed := removedPaths(removals); len(removed) != 1 || !removed[oldest] {
+		t.Fatalf("Expected only %s to be removed to fit 25 bytes, got %v", oldest, removals)
+	}
+}
+
+func TestRetentionMinFreePercent(t *testing.T) {
+	retention, now := newTestRetention(t, RetentionPolicyConfig{Name: "space", MinFreePercent: 10})
+	retention.diskUsage = func(path string) (uint64, uint64, error) { return 50, 1000, nil }
+	root := t.TempDir()
+	oldest := retentionTestFile(t, root, "Camera1", "a.dav", 30, 3*time.Hour, now)
+	older := retentionTestFile(t, root, "Camera2", "b.dav", 30, 2*time.Hour, now)
+	newest := retentionTestFile(t, root, "Camera1", "c.dav", 30, time.Hour, now)
+	for _, path := range []string{oldest, older, newest} {
+		retention.State.Uploaded(path, "etag")
+	}
+
+	removals, err := retention.Enforce()
+	if err != nil {
+		t.Fatalf("Expected retention to be enforced, got %s", err)
+	}
+	if removed := removedPaths(removals); len(removed) != 2 || !removed[oldest] || !removed[older] {
+		t.Fatalf("Expected the two oldest files to be removed to free 10%%, got %v", removals)
+	}
+}
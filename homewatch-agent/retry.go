@@ -0,0 +1,45 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff: How many times to attempt an operation and how long to wait between attempts
+type Backoff struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// DefaultBackoff: 5 attempts over roughly a minute
+var DefaultBackoff = Backoff{
+	MaxAttempts: 5,
+	BaseDelay:   2 * time.Second,
+	MaxDelay:    time.Minute,
+}
+
+/*
+Delay: The jittered wait before retrying after attempt has failed. The wait
+doubles each attempt up to MaxDelay and is randomized between half and all of it
+so retries from concurrent uploads spread out.
+*/
+func (b Backoff) Delay(attempt int) time.Duration {
+	if attempt < 1 || b.BaseDelay <= 0 {
+		return 0
+	}
+	delay := b.BaseDelay
+	for i := 1; i < attempt && i < 32 && (b.MaxDelay <= 0 || delay < b.MaxDelay); i++ {
+		delay *= 2
+	}
+	if b.MaxDelay > 0 && delay > b.MaxDelay {
+		delay = b.MaxDelay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// Exhausted: True when no attempts remain after attempt
+func (b Backoff) Exhausted(attempt int) bool {
+	return attempt >= b.MaxAttempts
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	backoff := Backoff{MaxAttempts: 5, BaseDelay: time.Second, MaxDelay: 4 * time.Second}
+
+	expectations := map[int]time.Duration{
+		1: time.Second,
+		2: 2 * time.Second,
+		3: 4 * time.Second,
+		9: 4 * time.Second,
+	}
+	for attempt, ceiling := range expectations {
+		for i := 0; i < 100; i++ {
+			delay := backoff.Delay(attempt)
+			if delay < ceiling/2 || delay > ceiling {
+				t.Fatalf("Expected attempt %d to wait between %s and %s, got %s", attempt, ceiling/2, ceiling, delay)
+			}
+		}
+	}
+	if delay := backoff.Delay(0); delay != 0 {
+		t.Fatalf("Expected no delay before the first attempt, got %s", delay)
+	}
+}
+
+func TestBackoffExhausted(t *testing.T) {
+	backoff := Backoff{MaxAttempts: 2}
+	if backoff.Exhausted(1) {
+		t.Fatalf("Expected a second attempt")
+	}
+	if !backoff.Exhausted(2) {
+		t.Fatalf("Expected no third attempt")
+	}
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/url"
 	"os"
@@ -14,117 +18,164 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 )
 
-type S3Uploader struct {
-	Context         context.Context
-	s3Client        *s3.Client
-	Bucket          string
-	prefix          string
-	localTrimPrefix string
+const (
+	defaultS3Region = "us-west-2"
+	// checksumMetadataKey: Object metadata holding the hex SHA-256 of the whole
+	// file, since the checksum S3 keeps for multipart objects is of the parts
+	checksumMetadataKey = "sha256"
+)
+
+// S3Storage: A StorageBackend putting files in an S3, or S3-compatible, bucket
+type S3Storage struct {
+	s3Client S3Client
+	Bucket   string
+	prefix   string
+	// Multipart: Upload files larger than Multipart.PartSize in parts when set
+	Multipart *MultipartOptions
 }
 
-type S3FileUploader interface {
-	UploadFile(string, chan<- int)
+// S3Client: The subset of *s3.Client used by S3Storage
+type S3Client interface {
+	PutObject(context.Context, *s3.PutObjectInput, ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	HeadObject(context.Context, *s3.HeadObjectInput, ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	HeadBucket(context.Context, *s3.HeadBucketInput, ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	CreateMultipartUpload(context.Context, *s3.CreateMultipartUploadInput, ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(context.Context, *s3.UploadPartInput, ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(context.Context, *s3.CompleteMultipartUploadInput, ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(context.Context, *s3.AbortMultipartUploadInput, ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
 }
 
-func DefaultS3Client() *s3.Client {
+// S3ClientOptions: Where DefaultS3Client sends requests. The zero value is AWS S3.
+type S3ClientOptions struct {
+	// Endpoint: Base URL of an S3-compatible service like http://minio:9000
+	Endpoint string
+	// Region: Defaults to the AWS configuration's region, then us-west-2
+	Region string
+	// UsePathStyle: Address buckets as endpoint/bucket instead of bucket.endpoint
+	UsePathStyle bool
+}
+
+func DefaultS3Client(options S3ClientOptions) (*s3.Client, error) {
 	ctx := context.TODO()
 
 	cfg, err := config.LoadDefaultConfig(ctx)
 	if err != nil {
-		log.Printf("Unable to create AWS configuration: %s", err)
-		return nil
+		return nil, fmt.Errorf("unable to create AWS configuration: %w", err)
+	}
+	region := options.Region
+	if len(region) == 0 {
+		region = cfg.Region
+	}
+	if len(region) == 0 {
+		region = defaultS3Region
 	}
 	cachedCredentialProvider := aws.NewCredentialsCache(cfg.Credentials)
-	return s3.New(s3.Options{
-		Credentials: cachedCredentialProvider,
-		Region:      "us-west-2",
-	})
+	s3Options := s3.Options{
+		Credentials:  cachedCredentialProvider,
+		Region:       region,
+		UsePathStyle: options.UsePathStyle,
+	}
+	if len(options.Endpoint) > 0 {
+		s3Options.EndpointResolver = s3.EndpointResolverFromURL(options.Endpoint, func(endpoint *aws.Endpoint) {
+			endpoint.HostnameImmutable = options.UsePathStyle
+		})
+	}
+	return s3.New(s3Options), nil
 }
 
 /*
-	NewS3Uploader
+	NewS3Storage
 
-Create a new uploader where the bucketUrl is a valid, schemed, url like
-s3://bucket/prefix/deeperPrefix
+Create a new S3 backend where the bucketUrl is a valid, schemed, url like
+s3://bucket/prefix/deeperPrefix. Returns an error when the bucket isn't accessible.
 */
-func NewS3Uploader(s3Client *s3.Client, bucketUrl string) *S3Uploader {
+func NewS3Storage(s3Client S3Client, bucketUrl string) (*S3Storage, error) {
 	url, err := url.Parse(bucketUrl)
 	if err != nil {
-		log.Printf("%s isn't a valid S3 bucket URL: %s", bucketUrl, err)
-		return nil
+		return nil, fmt.Errorf("%s isn't a valid S3 bucket URL: %w", bucketUrl, err)
 	}
-	if !canAccessBucket(s3Client, url.Host) {
-		log.Panicf("PANIC: Unable to access S3 bucket %s", url.Host)
+	if err := checkBucketAccess(s3Client, url.Host); err != nil {
+		return nil, err
 	}
 	log.Printf("INFO: Bucket access ok: %s", url.Host)
 
-	return &S3Uploader{
-		Context:  context.TODO(),
+	return &S3Storage{
 		s3Client: s3Client,
 		Bucket:   url.Host,
 		prefix:   url.Path,
-	}
+	}, nil
 }
 
-func canAccessBucket(client *s3.Client, bucket string) bool {
+func checkBucketAccess(client S3Client, bucket string) error {
 	_, err := client.HeadBucket(context.TODO(), &s3.HeadBucketInput{
 		Bucket: &bucket,
 	})
 	if err != nil {
-		log.Printf("ERROR: Unable to access S3 bucket %s: %s", bucket, err)
-		return false
+		return fmt.Errorf("unable to access S3 bucket %s: %w", bucket, err)
 	}
-	return true
+	return nil
 }
 
-/*
-	TrimLocalPrefix: Set the local prefix to trim from video files
-
-before uploading them
-*/
-func (u *S3Uploader) TrimLocalPrefix(prefix string) {
-	u.localTrimPrefix = prefix
+func (s *S3Storage) String() string {
+	return fmt.Sprintf("s3://%s%s", s.Bucket, s.prefix)
 }
 
-const (
-	ErrorOpeningVideoFile = iota
-	ErrorUploadingVideoFile
-	StartUploadVideoFile
-	DoneUploadVideoFile
-)
+func (s *S3Storage) objectKey(key string) string {
+	return strings.TrimPrefix(fmt.Sprintf("%s/%s", s.prefix, key), "/")
+}
 
-func (u *S3Uploader) UploadFile(filepath string, status chan<- int) {
-	if flagVerbose {
-		log.Printf("Uploading %s", filepath)
-	}
-	body, err := os.Open(filepath)
+// Exists: True when key has the SHA-256 metadata of sum
+func (s *S3Storage) Exists(ctx context.Context, key string, sum []byte) (bool, error) {
+	objectKey := s.objectKey(key)
+	output, err := s.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &s.Bucket,
+		Key:    &objectKey,
+	})
 	if err != nil {
-		log.Printf("Error opening video file %s: %s", filepath, err)
-		status <- ErrorOpeningVideoFile
-		return
+		var notFound *types.NotFound
+		var apiErr smithy.APIError
+		if errors.As(err, &notFound) || (errors.As(err, &apiErr) && apiErr.ErrorCode() == "NotFound") {
+			return false, nil
+		}
+		return false, err
 	}
-	defer body.Close()
+	return output.Metadata[checksumMetadataKey] == hex.EncodeToString(sum), nil
+}
 
-	sensorVideoPath := strings.TrimPrefix(filepath, u.localTrimPrefix)
-	key := strings.TrimPrefix(fmt.Sprintf("%s/%s", u.prefix, sensorVideoPath), "/")
-	log.Printf("DEBUG: Uploading %s to %s", filepath, key)
+/*
+Put: Upload body to key under the bucket prefix, in parts when it's large. S3
+rejects the upload when what it received doesn't match sum.
+*/
+func (s *S3Storage) Put(ctx context.Context, key string, body *os.File, sum []byte) (string, error) {
+	objectKey := s.objectKey(key)
+	if s.Multipart != nil {
+		info, err := body.Stat()
+		if err != nil {
+			return "", err
+		}
+		if info.Size() > s.Multipart.PartSize {
+			return s.putMultipart(ctx, body, info, objectKey, sum)
+		}
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
 	input := &s3.PutObjectInput{
-		Bucket:       &u.Bucket,
-		Key:          &key,
+		Bucket:       &s.Bucket,
+		Key:          &objectKey,
 		Body:         body,
 		StorageClass: types.StorageClassIntelligentTiering,
+		// S3 rejects the body when it doesn't match the checksum
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+		ChecksumSHA256:    aws.String(base64.StdEncoding.EncodeToString(sum)),
+		Metadata:          map[string]string{checksumMetadataKey: hex.EncodeToString(sum)},
 	}
-	status <- StartUploadVideoFile
-	_, err = u.s3Client.PutObject(u.Context, input)
+	output, err := s.s3Client.PutObject(ctx, input)
 	if err != nil {
-		log.Printf("Error uploading video file %s to %s: %s", filepath, key, err)
-		status <- ErrorUploadingVideoFile
-		return
-	}
-	if flagDebug {
-		log.Printf("Uploaded %s to %s", filepath, key)
+		return "", err
 	}
-	status <- DoneUploadVideoFile
+	return aws.ToString(output.ETag), nil
 }
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	v2 "github.com/mrmod/homewatch/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type MockS3Client struct {
+	Failures int
+	Puts     map[string]string
+	attempts int
+	// HeadBucketErr: Returned by HeadBucket when set
+	HeadBucketErr error
+	Metadata      map[string]map[string]string
+
+	// FailPart: UploadPart fails once for this part number
+	FailPart    int32
+	PartUploads int
+	// Aborted: The IDs of the multipart uploads aborted
+	Aborted  []string
+	lock     sync.Mutex
+	uploads  map[string]map[int32][]byte
+	metadata map[string]map[string]string
+}
+
+// verifyChecksum: Reject b like S3 does when it doesn't match its base64 SHA-256 checksum
+func verifyChecksum(b []byte, checksum *string) error {
+	if checksum == nil {
+		return nil
+	}
+	sum := sha256.Sum256(b)
+	if base64.StdEncoding.EncodeToString(sum[:]) != *checksum {
+		return errors.New("mock BadDigest")
+	}
+	return nil
+}
+
+func (c *MockS3Client) PutObject(ctx context.Context, input *s3.PutObjectInput, opts ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	c.attempts++
+	b, err := io.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	if c.attempts <= c.Failures {
+		return nil, errors.New("mock PutObject failure")
+	}
+	if err := verifyChecksum(b, input.ChecksumSHA256); err != nil {
+		return nil, err
+	}
+	c.Puts[*input.Key] = string(b)
+	c.setMetadata(*input.Key, input.Metadata)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (c *MockS3Client) setMetadata(key string, metadata map[string]string) {
+	if c.Metadata == nil {
+		c.Metadata = map[string]map[string]string{}
+	}
+	c.Metadata[key] = metadata
+}
+
+func (c *MockS3Client) HeadObject(ctx context.Context, input *s3.HeadObjectInput, opts ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	if _, ok := c.Puts[*input.Key]; !ok {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{Metadata: c.Metadata[*input.Key]}, nil
+}
+
+func (c *MockS3Client) HeadBucket(ctx context.Context, input *s3.HeadBucketInput, opts ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	if c.HeadBucketErr != nil {
+		return nil, c.HeadBucketErr
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (c *MockS3Client) CreateMultipartUpload(ctx context.Context, input *s3.CreateMultipartUploadInput, opts ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.uploads == nil {
+		c.uploads = map[string]map[int32][]byte{}
+	}
+	if c.metadata == nil {
+		c.metadata = map[string]map[string]string{}
+	}
+	uploadID := fmt.Sprintf("upload-%d", len(c.uploads)+1)
+	c.uploads[uploadID] = map[int32][]byte{}
+	c.metadata[uploadID] = input.Metadata
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(uploadID)}, nil
+}
+
+func (c *MockS3Client) UploadPart(ctx context.Context, input *s3.UploadPartInput, opts ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	b, err := io.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.PartUploads++
+	if input.PartNumber == c.FailPart {
+		c.FailPart = 0
+		return nil, errors.New("mock UploadPart failure")
+	}
+	if err := verifyChecksum(b, input.ChecksumSHA256); err != nil {
+		return nil, err
+	}
+	c.uploads[*input.UploadId][input.PartNumber] = b
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf("etag-%d", input.PartNumber))}, nil
+}
+
+func (c *MockS3Client) CompleteMultipartUpload(ctx context.Context, input *s3.CompleteMultipartUploadInput, opts ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	body := []byte{}
+	for _, part := range input.MultipartUpload.Parts {
+		body = append(body, c.uploads[*input.UploadId][part.PartNumber]...)
+	}
+	c.Puts[*input.Key] = string(body)
+	c.setMetadata(*input.Key, c.metadata[*input.UploadId])
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (c *MockS3Client) AbortMultipartUpload(ctx context.Context, input *s3.AbortMultipartUploadInput, opts ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Aborted = append(c.Aborted, *input.UploadId)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func newTestUploader(t *testing.T, client *MockS3Client) (*Uploader, string) {
+	root := t.TempDir()
+	storage, err := NewStorage("s3://bucket/prefix", StorageOptions{S3Client: client})
+	if err != nil {
+		t.Fatalf("Expected to create S3 storage, got %s", err)
+	}
+	uploader := NewUploader(storage)
+	uploader.TrimLocalPrefix(filepath.Join(root, "cameras") + "/")
+	uploader.Retry = Backoff{MaxAttempts: 3}
+	uploader.DeadLetterPath = filepath.Join(root, "dead-letters")
+	return uploader, root
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		t.Fatalf("Unable to create %s: %s", path, err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0640); err != nil {
+		t.Fatalf("Unable to write %s: %s", path, err)
+	}
+}
+
+func TestUploadFileRetries(t *testing.T) {
+	client := &MockS3Client{Failures: 2, Puts: map[string]string{}}
+	uploader, root := newTestUploader(t, client)
+	video := filepath.Join(root, "cameras", "Camera1", "a.dav")
+	writeTestFile(t, video, "video")
+
+	if status := uploadFile(video, uploader); status != DoneUploadVideoFile {
+		t.Fatalf("Expected DoneUploadVideoFile, got %d", status)
+	}
+	if body := client.Puts["prefix/Camera1/a.dav"]; body != "video" {
+		t.Fatalf("Expected the whole file to be uploaded on the last attempt, got %q", body)
+	}
+	if client.attempts != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", client.attempts)
+	}
+}
+
+func TestUploadFileDeadLettersAndRedrives(t *testing.T) {
+	client := &MockS3Client{Failures: 3, Puts: map[string]string{}}
+	uploader, root := newTestUploader(t, client)
+	video := filepath.Join(root, "cameras", "Camera1", "a.dav")
+	writeTestFile(t, video, "video")
+
+	if status := uploadFile(video, uploader); status != DeadLetterVideoFile {
+		t.Fatalf("Expected DeadLetterVideoFile, got %d", status)
+	}
+	if _, err := os.Stat(video); !os.IsNotExist(err) {
+		t.Fatalf("Expected %s to be moved, got %v", video, err)
+	}
+	deadLetter := filepath.Join(uploader.DeadLetterPath, "Camera1", "a.dav")
+	if _, err := os.Stat(deadLetter); err != nil {
+		t.Fatalf("Expected %s to exist, got %s", deadLetter, err)
+	}
+
+	redriven, failed := uploader.RedriveDeadLetters()
+	if redriven != 1 || failed != 0 {
+		t.Fatalf("Expected 1 redriven and 0 failed, got %d and %d", redriven, failed)
+	}
+	if body := client.Puts["prefix/Camera1/a.dav"]; body != "video" {
+		t.Fatalf("Expected the dead letter to be uploaded to its original key, got %v", client.Puts)
+	}
+	if _, err := os.Stat(deadLetter); !os.IsNotExist(err) {
+		t.Fatalf("Expected %s to be removed, got %v", deadLetter, err)
+	}
+}
+
+func TestUploadFileWithoutDeadLetterPath(t *testing.T) {
+	client := &MockS3Client{Failures: 3, Puts: map[string]string{}}
+	uploader, root := newTestUploader(t, client)
+	uploader.DeadLetterPath = ""
+	video := filepath.Join(root, "cameras", "Camera1", "a.dav")
+	writeTestFile(t, video, "video")
+
+	if status := uploadFile(video, uploader); status != ErrorUploadingVideoFile {
+		t.Fatalf("Expected ErrorUploadingVideoFile, got %d", status)
+	}
+	if _, err := os.Stat(video); err != nil {
+		t.Fatalf("Expected %s to be left in place, got %s", video, err)
+	}
+}
+
+func TestUploadFileSkipsDuplicates(t *testing.T) {
+	client := &MockS3Client{Puts: map[string]string{}}
+	uploader, root := newTestUploader(t, client)
+	video := filepath.Join(root, "cameras", "Camera1", "a.dav")
+	writeTestFile(t, video, "video")
+
+	for i := 0; i < 2; i++ {
+		if status := uploadFile(video, uploader); status != DoneUploadVideoFile {
+			t.Fatalf("Expected DoneUploadVideoFile, got %d", status)
+		}
+	}
+	if client.attempts != 1 {
+		t.Fatalf("Expected the unchanged file to be uploaded once, got %d uploads", client.attempts)
+	}
+	expected := "0cab1c9617404faf2b24e221e189ca5945813e14d3f766345b09ca13bbe28ffc"
+	if sum := client.Metadata["prefix/Camera1/a.dav"][checksumMetadataKey]; sum != expected {
+		t.Fatalf("Expected the SHA-256 in the object metadata, got %q", sum)
+	}
+
+	writeTestFile(t, video, "changed video")
+	if status := uploadFile(video, uploader); status != DoneUploadVideoFile {
+		t.Fatalf("Expected DoneUploadVideoFile, got %d", status)
+	}
+	if body := client.Puts["prefix/Camera1/a.dav"]; body != "changed video" {
+		t.Fatalf("Expected the changed file to be uploaded, got %q", body)
+	}
+}
+
+// gatheredValue: The value of the named counter, gauge, or histogram's sample count with labels
+func gatheredValue(t *testing.T, name string, labels map[string]string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Expected to gather metrics, got %s", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			matched := 0
+			for _, label := range metric.GetLabel() {
+				if labels[label.GetName()] == label.GetValue() {
+					matched++
+				}
+			}
+			if matched != len(labels) {
+				continue
+			}
+			switch {
+			case metric.Counter != nil:
+				return metric.GetCounter().GetValue()
+			case metric.Gauge != nil:
+				return metric.GetGauge().GetValue()
+			case metric.Histogram != nil:
+				return float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return 0
+}
+
+func TestUploadFileCountsMetrics(t *testing.T) {
+	client := &MockS3Client{Failures: 2, Puts: map[string]string{}}
+	uploader, root := newTestUploader(t, client)
+	uploader.Metrics = v2.NewCameraMetrics(filepath.Join(root, "cameras") + "/")
+	video := filepath.Join(root, "cameras", "MetricsCamera", "a.dav")
+	writeTestFile(t, video, "video")
+
+	if status := uploadFile(video, uploader); status != DoneUploadVideoFile {
+		t.Fatalf("Expected DoneUploadVideoFile, got %d", status)
+	}
+	labels := map[string]string{"camera_name": "MetricsCamera", "file_type": "dav"}
+	if retries := gatheredValue(t, "upload_retries", labels); retries != 2 {
+		t.Fatalf("Expected 2 retries, got %g", retries)
+	}
+	if uploads := gatheredValue(t, "upload_duration_seconds", labels); uploads != 1 {
+		t.Fatalf("Expected 1 upload to be timed, got %g", uploads)
+	}
+	if uploads := gatheredValue(t, "upload_bytes", labels); uploads != 1 {
+		t.Fatalf("Expected 1 upload to be sized, got %g", uploads)
+	}
+
+	client.Failures = 3
+	client.attempts = 0
+	failed := filepath.Join(root, "cameras", "MetricsCamera", "b.dav")
+	writeTestFile(t, failed, "failed")
+	if status := uploadFile(failed, uploader); status != DeadLetterVideoFile {
+		t.Fatalf("Expected DeadLetterVideoFile, got %d", status)
+	}
+	if failures := gatheredValue(t, "upload_failures", labels); failures != 1 {
+		t.Fatalf("Expected 1 failure, got %g", failures)
+	}
+}
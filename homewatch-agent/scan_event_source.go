@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How the v2 watch paths are watched
+const (
+	// NotifyWatchMode: Be notified of the files created in them
+	NotifyWatchMode = "notify"
+	// PollWatchMode: Scan them, for file systems like NFS and SMB which don't notify
+	PollWatchMode = "poll"
+	// BothWatchMode: Be notified and scan them for the files notifications miss
+	BothWatchMode = "both"
+)
+
+// DefaultScanInterval: How often watch paths are scanned
+const DefaultScanInterval = time.Minute
+
+/*
+SeenFiles: The files already reported, so each is reported once. With a Path
+they're appended to it, a path a line, and kept over a restart.
+*/
+type SeenFiles struct {
+	lock  sync.Mutex
+	Path  string
+	files map[string]bool
+}
+
+// NewSeenFiles: The files recorded in path, or none kept over a restart when path is empty
+func NewSeenFiles(path string) (*SeenFiles, error) {
+	s := &SeenFiles{Path: path, files: map[string]bool{}}
+	if len(path) == 0 {
+		return s, nil
+	}
+	fp, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read seen files %s: %w", path, err)
+	}
+	defer fp.Close()
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		// A torn last line is the start of a path, which is never reported
+		if line := scanner.Text(); len(line) > 0 {
+			s.files[line] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read seen files %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *SeenFiles) Has(file string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.files[file]
+}
+
+// Add: Record file, returning false when it was already seen
+func (s *SeenFiles) Add(file string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.files[file] {
+		return false
+	}
+	s.files[file] = true
+	if len(s.Path) == 0 {
+		return true
+	}
+	fp, err := os.OpenFile(s.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		log.Printf("ERROR: Unable to record %s as seen: %s", file, err)
+		return true
+	}
+	defer fp.Close()
+	if _, err := fmt.Fprintln(fp, file); err != nil {
+		log.Printf("ERROR: Unable to record %s as seen: %s", file, err)
+	}
+	return true
+}
+
+/*
+Retain: Forget the files under roots which aren't in found, like those
+cleaned up after they were uploaded, so Path doesn't grow forever
+*/
+func (s *SeenFiles) Retain(roots []string, found map[string]int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	forgotten := 0
+	for file := range s.files {
+		if _, exists := found[file]; !exists && underAny(roots, file) {
+			delete(s.files, file)
+			forgotten++
+		}
+	}
+	if forgotten == 0 || len(s.Path) == 0 {
+		return nil
+	}
+	files := make([]string, 0, len(s.files))
+	for file := range s.files {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	contents := strings.Join(files, "\n")
+	if len(files) > 0 {
+		contents += "\n"
+	}
+	if err := os.WriteFile(s.Path+".tmp", []byte(contents), 0640); err != nil {
+		return err
+	}
+	return os.Rename(s.Path+".tmp", s.Path)
+}
+
+// underAny: True when file is under one of roots
+func underAny(roots []string, file string) bool {
+	for _, root := range roots {
+		if strings.HasPrefix(file, filepath.Clean(root)+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ScanEventSource: Walks its roots every Interval for index and video files
+which aren't in Seen. A file is reported once its size is the same on two
+scans in a row, so files still being written, or copied by a file system
+which doesn't rename them into place, aren't reported early.
+*/
+type ScanEventSource struct {
+	lock     sync.Mutex
+	roots    []string
+	Interval time.Duration
+	Seen     *SeenFiles
+	// sizes: The size of each unseen file on the last scan
+	sizes    map[string]int64
+	files    chan string
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewScanEventSource(roots []string, interval time.Duration, seen *SeenFiles) *ScanEventSource {
+	if interval <= 0 {
+		interval = DefaultScanInterval
+	}
+	s := &ScanEventSource{
+		Interval: interval,
+		Seen:     seen,
+		sizes:    map[string]int64{},
+		files:    make(chan string, 1),
+		stop:     make(chan struct{}),
+	}
+	for _, root := range roots {
+		s.roots = append(s.roots, filepath.Clean(root))
+	}
+	return s
+}
+
+func (s *ScanEventSource) Start(indexFiles, videoFiles chan string) {
+	go s.run()
+	go dispatchFiles(s.files, s.Seen, indexFiles, videoFiles)
+}
+
+func (s *ScanEventSource) Stop() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+func (s *ScanEventSource) Watch(root string) error {
+	root = filepath.Clean(root)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, r := range s.roots {
+		if r == root {
+			return nil
+		}
+	}
+	s.roots = append(s.roots, root)
+	log.Printf("INFO: Scanning '%s'", root)
+	return nil
+}
+
+func (s *ScanEventSource) Unwatch(root string) {
+	root = filepath.Clean(root)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	roots := []string{}
+	for _, r := range s.roots {
+		if r != root {
+			roots = append(roots, r)
+		}
+	}
+	s.roots = roots
+	log.Printf("INFO: Stopped scanning '%s'", root)
+}
+
+// run: Scan now and every Interval until Stop, reporting the files which stopped growing
+func (s *ScanEventSource) run() {
+	defer close(s.files)
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		for _, file := range s.scan() {
+			select {
+			case s.files <- file:
+			case <-s.stop:
+				return
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// scan: Walk the roots, returning the unseen files whose size didn't change since the last scan
+func (s *ScanEventSource) scan() []string {
+	s.lock.Lock()
+	roots := append([]string{}, s.roots...)
+	s.lock.Unlock()
+
+	found := map[string]int64{}
+	stable := []string{}
+	complete := true
+	for _, root := range roots {
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				log.Printf("WARN: Error scanning %s: %s", path, err)
+				complete = false
+				return nil
+			}
+			if d.IsDir() || !(isIndexFilePath(path) || isVideoFilePath(path)) {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				// Removed since it was listed
+				return nil
+			}
+			found[path] = info.Size()
+			if s.Seen.Has(path) {
+				return nil
+			}
+			if size, scanned := s.sizes[path]; scanned && size == info.Size() {
+				stable = append(stable, path)
+			}
+			return nil
+		})
+	}
+
+	s.sizes = map[string]int64{}
+	for path, size := range found {
+		if !s.Seen.Has(path) {
+			s.sizes[path] = size
+		}
+	}
+	// A directory which couldn't be read may still have the files which weren't found
+	if complete {
+		if err := s.Seen.Retain(roots, found); err != nil {
+			log.Printf("WARN: Unable to forget removed files in %s: %s", s.Seen.Path, err)
+		}
+	}
+	sort.Strings(stable)
+	return stable
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScanEventSourceReportsStableFilesOnce(t *testing.T) {
+	root := t.TempDir()
+	seen, _ := NewSeenFiles("")
+	scanner := NewScanEventSource([]string{root}, 0, seen)
+	video := filepath.Join(root, "04.51.56-04.52.18[M][0@0][0].dav")
+	growing := filepath.Join(root, "04.52.18-04.52.40[M][0@0][0].dav")
+	os.WriteFile(video, []byte("video"), 0640)
+	os.WriteFile(growing, []byte("vi"), 0640)
+	os.WriteFile(filepath.Join(root, "04.52.40-04.53.02[M][0@0][0].dav_"), []byte("v"), 0640)
+
+	if stable := scanner.scan(); len(stable) != 0 {
+		t.Fatalf("Expected files to be seen twice before they're reported, got %v", stable)
+	}
+	os.WriteFile(growing, []byte("video"), 0640)
+	if stable := scanner.scan(); len(stable) != 1 || stable[0] != video {
+		t.Fatalf("Expected only %s to have stopped growing, got %v", video, stable)
+	}
+	seen.Add(video)
+	if stable := scanner.scan(); len(stable) != 1 || stable[0] != growing {
+		t.Fatalf("Expected only %s, got %v", growing, stable)
+	}
+}
+
+func TestSeenFilesPersist(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "seen")
+	seen, err := NewSeenFiles(path)
+	if err != nil {
+		t.Fatalf("Expected a new seen set, got %s", err)
+	}
+	kept := filepath.Join(root, "Camera1", "kept.dav")
+	removed := filepath.Join(root, "Camera1", "removed.dav")
+	if !seen.Add(kept) || !seen.Add(removed) || seen.Add(kept) {
+		t.Fatalf("Expected each file to be added once")
+	}
+
+	reopened, err := NewSeenFiles(path)
+	if err != nil || !reopened.Has(kept) || !reopened.Has(removed) {
+		t.Fatalf("Expected both files to be kept over a restart, got %v", err)
+	}
+	if err := reopened.Retain([]string{root}, map[string]int64{kept: 5}); err != nil {
+		t.Fatalf("Expected to forget removed files, got %s", err)
+	}
+	b, _ := os.ReadFile(path)
+	if strings.TrimSpace(string(b)) != kept {
+		t.Fatalf("Expected only %s to be kept, got %q", kept, b)
+	}
+}
+
+func TestDispatchFilesSkipsSeenFiles(t *testing.T) {
+	seen, _ := NewSeenFiles("")
+	files := make(chan string, 3)
+	indexFiles := make(chan string, 3)
+	videoFiles := make(chan string, 3)
+	files <- "/mnt/Camera1/04.idx"
+	files <- "/mnt/Camera1/04.idx"
+	files <- "/mnt/Camera1/04.dav"
+	close(files)
+	dispatchFiles(files, seen, indexFiles, videoFiles)
+	if len(indexFiles) != 1 || len(videoFiles) != 1 {
+		t.Fatalf("Expected each file once, got %d index and %d video files", len(indexFiles), len(videoFiles))
+	}
+}
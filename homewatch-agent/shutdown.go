@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultShutdownTimeout: How long shutdown waits for files being handled to finish
+const DefaultShutdownTimeout = 30 * time.Second
+
+/*
+InFlight: The files a handler has started but not finished handling. Once
+Wait is called no more files start, so they're left for after a restart.
+*/
+type InFlight struct {
+	lock     sync.Mutex
+	files    map[string]int
+	wg       sync.WaitGroup
+	draining bool
+	skipped  []string
+}
+
+func NewInFlight() *InFlight {
+	return &InFlight{files: map[string]int{}}
+}
+
+// Start: Record filepath as started, or return false when it mustn't start because of Wait
+func (f *InFlight) Start(filepath string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.draining {
+		f.skipped = append(f.skipped, filepath)
+		return false
+	}
+	f.files[filepath]++
+	f.wg.Add(1)
+	return true
+}
+
+func (f *InFlight) Finish(filepath string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.files[filepath]--; f.files[filepath] <= 0 {
+		delete(f.files, filepath)
+	}
+	f.wg.Done()
+}
+
+// Files: The files being handled and those which weren't started because of Wait, sorted
+func (f *InFlight) Files() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	files := append([]string{}, f.skipped...)
+	for filepath := range f.files {
+		files = append(files, filepath)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// Wait: Wait for every file to finish or ctx to be done, returning the files which didn't finish
+func (f *InFlight) Wait(ctx context.Context) []string {
+	f.lock.Lock()
+	f.draining = true
+	f.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	return f.Files()
+}
+
+// drainEvents: The file events waiting in events, which nothing will handle now
+func drainEvents(events chan string) []string {
+	drained := []string{}
+	for {
+		select {
+		case filepath, ok := <-events:
+			if !ok {
+				return drained
+			}
+			drained = append(drained, filepath)
+		default:
+			return drained
+		}
+	}
+}
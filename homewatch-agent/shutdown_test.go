@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingStorage: Blocks each Put until its context is done
+type blockingStorage struct {
+	*MemoryStorage
+	started chan string
+}
+
+func (s *blockingStorage) Put(ctx context.Context, key string, body *os.File, sum []byte) (string, error) {
+	s.started <- key
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+// recordingQueue: A FileEventQueue recording what's acknowledged
+type recordingQueue struct {
+	lock  sync.Mutex
+	acked []string
+}
+
+func (q *recordingQueue) Ack(filepath string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.acked = append(q.acked, filepath)
+	return nil
+}
+
+func TestInFlightWait(t *testing.T) {
+	inFlight := NewInFlight()
+	inFlight.Start("a.dav")
+	inFlight.Start("b.dav")
+	inFlight.Finish("a.dav")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if unfinished := inFlight.Wait(ctx); len(unfinished) != 1 || unfinished[0] != "b.dav" {
+		t.Fatalf("Expected b.dav to be unfinished, got %v", unfinished)
+	}
+	if inFlight.Start("c.dav") {
+		t.Fatalf("Expected no files to start once draining")
+	}
+	inFlight.Finish("b.dav")
+	if unfinished := inFlight.Wait(context.Background()); len(unfinished) != 1 || unfinished[0] != "c.dav" {
+		t.Fatalf("Expected only the skipped c.dav, got %v", unfinished)
+	}
+}
+
+func TestVideoEventHandlerDrainCancelsUploads(t *testing.T) {
+	root := t.TempDir()
+	storage := &blockingStorage{NewMemoryStorage("bucket"), make(chan string, 1)}
+	uploads, cancelUploads := context.WithCancel(context.Background())
+	defer cancelUploads()
+	uploader := NewUploader(storage)
+	uploader.Context = uploads
+	uploader.TrimLocalPrefix(root + "/")
+	queue := &recordingQueue{}
+
+	videoEvents := make(chan string, 1)
+	handler := NewVideoEventHandler(VideoConfig{Upload: true, Cleanup: true}, videoEvents)
+	handler.Context = uploads
+	handler.AddUploader(uploader)
+	handler.AddQueue(queue)
+	listening, stopListening := context.WithCancel(context.Background())
+	go handler.Listen(listening)
+
+	video := filepath.Join(root, "Camera1", "a.dav")
+	writeTestFile(t, video, "video")
+	videoEvents <- video
+	<-storage.started
+	stopListening()
+
+	deadline, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if unfinished := handler.Drain(deadline); len(unfinished) != 1 || unfinished[0] != video {
+		t.Fatalf("Expected %s to be unfinished, got %v", video, unfinished)
+	}
+	cancelUploads()
+	handler.Drain(context.Background())
+	if len(queue.acked) != 0 {
+		t.Fatalf("Expected the cancelled upload to stay queued, got %v", queue.acked)
+	}
+	if _, err := os.Stat(video); err != nil {
+		t.Fatalf("Expected %s not to be cleaned up, got %s", video, err)
+	}
+}
+
+// idleEventSource: An EventSource which never reports a file
+type idleEventSource struct{}
+
+func (idleEventSource) Start(indexFiles, videoFiles chan string) {}
+func (idleEventSource) Stop()                                    {}
+
+func TestPipelineShutdownPublishesBufferedIndexedEvents(t *testing.T) {
+	api := newTestApi(t)
+	p := api.pipeline
+	p.source = idleEventSource{}
+	_, p.stopListening = context.WithCancel(context.Background())
+	_, p.stopPublishing = context.WithCancel(context.Background())
+	// Like an event sent by the index file handler just as the publishing handler stopped listening
+	p.listened = make(chan struct{})
+	close(p.listened)
+	p.indexedEvents <- &IndexedEvent{
+		Source: "Camera1",
+		Events: []Event{{Action: "Start", Name: "VideoMotion", Data: []byte(`{"Id":[1],"RegionName":["Street"]}`)}},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p.Shutdown(ctx)
+	b, err := os.ReadFile(p.Config.Publisher.NDJSON.Path)
+	if err != nil || !strings.Contains(string(b), "Camera1:Start:VideoMotion") {
+		t.Fatalf("Expected the buffered event's datapoint to be published, got %q %v", b, err)
+	}
+}
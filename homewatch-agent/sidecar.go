@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sidecarExtension = ".json"
+	// sidecarPairTimeout: How long an index file or video waits for the other half of its clip
+	sidecarPairTimeout = 10 * time.Minute
+	// clipNameLayout: The start, or end, of a clip in its file name like 04.51.56-04.52.18[M][0@0][0]
+	clipNameLayout = "2006-01-02 15.04.05"
+)
+
+/*
+VideoSidecar: What happened in a clip, read from its index file and uploaded
+next to its video so it can be shown without parsing the index file
+*/
+type VideoSidecar struct {
+	Source string `json:"source"`
+	// Clip: The file name of the clip without its extension
+	Clip string `json:"clip"`
+	// Start, End: The wall clock times in the clip's file name, in the agent's time zone
+	Start      *time.Time        `json:"start,omitempty"`
+	End        *time.Time        `json:"end,omitempty"`
+	Frames     SidecarFrames     `json:"frames"`
+	Encoding   *SidecarEncoding  `json:"encoding,omitempty"`
+	Detections []DetectionRecord `json:"detections"`
+}
+
+// SidecarFrames: Where the clip's frames start and end
+type SidecarFrames struct {
+	Count         int   `json:"count"`
+	KeyFrames     int   `json:"keyFrames"`
+	FirstFrame    int64 `json:"firstFrame"`
+	LastFrame     int64 `json:"lastFrame"`
+	StartOffsetMs int64 `json:"startOffsetMs"`
+	EndOffsetMs   int64 `json:"endOffsetMs"`
+}
+
+type SidecarEncoding struct {
+	Video *SidecarStream `json:"video,omitempty"`
+	Audio *SidecarStream `json:"audio,omitempty"`
+}
+
+// SidecarStream: The encoding parameters of a video or audio stream, zero when the index file doesn't say
+type SidecarStream struct {
+	Codec       string  `json:"codec,omitempty"`
+	BitRateKbps float64 `json:"bitRateKbps,omitempty"`
+	Width       float64 `json:"width,omitempty"`
+	Height      float64 `json:"height,omitempty"`
+	FPS         float64 `json:"fps,omitempty"`
+	SampleRate  float64 `json:"sampleRate,omitempty"`
+}
+
+// DetectionRecord: An object detected by a tripwire or intrusion rule, as sidecars and alerts show it
+type DetectionRecord struct {
+	Time        time.Time   `json:"time"`
+	Action      string      `json:"action"`
+	Kind        string      `json:"kind"`
+	Rule        string      `json:"rule"`
+	RuleID      int         `json:"ruleId"`
+	ObjectType  string      `json:"objectType"`
+	ObjectID    int         `json:"objectId"`
+	BoundingBox BoundingBox `json:"boundingBox"`
+	Confidence  float64     `json:"confidence"`
+}
+
+// NewDetectionRecord: The detection of an event with action
+func NewDetectionRecord(action string, detection *RuleDetection) DetectionRecord {
+	return DetectionRecord{
+		Time:        time.Unix(detection.UTC, detection.UTCMS*int64(time.Millisecond)).UTC(),
+		Action:      action,
+		Kind:        detection.Kind(),
+		Rule:        detection.Name,
+		RuleID:      detection.RuleID,
+		ObjectType:  detection.Object.ObjectType,
+		ObjectID:    detection.Object.ObjectID,
+		BoundingBox: detection.Object.BoundingBox,
+		Confidence:  detection.Object.Confidence,
+	}
+}
+
+// NewVideoSidecar: The sidecar of the clip at filepath, a video or index file, read from its index
+func NewVideoSidecar(filepath string, index *IndexedEvent) VideoSidecar {
+	sidecar := VideoSidecar{
+		Source:     index.Source,
+		Clip:       strings.TrimSuffix(path.Base(filepath), path.Ext(filepath)),
+		Detections: []DetectionRecord{},
+	}
+	if start, end, ok := clipTimes(filepath); ok {
+		sidecar.Start, sidecar.End = &start, &end
+	}
+
+	for i, frame := range index.Frames {
+		if i == 0 {
+			sidecar.Frames.FirstFrame = frame.FrameNumber
+			sidecar.Frames.StartOffsetMs = frame.StartOffsetMs
+		}
+		sidecar.Frames.LastFrame = frame.FrameNumber
+		if frame.IsFirstFrame {
+			sidecar.Frames.KeyFrames++
+		}
+		if frame.StartOffsetMs < sidecar.Frames.StartOffsetMs {
+			sidecar.Frames.StartOffsetMs = frame.StartOffsetMs
+		}
+		if frame.EndOffsetMs > sidecar.Frames.EndOffsetMs {
+			sidecar.Frames.EndOffsetMs = frame.EndOffsetMs
+		}
+	}
+	sidecar.Frames.Count = len(index.Frames)
+
+	if len(index.Encodings) > 0 {
+		encoding := index.Encodings[0]
+		sidecar.Encoding = &SidecarEncoding{}
+		if encoding.VideoEnable {
+			sidecar.Encoding.Video = &SidecarStream{
+				Codec:       stringOf(encoding.Video, "Compression"),
+				BitRateKbps: numberOf(encoding.Video, "BitRate"),
+				Width:       numberOf(encoding.Video, "Width"),
+				Height:      numberOf(encoding.Video, "Height"),
+				FPS:         numberOf(encoding.Video, "FPS"),
+			}
+		}
+		if encoding.AudioEnable {
+			sidecar.Encoding.Audio = &SidecarStream{
+				Codec:       stringOf(encoding.Audio, "Compression"),
+				BitRateKbps: numberOf(encoding.Audio, "Bitrate"),
+				SampleRate:  numberOf(encoding.Audio, "Frequency"),
+			}
+		}
+	}
+
+	for _, event := range index.Events {
+		detection := event.RuleDetection()
+		if detection == nil {
+			continue
+		}
+		sidecar.Detections = append(sidecar.Detections, NewDetectionRecord(event.Action, detection))
+	}
+	sort.SliceStable(sidecar.Detections, func(i, j int) bool {
+		return sidecar.Detections[i].Time.Before(sidecar.Detections[j].Time)
+	})
+	return sidecar
+}
+
+/*
+clipTimes: The start and end of the clip at a path like
+Camera1/2022-03-06/001/dav/04/04.51.56-04.52.18[M][0@0][0].dav
+*/
+func clipTimes(clipPath string) (time.Time, time.Time, bool) {
+	s := strings.Split(clipPath, string(os.PathSeparator))
+	if len(s) < 5 {
+		return time.Time{}, time.Time{}, false
+	}
+	date := s[len(s)-5]
+	times := strings.SplitN(strings.SplitN(s[len(s)-1], "[", 2)[0], "-", 2)
+	if len(times) != 2 {
+		return time.Time{}, time.Time{}, false
+	}
+	start, err := time.ParseInLocation(clipNameLayout, date+" "+times[0], time.Local)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	end, err := time.ParseInLocation(clipNameLayout, date+" "+times[1], time.Local)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	// A clip recorded over midnight
+	if end.Before(start) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return start, end, true
+}
+
+func stringOf(values map[string]interface{}, key string) string {
+	s, _ := values[key].(string)
+	return s
+}
+
+func numberOf(values map[string]interface{}, key string) float64 {
+	n, _ := values[key].(float64)
+	return n
+}
+
+// sidecarPair: The halves of a clip seen so far
+type sidecarPair struct {
+	index *IndexedEvent
+	// video: The uploaded video
+	video string
+	seen  time.Time
+}
+
+/*
+Sidecars: Pairs each index file with the video of the same clip, which arrive
+in either order, and uploads the clip's sidecar once the video is uploaded.
+Halves which aren't paired within sidecarPairTimeout are forgotten.
+*/
+type Sidecars struct {
+	lock     sync.Mutex
+	Uploader S3FileUploader
+	pending  map[string]*sidecarPair
+}
+
+func NewSidecars(uploader S3FileUploader) *Sidecars {
+	return &Sidecars{
+		Uploader: uploader,
+		pending:  map[string]*sidecarPair{},
+	}
+}
+
+// AddIndex: Record the events read from the index file at filepath
+func (s *Sidecars) AddIndex(filepath string, index *IndexedEvent) {
+	s.add(filepath, func(pair *sidecarPair) { pair.index = index })
+}
+
+// AddVideo: Record that the video at filepath was uploaded
+func (s *Sidecars) AddVideo(filepath string) {
+	s.add(filepath, func(pair *sidecarPair) { pair.video = filepath })
+}
+
+func (s *Sidecars) add(filepath string, update func(*sidecarPair)) {
+	clip := strings.TrimSuffix(filepath, path.Ext(filepath))
+	now := time.Now()
+
+	s.lock.Lock()
+	for key, pair := range s.pending {
+		if now.Sub(pair.seen) > sidecarPairTimeout {
+			if flagDebug {
+				log.Printf("DEBUG: Forgetting unpaired clip %s", key)
+			}
+			delete(s.pending, key)
+		}
+	}
+	pair, exists := s.pending[clip]
+	if !exists {
+		pair = &sidecarPair{}
+		s.pending[clip] = pair
+	}
+	pair.seen = now
+	update(pair)
+	paired := pair.index != nil && len(pair.video) > 0
+	if paired {
+		delete(s.pending, clip)
+	}
+	s.lock.Unlock()
+
+	if paired {
+		s.upload(pair.video, pair.index)
+	}
+}
+
+// upload: Write the sidecar next to video, upload it with the video's uploader, then remove it
+func (s *Sidecars) upload(video string, index *IndexedEvent) {
+	b, err := json.Marshal(NewVideoSidecar(video, index))
+	if err != nil {
+		log.Printf("ERROR: Unable to encode the sidecar of %s: %s", video, err)
+		return
+	}
+	sidecarPath := strings.TrimSuffix(video, path.Ext(video)) + sidecarExtension
+	if err := os.WriteFile(sidecarPath, b, 0640); err != nil {
+		log.Printf("ERROR: Unable to write the sidecar of %s: %s", video, err)
+		return
+	}
+	// A dead lettered sidecar was moved
+	if uploadStatus := uploadFile(sidecarPath, s.Uploader); uploadStatus != DeadLetterVideoFile {
+		tryRemove(sidecarPath)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testClip = "Camera1/2022-03-06/001/dav/23/23.59.56-00.00.18[M][0@0][0]"
+
+func newTestSidecarIndex(t *testing.T) *IndexedEvent {
+	var detection Event
+	b, _ := os.ReadFile(eventWithDetection)
+	if err := json.Unmarshal(b, &detection); err != nil {
+		t.Fatalf("Expected to unmarshal event, got %s", err)
+	}
+	return &IndexedEvent{
+		Source: "Camera1",
+		Events: []Event{
+			{Action: "Start", Name: "VideoMotion", Data: json.RawMessage(`{"Id":[1],"RegionName":["Street"]}`)},
+			detection,
+		},
+		Encodings: []Encoding{{
+			VideoEnable: true,
+			Video:       VideoEncoding{"Compression": "H.265", "Width": float64(3840), "Height": float64(2160), "FPS": float64(15), "BitRate": float64(4096)},
+		}},
+		Frames: []Frame{
+			{Type: "P", FrameNumber: 47281928210, StartOffsetMs: 0, EndOffsetMs: 5158, IsFirstFrame: true},
+			{Type: "P", FrameNumber: 47281928310, StartOffsetMs: 5158, EndOffsetMs: 6469},
+		},
+	}
+}
+
+func TestNewVideoSidecar(t *testing.T) {
+	sidecar := NewVideoSidecar("/mnt/VideoUploads/"+testClip+".dav", newTestSidecarIndex(t))
+
+	if sidecar.Source != "Camera1" || sidecar.Clip != "23.59.56-00.00.18[M][0@0][0]" {
+		t.Fatalf("Expected the Camera1 clip, got %s %s", sidecar.Source, sidecar.Clip)
+	}
+	start := time.Date(2022, 3, 6, 23, 59, 56, 0, time.Local)
+	if sidecar.Start == nil || !sidecar.Start.Equal(start) || sidecar.End.Sub(start) != 22*time.Second {
+		t.Fatalf("Expected a 22s clip from %s, got %v to %v", start, sidecar.Start, sidecar.End)
+	}
+	frames := SidecarFrames{Count: 2, KeyFrames: 1, FirstFrame: 47281928210, LastFrame: 47281928310, EndOffsetMs: 6469}
+	if sidecar.Frames != frames {
+		t.Fatalf("Expected %+v, got %+v", frames, sidecar.Frames)
+	}
+	if video := sidecar.Encoding.Video; video == nil || video.Codec != "H.265" || video.Width != 3840 || sidecar.Encoding.Audio != nil {
+		t.Fatalf("Expected only 3840 wide H.265 video, got %+v", sidecar.Encoding)
+	}
+	if len(sidecar.Detections) != 1 {
+		t.Fatalf("Expected 1 detection, got %d", len(sidecar.Detections))
+	}
+	detection := sidecar.Detections[0]
+	if detection.Kind != IntrusionEventKind || detection.ObjectType != "Vehicle" || detection.ObjectID != 439 || len(detection.BoundingBox) != 4 {
+		t.Fatalf("Expected an intrusion by Vehicle 439, got %+v", detection)
+	}
+	if expectation := time.Unix(1644929237, 671*int64(time.Millisecond)); !detection.Time.Equal(expectation) {
+		t.Fatalf("Expected the detection at %s, got %s", expectation, detection.Time)
+	}
+}
+
+func TestSidecarsUploadOnceBothHalvesArrive(t *testing.T) {
+	for _, indexFirst := range []bool{true, false} {
+		root := t.TempDir()
+		storage := NewMemoryStorage("bucket")
+		uploader := NewUploader(storage)
+		uploader.TrimLocalPrefix(root + "/")
+		sidecars := NewSidecars(uploader)
+
+		video := filepath.Join(root, testClip+".dav")
+		writeTestFile(t, video, "video")
+		index := filepath.Join(root, testClip+".idx")
+		if indexFirst {
+			sidecars.AddIndex(index, newTestSidecarIndex(t))
+		} else {
+			sidecars.AddVideo(video)
+		}
+		if keys := storage.Keys(); len(keys) != 0 {
+			t.Fatalf("Expected nothing uploaded before the clip is paired, got %v", keys)
+		}
+		if indexFirst {
+			sidecars.AddVideo(video)
+		} else {
+			sidecars.AddIndex(index, newTestSidecarIndex(t))
+		}
+
+		b, ok := storage.Get("bucket/" + testClip + ".json")
+		if !ok {
+			t.Fatalf("Expected the sidecar next to the video, got %v", storage.Keys())
+		}
+		sidecar := VideoSidecar{}
+		if err := json.Unmarshal(b, &sidecar); err != nil || len(sidecar.Detections) != 1 {
+			t.Fatalf("Expected a sidecar with a detection, got %s and %v", b, err)
+		}
+		if _, err := os.Stat(filepath.Join(root, testClip+".json")); !os.IsNotExist(err) {
+			t.Fatalf("Expected the uploaded sidecar to be removed, got %v", err)
+		}
+		if len(sidecars.pending) != 0 {
+			t.Fatalf("Expected no pending clips, got %d", len(sidecars.pending))
+		}
+	}
+}
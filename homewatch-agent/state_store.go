@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Where a file is in its lifecycle
+const (
+	DiscoveredFile = "discovered"
+	TranscodedFile = "transcoded"
+	UploadingFile  = "uploading"
+	UploadedFile   = "uploaded"
+	ReapedFile     = "reaped"
+)
+
+// ForgetReapedAfter: How long a reaped file's record is kept
+const ForgetReapedAfter = 7 * 24 * time.Hour
+
+var (
+	filesBucket   = []byte("files")
+	watchesBucket = []byte("watches")
+)
+
+// FileRecord: What happened to an index or video file
+type FileRecord struct {
+	Path   string `json:"path"`
+	Camera string `json:"camera"`
+	State  string `json:"state"`
+	// ETag: Of the uploaded object, or its SHA-256 for backends without ETags
+	ETag string `json:"etag,omitempty"`
+	// Transcoded: The MP4 a video was transcoded to
+	Transcoded string `json:"transcoded,omitempty"`
+	// Times: When the file entered each state
+	Times map[string]time.Time `json:"times"`
+}
+
+/*
+StateStore: Records the lifecycle of every file and the directories being
+watched in a bbolt database, so they're kept over a restart. A nil StateStore
+records nothing, so handlers can call it whether or not there's a store.
+*/
+type StateStore struct {
+	db  *bolt.DB
+	now func() time.Time
+}
+
+// OpenStateStore: Open or create the database at path
+func OpenStateStore(path string) (*StateStore, error) {
+	db, err := bolt.Open(path, 0640, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open state store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{filesBucket, watchesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to create state store %s: %w", path, err)
+	}
+	return &StateStore{db: db, now: time.Now}, nil
+}
+
+func (s *StateStore) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// record: Move path to state, applying update to its record
+func (s *StateStore) record(path, state string, update func(*FileRecord)) {
+	if s == nil {
+		return
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(filesBucket)
+		record := FileRecord{Path: path, Camera: GetSourceFromPath(path), Times: map[string]time.Time{}}
+		if b := bucket.Get([]byte(path)); b != nil {
+			if err := json.Unmarshal(b, &record); err != nil {
+				return err
+			}
+		}
+		record.State = state
+		record.Times[state] = s.now().UTC()
+		if update != nil {
+			update(&record)
+		}
+		b, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(path), b)
+	})
+	if err != nil {
+		log.Printf("WARN: Unable to record %s as %s: %s", path, state, err)
+	}
+}
+
+// Discovered: Record that path was reported by an EventSource
+func (s *StateStore) Discovered(path string) {
+	s.record(path, DiscoveredFile, nil)
+}
+
+// Transcoded: Record that the video at path was transcoded to mp4
+func (s *StateStore) Transcoded(path, mp4 string) {
+	s.record(path, TranscodedFile, func(record *FileRecord) { record.Transcoded = mp4 })
+}
+
+func (s *StateStore) Uploading(path string) {
+	s.record(path, UploadingFile, nil)
+}
+
+// Uploaded: Record that path was uploaded as an object with etag
+func (s *StateStore) Uploaded(path, etag string) {
+	s.record(path, UploadedFile, func(record *FileRecord) { record.ETag = etag })
+}
+
+// Reaped: Record that path was removed after it was uploaded
+func (s *StateStore) Reaped(path string) {
+	s.record(path, ReapedFile, nil)
+}
+
+// cleanup: Remove an uploaded file, recording it as reaped in state once it's gone
+func cleanup(path string, state *StateStore) {
+	tryRemove(path)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		state.Reaped(path)
+	}
+}
+
+// File: The record of path
+func (s *StateStore) File(path string) (FileRecord, bool) {
+	record := FileRecord{}
+	if s == nil {
+		return record, false
+	}
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(filesBucket).Get([]byte(path))
+		if b == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(b, &record)
+	})
+	if err != nil {
+		log.Printf("WARN: Unable to read the record of %s: %s", path, err)
+		return record, false
+	}
+	return record, found
+}
+
+// Files: The records accepted by include, or every record when it's nil, in path order
+func (s *StateStore) Files(include func(FileRecord) bool) ([]FileRecord, error) {
+	records := []FileRecord{}
+	if s == nil {
+		return records, nil
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).ForEach(func(k, v []byte) error {
+			record := FileRecord{}
+			if err := json.Unmarshal(v, &record); err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
+			if include == nil || include(record) {
+				records = append(records, record)
+			}
+			return nil
+		})
+	})
+	return records, err
+}
+
+// Forget: Remove the records of files reaped before t, so the store doesn't grow forever
+func (s *StateStore) Forget(t time.Time) (int, error) {
+	if s == nil {
+		return 0, nil
+	}
+	forgotten := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(filesBucket)
+		keys := [][]byte{}
+		err := bucket.ForEach(func(k, v []byte) error {
+			record := FileRecord{}
+			if err := json.Unmarshal(v, &record); err != nil {
+				return nil
+			}
+			if record.State == ReapedFile && record.Times[ReapedFile].Before(t) {
+				keys = append(keys, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		forgotten = len(keys)
+		return nil
+	})
+	return forgotten, err
+}
+
+/*
+forgetReaped: Every hour, forget the files reaped more than ForgetReapedAfter
+ago. They're gone, so there's nothing left to do with them.
+*/
+func forgetReaped(state *StateStore) {
+	for {
+		time.Sleep(time.Hour)
+		forgotten, err := state.Forget(time.Now().Add(-ForgetReapedAfter))
+		if err != nil {
+			log.Printf("WARN: Unable to forget reaped files: %s", err)
+			continue
+		}
+		if flagDebug && forgotten > 0 {
+			log.Printf("DEBUG: Forgot %d reaped files", forgotten)
+		}
+	}
+}
+
+// Watched: Record that the directory at path has been watched since at
+func (s *StateStore) Watched(path string, at time.Time) {
+	if s == nil {
+		return
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := at.UTC().MarshalText()
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(watchesBucket).Put([]byte(path), b)
+	})
+	if err != nil {
+		log.Printf("WARN: Unable to record the watch on %s: %s", path, err)
+	}
+}
+
+func (s *StateStore) Unwatched(path string) {
+	if s == nil {
+		return
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(watchesBucket).Delete([]byte(path))
+	})
+	if err != nil {
+		log.Printf("WARN: Unable to forget the watch on %s: %s", path, err)
+	}
+}
+
+// Watches: When each watched directory was first watched
+func (s *StateStore) Watches() map[string]time.Time {
+	watches := map[string]time.Time{}
+	if s == nil {
+		return watches
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(watchesBucket).ForEach(func(k, v []byte) error {
+			at := time.Time{}
+			if err := at.UnmarshalText(v); err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
+			watches[string(k)] = at
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("WARN: Unable to list watches: %s", err)
+	}
+	return watches
+}
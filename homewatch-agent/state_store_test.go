@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestStateStore(t *testing.T, path string) *StateStore {
+	state, err := OpenStateStore(path)
+	if err != nil {
+		t.Fatalf("Expected a state store, got %s", err)
+	}
+	return state
+}
+
+func TestStateStoreRecordsUploadsOverARestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	state := openTestStateStore(t, path)
+	storage := NewMemoryStorage("bucket")
+	uploader := NewUploader(storage)
+	uploader.State = state
+	root := t.TempDir()
+	uploader.TrimLocalPrefix(root + "/")
+	video := filepath.Join(root, "Camera1", "a.dav")
+	writeTestFile(t, video, "video")
+
+	state.Discovered(video)
+	if status := uploadFile(video, uploader); status != DoneUploadVideoFile {
+		t.Fatalf("Expected DoneUploadVideoFile, got %d", status)
+	}
+	state.Close()
+
+	state = openTestStateStore(t, path)
+	defer state.Close()
+	record, ok := state.File(video)
+	if !ok || record.State != UploadedFile {
+		t.Fatalf("Expected %s to be uploaded, got %#v", video, record)
+	}
+	if sum := sha256.Sum256([]byte("video")); record.ETag != hex.EncodeToString(sum[:]) {
+		t.Fatalf("Expected the ETag to be the video's sha256, got %s", record.ETag)
+	}
+	for _, s := range []string{DiscoveredFile, UploadingFile, UploadedFile} {
+		if record.Times[s].IsZero() {
+			t.Fatalf("Expected a time for %s, got %v", s, record.Times)
+		}
+	}
+}
+
+func TestStateStoreForgetsReapedFiles(t *testing.T) {
+	state := openTestStateStore(t, filepath.Join(t.TempDir(), "state.db"))
+	defer state.Close()
+	now := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	state.now = func() time.Time { return now }
+	state.Uploaded("/data/old.dav", "a")
+	state.Uploaded("/data/reaped.dav", "b")
+	state.Reaped("/data/reaped.dav")
+	now = now.Add(8 * 24 * time.Hour)
+	state.Reaped("/data/new.dav")
+
+	if forgotten, err := state.Forget(now.Add(-7 * 24 * time.Hour)); err != nil || forgotten != 1 {
+		t.Fatalf("Expected to forget 1 reaped file, got %d %v", forgotten, err)
+	}
+	if _, ok := state.File("/data/new.dav"); !ok {
+		t.Fatalf("Expected /data/new.dav to be kept until it's been reaped a week")
+	}
+	if _, ok := state.File("/data/reaped.dav"); ok {
+		t.Fatalf("Expected /data/reaped.dav to be forgotten")
+	}
+	if record, ok := state.File("/data/old.dav"); !ok || record.State != UploadedFile {
+		t.Fatalf("Expected /data/old.dav to be kept until it's reaped, got %#v", record)
+	}
+}
+
+func TestStateStoreWatches(t *testing.T) {
+	state := openTestStateStore(t, filepath.Join(t.TempDir(), "state.db"))
+	defer state.Close()
+	at := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	state.Watched("/data/Camera1", at)
+	state.Watched("/data/Camera2", at)
+	state.Unwatched("/data/Camera2")
+
+	watches := state.Watches()
+	if len(watches) != 1 || !watches["/data/Camera1"].Equal(at) {
+		t.Fatalf("Expected only /data/Camera1 to be watched since %s, got %v", at, watches)
+	}
+}
+
+func TestNilStateStoreRecordsNothing(t *testing.T) {
+	var state *StateStore
+	state.Discovered("/data/a.dav")
+	state.Uploaded("/data/a.dav", "a")
+	if _, ok := state.File("/data/a.dav"); ok {
+		t.Fatalf("Expected a nil state store to record nothing")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrUnsupportedStorageScheme = errors.New("unsupported storage URL scheme")
+
+var ErrChecksumMismatch = errors.New("content doesn't match its SHA-256 checksum")
+
+/*
+StorageBackend: Where an Uploader puts files. Keys are slash separated paths
+relative to the backend's URL and sums are the SHA-256 of the file's content.
+*/
+type StorageBackend interface {
+	// Put: Store the whole of body at key, failing when it doesn't match sum.
+	// Returns the stored object's ETag, or the hex sum when the backend has none.
+	Put(ctx context.Context, key string, body *os.File, sum []byte) (string, error)
+	// Exists: True when key is already stored with content matching sum
+	Exists(ctx context.Context, key string, sum []byte) (bool, error)
+	String() string
+}
+
+/*
+AbandoningStorage: A StorageBackend which keeps partial uploads to resume them,
+and drops a key's partial upload once the Uploader gives up on its file
+*/
+type AbandoningStorage interface {
+	Abandon(key string)
+}
+
+// StorageOptions: Backend specific settings used by NewStorage
+type StorageOptions struct {
+	// S3Client: Used for s3:// URLs instead of DefaultS3Client(S3)
+	S3Client S3Client
+	S3       S3ClientOptions
+	// Multipart: How s3:// backends split large files
+	Multipart *MultipartOptions
+}
+
+/*
+NewStorage: Create the backend for storageUrl by its scheme and check it's
+accessible. Supported URLs are
+  - s3://bucket/prefix
+  - file:///mnt/nas/prefix, which must already exist
+  - memory://name/prefix, kept in memory for tests
+*/
+func NewStorage(storageUrl string, options StorageOptions) (StorageBackend, error) {
+	u, err := url.Parse(storageUrl)
+	if err != nil {
+		return nil, fmt.Errorf("%s isn't a valid storage URL: %w", storageUrl, err)
+	}
+	switch u.Scheme {
+	case "s3":
+		client := options.S3Client
+		if client == nil {
+			client, err = DefaultS3Client(options.S3)
+			if err != nil {
+				return nil, err
+			}
+		}
+		storage, err := NewS3Storage(client, storageUrl)
+		if err != nil {
+			return nil, err
+		}
+		storage.Multipart = options.Multipart
+		return storage, nil
+	case "file":
+		return NewFileStorage(u.Path)
+	case "memory":
+		return NewMemoryStorage(u.Host + u.Path), nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedStorageScheme, storageUrl)
+}
+
+// storageKey: key as a clean relative path which can't escape its root
+func storageKey(key string) string {
+	return strings.TrimPrefix(path.Clean("/"+key), "/")
+}
+
+// FileStorage: A StorageBackend copying files under Root, like a NAS mount
+type FileStorage struct {
+	Root string
+}
+
+// NewFileStorage: Store files under root, which must be an existing directory
+func NewFileStorage(root string) (*FileStorage, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("unable to access storage directory %s: %w", root, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("storage path %s isn't a directory", root)
+	}
+	return &FileStorage{Root: root}, nil
+}
+
+func (s *FileStorage) String() string {
+	return "file://" + s.Root
+}
+
+func (s *FileStorage) path(key string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(storageKey(key)))
+}
+
+/*
+Put: Copy body to a temporary file beside key, verifying what was copied
+matches sum, then rename it into place
+*/
+func (s *FileStorage) Put(ctx context.Context, key string, body *os.File, sum []byte) (string, error) {
+	destination := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(destination), 0750); err != nil {
+		return "", err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(destination), "."+filepath.Base(destination)+".*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), body); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if !bytes.Equal(hash.Sum(nil), sum) {
+		tmp.Close()
+		return "", fmt.Errorf("%w: %s", ErrChecksumMismatch, destination)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum), os.Rename(tmp.Name(), destination)
+}
+
+func (s *FileStorage) Exists(ctx context.Context, key string, sum []byte) (bool, error) {
+	fp, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer fp.Close()
+	stored, err := fileSHA256(fp)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(stored, sum), nil
+}
+
+// MemoryStorage: A StorageBackend keeping objects in memory
+type MemoryStorage struct {
+	Prefix  string
+	lock    sync.Mutex
+	objects map[string][]byte
+}
+
+func NewMemoryStorage(prefix string) *MemoryStorage {
+	return &MemoryStorage{
+		Prefix:  storageKey(prefix),
+		objects: map[string][]byte{},
+	}
+}
+
+func (s *MemoryStorage) String() string {
+	return "memory://" + s.Prefix
+}
+
+func (s *MemoryStorage) key(key string) string {
+	return storageKey(path.Join(s.Prefix, key))
+}
+
+func (s *MemoryStorage) Put(ctx context.Context, key string, body *os.File, sum []byte) (string, error) {
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	if stored := sha256.Sum256(b); !bytes.Equal(stored[:], sum) {
+		return "", fmt.Errorf("%w: %s", ErrChecksumMismatch, key)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.objects[s.key(key)] = b
+	return hex.EncodeToString(sum), nil
+}
+
+func (s *MemoryStorage) Exists(ctx context.Context, key string, sum []byte) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	b, ok := s.objects[s.key(key)]
+	if !ok {
+		return false, nil
+	}
+	stored := sha256.Sum256(b)
+	return bytes.Equal(stored[:], sum), nil
+}
+
+// Get: The object stored at key, including the prefix
+func (s *MemoryStorage) Get(key string) ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	b, ok := s.objects[key]
+	return b, ok
+}
+
+// Keys: Every stored key, sorted
+func (s *MemoryStorage) Keys() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewStorageChoosesBackendByScheme(t *testing.T) {
+	root := t.TempDir()
+	expectations := map[string]string{
+		"s3://bucket/prefix":     "s3://bucket/prefix",
+		"file://" + root:         "file://" + root,
+		"memory://bucket/prefix": "memory://bucket/prefix",
+	}
+	for storageUrl, expectation := range expectations {
+		storage, err := NewStorage(storageUrl, StorageOptions{S3Client: &MockS3Client{}})
+		if err != nil {
+			t.Fatalf("Expected a backend for %s, got %s", storageUrl, err)
+		}
+		if storage.String() != expectation {
+			t.Fatalf("Expected %s, got %s", expectation, storage)
+		}
+	}
+
+	if _, err := NewStorage("ftp://host/path", StorageOptions{}); !errors.Is(err, ErrUnsupportedStorageScheme) {
+		t.Fatalf("Expected ErrUnsupportedStorageScheme, got %v", err)
+	}
+	if _, err := NewStorage("file://"+filepath.Join(root, "unmounted"), StorageOptions{}); err == nil {
+		t.Fatalf("Expected an error for a missing storage directory")
+	}
+	inaccessible := &MockS3Client{HeadBucketErr: errors.New("forbidden")}
+	if _, err := NewStorage("s3://bucket/prefix", StorageOptions{S3Client: inaccessible}); err == nil {
+		t.Fatalf("Expected an error for an inaccessible bucket")
+	}
+}
+
+func TestFileStorageUpload(t *testing.T) {
+	root := t.TempDir()
+	nas := filepath.Join(root, "nas")
+	os.Mkdir(nas, 0750)
+	storage, err := NewStorage("file://"+nas, StorageOptions{})
+	if err != nil {
+		t.Fatalf("Expected file storage, got %s", err)
+	}
+	uploader := NewUploader(storage)
+	uploader.TrimLocalPrefix(filepath.Join(root, "cameras") + "/")
+	video := filepath.Join(root, "cameras", "Camera1", "a.dav")
+	writeTestFile(t, video, "video")
+
+	if status := uploadFile(video, uploader); status != DoneUploadVideoFile {
+		t.Fatalf("Expected DoneUploadVideoFile, got %d", status)
+	}
+	b, err := os.ReadFile(filepath.Join(nas, "Camera1", "a.dav"))
+	if err != nil || string(b) != "video" {
+		t.Fatalf("Expected the video to be copied, got %q and %v", b, err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(nas, "Camera1"))
+	if len(entries) != 1 {
+		t.Fatalf("Expected no temporary files to remain, got %d entries", len(entries))
+	}
+}
+
+func TestFileStorageKeepsKeysUnderRoot(t *testing.T) {
+	root := t.TempDir()
+	storage, _ := NewFileStorage(root)
+	body := filepath.Join(t.TempDir(), "a.dav")
+	writeTestFile(t, body, "video")
+	fp, _ := os.Open(body)
+	defer fp.Close()
+	sum, _ := fileSHA256(fp)
+
+	if _, err := storage.Put(context.TODO(), "../../escaped/a.dav", fp, sum); err != nil {
+		t.Fatalf("Expected to store the file, got %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "escaped", "a.dav")); err != nil {
+		t.Fatalf("Expected the file to stay under the root, got %s", err)
+	}
+}
+
+func TestMemoryStorageUpload(t *testing.T) {
+	storage := NewMemoryStorage("bucket/prefix")
+	uploader := NewUploader(storage)
+	root := t.TempDir()
+	uploader.TrimLocalPrefix(root + "/")
+	video := filepath.Join(root, "Camera1", "a.dav")
+	writeTestFile(t, video, "video")
+
+	if status := uploadFile(video, uploader); status != DoneUploadVideoFile {
+		t.Fatalf("Expected DoneUploadVideoFile, got %d", status)
+	}
+	if b, ok := storage.Get("bucket/prefix/Camera1/a.dav"); !ok || string(b) != "video" {
+		t.Fatalf("Expected the video to be stored, got %v", storage.Keys())
+	}
+}
+
+func TestStoragePutRejectsChecksumMismatch(t *testing.T) {
+	body := filepath.Join(t.TempDir(), "a.dav")
+	writeTestFile(t, body, "video")
+	fp, _ := os.Open(body)
+	defer fp.Close()
+	wrongSum := make([]byte, 32)
+
+	fileStorage, _ := NewFileStorage(t.TempDir())
+	for _, storage := range []StorageBackend{fileStorage, NewMemoryStorage("bucket")} {
+		if _, err := storage.Put(context.TODO(), "a.dav", fp, wrongSum); !errors.Is(err, ErrChecksumMismatch) {
+			t.Fatalf("Expected ErrChecksumMismatch from %s, got %v", storage, err)
+		}
+		if exists, _ := storage.Exists(context.TODO(), "a.dav", wrongSum); exists {
+			t.Fatalf("Expected %s not to store mismatched content", storage)
+		}
+	}
+}
@@ -1,35 +1,122 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
+	"os"
+	"strconv"
+	"sync"
 )
 
 const (
 	stopSyslogServer = iota
 )
 
+// maxOctetCountDigits: Longer digit runs can't be a MSG-LEN within DatagramSize
+const maxOctetCountDigits = 9
+
 type SyslogServer struct {
 	// BindAddress: IP:Port to bind to
 	BindAddress string
+	// StreamListeners: TCP bind addresses, each optionally served over TLS
+	StreamListeners []SyslogListener
 	// DatagramSize: Size of message buffer
 	DatagramSize int
-	control      chan int
+	// ParseErrors: Called with each message which can't be parsed, when it's set
+	ParseErrors func()
+	control     chan int
+	stopOnce    sync.Once
+	connections *syslogConnections
+}
+
+// syslogConnections: The accepted TCP and TLS connections, closed when the server stops
+type syslogConnections struct {
+	lock     sync.Mutex
+	conns    map[net.Conn]bool
+	handling sync.WaitGroup
+	// stopped: Closed once the server stops, so messages aren't dispatched after it
+	stopped chan struct{}
+}
+
+// add: Track conn until done, or false when the server has stopped and conn shouldn't be handled
+func (c *syslogConnections) add(conn net.Conn) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	select {
+	case <-c.stopped:
+		return false
+	default:
+	}
+	c.conns[conn] = true
+	c.handling.Add(1)
+	return true
+}
+
+// done: Stop tracking conn once its handler returns
+func (c *syslogConnections) done(conn net.Conn) {
+	c.lock.Lock()
+	delete(c.conns, conn)
+	c.lock.Unlock()
+	c.handling.Done()
 }
 
-func NewSyslogServer(bindAddress string) SyslogServer {
-	return SyslogServer{
+// close: Close every connection and wait for their handlers to return
+func (c *syslogConnections) close() {
+	c.lock.Lock()
+	close(c.stopped)
+	for conn := range c.conns {
+		conn.Close()
+	}
+	c.lock.Unlock()
+	c.handling.Wait()
+}
+
+// SyslogListener: A TCP bind address which is served over TLS when TLSConfig is set
+type SyslogListener struct {
+	Address   string
+	TLSConfig *tls.Config
+}
+
+func NewSyslogServer(bindAddress string) *SyslogServer {
+	return &SyslogServer{
 		BindAddress:  bindAddress,
 		DatagramSize: 64 * 1024,
 		control:      make(chan int, 1),
+		connections:  &syslogConnections{conns: map[net.Conn]bool{}, stopped: make(chan struct{})},
 	}
 }
-func (s SyslogServer) Stop() {
-	s.control <- stopSyslogServer
+
+/*
+AddTcpListener: Accept newline or octet-counted TCP syslog streams on bindAddress.
+Streams are wrapped in TLS when tlsConfig isn't nil.
+*/
+func (s *SyslogServer) AddTcpListener(bindAddress string, tlsConfig *tls.Config) {
+	s.StreamListeners = append(s.StreamListeners, SyslogListener{bindAddress, tlsConfig})
 }
-func (s SyslogServer) Serve(stream chan *SyslogMessage) {
 
-	go func() {
+/*
+Stop: Close the listeners and the accepted connections, waiting for the
+connections to be let go. Only the first Stop does anything, so it can be
+called again, like by a reload and then a shutdown.
+*/
+func (s *SyslogServer) Stop() {
+	s.stopOnce.Do(func() {
+		s.control <- stopSyslogServer
+		s.connections.close()
+	})
+}
+
+func (s *SyslogServer) Serve(stream chan *SyslogMessage) {
+	closers := []io.Closer{}
+
+	if len(s.BindAddress) > 0 {
 		addr, err := net.ResolveUDPAddr("udp", s.BindAddress)
 		if err != nil {
 			log.Fatalf("Unable to resolve address %s: %s", s.BindAddress, err)
@@ -40,25 +127,176 @@ func (s SyslogServer) Serve(stream chan *SyslogMessage) {
 			log.Fatalf("Unable to bind listener to %s: %s", addr, err)
 		}
 		listener.SetReadBuffer(s.DatagramSize)
+		closers = append(closers, listener)
 
 		log.Printf("Started listener on %s", listener.LocalAddr())
-		for {
-			data := make([]byte, s.DatagramSize)
-			// byteCount, connectionAddress, err := listener.ReadFrom(data)
-			byteCount, err := listener.Read(data)
-			if err != nil {
-				log.Printf("Failed to read: %s", err)
-				continue
-			}
-			if byteCount > 0 {
-				message := NewSyslogMessage(data[0:byteCount])
-				if flagVerbose {
-					log.Printf("Dispatching message to stream %v", message)
-				}
-				stream <- message
-			}
+		go s.serveDatagrams(listener, stream)
+	}
+
+	for _, streamListener := range s.StreamListeners {
+		listener, err := net.Listen("tcp", streamListener.Address)
+		if err != nil {
+			log.Fatalf("Unable to bind listener to %s: %s", streamListener.Address, err)
 		}
-	}()
+		protocol := "tcp"
+		if streamListener.TLSConfig != nil {
+			listener = tls.NewListener(listener, streamListener.TLSConfig)
+			protocol = "tls"
+		}
+		closers = append(closers, listener)
+
+		log.Printf("Started %s listener on %s", protocol, listener.Addr())
+		go s.serveStream(listener, stream)
+	}
+
 	<-s.control
+	for _, closer := range closers {
+		closer.Close()
+	}
 	log.Printf("Quitting camera event streamer")
 }
+
+func (s *SyslogServer) serveDatagrams(listener *net.UDPConn, stream chan *SyslogMessage) {
+	for {
+		data := make([]byte, s.DatagramSize)
+		// byteCount, connectionAddress, err := listener.ReadFrom(data)
+		byteCount, err := listener.Read(data)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to read: %s", err)
+			continue
+		}
+		if byteCount > 0 {
+			s.dispatch(data[0:byteCount], stream)
+		}
+	}
+}
+
+func (s *SyslogServer) serveStream(listener net.Listener, stream chan *SyslogMessage) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to accept: %s", err)
+			continue
+		}
+		if flagDebug {
+			log.Printf("Accepted syslog connection from %s", conn.RemoteAddr())
+		}
+		if !s.connections.add(conn) {
+			conn.Close()
+			return
+		}
+		go s.handleConnection(conn, stream)
+	}
+}
+
+// handleConnection: Dispatch each frame of a stream until the sender disconnects
+func (s *SyslogServer) handleConnection(conn net.Conn, stream chan *SyslogMessage) {
+	defer s.connections.done(conn)
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), s.DatagramSize)
+	scanner.Split(ScanSyslogFrames)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			s.dispatch(scanner.Bytes(), stream)
+		}
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("Closing syslog connection from %s: %s", conn.RemoteAddr(), err)
+	}
+}
+
+func (s *SyslogServer) dispatch(data []byte, stream chan *SyslogMessage) {
+	message := NewSyslogMessage(data)
+	if message == nil {
+		if s.ParseErrors != nil {
+			s.ParseErrors()
+		}
+		return
+	}
+	if flagVerbose {
+		log.Printf("Dispatching message to stream %v", message)
+	}
+	// Once stopped, nothing may be reading the stream
+	select {
+	case stream <- message:
+	case <-s.connections.stopped:
+	}
+}
+
+/*
+ScanSyslogFrames: A bufio.SplitFunc for RFC 6587 streams. Frames starting with
+`MSG-LEN SP <` are octet-counted, everything else is newline delimited.
+*/
+func ScanSyslogFrames(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	digits := 0
+	for digits < len(data) && digits <= maxOctetCountDigits && data[digits] >= '0' && data[digits] <= '9' {
+		digits++
+	}
+	if digits > 0 && digits <= maxOctetCountDigits {
+		// Need to see past `MSG-LEN SP` to tell the framing apart
+		if digits+1 >= len(data) && !atEOF {
+			return 0, nil, nil
+		}
+		if digits+1 < len(data) && data[digits] == ' ' && data[digits+1] == '<' {
+			length, _ := strconv.Atoi(string(data[:digits]))
+			frameEnd := digits + 1 + length
+			if frameEnd <= len(data) {
+				return frameEnd, data[digits+1 : frameEnd], nil
+			}
+			if atEOF {
+				return 0, nil, ErrInvalidSyslogFrame
+			}
+			return 0, nil, nil
+		}
+	}
+
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, bytes.TrimRight(data[:i], "\r"), nil
+	}
+	if atEOF {
+		return len(data), bytes.TrimRight(data, "\r"), nil
+	}
+	return 0, nil, nil
+}
+
+/*
+LoadSyslogTLSConfig: Create a server TLS configuration from PEM files. Clients
+must present a certificate signed by clientCAFile when it's set.
+*/
+func LoadSyslogTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load syslog TLS certificate %s: %w", certFile, err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if len(clientCAFile) == 0 {
+		return config, nil
+	}
+
+	pem, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read syslog TLS client CA %s: %w", clientCAFile, err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in syslog TLS client CA %s", clientCAFile)
+	}
+	config.ClientCAs = clientCAs
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
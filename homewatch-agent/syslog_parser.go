@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SyslogFormat: The wire format a SyslogMessage was decoded from
+type SyslogFormat int
+
+const (
+	LegacySyslogFormat SyslogFormat = iota
+	RFC3164SyslogFormat
+	RFC5424SyslogFormat
+)
+
+const (
+	syslogNilValue     = "-"
+	syslogMaxPriority  = 191
+	rfc3164TimeLayout  = "Jan _2 15:04:05"
+	rfc3164TimeLength  = len(rfc3164TimeLayout)
+	syslogUTF8ByteMark = "\xef\xbb\xbf"
+)
+
+var (
+	ErrEmptySyslogMessage    = errors.New("empty syslog message")
+	ErrInvalidSyslogFrame    = errors.New("invalid octet-counted frame")
+	ErrInvalidSyslogPriority = errors.New("invalid priority")
+	ErrInvalidSyslogVersion  = errors.New("invalid version")
+	ErrInvalidSyslogTime     = errors.New("invalid timestamp")
+	ErrInvalidSyslogHeader   = errors.New("invalid header")
+	ErrInvalidStructuredData = errors.New("invalid structured data")
+	ErrUnknownSyslogFormat   = errors.New("unknown syslog format")
+)
+
+func (f SyslogFormat) String() string {
+	switch f {
+	case RFC3164SyslogFormat:
+		return "rfc3164"
+	case RFC5424SyslogFormat:
+		return "rfc5424"
+	}
+	return "legacy"
+}
+
+// SyslogParseError: Reports which format was being decoded, the byte offset
+// decoding stopped at, and the reason as one of the ErrInvalid* errors
+type SyslogParseError struct {
+	Format SyslogFormat
+	Offset int
+	Err    error
+}
+
+func (e *SyslogParseError) Error() string {
+	return fmt.Sprintf("%s: %s at offset %d", e.Format, e.Err, e.Offset)
+}
+
+func (e *SyslogParseError) Unwrap() error {
+	return e.Err
+}
+
+type syslogScanner struct {
+	data   []byte
+	pos    int
+	format SyslogFormat
+}
+
+func (s *syslogScanner) fail(err error) error {
+	return &SyslogParseError{Format: s.format, Offset: s.pos, Err: err}
+}
+
+func (s *syslogScanner) done() bool {
+	return s.pos >= len(s.data)
+}
+
+// token: Read up to the next space and consume the space
+func (s *syslogScanner) token() (string, bool) {
+	if s.done() {
+		return "", false
+	}
+	start := s.pos
+	end := bytes.IndexByte(s.data[start:], ' ')
+	if end < 0 {
+		s.pos = len(s.data)
+		return string(s.data[start:]), true
+	}
+	s.pos = start + end + 1
+	return string(s.data[start : start+end]), true
+}
+
+func (s *syslogScanner) rest() string {
+	if s.done() {
+		return ""
+	}
+	r := string(s.data[s.pos:])
+	s.pos = len(s.data)
+	return r
+}
+
+/*
+ParseSyslogMessage: Decode an RFC 5424, RFC 3164, or legacy rsyslog template
+message. An RFC 6587 octet-count prefix is removed before decoding.
+*/
+func ParseSyslogMessage(b []byte) (*SyslogMessage, error) {
+	m := &SyslogMessage{}
+	if err := m.UnmarshalText(b); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+/*
+stripOctetCount: Remove the `MSG-LEN SP` prefix of an octet-counted frame.
+Messages without the prefix are returned unchanged.
+*/
+func stripOctetCount(b []byte) ([]byte, error) {
+	i := 0
+	for i < len(b) && b[i] >= '0' && b[i] <= '9' {
+		i++
+	}
+	if i == 0 || i+1 >= len(b) || b[i] != ' ' || b[i+1] != '<' {
+		return b, nil
+	}
+	length, err := strconv.Atoi(string(b[:i]))
+	if err != nil || length > len(b)-i-1 {
+		return nil, &SyslogParseError{Offset: 0, Err: ErrInvalidSyslogFrame}
+	}
+	return b[i+1 : i+1+length], nil
+}
+
+func parseSyslogMessage(m *SyslogMessage, b []byte) error {
+	b = bytes.TrimRight(b, "\r\n\x00")
+	if len(bytes.TrimSpace(b)) == 0 {
+		return &SyslogParseError{Err: ErrEmptySyslogMessage}
+	}
+	b, err := stripOctetCount(b)
+	if err != nil {
+		return err
+	}
+	if b[0] != '<' {
+		return parseLegacySyslog(m, string(b))
+	}
+
+	s := &syslogScanner{data: b, pos: 1, format: RFC3164SyslogFormat}
+	end := bytes.IndexByte(b, '>')
+	if end < 2 || end > 4 {
+		return s.fail(ErrInvalidSyslogPriority)
+	}
+	priority, err := strconv.Atoi(string(b[1:end]))
+	if err != nil || priority < 0 || priority > syslogMaxPriority {
+		return s.fail(ErrInvalidSyslogPriority)
+	}
+	s.pos = end + 1
+	m.Priority = priority
+	m.Facility = priority / 8
+	m.Severity = priority % 8
+	m.Code = strconv.Itoa(priority)
+
+	if !s.done() && b[s.pos] >= '1' && b[s.pos] <= '9' {
+		s.format = RFC5424SyslogFormat
+		return parseRFC5424(m, s)
+	}
+	return parseRFC3164(m, s)
+}
+
+func parseRFC5424(m *SyslogMessage, s *syslogScanner) error {
+	m.Format = RFC5424SyslogFormat
+
+	token, ok := s.token()
+	version, err := strconv.Atoi(token)
+	if !ok || err != nil || version > 99 {
+		return s.fail(ErrInvalidSyslogVersion)
+	}
+	m.Version = version
+
+	timestamp, ok := s.token()
+	if !ok {
+		return s.fail(ErrInvalidSyslogTime)
+	}
+	if timestamp != syslogNilValue {
+		t, err := time.Parse(time.RFC3339Nano, timestamp)
+		if err != nil {
+			return s.fail(ErrInvalidSyslogTime)
+		}
+		m.Timestamp = t
+	}
+
+	header := make([]string, 4)
+	for i := range header {
+		field, ok := s.token()
+		if !ok || len(field) == 0 {
+			return s.fail(ErrInvalidSyslogHeader)
+		}
+		if field != syslogNilValue {
+			header[i] = field
+		}
+	}
+	m.LogHost, m.Service, m.PID, m.MsgID = header[0], header[1], header[2], header[3]
+
+	sd, err := parseStructuredData(s)
+	if err != nil {
+		return err
+	}
+	m.StructuredData = sd
+	if !s.done() {
+		if s.data[s.pos] != ' ' {
+			return s.fail(ErrInvalidStructuredData)
+		}
+		s.pos++
+	}
+
+	setSyslogContent(m, strings.TrimPrefix(s.rest(), syslogUTF8ByteMark))
+	return nil
+}
+
+/*
+parseStructuredData: Decode `-` or one or more
+`[SD-ID PARAM-NAME="PARAM-VALUE" ...]` elements
+*/
+func parseStructuredData(s *syslogScanner) (map[string]map[string]string, error) {
+	if s.done() {
+		return nil, s.fail(ErrInvalidStructuredData)
+	}
+	if s.data[s.pos] == '-' {
+		s.pos++
+		return nil, nil
+	}
+
+	sd := map[string]map[string]string{}
+	for !s.done() && s.data[s.pos] == '[' {
+		s.pos++
+		id := readSDName(s)
+		if len(id) == 0 {
+			return nil, s.fail(ErrInvalidStructuredData)
+		}
+		params := map[string]string{}
+		for {
+			if s.done() {
+				return nil, s.fail(ErrInvalidStructuredData)
+			}
+			if s.data[s.pos] == ']' {
+				s.pos++
+				break
+			}
+			if s.data[s.pos] != ' ' {
+				return nil, s.fail(ErrInvalidStructuredData)
+			}
+			s.pos++
+			name := readSDName(s)
+			if len(name) == 0 || s.pos+1 >= len(s.data) || s.data[s.pos] != '=' || s.data[s.pos+1] != '"' {
+				return nil, s.fail(ErrInvalidStructuredData)
+			}
+			s.pos += 2
+			value, err := readSDValue(s)
+			if err != nil {
+				return nil, err
+			}
+			params[name] = value
+		}
+		sd[id] = params
+	}
+	if len(sd) == 0 {
+		return nil, s.fail(ErrInvalidStructuredData)
+	}
+	return sd, nil
+}
+
+func readSDName(s *syslogScanner) string {
+	start := s.pos
+	for !s.done() {
+		c := s.data[s.pos]
+		if c == '=' || c == ' ' || c == ']' || c == '"' {
+			break
+		}
+		s.pos++
+	}
+	return string(s.data[start:s.pos])
+}
+
+// readSDValue: Read a PARAM-VALUE through its closing quote, unescaping \" \\ and \]
+func readSDValue(s *syslogScanner) (string, error) {
+	value := strings.Builder{}
+	for !s.done() {
+		c := s.data[s.pos]
+		s.pos++
+		switch c {
+		case '"':
+			return value.String(), nil
+		case '\\':
+			if !s.done() {
+				if next := s.data[s.pos]; next == '"' || next == '\\' || next == ']' {
+					c = next
+					s.pos++
+				}
+			}
+		}
+		value.WriteByte(c)
+	}
+	return "", s.fail(ErrInvalidStructuredData)
+}
+
+func parseRFC3164(m *SyslogMessage, s *syslogScanner) error {
+	m.Format = RFC3164SyslogFormat
+
+	if len(s.data)-s.pos < rfc3164TimeLength {
+		return s.fail(ErrInvalidSyslogTime)
+	}
+	t, err := parseRFC3164Time(string(s.data[s.pos:s.pos+rfc3164TimeLength]), time.Now())
+	if err != nil {
+		return s.fail(ErrInvalidSyslogTime)
+	}
+	m.Timestamp = t
+	s.pos += rfc3164TimeLength
+	for !s.done() && s.data[s.pos] == ' ' {
+		s.pos++
+	}
+
+	// HOSTNAME is optional; a first field carrying the pid or ending in ':' is the TAG
+	mark := s.pos
+	host, ok := s.token()
+	if !ok {
+		return s.fail(ErrInvalidSyslogHeader)
+	}
+	if strings.ContainsAny(host, "[:") {
+		s.pos = mark
+	} else {
+		m.LogHost = host
+	}
+
+	mark = s.pos
+	tag := s.rest()
+	end := strings.Index(tag, ": ")
+	if end < 0 {
+		end = strings.IndexByte(tag, ':')
+	}
+	if end < 0 {
+		s.pos = mark
+		return s.fail(ErrInvalidSyslogHeader)
+	}
+	content := strings.TrimPrefix(tag[end+1:], " ")
+	tag = tag[:end]
+	if open := strings.IndexByte(tag, '['); open >= 0 && strings.HasSuffix(tag, "]") {
+		m.PID = tag[open+1 : len(tag)-1]
+		tag = tag[:open]
+	}
+	m.Service = tag
+
+	setSyslogContent(m, content)
+	return nil
+}
+
+/*
+parseRFC3164Time: RFC 3164 timestamps carry no year or zone so they are read in
+local time for the year of now, rolling back a year for messages from the future
+*/
+func parseRFC3164Time(timestamp string, now time.Time) (time.Time, error) {
+	t, err := time.ParseInLocation(rfc3164TimeLayout, timestamp, now.Location())
+	if err != nil {
+		return t, err
+	}
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t, nil
+}
+
+// parseLegacySyslog: The `<code> <date time zone> <host> <service> <pid> <message>` rsyslog template
+func parseLegacySyslog(m *SyslogMessage, logMessage string) error {
+	matches := dataDecoderV2.FindStringSubmatch(logMessage)
+	if matches == nil {
+		return &SyslogParseError{Format: LegacySyslogFormat, Err: ErrUnknownSyslogFormat}
+	}
+	m.Format = LegacySyslogFormat
+	m.Code = matches[dataDecoderV2.SubexpIndex("code")]
+	if priority, err := strconv.Atoi(m.Code); err == nil && priority <= syslogMaxPriority {
+		m.Priority = priority
+		m.Facility = priority / 8
+		m.Severity = priority % 8
+	}
+	t, err := time.Parse(legacyTimeFormat, matches[dataDecoderV2.SubexpIndex("dateTime")])
+	if err != nil {
+		return &SyslogParseError{Format: LegacySyslogFormat, Offset: len(m.Code) + 1, Err: ErrInvalidSyslogTime}
+	}
+	m.Timestamp = t
+
+	rest := matches[dataDecoderV2.SubexpIndex("rest")]
+	body := bodyDecoderV2.FindStringSubmatch(rest)
+	if body == nil {
+		return &SyslogParseError{Format: LegacySyslogFormat, Offset: len(logMessage) - len(rest), Err: ErrInvalidSyslogHeader}
+	}
+	m.LogHost = body[bodyDecoderV2.SubexpIndex("logHost")]
+	m.Service = body[bodyDecoderV2.SubexpIndex("service")]
+	m.PID = body[bodyDecoderV2.SubexpIndex("pid")]
+	m.Message = strings.TrimSpace(body[bodyDecoderV2.SubexpIndex("cmd")] + " " + body[bodyDecoderV2.SubexpIndex("action")])
+	m.Command = body[bodyDecoderV2.SubexpIndex("cmd")]
+	m.Action = body[bodyDecoderV2.SubexpIndex("action")]
+	return nil
+}
+
+// setSyslogContent: The first word of an SFTP log message is its command
+func setSyslogContent(m *SyslogMessage, content string) {
+	m.Message = content
+	fields := strings.SplitN(strings.TrimLeft(content, " "), " ", 2)
+	m.Command = fields[0]
+	if len(fields) > 1 {
+		m.Action = strings.TrimLeft(fields[1], " ")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseRFC5424Message(t *testing.T) {
+	m, err := ParseSyslogMessage([]byte(`<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="App\"lication" eventID="1011"][examplePriority@32473 class="high"] An application event`))
+	if err != nil {
+		t.Fatalf("Expected to parse the message, got %s", err)
+	}
+	if m.Format != RFC5424SyslogFormat {
+		t.Fatalf("Expected rfc5424, got %s", m.Format)
+	}
+	if m.Facility != 20 || m.Severity != 5 || m.Code != "165" {
+		t.Fatalf("Expected facility 20 severity 5, got %d %d", m.Facility, m.Severity)
+	}
+	if m.LogHost != "mymachine.example.com" || m.Service != "evntslog" || m.PID != "" || m.MsgID != "ID47" {
+		t.Fatalf("Unexpected header %#v", m)
+	}
+	expectTime := time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC)
+	if !m.Timestamp.Equal(expectTime) {
+		t.Fatalf("Expected %s, got %s", expectTime, m.Timestamp)
+	}
+	if v := m.StructuredData["exampleSDID@32473"]["eventSource"]; v != `App"lication` {
+		t.Fatalf("Expected an unescaped param value, got %s", v)
+	}
+	if v := m.StructuredData["examplePriority@32473"]["class"]; v != "high" {
+		t.Fatalf("Expected 'high', got %s", v)
+	}
+	if m.Command != "An" || m.Action != "application event" {
+		t.Fatalf("Unexpected command %s and action %s", m.Command, m.Action)
+	}
+}
+
+func TestParseRFC5424RenameMessage(t *testing.T) {
+	m, err := ParseSyslogMessage([]byte(`<86>1 2024-01-02T03:04:05.123456+00:00 cameraProxy internal-sftp 1234 - - posix-rename old "/home/cameras/Cam/a.dav_" new "/home/cameras/Cam/a.dav"` + "\n"))
+	if err != nil {
+		t.Fatalf("Expected to parse the message, got %s", err)
+	}
+	if m.PID != "1234" || m.Service != "internal-sftp" {
+		t.Fatalf("Unexpected header %#v", m)
+	}
+	rm := m.RenameMessage()
+	if rm == nil {
+		t.Fatalf("Expected a RenameMessage")
+	}
+	if rm.Dest != "/home/cameras/Cam/a.dav" {
+		t.Fatalf("Expected '/home/cameras/Cam/a.dav', got %s", rm.Dest)
+	}
+}
+
+func TestParseRFC3164Message(t *testing.T) {
+	m, err := ParseSyslogMessage([]byte("<190>Sep  3 23:41:09 cameraProxy internal-sftp[111792]: rename old \"/a.dav_\" new \"/a.dav\""))
+	if err != nil {
+		t.Fatalf("Expected to parse the message, got %s", err)
+	}
+	if m.Format != RFC3164SyslogFormat {
+		t.Fatalf("Expected rfc3164, got %s", m.Format)
+	}
+	if m.LogHost != "cameraProxy" || m.Service != "internal-sftp" || m.PID != "111792" {
+		t.Fatalf("Unexpected header %#v", m)
+	}
+	if m.Timestamp.Month() != time.September || m.Timestamp.Day() != 3 {
+		t.Fatalf("Expected Sep 3, got %s", m.Timestamp)
+	}
+	if m.MessageType() != SftpRenameMessageType {
+		t.Fatalf("Expected SftpRenameMessageType, got %d", m.MessageType())
+	}
+}
+
+func TestParseRFC3164MessageWithoutHostname(t *testing.T) {
+	m, err := ParseSyslogMessage([]byte("<13>Feb 28 01:02:03 sshd: session opened"))
+	if err != nil {
+		t.Fatalf("Expected to parse the message, got %s", err)
+	}
+	if m.LogHost != "" || m.Service != "sshd" || m.Command != "session" {
+		t.Fatalf("Unexpected header %#v", m)
+	}
+}
+
+func TestParseRFC3164TimeRollsBackAYear(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ts, err := parseRFC3164Time("Dec 31 23:59:59", now)
+	if err != nil {
+		t.Fatalf("Expected to parse the time, got %s", err)
+	}
+	if ts.Year() != 2023 {
+		t.Fatalf("Expected 2023, got %d", ts.Year())
+	}
+}
+
+func TestParseOctetCountedMessage(t *testing.T) {
+	payload := "<34>1 2003-10-11T22:14:15.003Z host su - ID47 - 'su root' failed"
+	m, err := ParseSyslogMessage([]byte(fmt.Sprintf("%d %s", len(payload), payload)))
+	if err != nil {
+		t.Fatalf("Expected to parse the message, got %s", err)
+	}
+	if m.Service != "su" || m.Message != "'su root' failed" {
+		t.Fatalf("Unexpected message %#v", m)
+	}
+
+	_, err = ParseSyslogMessage([]byte("900 " + payload))
+	if !errors.Is(err, ErrInvalidSyslogFrame) {
+		t.Fatalf("Expected ErrInvalidSyslogFrame, got %v", err)
+	}
+}
+
+func TestParseSyslogMessageErrors(t *testing.T) {
+	cases := map[string]error{
+		"":                                   ErrEmptySyslogMessage,
+		"\n":                                 ErrEmptySyslogMessage,
+		"garbage":                            ErrUnknownSyslogFormat,
+		"<999>Sep 23 23:41:09 host tag: msg": ErrInvalidSyslogPriority,
+		"<abc>Sep 23 23:41:09 host tag: msg": ErrInvalidSyslogPriority,
+		"<13>Sept 23 23:41 host tag: msg":    ErrInvalidSyslogTime,
+		"<13>Sep 23 23:41:09 host no-tag-message": ErrInvalidSyslogHeader,
+		"<13>1 yesterday host app - - -":          ErrInvalidSyslogTime,
+		"<13>1 - host app":                        ErrInvalidSyslogHeader,
+		"<13>1 - host app - - [id key=value]":     ErrInvalidStructuredData,
+		"<13>1 - host app - - [id key=\"value":    ErrInvalidStructuredData,
+		"<13>1 - host app - - [id]message":        ErrInvalidStructuredData,
+	}
+	for message, expectation := range cases {
+		m, err := ParseSyslogMessage([]byte(message))
+		if !errors.Is(err, expectation) {
+			t.Fatalf("Expected %s for %q, got %v", expectation, message, err)
+		}
+		var parseError *SyslogParseError
+		if !errors.As(err, &parseError) {
+			t.Fatalf("Expected a SyslogParseError for %q, got %T", message, err)
+		}
+		if m != nil {
+			t.Fatalf("Expected no message for %q, got %#v", message, m)
+		}
+	}
+}
+
+func TestNewSyslogMessageDoesNotPanic(t *testing.T) {
+	if m := NewSyslogMessage([]byte("<190>")); m != nil {
+		t.Fatalf("Expected no message, got %#v", m)
+	}
+	m := NewSyslogMessage([]byte("<190>Sep 23 23:41:09 host internal-sftp[1]: rename \"/a.dav_\""))
+	if m == nil {
+		t.Fatalf("Expected a message")
+	}
+	if rm := m.RenameMessage(); rm != nil {
+		t.Fatalf("Expected a short rename action to be ignored, got %#v", rm)
+	}
+}
@@ -1,9 +1,24 @@
 package main
 
 import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
+	"math/big"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestMessageHandler(t *testing.T) {
@@ -24,3 +39,189 @@ func TestMessageHandler(t *testing.T) {
 		t.Fatalf("Expected SftpRenameMessageType, got %v", messageType)
 	}
 }
+
+func TestScanSyslogFrames(t *testing.T) {
+	octetCounted := "<13>1 - host app - - - hello\nworld"
+	input := fmt.Sprintf("%d %s", len(octetCounted), octetCounted) +
+		"<13>Sep 23 23:41:09 host tag: newline\r\n" +
+		"190 2023-09-23 18:26:57 +0000 UTC void internal-sftp 1 session closed"
+
+	scanner := bufio.NewScanner(strings.NewReader(input))
+	scanner.Split(ScanSyslogFrames)
+	frames := []string{}
+	for scanner.Scan() {
+		frames = append(frames, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("Expected to scan frames, got %s", err)
+	}
+	expectation := []string{
+		octetCounted,
+		"<13>Sep 23 23:41:09 host tag: newline",
+		"190 2023-09-23 18:26:57 +0000 UTC void internal-sftp 1 session closed",
+	}
+	if len(frames) != len(expectation) {
+		t.Fatalf("Expected %d frames, got %#v", len(expectation), frames)
+	}
+	for i, frame := range frames {
+		if frame != expectation[i] {
+			t.Fatalf("Expected %q, got %q", expectation[i], frame)
+		}
+	}
+}
+
+func TestScanSyslogFramesTruncatedFrame(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader("100 <13>1 - host app - - - short"))
+	scanner.Split(ScanSyslogFrames)
+	for scanner.Scan() {
+		t.Fatalf("Expected no frames, got %q", scanner.Text())
+	}
+	if err := scanner.Err(); !errors.Is(err, ErrInvalidSyslogFrame) {
+		t.Fatalf("Expected ErrInvalidSyslogFrame, got %v", err)
+	}
+}
+
+func TestSyslogServerTcpStream(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer listener.Close()
+
+	stream := make(chan *SyslogMessage, 2)
+	server := NewSyslogServer("")
+	go server.serveStream(listener, stream)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	defer conn.Close()
+	assertSyslogStream(t, conn, stream)
+}
+
+func TestSyslogServerTlsStream(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	tlsConfig, err := LoadSyslogTLSConfig(certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("Expected to load the TLS config, got %s", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	listener = tls.NewListener(listener, tlsConfig)
+	defer listener.Close()
+
+	stream := make(chan *SyslogMessage, 2)
+	server := NewSyslogServer("")
+	go server.serveStream(listener, stream)
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	defer conn.Close()
+	assertSyslogStream(t, conn, stream)
+}
+
+func TestSyslogServerStopClosesConnections(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer listener.Close()
+
+	// Nothing reads the stream, so the connection's handler blocks dispatching
+	stream := make(chan *SyslogMessage)
+	server := NewSyslogServer("")
+	go server.serveStream(listener, stream)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "<190>Sep 23 23:41:09 cameraProxy internal-sftp[111792]: session closed\n")
+
+	// Stopping again, like a reload and then a shutdown, doesn't block
+	stopped := make(chan struct{})
+	go func() {
+		server.Stop()
+		server.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the connection's handler to return")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// Closing with the message unread can reset the connection instead of ending it
+	_, err = conn.Read(make([]byte, 1))
+	if timeout, ok := err.(net.Error); err == nil || ok && timeout.Timeout() {
+		t.Fatalf("Expected the server to close the connection, got %v", err)
+	}
+}
+
+func assertSyslogStream(t *testing.T, conn net.Conn, stream chan *SyslogMessage) {
+	rename := `<86>1 - cameraProxy internal-sftp 1 - - posix-rename old "/a.dav_" new "/a.dav"`
+	fmt.Fprintf(conn, "%d %s", len(rename), rename)
+	fmt.Fprint(conn, "not syslog\n")
+	fmt.Fprint(conn, "<190>Sep 23 23:41:09 cameraProxy internal-sftp[111792]: session closed\n")
+
+	for _, command := range []string{PosixRenameCmd, SessionCmd} {
+		select {
+		case message := <-stream:
+			if message.Command != command {
+				t.Fatalf("Expected %s, got %s", command, message.Command)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %s", command)
+		}
+	}
+}
+
+func writeTestCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unable to create certificate: %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Unable to marshal key: %s", err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestSyslogServerCountsParseErrors(t *testing.T) {
+	stream := make(chan *SyslogMessage, 1)
+	server := NewSyslogServer("")
+	parseErrors := 0
+	server.ParseErrors = func() { parseErrors++ }
+
+	server.dispatch([]byte("not syslog"), stream)
+	server.dispatch([]byte(`<86>1 - cameraProxy internal-sftp 1 - - posix-rename old "/a.dav_" new "/a.dav"`), stream)
+	if parseErrors != 1 || len(stream) != 1 {
+		t.Fatalf("Expected 1 parse error and 1 message, got %d and %d", parseErrors, len(stream))
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const transcodedVideoExtension = ".mp4"
+
+// Transcoder: Converts the video at source into the video at destination
+type Transcoder interface {
+	Transcode(ctx context.Context, source, destination string) error
+}
+
+// DefaultFFmpegArgs: H.264 and AAC in an MP4 which browsers can start playing before it's downloaded
+var DefaultFFmpegArgs = []string{
+	"-c:v", "libx264",
+	"-preset", "veryfast",
+	"-crf", "23",
+	"-c:a", "aac",
+	"-movflags", "+faststart",
+	"-f", "mp4",
+}
+
+// FFmpegTranscoder: A Transcoder running a local ffmpeg
+type FFmpegTranscoder struct {
+	// Path: ffmpeg executable, looked up in PATH when it has no directory
+	Path string
+	// Args: Output options placed between the input and destination
+	Args []string
+}
+
+func NewFFmpegTranscoder(path string) *FFmpegTranscoder {
+	return &FFmpegTranscoder{
+		Path: path,
+		Args: DefaultFFmpegArgs,
+	}
+}
+
+func (t *FFmpegTranscoder) args(source, destination string) []string {
+	args := []string{"-hide_banner", "-loglevel", "error", "-nostdin", "-y", "-i", source}
+	args = append(args, t.Args...)
+	return append(args, destination)
+}
+
+/*
+Transcode: Run ffmpeg writing to a temporary file beside destination, which is
+renamed into place once ffmpeg succeeds so a partial video is never uploaded
+*/
+func (t *FFmpegTranscoder) Transcode(ctx context.Context, source, destination string) error {
+	// Hidden, but keeping its extension so ffmpeg can tell the output format
+	tmp := filepath.Join(filepath.Dir(destination), "."+filepath.Base(destination))
+	defer os.Remove(tmp)
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, t.Path, t.args(source, tmp)...)
+	cmd.Stderr = stderr
+	if flagVerbose {
+		log.Printf("Running %s", strings.Join(cmd.Args, " "))
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("unable to transcode %s: %w: %s", source, err, strings.TrimSpace(stderr.String()))
+	}
+	return os.Rename(tmp, destination)
+}
+
+// transcodedPath: The path of the video transcoded from source, beside it
+func transcodedPath(source string) string {
+	return strings.TrimSuffix(source, filepath.Ext(source)) + transcodedVideoExtension
+}
+
+type transcodeJob struct {
+	ctx         context.Context
+	source      string
+	destination string
+	result      chan error
+}
+
+/*
+TranscodePool: Runs a Transcoder on at most Workers videos at once. Transcoding
+is CPU bound so callers beyond Workers wait their turn.
+*/
+type TranscodePool struct {
+	Transcoder Transcoder
+	Workers    int
+	jobs       chan transcodeJob
+	wg         sync.WaitGroup
+	closeOnce  sync.Once
+}
+
+func NewTranscodePool(transcoder Transcoder, workers int) *TranscodePool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &TranscodePool{
+		Transcoder: transcoder,
+		Workers:    workers,
+		jobs:       make(chan transcodeJob),
+	}
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+func (p *TranscodePool) work() {
+	defer p.wg.Done()
+	for job := range p.jobs {
+		start := time.Now()
+		err := p.Transcoder.Transcode(job.ctx, job.source, job.destination)
+		if err == nil && flagDebug {
+			log.Printf("Transcoded %s to %s in %s", job.source, job.destination, time.Since(start))
+		}
+		job.result <- err
+	}
+}
+
+// Transcode: Transcode source to the MP4 beside it, waiting for a free worker until ctx is done
+func (p *TranscodePool) Transcode(ctx context.Context, source string) (string, error) {
+	job := transcodeJob{ctx, source, transcodedPath(source), make(chan error, 1)}
+	select {
+	case p.jobs <- job:
+	case <-ctx.Done():
+		return job.destination, ctx.Err()
+	}
+	return job.destination, <-job.result
+}
+
+// Close: Stop the workers once they finish their current videos
+func (p *TranscodePool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.jobs)
+	})
+	p.wg.Wait()
+}
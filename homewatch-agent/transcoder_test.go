@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type MockTranscoder struct {
+	Err        error
+	lock       sync.Mutex
+	running    int
+	MaxRunning int
+}
+
+func (m *MockTranscoder) Transcode(ctx context.Context, source, destination string) error {
+	m.lock.Lock()
+	m.running++
+	if m.running > m.MaxRunning {
+		m.MaxRunning = m.running
+	}
+	m.lock.Unlock()
+	defer func() {
+		m.lock.Lock()
+		m.running--
+		m.lock.Unlock()
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	if m.Err != nil {
+		return m.Err
+	}
+	b, err := os.ReadFile(source)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(destination, append([]byte("mp4:"), b...), 0640)
+}
+
+func TestTranscodePoolIsBounded(t *testing.T) {
+	transcoder := &MockTranscoder{}
+	pool := NewTranscodePool(transcoder, 2)
+	defer pool.Close()
+	root := t.TempDir()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 6; i++ {
+		video := filepath.Join(root, string(rune('a'+i))+".dav")
+		writeTestFile(t, video, "video")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			destination, err := pool.Transcode(context.TODO(), video)
+			if err != nil || destination != strings.TrimSuffix(video, ".dav")+".mp4" {
+				t.Errorf("Expected %s to be transcoded, got %s and %v", video, destination, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if transcoder.MaxRunning != 2 {
+		t.Fatalf("Expected 2 videos transcoding at once, got %d", transcoder.MaxRunning)
+	}
+}
+
+func TestFFmpegTranscoder(t *testing.T) {
+	root := t.TempDir()
+	// Stands in for ffmpeg by copying the input to the last argument
+	ffmpeg := filepath.Join(root, "ffmpeg")
+	script := "#!/bin/sh\nwhile [ \"$1\" != \"-i\" ]; do shift; done\nsource=$2\nfor last; do :; done\n[ -s \"$source\" ] || { echo \"empty input\" >&2; exit 1; }\ncp \"$source\" \"$last\"\n"
+	if err := os.WriteFile(ffmpeg, []byte(script), 0750); err != nil {
+		t.Fatalf("Unable to write %s: %s", ffmpeg, err)
+	}
+	transcoder := NewFFmpegTranscoder(ffmpeg)
+	video := filepath.Join(root, "a.dav")
+	writeTestFile(t, video, "video")
+
+	if err := transcoder.Transcode(context.TODO(), video, transcodedPath(video)); err != nil {
+		t.Fatalf("Expected to transcode, got %s", err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(root, "a.mp4")); string(b) != "video" {
+		t.Fatalf("Expected a.mp4, got %q", b)
+	}
+
+	writeTestFile(t, video, "")
+	err := transcoder.Transcode(context.TODO(), video, filepath.Join(root, "b.mp4"))
+	if err == nil || !strings.Contains(err.Error(), "empty input") {
+		t.Fatalf("Expected ffmpeg's error output, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, ".b.mp4")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the partial output to be removed, got %v", err)
+	}
+}
+
+func newTranscodingHandler(t *testing.T, transcoder Transcoder, uploadOriginal bool) (*VideoEventHandler, *MemoryStorage, string) {
+	root := t.TempDir()
+	storage := NewMemoryStorage("bucket")
+	uploader := NewUploader(storage)
+	uploader.TrimLocalPrefix(root + "/")
+	config := VideoConfig{
+		Upload:    true,
+		Transcode: TranscodeConfig{Enabled: true, UploadOriginal: uploadOriginal},
+	}
+	handler := NewVideoEventHandler(config, make(chan string))
+	handler.AddUploader(uploader)
+	pool := NewTranscodePool(transcoder, 1)
+	t.Cleanup(pool.Close)
+	handler.AddTranscoder(pool)
+	return handler, storage, root
+}
+
+func TestVideoEventHandlerUploadsTranscodedVideo(t *testing.T) {
+	for _, uploadOriginal := range []bool{false, true} {
+		handler, storage, root := newTranscodingHandler(t, &MockTranscoder{}, uploadOriginal)
+		video := filepath.Join(root, "Camera1", "a.dav")
+		writeTestFile(t, video, "video")
+
+		if status := handler.uploadVideo(video); status != DoneUploadVideoFile {
+			t.Fatalf("Expected DoneUploadVideoFile, got %d", status)
+		}
+		expectation := "[bucket/Camera1/a.mp4]"
+		if uploadOriginal {
+			expectation = "[bucket/Camera1/a.dav bucket/Camera1/a.mp4]"
+		}
+		if keys := storage.Keys(); len(keys) == 0 || "["+strings.Join(keys, " ")+"]" != expectation {
+			t.Fatalf("Expected %s, got %v", expectation, keys)
+		}
+		if _, err := os.Stat(filepath.Join(root, "Camera1", "a.mp4")); !os.IsNotExist(err) {
+			t.Fatalf("Expected the uploaded MP4 to be removed, got %v", err)
+		}
+	}
+}
+
+func TestVideoEventHandlerUploadsOriginalWhenTranscodingFails(t *testing.T) {
+	handler, storage, root := newTranscodingHandler(t, &MockTranscoder{Err: errors.New("bad video")}, false)
+	video := filepath.Join(root, "Camera1", "a.dav")
+	writeTestFile(t, video, "video")
+
+	if status := handler.uploadVideo(video); status != DoneUploadVideoFile {
+		t.Fatalf("Expected DoneUploadVideoFile, got %d", status)
+	}
+	if b, ok := storage.Get("bucket/Camera1/a.dav"); !ok || string(b) != "video" {
+		t.Fatalf("Expected the original to be uploaded, got %v", storage.Keys())
+	}
+}
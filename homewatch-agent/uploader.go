@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	v2 "github.com/mrmod/homewatch/v2"
+)
+
+type S3FileUploader interface {
+	UploadFile(string, chan<- int)
+}
+
+/*
+Uploader: Uploads local files to a StorageBackend at their path relative to
+the local trim prefix, retrying failures and dead lettering files it gives up on
+*/
+type Uploader struct {
+	Context         context.Context
+	Storage         StorageBackend
+	localTrimPrefix string
+	// Retry: Attempts and waits between failed Put calls
+	Retry Backoff
+	// DeadLetterPath: Where files are moved once Retry is exhausted. Files are
+	// left in place when it's empty.
+	DeadLetterPath string
+	// State: Where each upload is recorded, nil to record nothing
+	State *StateStore
+	// Metrics: Where upload latency, sizes, failures and retries are counted, nil to count nothing
+	Metrics *v2.CameraMetrics
+	// Gate: Holds uploads back while it's paused, nil to never hold them
+	Gate *UploadGate
+}
+
+func NewUploader(storage StorageBackend) *Uploader {
+	return &Uploader{
+		Context: context.TODO(),
+		Storage: storage,
+		Retry:   DefaultBackoff,
+	}
+}
+
+/*
+	TrimLocalPrefix: Set the local prefix to trim from video files
+
+before uploading them
+*/
+func (u *Uploader) TrimLocalPrefix(prefix string) {
+	u.localTrimPrefix = prefix
+}
+
+const (
+	ErrorOpeningVideoFile = iota
+	ErrorUploadingVideoFile
+	StartUploadVideoFile
+	DoneUploadVideoFile
+	RetryUploadVideoFile
+	DeadLetterVideoFile
+	// CancelledUploadVideoFile: The upload stopped because Context was cancelled, leaving the file to upload again
+	CancelledUploadVideoFile
+)
+
+/*
+UploadFile: Upload filepath, retrying failures with backoff. The last status
+sent is one of DoneUploadVideoFile, ErrorOpeningVideoFile, DeadLetterVideoFile
+when the file was moved to DeadLetterPath, CancelledUploadVideoFile when Context
+was cancelled, or ErrorUploadingVideoFile.
+
+The file is read once to hash it before it's uploaded, then again to upload
+it. The SHA-256 isn't computed while streaming since it's needed before the
+upload starts, to skip keys already stored with it and because S3 takes the
+checksum and sha256 metadata as request headers.
+*/
+func (u *Uploader) UploadFile(filepath string, status chan<- int) {
+	if flagVerbose {
+		log.Printf("Uploading %s", filepath)
+	}
+	body, err := os.Open(filepath)
+	if err != nil {
+		log.Printf("Error opening video file %s: %s", filepath, err)
+		u.Metrics.UploadFailed(filepath)
+		status <- ErrorOpeningVideoFile
+		return
+	}
+	defer body.Close()
+
+	sum, err := fileSHA256(body)
+	if err != nil {
+		log.Printf("Error reading video file %s: %s", filepath, err)
+		u.Metrics.UploadFailed(filepath)
+		status <- ErrorOpeningVideoFile
+		return
+	}
+	info, err := body.Stat()
+	if err != nil {
+		log.Printf("Error reading video file %s: %s", filepath, err)
+		u.Metrics.UploadFailed(filepath)
+		status <- ErrorOpeningVideoFile
+		return
+	}
+
+	sensorVideoPath := u.relativePath(filepath)
+	if err := u.Gate.Wait(u.Context); err != nil {
+		log.Printf("WARN: Stopped waiting to upload %s while uploads are paused: %s", filepath, err)
+		status <- CancelledUploadVideoFile
+		return
+	}
+	log.Printf("DEBUG: Uploading %s to %s as %s", filepath, u.Storage, sensorVideoPath)
+	status <- StartUploadVideoFile
+	if u.isUploaded(sensorVideoPath, sum) {
+		log.Printf("INFO: Skipping upload of %s, %s already has sha256 %x", filepath, u.Storage, sum)
+		u.State.Uploaded(filepath, hex.EncodeToString(sum))
+		status <- DoneUploadVideoFile
+		return
+	}
+	u.State.Uploading(filepath)
+	started := time.Now()
+	etag := ""
+	for attempt := 1; ; attempt++ {
+		etag, err = u.Storage.Put(u.Context, sensorVideoPath, body, sum)
+		if err == nil {
+			break
+		}
+		if u.Context.Err() != nil {
+			log.Printf("WARN: Stopped uploading %s to %s: %s", filepath, u.Storage, err)
+			status <- CancelledUploadVideoFile
+			return
+		}
+		log.Printf("Error uploading video file %s to %s on attempt %d of %d: %s", filepath, u.Storage, attempt, u.Retry.MaxAttempts, err)
+		if u.Retry.Exhausted(attempt) {
+			body.Close()
+			u.Metrics.UploadFailed(filepath)
+			u.abandon(sensorVideoPath)
+			status <- u.moveToDeadLetter(filepath, sensorVideoPath)
+			return
+		}
+		u.Metrics.UploadRetried(filepath)
+		status <- RetryUploadVideoFile
+		select {
+		case <-time.After(u.Retry.Delay(attempt)):
+		case <-u.Context.Done():
+			log.Printf("WARN: Stopped retrying the upload of %s to %s", filepath, u.Storage)
+			status <- CancelledUploadVideoFile
+			return
+		}
+	}
+	if flagDebug {
+		log.Printf("Uploaded %s to %s", filepath, u.Storage)
+	}
+	u.Metrics.ObserveUpload(filepath, info.Size(), time.Since(started))
+	u.State.Uploaded(filepath, etag)
+	status <- DoneUploadVideoFile
+}
+
+// abandon: Drop the partial upload of key once its retries are exhausted, when Storage keeps them
+func (u *Uploader) abandon(key string) {
+	if storage, ok := u.Storage.(AbandoningStorage); ok {
+		storage.Abandon(key)
+	}
+}
+
+// isUploaded: True when key is already stored with sum, so uploading it again would be a duplicate
+func (u *Uploader) isUploaded(key string, sum []byte) bool {
+	exists, err := u.Storage.Exists(u.Context, key, sum)
+	if err != nil {
+		log.Printf("WARN: Unable to check whether %s exists in %s, uploading it: %s", key, u.Storage, err)
+		return false
+	}
+	return exists
+}
+
+// fileSHA256: The SHA-256 of body's content, read from the start in a pass of its own before uploading
+func fileSHA256(body *os.File) ([]byte, error) {
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, body); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+func (u *Uploader) relativePath(filepath string) string {
+	return strings.TrimPrefix(filepath, u.localTrimPrefix)
+}
+
+/*
+moveToDeadLetter: Move filepath under DeadLetterPath at its upload-relative
+path so RedriveDeadLetters uploads it to the same key
+*/
+func (u *Uploader) moveToDeadLetter(filepath, relativePath string) int {
+	if len(u.DeadLetterPath) == 0 {
+		return ErrorUploadingVideoFile
+	}
+	destination := deadLetterDestination(u.DeadLetterPath, relativePath)
+	if err := moveFile(filepath, destination); err != nil {
+		log.Printf("ERROR: Unable to move %s to dead letter %s: %s", filepath, destination, err)
+		return ErrorUploadingVideoFile
+	}
+	log.Printf("WARN: Moved %s to dead letter %s", filepath, destination)
+	return DeadLetterVideoFile
+}
+
+func deadLetterDestination(deadLetterPath, relativePath string) string {
+	return filepath.Join(deadLetterPath, filepath.Clean("/"+relativePath))
+}
+
+// moveFile: Rename source to destination, copying when they're on different devices
+func moveFile(source, destination string) error {
+	if err := os.MkdirAll(filepath.Dir(destination), 0750); err != nil {
+		return err
+	}
+	err := os.Rename(source, destination)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(destination, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(destination)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(destination)
+		return err
+	}
+	return os.Remove(source)
+}
+
+/*
+RedriveDeadLetters: Try to upload each file under DeadLetterPath again,
+removing it once it's uploaded. Files which still fail stay dead lettered.
+*/
+func (u *Uploader) RedriveDeadLetters() (redriven, failed int) {
+	if len(u.DeadLetterPath) == 0 {
+		return 0, 0
+	}
+	redriver := u.redriver()
+	filepath.WalkDir(u.DeadLetterPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("WARN: Error walking dead letters %s: %s", path, err)
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if redriveDeadLetter(path, redriver) != DoneUploadVideoFile {
+			failed++
+			return nil
+		}
+		redriven++
+		return nil
+	})
+	return redriven, failed
+}
+
+// redriver: An uploader of dead letters to the keys they would have been uploaded to, which doesn't dead letter them again
+func (u *Uploader) redriver() *Uploader {
+	redriver := *u
+	redriver.localTrimPrefix = filepath.Clean(u.DeadLetterPath) + string(os.PathSeparator)
+	redriver.DeadLetterPath = ""
+	return &redriver
+}
+
+// isDeadLetter: True when path is under DeadLetterPath
+func (u *Uploader) isDeadLetter(path string) bool {
+	return len(u.DeadLetterPath) > 0 && strings.HasPrefix(path, filepath.Clean(u.DeadLetterPath)+string(os.PathSeparator))
+}
+
+// redriveDeadLetter: Upload the dead letter path with redriver, removing it once it's uploaded
+func redriveDeadLetter(path string, redriver *Uploader) int {
+	status := uploadFile(path, redriver)
+	if status == DoneUploadVideoFile {
+		tryRemove(path)
+	}
+	return status
+}
+
+/*
+UploadGate: Pauses uploads which haven't started yet until it's resumed.
+Uploads already started finish. A nil UploadGate is never paused.
+*/
+type UploadGate struct {
+	lock    sync.Mutex
+	paused  bool
+	resumed chan struct{}
+}
+
+func NewUploadGate() *UploadGate {
+	return &UploadGate{}
+}
+
+// Pause: Hold back uploads until Resume
+func (g *UploadGate) Pause() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if !g.paused {
+		g.paused = true
+		g.resumed = make(chan struct{})
+	}
+}
+
+// Resume: Let the uploads being held back start
+func (g *UploadGate) Resume() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.paused {
+		g.paused = false
+		close(g.resumed)
+	}
+}
+
+func (g *UploadGate) Paused() bool {
+	if g == nil {
+		return false
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.paused
+}
+
+// Wait: Return once uploads aren't paused, or with ctx's error once it's done
+func (g *UploadGate) Wait(ctx context.Context) error {
+	if g == nil {
+		return nil
+	}
+	g.lock.Lock()
+	paused, resumed := g.paused, g.resumed
+	g.lock.Unlock()
+	if !paused {
+		return nil
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -3,54 +3,82 @@ package v2
 import (
 	"io/fs"
 	"log"
-	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 )
 
-type WatchedPath struct {
-	Path           string
-	WatchStartTime time.Time
+// State records the directories being watched so the watch reaper can clean them up. It's safe for concurrent use.
+type State interface {
+	Watched(path string, at time.Time)
+	Unwatched(path string)
+	// Watches returns when each watched directory was first watched
+	Watches() map[string]time.Time
 }
 
-type UploadedPath struct {
-	Path       string
-	UploadTime time.Time
+// memoryState keeps the watches until the agent exits, it's used until SetState is called
+type memoryState struct {
+	lock    sync.Mutex
+	watches map[string]time.Time
+}
+
+func newMemoryState() *memoryState {
+	return &memoryState{watches: map[string]time.Time{}}
+}
+
+func (s *memoryState) Watched(path string, at time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.watches[path] = at
+}
+
+func (s *memoryState) Unwatched(path string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.watches, path)
+}
+
+func (s *memoryState) Watches() map[string]time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	watches := map[string]time.Time{}
+	for path, at := range s.watches {
+		watches[path] = at
+	}
+	return watches
 }
 
 var (
-	watchedPaths  = map[string]*WatchedPath{}
-	uploadedPaths = map[string]*UploadedPath{}
+	state     State = newMemoryState()
+	stateLock sync.Mutex
 )
 
-// WatchReaper Cleans up watches older than 24 hours
-func WatchReaper() {
-	log.Printf("DEBUG: Starting watch reaper")
-	for {
-		time.Sleep(1 * time.Hour)
-		for path, watchedPath := range watchedPaths {
-			if time.Since(watchedPath.WatchStartTime) > (24 * time.Hour) {
-				log.Printf("DEBUG: Removing watch on %s from %s", path, watchedPath.WatchStartTime)
-				delete(watchedPaths, path)
-			}
-		}
-	}
+// SetState keeps the watches in s
+func SetState(s State) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	state = s
+}
+
+func currentState() State {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	return state
 }
 
-// UploadReaper Cleans up uploaded files older than 7 days
-func UploadReaper() {
-	log.Printf("DEBUG: Starting upload reaper")
+// WatchReaper Cleans up watches older than maxAge
+func WatchReaper(maxAge time.Duration) {
+	log.Printf("DEBUG: Starting watch reaper")
 	for {
 		time.Sleep(1 * time.Hour)
-		for path, uploadedPath := range uploadedPaths {
-			if time.Since(uploadedPath.UploadTime) > (24 * 7 * time.Hour) {
-				log.Printf("DEBUG: Removing uploaded file on %s uploaded at %s", path, uploadedPath.UploadTime)
-				if err := os.Remove(path); err != nil {
-					log.Printf("WARN: Error removing uploaded file %s: %s", path, err)
-				}
+		s := currentState()
+		for path, watchStartTime := range s.Watches() {
+			if time.Since(watchStartTime) > maxAge {
+				log.Printf("DEBUG: Removing watch on %s from %s", path, watchStartTime)
+				s.Unwatched(path)
 			}
 		}
 	}
@@ -62,10 +90,26 @@ func tryAddPath(w *fsnotify.Watcher, root string) error {
 		return err
 	}
 	log.Printf("INFO: Added watch on '%s'", root)
-	watchedPaths[root] = &WatchedPath{root, time.Now().UTC()}
+	currentState().Watched(root, time.Now().UTC())
 	return nil
 }
 
+// RemovePaths removes the watches on root and its child paths
+func RemovePaths(w *fsnotify.Watcher, root string) {
+	root = filepath.Clean(root)
+	s := currentState()
+	for path := range s.Watches() {
+		if path != root && !strings.HasPrefix(path, root+string(filepath.Separator)) {
+			continue
+		}
+		if err := w.Remove(path); err != nil {
+			log.Printf("DEBUG: Error removing watch on '%s': %s", path, err)
+		}
+		s.Unwatched(path)
+		log.Printf("INFO: Removed watch on '%s'", path)
+	}
+}
+
 // AddPaths adds child paths of some root path
 func AddPaths(w *fsnotify.Watcher, root string) error {
 	errorPaths := []string{}
@@ -89,56 +133,68 @@ func AddPaths(w *fsnotify.Watcher, root string) error {
 	return filepath.WalkDir(root, walkFun)
 }
 
-// HandleCreate is called when a video file is created by a camera
+// HandleCreate is called when a video or index file is created by a camera
 func HandleCreate(filenames chan string, event fsnotify.Event) {
 	log.Printf("DEBUG: Created file: %s", event.Name)
-	if strings.HasSuffix(event.Name, ".dav") {
+	if strings.HasSuffix(event.Name, ".dav") || strings.HasSuffix(event.Name, ".idx") {
 		filenames <- event.Name
 	}
 }
 
-// Listen starts watching for changes on the given paths
-func Listen(createEventFilenames chan string, paths ...string) {
+// Listener watches root paths, which can be added and removed while it runs, for created videos and index files
+type Listener struct {
+	watcher   *fsnotify.Watcher
+	filenames chan string
+}
+
+func NewListener(createEventFilenames chan string) (*Listener, error) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer watcher.Close()
+	return &Listener{watcher, createEventFilenames}, nil
+}
 
-	done := make(chan bool)
-	go func() {
-		for {
-			select {
-			case event, ok := <-watcher.Events:
+// Watch starts watching root and its child paths
+func (l *Listener) Watch(root string) error {
+	return AddPaths(l.watcher, root)
+}
 
-				if !ok {
-					return
-				}
-				// Don't emit events for temporary files
-				if !strings.HasSuffix(event.Name, "_") {
-					log.Printf("DEBUG: event: %#v Op: %s", event, event.Op)
-				}
-				if event.Op&fsnotify.Create == fsnotify.Create {
-					// Add a watcher if this is a path
-					if err := AddPaths(watcher, event.Name); err != nil {
-						log.Printf("WARN: Error adding path new path %s: %s", event.Name, err)
-					}
-					//
-					HandleCreate(createEventFilenames, event)
-				}
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					return
+// Unwatch stops watching root and its child paths
+func (l *Listener) Unwatch(root string) {
+	RemovePaths(l.watcher, root)
+}
+
+// Run sends created videos to the listener's filenames until it's closed
+func (l *Listener) Run() {
+	for {
+		select {
+		case event, ok := <-l.watcher.Events:
+
+			if !ok {
+				return
+			}
+			// Don't emit events for temporary files
+			if !strings.HasSuffix(event.Name, "_") {
+				log.Printf("DEBUG: event: %#v Op: %s", event, event.Op)
+			}
+			if event.Op&fsnotify.Create == fsnotify.Create {
+				// Add a watcher if this is a path
+				if err := AddPaths(l.watcher, event.Name); err != nil {
+					log.Printf("WARN: Error adding path new path %s: %s", event.Name, err)
 				}
-				log.Printf("error: %s", err)
+				//
+				HandleCreate(l.filenames, event)
 			}
-		}
-	}()
-	for _, path := range paths {
-
-		if err := AddPaths(watcher, path); err != nil {
-			log.Printf("WARN: Error watching %s: %s", path, err)
+		case err, ok := <-l.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("error: %s", err)
 		}
 	}
-	<-done
+}
+
+func (l *Listener) Close() error {
+	return l.watcher.Close()
 }
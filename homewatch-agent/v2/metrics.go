@@ -4,16 +4,18 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-var (
-	metricsPort = "2112"
-)
+// DefaultMetricsAddress is where the metrics are served unless another address is configured
+const DefaultMetricsAddress = ":2112"
 
 var (
 	videosCaptured = promauto.NewCounterVec(prometheus.CounterOpts{
@@ -24,8 +26,55 @@ var (
 		Name: "videos_uploaded",
 		Help: "The total number of videos uploaded by camera",
 	}, []string{"camera_name"})
+	uploadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "upload_duration_seconds",
+		Help:    "How long uploading each file took by camera and file type",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"camera_name", "file_type"})
+	uploadBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "upload_bytes",
+		Help:    "The size of each file uploaded by camera and file type",
+		Buckets: prometheus.ExponentialBuckets(16*1024, 4, 10),
+	}, []string{"camera_name", "file_type"})
+	uploadFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "upload_failures",
+		Help: "The total number of files which couldn't be uploaded by camera and file type",
+	}, []string{"camera_name", "file_type"})
+	uploadRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "upload_retries",
+		Help: "The total number of upload attempts retried by camera and file type",
+	}, []string{"camera_name", "file_type"})
+	syslogParseErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "syslog_parse_errors",
+		Help: "The total number of syslog messages which couldn't be parsed by pipeline",
+	}, []string{"pipeline"})
+	queueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "queue_depth",
+		Help: "The index or video files by pipeline which haven't been handled yet",
+	}, []string{"pipeline", "queue"})
+	diskFreeBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "disk_free_bytes",
+		Help: "The bytes available on the file system holding a path",
+	}, []string{"path"})
+	diskSizeBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "disk_size_bytes",
+		Help: "The size of the file system holding a path",
+	}, []string{"path"})
+	cameraSilent = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "camera_silent",
+		Help: "1 while the camera hasn't sent a video within its expected cadence",
+	}, []string{"camera_name"})
+	cameraCadence = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "camera_cadence_seconds",
+		Help: "How often the camera is expected to send a video, 0 until it's learned",
+	}, []string{"camera_name"})
+	lastVideos = newLastVideoCollector()
 )
 
+func init() {
+	prometheus.MustRegister(lastVideos)
+}
+
 type CameraMetrics struct {
 	VideosCaptured *prometheus.CounterVec
 	VideosUploaded *prometheus.CounterVec
@@ -54,10 +103,14 @@ func getCameraName(videoPath string, trimPrefix string) string {
 			trimPrefix,
 		), string(os.PathSeparator), 2)[0]
 }
-func (m *CameraMetrics) Handle() {
-	defer close(m.VideoEvents)
-	defer close(m.UploadEvents)
 
+// getFileType returns the extension of path without its dot, like dav or idx
+func getFileType(path string) string {
+	return strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+}
+
+// Run counts the videos sent to VideoEvents and UploadEvents until they're closed
+func (m *CameraMetrics) Run() {
 	go func() {
 		log.Print("DEBUG: Starting video event handler")
 		for videoEvent := range m.VideoEvents {
@@ -65,20 +118,120 @@ func (m *CameraMetrics) Handle() {
 			cameraName := getCameraName(videoEvent, m.trimPrefix)
 			log.Printf("DEBUG: Camera video event: %s", cameraName)
 			m.VideosCaptured.With(prometheus.Labels{"camera_name": cameraName}).Inc()
+			lastVideos.Set(cameraName, time.Now())
 		}
 	}()
 
-	go func() {
-		log.Print("DEBUG: Starting upload event handler")
-		for uploadEvent := range m.UploadEvents {
-			log.Printf("DEBUG: Upload event: %s", uploadEvent)
-			cameraName := getCameraName(uploadEvent, m.trimPrefix)
-			log.Printf("DEBUG: Camera upload event: %s", cameraName)
-			m.VideosUploaded.With(prometheus.Labels{"camera_name": cameraName}).Inc()
-		}
-	}()
+	log.Print("DEBUG: Starting upload event handler")
+	for uploadEvent := range m.UploadEvents {
+		log.Printf("DEBUG: Upload event: %s", uploadEvent)
+		cameraName := getCameraName(uploadEvent, m.trimPrefix)
+		log.Printf("DEBUG: Camera upload event: %s", cameraName)
+		m.VideosUploaded.With(prometheus.Labels{"camera_name": cameraName}).Inc()
+	}
+}
+
+// labels returns the camera and file type of path
+func (m *CameraMetrics) labels(path string) prometheus.Labels {
+	return prometheus.Labels{"camera_name": getCameraName(path, m.trimPrefix), "file_type": getFileType(path)}
+}
+
+// ObserveUpload records that path, of size bytes, took duration to upload. A nil CameraMetrics records nothing.
+func (m *CameraMetrics) ObserveUpload(path string, size int64, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	uploadDuration.With(m.labels(path)).Observe(duration.Seconds())
+	uploadBytes.With(m.labels(path)).Observe(float64(size))
+}
+
+// UploadFailed counts a file which couldn't be uploaded
+func (m *CameraMetrics) UploadFailed(path string) {
+	if m == nil {
+		return
+	}
+	uploadFailures.With(m.labels(path)).Inc()
+}
+
+// UploadRetried counts an upload attempt which is being retried
+func (m *CameraMetrics) UploadRetried(path string) {
+	if m == nil {
+		return
+	}
+	uploadRetries.With(m.labels(path)).Inc()
+}
+
+// SyslogParseError counts a syslog message the pipeline couldn't parse
+func SyslogParseError(pipeline string) {
+	syslogParseErrors.With(prometheus.Labels{"pipeline": pipeline}).Inc()
+}
+
+// SetQueueDepth records how many files are waiting in one of the pipeline's queues
+func SetQueueDepth(pipeline, queue string, depth int) {
+	queueDepth.With(prometheus.Labels{"pipeline": pipeline, "queue": queue}).Set(float64(depth))
+}
+
+// SetDiskUsage records the free and total bytes of the file system holding path
+func SetDiskUsage(path string, free, total uint64) {
+	diskFreeBytes.With(prometheus.Labels{"path": path}).Set(float64(free))
+	diskSizeBytes.With(prometheus.Labels{"path": path}).Set(float64(total))
+}
+
+// SetCameraLiveness records whether camera is silent and how often it's expected to send a video
+func SetCameraLiveness(camera string, silent bool, cadence time.Duration) {
+	value := 0.0
+	if silent {
+		value = 1
+	}
+	cameraSilent.With(prometheus.Labels{"camera_name": camera}).Set(value)
+	cameraCadence.With(prometheus.Labels{"camera_name": camera}).Set(cadence.Seconds())
+}
+
+// lastVideoCollector reports how long ago each camera's last video was captured, measured when it's scraped
+type lastVideoCollector struct {
+	lock   sync.Mutex
+	desc   *prometheus.Desc
+	videos map[string]time.Time
+}
+
+func newLastVideoCollector() *lastVideoCollector {
+	return &lastVideoCollector{
+		desc: prometheus.NewDesc(
+			"last_video_age_seconds",
+			"How long ago the camera's last video was captured",
+			[]string{"camera_name"}, nil,
+		),
+		videos: map[string]time.Time{},
+	}
+}
+
+func (c *lastVideoCollector) Set(camera string, at time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.videos[camera] = at
+}
+
+func (c *lastVideoCollector) Describe(descs chan<- *prometheus.Desc) {
+	descs <- c.desc
+}
+
+func (c *lastVideoCollector) Collect(metrics chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for camera, at := range c.videos {
+		metrics <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, time.Since(at).Seconds(), camera)
+	}
+}
+
+// NewMetricsServeMux returns a ServeMux serving the metrics on /metrics, which other handlers can be added to
+func NewMetricsServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
 
-	log.Printf("DEBUG: Starting metrics server on port %s", metricsPort)
-	http.Handle("/metrics", promhttp.Handler())
-	http.ListenAndServe(":"+metricsPort, nil)
+// ServeMetrics serves mux on address, like :2112, until it fails
+func ServeMetrics(address string, mux *http.ServeMux) error {
+	log.Printf("DEBUG: Starting metrics server on %s", address)
+	return http.ListenAndServe(address, mux)
 }
@@ -0,0 +1,68 @@
+package v2
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestNilCameraMetricsCountNothing(t *testing.T) {
+	var metrics *CameraMetrics
+	metrics.ObserveUpload("/cameras/Camera1/a.dav", 10, time.Second)
+	metrics.UploadFailed("/cameras/Camera1/a.dav")
+	metrics.UploadRetried("/cameras/Camera1/a.dav")
+}
+
+func TestCameraMetricsLabels(t *testing.T) {
+	metrics := NewCameraMetrics("/cameras/")
+	labels := metrics.labels("/cameras/Camera1/2022-03-01/001/dav/04/a.DAV")
+	if labels["camera_name"] != "Camera1" || labels["file_type"] != "dav" {
+		t.Fatalf("Expected Camera1 and dav, got %v", labels)
+	}
+}
+
+func TestLastVideoCollectorAgesEachCamera(t *testing.T) {
+	collector := newLastVideoCollector()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	collector.Set("Camera1", time.Now().Add(-time.Minute))
+	collector.Set("Camera2", time.Now().Add(-time.Hour))
+
+	families, err := registry.Gather()
+	if err != nil || len(families) != 1 || families[0].GetName() != "last_video_age_seconds" {
+		t.Fatalf("Expected last_video_age_seconds, got %v %v", families, err)
+	}
+	ages := map[string]float64{}
+	for _, metric := range families[0].GetMetric() {
+		ages[metric.GetLabel()[0].GetValue()] = metric.GetGauge().GetValue()
+	}
+	if len(ages) != 2 || ages["Camera1"] < 60 || ages["Camera1"] >= 3600 || ages["Camera2"] < 3600 {
+		t.Fatalf("Expected Camera1 a minute old and Camera2 an hour old, got %v", ages)
+	}
+}
+
+func TestMetricsServeMux(t *testing.T) {
+	mux := NewMetricsServeMux()
+	lastVideos.Set("Camera1", time.Now())
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `last_video_age_seconds{camera_name="Camera1"}`) {
+		t.Fatalf("Expected the metrics to be served, got %d %s", w.Code, w.Body.String())
+	}
+	if _, pattern := http.DefaultServeMux.Handler(httptest.NewRequest("GET", "/metrics", nil)); len(pattern) > 0 {
+		t.Fatalf("Expected nothing added to http.DefaultServeMux, got %s", pattern)
+	}
+}
+
+func TestDefaultMetricsAddressListensOnEveryInterface(t *testing.T) {
+	host, port, err := net.SplitHostPort(DefaultMetricsAddress)
+	if err != nil || len(host) > 0 || port != "2112" {
+		t.Fatalf("Expected :2112, got %q %q %v", host, port, err)
+	}
+}
@@ -1,27 +1,36 @@
 package main
 
 import (
+	"context"
 	"io/ioutil"
 	"log"
 	"path"
-	"sync"
+	"strings"
+
+	v2 "github.com/mrmod/homewatch/v2"
 )
 
 type VideoEventHandler struct {
-	enableUploads bool
-	decodeVideos  bool
-	videoEvents   chan string
-	control       chan int
-	Uploader      S3FileUploader
+	// Context: Cancelling it stops transcoding, so set it to the uploader's Context
+	Context     context.Context
+	config      VideoConfig
+	videoEvents chan string
+	Uploader    S3FileUploader
+	queue       FileEventQueue
+	transcoder  *TranscodePool
+	sidecars    *Sidecars
+	metrics     *v2.CameraMetrics
+	state       *StateStore
+	liveness    *LivenessTracker
+	inFlight    *InFlight
 }
 
-func NewVideoEventHandler(enableUploads, decodeVideos bool, videoEvents chan string) *VideoEventHandler {
+func NewVideoEventHandler(config VideoConfig, videoEvents chan string) *VideoEventHandler {
 	return &VideoEventHandler{
-		enableUploads,
-		decodeVideos,
-		videoEvents,
-		make(chan int, 1),
-		nil,
+		Context:     context.TODO(),
+		config:      config,
+		videoEvents: videoEvents,
+		inFlight:    NewInFlight(),
 	}
 }
 
@@ -29,24 +38,129 @@ func (v *VideoEventHandler) AddUploader(uploader S3FileUploader) {
 	v.Uploader = uploader
 }
 
-func (v *VideoEventHandler) Listen() {
-	for filepath := range v.videoEvents {
-		if v.enableUploads && v.Uploader != nil {
+// AddQueue: Acknowledge each video event on queue once it has been handled
+func (v *VideoEventHandler) AddQueue(queue FileEventQueue) {
+	v.queue = queue
+}
+
+/*
+AddTranscoder: Upload videos transcoded by transcoder when transcoding is
+enabled. The original video is uploaded too when Transcode.UploadOriginal is set.
+*/
+func (v *VideoEventHandler) AddTranscoder(transcoder *TranscodePool) {
+	v.transcoder = transcoder
+}
+
+// AddSidecars: Upload the sidecar of each uploaded video once its index file is read
+func (v *VideoEventHandler) AddSidecars(sidecars *Sidecars) {
+	v.sidecars = sidecars
+}
+
+// AddMetrics: Count each video captured and uploaded in metrics
+func (v *VideoEventHandler) AddMetrics(metrics *v2.CameraMetrics) {
+	v.metrics = metrics
+}
+
+// AddStateStore: Record each video's lifecycle in state
+func (v *VideoEventHandler) AddStateStore(state *StateStore) {
+	v.state = state
+}
+
+// AddLiveness: Count each video received as a heartbeat of its camera
+func (v *VideoEventHandler) AddLiveness(liveness *LivenessTracker) {
+	v.liveness = liveness
+}
+
+// Listen: Start uploading each video event until ctx is done. Use Drain to wait for the uploads.
+func (v *VideoEventHandler) Listen(ctx context.Context) {
+	for {
+		var filepath string
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-v.videoEvents:
+			if !ok {
+				return
+			}
+			filepath = event
+		}
+		v.state.Discovered(filepath)
+		v.liveness.Heartbeat(filepath)
+		if v.metrics != nil {
+			v.metrics.VideoEvents <- filepath
+		}
+		if v.config.Upload && v.Uploader != nil {
+			if !v.inFlight.Start(filepath) {
+				return
+			}
 			go func(videofilePath string) {
+				defer v.inFlight.Finish(videofilePath)
 
-				wg := &sync.WaitGroup{}
-				wg.Add(1)
-				go uploadVideo(videofilePath, v.Uploader, wg)
-				wg.Wait()
+				uploadStatus := v.uploadVideo(videofilePath)
+				// Left unacknowledged so it's uploaded after a restart
+				if !uploadSettled(uploadStatus) {
+					return
+				}
 
-				if flagCleanupVideoFiles || flagCleanupAllFiles {
+				if uploadStatus == DoneUploadVideoFile && v.metrics != nil {
+					v.metrics.UploadEvents <- videofilePath
+				}
+				if uploadStatus == DoneUploadVideoFile && v.sidecars != nil {
+					v.sidecars.AddVideo(videofilePath)
+				}
+				if uploadStatus == DoneUploadVideoFile && v.config.Cleanup {
 					_, fn := path.Split(videofilePath)
 					log.Printf("Removing %s", fn)
-					tryRemove(videofilePath)
+					cleanup(videofilePath, v.state)
 				}
+				ackFileEvent(v.queue, videofilePath)
 			}(filepath)
+		} else {
+			ackFileEvent(v.queue, filepath)
+		}
+	}
+}
+
+// Drain: Wait for started uploads until ctx is done, returning the videos which didn't finish
+func (v *VideoEventHandler) Drain(ctx context.Context) []string {
+	return v.inFlight.Wait(ctx)
+}
+
+/*
+uploadVideo: Upload the video, transcoding it first when decoding is enabled.
+Returns DoneUploadVideoFile only when everything which should be uploaded was.
+The original video is uploaded instead when it can't be transcoded.
+*/
+func (v *VideoEventHandler) uploadVideo(videofilePath string) int {
+	alreadyTranscoded := strings.EqualFold(path.Ext(videofilePath), transcodedVideoExtension)
+	if !v.config.Transcode.Enabled || v.transcoder == nil || alreadyTranscoded {
+		return uploadFile(videofilePath, v.Uploader)
+	}
+
+	transcoded, err := v.transcoder.Transcode(v.Context, videofilePath)
+	if v.Context.Err() != nil {
+		return CancelledUploadVideoFile
+	}
+	if err != nil {
+		log.Printf("WARN: Uploading the original of %s: %s", videofilePath, err)
+		return uploadFile(videofilePath, v.Uploader)
+	}
+	v.state.Transcoded(videofilePath, transcoded)
+	uploadStatus := uploadFile(transcoded, v.Uploader)
+	// A dead lettered MP4 was moved, otherwise it can be made again from the original
+	if uploadStatus != DeadLetterVideoFile {
+		cleanup(transcoded, v.state)
+	}
+	if uploadStatus == DoneUploadVideoFile && v.config.Transcode.UploadOriginal {
+		return uploadFile(videofilePath, v.Uploader)
+	}
+	// The original is uploaded as its MP4, so it can be reaped like any other upload
+	if uploadStatus == DoneUploadVideoFile {
+		if record, ok := v.state.File(transcoded); ok {
+			v.state.Uploaded(videofilePath, record.ETag)
 		}
 	}
+	return uploadStatus
 }
 func debugFilepath(filepath string) {
 	dirname := path.Dir(filepath)
@@ -62,28 +176,39 @@ func debugFilepath(filepath string) {
 	}
 }
 
-func uploadVideo(filepath string, uploader S3FileUploader, wg *sync.WaitGroup) {
+/*
+uploadFile: Upload filepath and wait for the uploader to finish. Returns the last
+status, so only DoneUploadVideoFile means the file is safe to clean up.
+*/
+func uploadFile(filepath string, uploader S3FileUploader) int {
 	done := make(chan int, 1)
-	defer close(done)
-	defer wg.Done()
 
 	go uploader.UploadFile(filepath, done)
 	for msg := range done {
 		switch msg {
 		case ErrorUploadingVideoFile:
 			log.Printf("Error uploading the video file %s", filepath)
-			return
+			return msg
 		case ErrorOpeningVideoFile:
 			log.Printf("Unable to open video file %s", filepath)
 			if flagDebug {
 				debugFilepath(filepath)
 			}
-			return
+			return msg
+		case DeadLetterVideoFile:
+			log.Printf("Gave up uploading %s", filepath)
+			return msg
+		case CancelledUploadVideoFile:
+			log.Printf("Cancelled uploading %s", filepath)
+			return msg
 		case StartUploadVideoFile:
 			log.Printf("Started uploading %s", filepath)
+		case RetryUploadVideoFile:
+			log.Printf("Retrying upload of %s", filepath)
 		case DoneUploadVideoFile:
 			log.Printf("Finished uploading %s", filepath)
-			return
+			return msg
 		}
 	}
+	return ErrorUploadingVideoFile
 }